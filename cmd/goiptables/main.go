@@ -0,0 +1,255 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command goiptables applies, compares, snapshots and inspects iptables rules
+// using the go-iptables structured model, so operators can use it without
+// writing Go.
+//
+// Usage:
+//
+//	goiptables [-6] apply [-var KEY=VALUE]... FILE
+//	goiptables [-6] diff [-var KEY=VALUE]... FILE
+//	goiptables [-6] snapshot [-o FILE] [TABLE...]
+//	goiptables [-6] rollback FILE
+//	goiptables [-6] stats [-format text|json|csv] TABLE [CHAIN]
+//
+// Rulesets are read as YAML if the file name ends in ".yaml" or ".yml", and
+// as JSON otherwise; FILE may be "-" for JSON on standard input. Template
+// variables such as {{ .WanIface }} in the ruleset are set with -var.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const usage = `usage: goiptables [-6] <command> [arguments]
+
+commands:
+  apply [-var K=V]... FILE        apply a ruleset
+  diff [-var K=V]... FILE         show how the current rules differ from a ruleset
+  snapshot [-o FILE] [TABLE...]   save the rules with counters
+  rollback FILE                   restore a snapshot
+  stats [-format F] TABLE [CHAIN] print rule counters as text, json or csv
+`
+
+func main() {
+	ipv6 := flag.Bool("6", false, "operate on ip6tables")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	proto := iptables.ProtocolIPv4
+	if *ipv6 {
+		proto = iptables.ProtocolIPv6
+	}
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		fatal(err)
+	}
+
+	args := flag.Args()
+	switch args[0] {
+	case "apply":
+		err = apply(ipt, args[1:])
+	case "diff":
+		err = diff(ipt, args[1:])
+	case "snapshot":
+		err = snapshot(ipt, args[1:])
+	case "rollback":
+		err = rollback(ipt, args[1:])
+	case "stats":
+		err = stats(ipt, args[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "goiptables: %v\n", err)
+	os.Exit(1)
+}
+
+// open opens the named file, or returns standard input for "-".
+func open(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+func loadRuleset(name string) (*iptables.Ruleset, error) {
+	f, err := open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rs *iptables.Ruleset
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml":
+		rs, err = iptables.LoadRulesetYAML(f)
+	default:
+		rs, err = iptables.LoadRulesetJSON(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return rs, nil
+}
+
+// vars collects repeated -var KEY=VALUE flags.
+type vars map[string]string
+
+func (v vars) String() string {
+	return fmt.Sprint(map[string]string(v))
+}
+
+func (v vars) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected KEY=VALUE, got %q", s)
+	}
+	v[s[:i]] = s[i+1:]
+	return nil
+}
+
+// parseRulesetArgs parses the flags and FILE argument of apply and diff, and
+// returns the ruleset with its template variables expanded.
+func parseRulesetArgs(name string, args []string) (*iptables.Ruleset, error) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	v := vars{}
+	fs.Var(v, "var", "set template variable `KEY=VALUE`; may be repeated")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return nil, fmt.Errorf("usage: %s [-var KEY=VALUE]... FILE", name)
+	}
+	rs, err := loadRuleset(fs.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	return rs.Expand(map[string]string(v))
+}
+
+func apply(ipt *iptables.IPTables, args []string) error {
+	rs, err := parseRulesetArgs("apply", args)
+	if err != nil {
+		return err
+	}
+	return ipt.ApplyRuleset(rs)
+}
+
+func diff(ipt *iptables.IPTables, args []string) error {
+	rs, err := parseRulesetArgs("diff", args)
+	if err != nil {
+		return err
+	}
+	diffs, err := ipt.DiffRuleset(rs)
+	if err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		fmt.Print(d)
+	}
+	return nil
+}
+
+func snapshot(ipt *iptables.IPTables, args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	out := fs.String("o", "", "write the snapshot to `FILE` instead of standard output")
+	fs.Parse(args)
+
+	data, err := ipt.Snapshot(fs.Args()...)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.WriteString(data)
+		return err
+	}
+	return ioutil.WriteFile(*out, []byte(data), 0600)
+}
+
+func rollback(ipt *iptables.IPTables, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: rollback FILE")
+	}
+	f, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	return ipt.Restore(string(data), iptables.RestoreOptions{PreserveCounters: true})
+}
+
+func stats(ipt *iptables.IPTables, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	format := fs.String("format", "text", "output `format`: text, json or csv")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return fmt.Errorf("usage: stats [-format F] TABLE [CHAIN]")
+	}
+	chain := ""
+	if fs.NArg() == 2 {
+		chain = fs.Arg(1)
+	}
+
+	stats, err := ipt.Stats(fs.Arg(0), chain)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "text":
+		for _, s := range stats {
+			fmt.Printf("%12d %14d %s %s\n", s.Packets, s.Bytes, s.Chain, s.Rule)
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"table", "chain", "rule", "packets", "bytes"})
+		for _, s := range stats {
+			w.Write([]string{s.Table, s.Chain, s.Rule, strconv.FormatUint(s.Packets, 10), strconv.FormatUint(s.Bytes, 10)})
+		}
+		w.Flush()
+		return w.Error()
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	return nil
+}
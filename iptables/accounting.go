@@ -0,0 +1,241 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// AccountingEntry selects the traffic counted under one name: the traffic
+// sent from and received by the addresses of CIDR, optionally restricted to
+// a protocol and a port on those addresses.
+type AccountingEntry struct {
+	CIDR     string
+	Protocol string
+	// Port requires Protocol to be "tcp", "udp" or another protocol with ports.
+	Port int
+}
+
+// Counters are the traffic counts of an accounting entry.
+type Counters struct {
+	// Sent counts the traffic from the addresses of the entry.
+	SentPackets uint64
+	SentBytes   uint64
+	// Received counts the traffic to the addresses of the entry.
+	ReceivedPackets uint64
+	ReceivedBytes   uint64
+}
+
+// Accounting maintains a dedicated chain of counter-only rules, two per
+// entry, jumped to from the hook chains, e.g. FORWARD. Rules have no target,
+// so they count the traffic without affecting it.
+type Accounting struct {
+	ipt   *IPTables
+	table string
+	chain string
+	hooks []string
+
+	mu      sync.Mutex
+	entries map[string]AccountingEntry
+}
+
+// NewAccounting returns an accounting manager owning the specified
+// table/chain, which Sync creates and jumps to from each of hooks.
+func NewAccounting(ipt *IPTables, table, chain string, hooks ...string) *Accounting {
+	return &Accounting{
+		ipt:     ipt,
+		table:   table,
+		chain:   chain,
+		hooks:   hooks,
+		entries: make(map[string]AccountingEntry),
+	}
+}
+
+// Set adds or replaces the entry with the given name. The name must be valid
+// as a RuleTags value. It takes effect on the next Sync.
+func (a *Accounting) Set(name string, entry AccountingEntry) error {
+	if !validTag(name) {
+		return fmt.Errorf("invalid accounting entry name %q", name)
+	}
+	if _, _, err := net.ParseCIDR(entry.CIDR); err != nil {
+		return fmt.Errorf("accounting entry %s: %v", name, err)
+	}
+	if entry.Port != 0 && entry.Protocol == "" {
+		return fmt.Errorf("accounting entry %s: port without protocol", name)
+	}
+	if entry.Port < 0 || entry.Port > 65535 {
+		return fmt.Errorf("accounting entry %s: invalid port %d", name, entry.Port)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries[name] = entry
+	return nil
+}
+
+// Remove removes the entry with the given name. It takes effect on the next Sync.
+func (a *Accounting) Remove(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.entries, name)
+}
+
+// Sync rebuilds the chain from the entries in a single iptables-restore
+// transaction and ensures the jumps from the hooks. The counters of entries
+// that did not change are carried over.
+func (a *Accounting) Sync() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	exists, err := a.ipt.ChainExists(a.table, a.chain)
+	if err != nil {
+		return err
+	}
+	var current []Stat
+	if exists {
+		if current, err = a.ipt.Stats(a.table, a.chain); err != nil {
+			return err
+		}
+	}
+	snippet, err := a.snippet(current)
+	if err != nil {
+		return err
+	}
+	if err := a.ipt.RestoreChainWithCounters(a.table, a.chain, snippet, true); err != nil {
+		return err
+	}
+	for _, hook := range a.hooks {
+		if err := a.ipt.EnsureJump(a.table, hook, a.chain, JumpFirst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Usage returns the counters of every entry in the chain, by name.
+func (a *Accounting) Usage() (map[string]Counters, error) {
+	stats, err := a.ipt.Stats(a.table, a.chain)
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]Counters)
+	for _, s := range stats {
+		tags := accountingTags(a.chain, s.Rule)
+		if tags == nil {
+			continue
+		}
+		name := tags["acct"]
+		c := usage[name]
+		if tags["dir"] == "sent" {
+			c.SentPackets += s.Packets
+			c.SentBytes += s.Bytes
+		} else {
+			c.ReceivedPackets += s.Packets
+			c.ReceivedBytes += s.Bytes
+		}
+		usage[name] = c
+	}
+	return usage, nil
+}
+
+// Cleanup removes the jumps from the hooks and deletes the chain.
+func (a *Accounting) Cleanup() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, hook := range a.hooks {
+		if err := a.ipt.DeleteIfExists(a.table, hook, "-j", a.chain); err != nil {
+			return err
+		}
+	}
+	if err := a.ipt.ClearChain(a.table, a.chain); err != nil {
+		return err
+	}
+	return a.ipt.DeleteChain(a.table, a.chain)
+}
+
+// snippet renders the rules of the entries, ordered by name, with the
+// counters of the matching rules in current.
+func (a *Accounting) snippet(current []Stat) (string, error) {
+	// counters are carried over by name, direction and spec
+	counters := make(map[string]Stat)
+	for _, s := range current {
+		if tags := accountingTags(a.chain, s.Rule); tags != nil {
+			counters[tags.String()] = s
+		}
+	}
+
+	names := make([]string, 0, len(a.entries))
+	for name := range a.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		e := a.entries[name]
+		for _, dir := range []string{"sent", "received"} {
+			addr, port := "-s", "--sport"
+			if dir == "received" {
+				addr, port = "-d", "--dport"
+			}
+			args := []string{addr, e.CIDR}
+			if e.Protocol != "" {
+				args = append(args, "-p", e.Protocol)
+			}
+			if e.Port != 0 {
+				args = append(args, port, strconv.Itoa(e.Port))
+			}
+			tags := RuleTags{"acct": name, "dir": dir, "spec": accountingSpec(e)}
+			args, err := tagged(tags, args)
+			if err != nil {
+				return "", err
+			}
+			s := counters[tags.String()]
+			fmt.Fprintf(&buf, "[%d:%d] -A %s %s\n", s.Packets, s.Bytes, a.chain, joinRule(args))
+		}
+	}
+	return buf.String(), nil
+}
+
+// accountingSpec summarizes an entry in a tag value, so Sync can tell whether
+// the entry of a rule changed and its counters must be reset.
+func accountingSpec(e AccountingEntry) string {
+	spec := e.CIDR
+	if e.Protocol != "" {
+		spec += "@" + e.Protocol
+	}
+	if e.Port != 0 {
+		spec += ":" + strconv.Itoa(e.Port)
+	}
+	return spec
+}
+
+// accountingTags returns the tags of a listed rule of the accounting chain,
+// or nil if it was not created by Accounting.
+func accountingTags(chain, rule string) RuleTags {
+	r, err := ParseRule("-A " + chain + " " + rule)
+	if err != nil {
+		return nil
+	}
+	tags := r.Tags()
+	if tags["acct"] == "" || (tags["dir"] != "sent" && tags["dir"] != "received") {
+		return nil
+	}
+	return tags
+}
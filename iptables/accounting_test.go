@@ -0,0 +1,77 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAccountingSnippet(t *testing.T) {
+	a := NewAccounting(&IPTables{}, "filter", "ACCT", "FORWARD")
+	if err := a.Set("lan", AccountingEntry{CIDR: "192.168.1.0/24"}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := a.Set("web", AccountingEntry{CIDR: "10.0.0.5/32", Protocol: "tcp", Port: 443}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	for _, e := range []AccountingEntry{{CIDR: "bogus"}, {CIDR: "10.0.0.0/8", Port: 80}} {
+		if err := a.Set("bad", e); err == nil {
+			t.Fatalf("Set accepted invalid entry %+v", e)
+		}
+	}
+	if err := a.Set("not valid", AccountingEntry{CIDR: "10.0.0.0/8"}); err == nil {
+		t.Fatalf("Set accepted an invalid name")
+	}
+
+	// the counters of "lan" carry over, those of the changed "web" entry do not
+	current := []Stat{
+		{Rule: "-s 192.168.1.0/24 -m comment --comment acct=lan,dir=sent,spec=192.168.1.0/24", Packets: 3, Bytes: 300},
+		{Rule: "-d 192.168.1.0/24 -m comment --comment acct=lan,dir=received,spec=192.168.1.0/24", Packets: 4, Bytes: 400},
+		{Rule: "-s 10.0.0.5/32 -p tcp -m tcp --sport 80 -m comment --comment acct=web,dir=sent,spec=10.0.0.5/32@tcp:80", Packets: 5, Bytes: 500},
+	}
+	snippet, err := a.snippet(current)
+	if err != nil {
+		t.Fatalf("snippet failed: %v", err)
+	}
+	expected := `[3:300] -A ACCT -s 192.168.1.0/24 -m comment --comment acct=lan,dir=sent,spec=192.168.1.0/24
+[4:400] -A ACCT -d 192.168.1.0/24 -m comment --comment acct=lan,dir=received,spec=192.168.1.0/24
+[0:0] -A ACCT -s 10.0.0.5/32 -p tcp --sport 443 -m comment --comment acct=web,dir=sent,spec=10.0.0.5/32@tcp:443
+[0:0] -A ACCT -d 10.0.0.5/32 -p tcp --dport 443 -m comment --comment acct=web,dir=received,spec=10.0.0.5/32@tcp:443
+`
+	if snippet != expected {
+		t.Fatalf("snippet mismatch: \ngot  %s \nneed %s", snippet, expected)
+	}
+}
+
+func TestAccountingUsage(t *testing.T) {
+	ipt, log := newFakeIPTables(t, `printf -- '-N ACCT\n-A ACCT -s 192.168.1.0/24 -m comment --comment acct=lan,dir=sent,spec=192.168.1.0/24 -c 3 300\n-A ACCT -d 192.168.1.0/24 -m comment --comment acct=lan,dir=received,spec=192.168.1.0/24 -c 4 400\n-A ACCT -j RETURN -c 9 900\n'`)
+	a := NewAccounting(ipt, "filter", "ACCT")
+
+	usage, err := a.Usage()
+	if err != nil {
+		t.Fatalf("Usage failed: %v", err)
+	}
+	expected := map[string]Counters{"lan": {SentPackets: 3, SentBytes: 300, ReceivedPackets: 4, ReceivedBytes: 400}}
+	if !reflect.DeepEqual(usage, expected) {
+		t.Fatalf("Usage returned %+v, want %+v", usage, expected)
+	}
+	if calls := fakeCalls(t, log); len(calls) != 1 || calls[0] != "--wait -t filter -v -S ACCT" {
+		t.Fatalf("unexpected calls %#v", calls)
+	}
+}
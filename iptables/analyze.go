@@ -0,0 +1,176 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+)
+
+// FindingKind classifies a Finding reported by Analyze.
+type FindingKind string
+
+const (
+	// FindingUnreachable is a rule that can never match, because an earlier
+	// rule with a terminating target matches every packet it would match.
+	FindingUnreachable FindingKind = "unreachable"
+	// FindingDuplicate is a rule identical to an earlier rule of the same chain.
+	FindingDuplicate FindingKind = "duplicate"
+	// FindingEmptyChain is a user-defined chain without rules that is the target of a jump.
+	FindingEmptyChain FindingKind = "empty-chain"
+)
+
+// Finding is a problem found in a ruleset by Analyze or ValidateRuleset.
+type Finding struct {
+	Kind FindingKind
+	// Table is set by ValidateRuleset, whose findings span tables.
+	Table string
+	Chain string
+	// Rule is the 1-based position of the offending rule in Chain, or 0 for chain findings.
+	Rule int
+	// RuleSpec is the offending rule, as listed by List.
+	RuleSpec string
+	// Related is the position of the earlier rule responsible for the finding, if any.
+	Related int
+	Message string
+}
+
+func (f Finding) String() string {
+	chain := f.Chain
+	if f.Table != "" {
+		chain = f.Table + "/" + f.Chain
+	}
+	if f.Rule == 0 {
+		return fmt.Sprintf("%s: chain %s: %s", f.Kind, chain, f.Message)
+	}
+	return fmt.Sprintf("%s: %s rule %d (%s): %s", f.Kind, chain, f.Rule, f.RuleSpec, f.Message)
+}
+
+// terminalTargets are the targets that end the traversal of a chain.
+var terminalTargets = map[string]bool{
+	"ACCEPT":     true,
+	"DROP":       true,
+	"REJECT":     true,
+	"RETURN":     true,
+	"DNAT":       true,
+	"SNAT":       true,
+	"MASQUERADE": true,
+	"REDIRECT":   true,
+	"NETMAP":     true,
+}
+
+// statefulMatches are match modules whose result depends on more than the
+// packet itself, so a rule using them cannot be relied on to shadow another.
+var statefulMatches = map[string]bool{
+	"limit":     true,
+	"hashlimit": true,
+	"recent":    true,
+	"statistic": true,
+	"quota":     true,
+	"connbytes": true,
+	"connlimit": true,
+	"time":      true,
+}
+
+// Analyze lists the specified table and reports basic hygiene problems:
+// unreachable rules, duplicate rules, and empty chains that are jumped to.
+// Only rules whose matches are a subset of an earlier rule's matches are
+// recognized as unreachable, so the result is conservative.
+func (ipt *IPTables) Analyze(table string) ([]Finding, error) {
+	lines, err := ipt.ExecuteList([]string{"-t", table, "-S"})
+	if err != nil {
+		return nil, err
+	}
+	t, err := parseTableRules(lines)
+	if err != nil {
+		return nil, err
+	}
+	return analyzeTableRules(t), nil
+}
+
+func analyzeTableRules(t *tableRules) []Finding {
+	var findings []Finding
+	referenced := make(map[string]bool)
+
+	for _, chain := range t.chains {
+		rules := t.rules[chain]
+	next:
+		for i, r := range rules {
+			if !terminalTargets[r.Target] {
+				referenced[r.Target] = true
+			}
+			for j := 0; j < i; j++ {
+				prev := rules[j]
+				switch {
+				case prev.Spec == r.Spec:
+					findings = append(findings, Finding{
+						Kind:     FindingDuplicate,
+						Chain:    chain,
+						Rule:     i + 1,
+						RuleSpec: r.Spec,
+						Related:  j + 1,
+						Message:  fmt.Sprintf("duplicate of rule %d", j+1),
+					})
+					continue next
+				case shadows(prev, r):
+					findings = append(findings, Finding{
+						Kind:     FindingUnreachable,
+						Chain:    chain,
+						Rule:     i + 1,
+						RuleSpec: r.Spec,
+						Related:  j + 1,
+						Message:  fmt.Sprintf("rule %d (%s) matches first", j+1, prev.Spec),
+					})
+					continue next
+				}
+			}
+		}
+	}
+
+	for _, chain := range t.chains {
+		if !t.builtin[chain] && referenced[chain] && len(t.rules[chain]) == 0 {
+			findings = append(findings, Finding{
+				Kind:    FindingEmptyChain,
+				Chain:   chain,
+				Message: "chain is jumped to but has no rules",
+			})
+		}
+	}
+	return findings
+}
+
+// shadows reports whether rule prev, when evaluated before r, catches every
+// packet r could match: prev terminates traversal and each of its match
+// clauses is also a clause of r.
+func shadows(prev, r *ParsedRule) bool {
+	if !terminalTargets[prev.Target] || prev.Goto {
+		return false
+	}
+	for _, pc := range prev.clauses {
+		if (pc.option == "-m" || pc.option == "--match") && len(pc.values) == 1 && statefulMatches[pc.values[0]] {
+			return false
+		}
+		found := false
+		for _, c := range r.clauses {
+			if pc.equal(c) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitRule(t *testing.T) {
+	args, err := splitRule(`-A INPUT -m comment --comment "allow \"ssh\" in" -j ACCEPT`)
+	if err != nil {
+		t.Fatalf("splitRule failed: %v", err)
+	}
+	expected := []string{"-A", "INPUT", "-m", "comment", "--comment", `allow "ssh" in`, "-j", "ACCEPT"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("splitRule mismatch: \ngot  %#v \nneed %#v", args, expected)
+	}
+
+	if _, err := splitRule(`-A INPUT -m comment --comment "open`); err == nil {
+		t.Fatalf("splitRule of unterminated quote did not fail")
+	}
+}
+
+func TestJoinRule(t *testing.T) {
+	args := []string{"-m", "comment", "--comment", `allow "ssh" in`, "--log-prefix", `C:\`, "--empty", ""}
+	line := joinRule(args)
+	expected := `-m comment --comment "allow \"ssh\" in" --log-prefix "C:\\" --empty ""`
+	if line != expected {
+		t.Fatalf("joinRule mismatch: \ngot  %s \nneed %s", line, expected)
+	}
+	split, err := splitRule(line)
+	if err != nil {
+		t.Fatalf("splitRule failed: %v", err)
+	}
+	if !reflect.DeepEqual(split, args) {
+		t.Fatalf("joinRule does not round-trip: \ngot  %#v \nneed %#v", split, args)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	lines := []string{
+		"-P INPUT ACCEPT",
+		"-N EMPTY",
+		"-N USED",
+		"-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT",
+		"-A INPUT -s 192.0.2.0/24 -p tcp -m tcp --dport 22 -j ACCEPT",
+		"-A INPUT -p tcp -m tcp --dport 80 -j EMPTY",
+		"-A INPUT -p tcp -m tcp --dport 80 -j EMPTY",
+		"-A INPUT -m limit --limit 5/min -j DROP",
+		"-A INPUT -p udp -m limit --limit 5/min -j DROP",
+		"-A INPUT -p tcp ! --dport 443 -j USED",
+		"-A INPUT -p tcp --dport 443 -j DROP",
+		"-A USED -j RETURN",
+	}
+	tr, err := parseTableRules(lines)
+	if err != nil {
+		t.Fatalf("parseTableRules failed: %v", err)
+	}
+	findings := analyzeTableRules(tr)
+
+	type key struct {
+		kind    FindingKind
+		chain   string
+		rule    int
+		related int
+	}
+	var got []key
+	for _, f := range findings {
+		got = append(got, key{f.Kind, f.Chain, f.Rule, f.Related})
+	}
+	expected := []key{
+		{FindingUnreachable, "INPUT", 2, 1},
+		{FindingDuplicate, "INPUT", 4, 3},
+		{FindingEmptyChain, "EMPTY", 0, 0},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Analyze mismatch: \ngot  %#v \nneed %#v", got, expected)
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	r, err := ParseRule(`-A INPUT ! -s 192.0.2.0/24 -p tcp -m tcp --dport 22 -m comment --comment "no ssh" -j REJECT --reject-with tcp-reset`)
+	if err != nil {
+		t.Fatalf("ParseRule failed: %v", err)
+	}
+	expected := &ParsedRule{
+		Chain: "INPUT",
+		Spec:  `! -s 192.0.2.0/24 -p tcp -m tcp --dport 22 -m comment --comment "no ssh" -j REJECT --reject-with tcp-reset`,
+		Matches: map[string][]string{
+			"! -s":      {"192.0.2.0/24"},
+			"-p":        {"tcp"},
+			"-m":        {"tcp", "comment"},
+			"--dport":   {"22"},
+			"--comment": {"no ssh"},
+		},
+		Target:        "REJECT",
+		TargetOptions: []string{"--reject-with", "tcp-reset"},
+	}
+	r.clauses = nil
+	if !reflect.DeepEqual(r, expected) {
+		t.Fatalf("ParseRule mismatch: \ngot  %#v \nneed %#v", r, expected)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrAnchorNotFound is returned by InsertAfter and InsertBefore when the
+// anchor rule is not in the chain.
+var ErrAnchorNotFound = errors.New("iptables: anchor rule not found")
+
+// InsertAfter inserts rulespec into specified table/chain right after the
+// first rule equal to anchor (see RulesEqual), instead of at a hardcoded
+// position that breaks as soon as another agent adds rules. The chain is
+// listed and the rule inserted in two steps, so a caller racing with other
+// users of this package should hold AcquireSequenceLock.
+func (ipt *IPTables) InsertAfter(table, chain string, anchor []string, rulespec ...string) error {
+	pos, err := ipt.anchorPosition(table, chain, anchor)
+	if err != nil {
+		return err
+	}
+	return ipt.Insert(table, chain, pos+1, rulespec...)
+}
+
+// InsertBefore inserts rulespec into specified table/chain right before the
+// first rule equal to anchor, like InsertAfter.
+func (ipt *IPTables) InsertBefore(table, chain string, anchor []string, rulespec ...string) error {
+	pos, err := ipt.anchorPosition(table, chain, anchor)
+	if err != nil {
+		return err
+	}
+	return ipt.Insert(table, chain, pos, rulespec...)
+}
+
+// anchorPosition returns the 1-based position of the first rule of the chain
+// equal to anchor, either as given or as tagged by the owner of the handle.
+// All rules are listed, as positions count the rules of every owner.
+func (ipt *IPTables) anchorPosition(table, chain string, anchor []string) (int, error) {
+	owned, err := ipt.owned(anchor)
+	if err != nil {
+		return 0, err
+	}
+	rules, err := ipt.ExecuteList([]string{"-t", table, "-S", chain})
+	if err != nil {
+		return 0, err
+	}
+	pos := 0
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule, "-A ") {
+			continue
+		}
+		pos++
+		args, err := splitRule(rule)
+		if err != nil || len(args) < 2 {
+			continue
+		}
+		if RulesEqual(args[2:], anchor) || RulesEqual(args[2:], owned) {
+			return pos, nil
+		}
+	}
+	return 0, ErrAnchorNotFound
+}
@@ -0,0 +1,51 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInsertRelative(t *testing.T) {
+	ipt, log := newFakeIPTables(t, `case "$*" in
+*-S*) printf -- '-P INPUT ACCEPT\n-A INPUT -i lo -j ACCEPT\n-A INPUT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT\n-A INPUT -j DROP\n';;
+esac`)
+
+	anchor := []string{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"}
+	if err := ipt.InsertAfter("filter", "INPUT", anchor, "-p", "tcp", "--dport", "22", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("InsertAfter failed: %v", err)
+	}
+	if err := ipt.InsertBefore("filter", "INPUT", []string{"-j", "DROP"}, "-j", "LOG"); err != nil {
+		t.Fatalf("InsertBefore failed: %v", err)
+	}
+	if err := ipt.InsertAfter("filter", "INPUT", []string{"-j", "REJECT"}, "-j", "LOG"); err != ErrAnchorNotFound {
+		t.Fatalf("InsertAfter with a missing anchor returned %v", err)
+	}
+
+	expectedCalls := []string{
+		"--wait -t filter -S INPUT",
+		"--wait -t filter -I INPUT 3 -p tcp --dport 22 -j ACCEPT",
+		"--wait -t filter -S INPUT",
+		"--wait -t filter -I INPUT 3 -j LOG",
+		"--wait -t filter -S INPUT",
+	}
+	if calls := fakeCalls(t, log); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("calls mismatch: \ngot  %q \nneed %q", calls, expectedCalls)
+	}
+}
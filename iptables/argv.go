@@ -0,0 +1,70 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+// Linux limits each argument passed to a program to MAX_ARG_STRLEN (32
+// pages), and all of them together to a quarter of the stack limit, which
+// is at least 2 MiB with the default 8 MiB stack; the environment counts
+// against the latter too.
+var (
+	maxArgLen   = 128*1024 - 1
+	maxArgvSize = 1024 * 1024
+)
+
+// restoreCommands are the iptables commands that iptables-restore accepts.
+var restoreCommands = map[string]bool{
+	"-A": true, "--append": true,
+	"-I": true, "--insert": true,
+	"-D": true, "--delete": true,
+	"-R": true, "--replace": true,
+	"-N": true, "--new-chain": true,
+	"-X": true, "--delete-chain": true,
+	"-F": true, "--flush": true,
+	"-E": true, "--rename-chain": true,
+	"-P": true, "--policy": true,
+}
+
+// argvTooLong reports whether the arguments exceed what can be passed to a
+// program on the command line.
+func argvTooLong(args []string) bool {
+	size := 0
+	for _, arg := range args {
+		if len(arg) > maxArgLen {
+			return true
+		}
+		size += len(arg) + 1
+	}
+	return size > maxArgvSize
+}
+
+// restoreCommandData returns the iptables-restore data running the iptables
+// command given by args, for use with "--noflush", or false if the command
+// cannot be run through iptables-restore. Some iptables-restore versions
+// bound the length of a line too; exceeding it fails the restore as usual.
+func restoreCommandData(args []string) (string, bool) {
+	table := "filter"
+	if len(args) >= 2 && (args[0] == "-t" || args[0] == "--table") {
+		table, args = args[1], args[2:]
+	}
+	if len(args) == 0 || !restoreCommands[args[0]] {
+		return "", false
+	}
+	for _, arg := range args {
+		if arg == "-t" || arg == "--table" || arg == "--wait" || arg == "-w" {
+			return "", false
+		}
+	}
+	return "*" + table + "\n" + joinRule(args) + "\nCOMMIT\n", true
+}
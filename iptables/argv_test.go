@@ -0,0 +1,55 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestArgvTooLong(t *testing.T) {
+	if argvTooLong([]string{"-t", "filter", "-A", "INPUT", "-j", "ACCEPT"}) {
+		t.Fatalf("short argv reported too long")
+	}
+	if !argvTooLong([]string{"-m", "comment", "--comment", strings.Repeat("x", maxArgLen+1)}) {
+		t.Fatalf("overlong argument not detected")
+	}
+	many := make([]string, maxArgvSize/1000)
+	for i := range many {
+		many[i] = strings.Repeat("x", 1000)
+	}
+	if !argvTooLong(many) {
+		t.Fatalf("overlong argv not detected")
+	}
+}
+
+func TestRestoreCommandData(t *testing.T) {
+	data, ok := restoreCommandData([]string{"-t", "nat", "-I", "PREROUTING", "1", "-m", "comment", "--comment", "a b", "-j", "ACCEPT"})
+	if !ok || data != "*nat\n-I PREROUTING 1 -m comment --comment \"a b\" -j ACCEPT\nCOMMIT\n" {
+		t.Fatalf("unexpected restore data %q, %v", data, ok)
+	}
+	if data, ok := restoreCommandData([]string{"-A", "INPUT", "-j", "DROP"}); !ok || data != "*filter\n-A INPUT -j DROP\nCOMMIT\n" {
+		t.Fatalf("unexpected restore data %q, %v", data, ok)
+	}
+	for _, args := range [][]string{
+		{"-t", "filter", "-S", "INPUT"},
+		{"-t", "filter", "-C", "INPUT", "-j", "DROP"},
+		{"-t", "filter", "-N", "X", "--wait"},
+	} {
+		if _, ok := restoreCommandData(args); ok {
+			t.Errorf("restoreCommandData accepted %q", args)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord is the JSON record WithAudit writes for a mutating call.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// Operation is the long name of the iptables command, e.g. "append", or
+	// "restore" for iptables-restore transactions.
+	Operation string   `json:"operation"`
+	Table     string   `json:"table,omitempty"`
+	Chain     string   `json:"chain,omitempty"`
+	Rulespec  []string `json:"rulespec,omitempty"`
+	// Tables lists the tables changed by a restore.
+	Tables []string `json:"tables,omitempty"`
+	// Result is "ok", or the error message.
+	Result string `json:"result"`
+	// RulesBefore is the number of rules in the chain before the call; it
+	// is left out if the chain could not be listed, e.g. did not exist.
+	RulesBefore *int `json:"rules_before,omitempty"`
+}
+
+// auditOperations maps iptables commands to the Operation of their records.
+var auditOperations = map[string]string{
+	"-A": "append", "--append": "append",
+	"-I": "insert", "--insert": "insert",
+	"-D": "delete", "--delete": "delete",
+	"-R": "replace", "--replace": "replace",
+	"-N": "new-chain", "--new-chain": "new-chain",
+	"-X": "delete-chain", "--delete-chain": "delete-chain",
+	"-F": "flush", "--flush": "flush",
+	"-E": "rename-chain", "--rename-chain": "rename-chain",
+	"-P": "policy", "--policy": "policy",
+	"-Z": "zero", "--zero": "zero",
+}
+
+// auditLog serializes the records written to an audit writer.
+type auditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// WithAudit writes an AuditRecord as a line of JSON to w for every call
+// that changes the firewall, once it has completed. Counting the rules of the
+// chain beforehand costs an extra listing per call. Write errors are ignored.
+func WithAudit(w io.Writer) Option {
+	return func(ipt *IPTables) {
+		ipt.audit = &auditLog{enc: json.NewEncoder(w)}
+	}
+}
+
+func (a *auditLog) write(rec *AuditRecord, err error) {
+	rec.Result = "ok"
+	if err != nil {
+		rec.Result = strings.TrimSpace(err.Error())
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.enc.Encode(rec)
+}
+
+// auditCommand starts the record of the iptables command given by args,
+// counting the rules of its chain.
+func (ipt *IPTables) auditCommand(args []string) *AuditRecord {
+	rec := &AuditRecord{Time: time.Now().UTC(), Table: "filter"}
+	i := 0
+	if len(args) >= 2 && (args[0] == "-t" || args[0] == "--table") {
+		rec.Table = args[1]
+		i = 2
+	}
+	if i < len(args) {
+		rec.Operation = auditOperations[args[i]]
+		i++
+	}
+	if i < len(args) && !strings.HasPrefix(args[i], "-") {
+		rec.Chain = args[i]
+		rec.Rulespec = args[i+1:]
+	}
+	if rec.Chain != "" && rec.Operation != "new-chain" {
+		n := 0
+		err := ipt.ExecuteListFunc([]string{"-t", rec.Table, "-S", rec.Chain}, func(line string) error {
+			if strings.HasPrefix(line, "-A ") {
+				n++
+			}
+			return nil
+		})
+		if err == nil {
+			rec.RulesBefore = &n
+		}
+	}
+	return rec
+}
+
+// auditRestore starts the record of an iptables-restore transaction.
+func auditRestore(data string) *AuditRecord {
+	rec := &AuditRecord{Time: time.Now().UTC(), Operation: "restore"}
+	if _, order, err := splitRestoreData(data); err == nil {
+		rec.Tables = order
+	}
+	return rec
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWithAudit(t *testing.T) {
+	ipt, _ := newFakeIPTables(t, `case "$*" in
+*"-S INPUT") printf -- '-P INPUT ACCEPT\n-A INPUT -j ACCEPT\n-A INPUT -j LOG\n';;
+*"-S MISSING") echo "iptables: No chain/target/match by that name." >&2; exit 1;;
+*-D*) echo "iptables: Bad rule (does a matching rule exist in that chain?)." >&2; exit 1;;
+esac`)
+	var buf bytes.Buffer
+	WithAudit(&buf)(ipt)
+
+	if err := ipt.Append("filter", "INPUT", "-s", "192.0.2.1", "-j", "DROP"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := ipt.Delete("filter", "INPUT", "-j", "REJECT"); err == nil {
+		t.Fatalf("Delete did not fail")
+	}
+	if err := ipt.NewChain("nat", "MISSING"); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	if _, err := ipt.List("filter", "INPUT"); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 records, got %q", lines)
+	}
+	var recs []AuditRecord
+	for _, line := range lines {
+		var rec AuditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+		if rec.Time.IsZero() {
+			t.Fatalf("record without time: %q", line)
+		}
+		recs = append(recs, rec)
+	}
+	two := 2
+	expected := []AuditRecord{
+		{Operation: "append", Table: "filter", Chain: "INPUT", Rulespec: []string{"-s", "192.0.2.1", "-j", "DROP"}, Result: "ok", RulesBefore: &two},
+		{Operation: "delete", Table: "filter", Chain: "INPUT", Rulespec: []string{"-j", "REJECT"}, Result: "exit status 1: iptables: Bad rule (does a matching rule exist in that chain?).", RulesBefore: &two},
+		{Operation: "new-chain", Table: "nat", Chain: "MISSING", Result: "ok"},
+	}
+	for i := range recs {
+		recs[i].Time = expected[i].Time
+	}
+	if !reflect.DeepEqual(recs, expected) {
+		t.Fatalf("records mismatch: \ngot  %s", buf.String())
+	}
+}
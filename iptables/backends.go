@@ -0,0 +1,217 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Backends maintains a nat chain spreading new connections over a pool of
+// DNAT backends by weight, as built by BalanceDNAT. Backends can be added,
+// removed, reweighted and drained at runtime; every change regenerates the
+// chain in a single iptables-restore transaction, so new connections always
+// find a complete set of rules, and established ones keep their backend, as
+// conntrack remembers the translation. The chain is created on the first
+// change; jump to it from PREROUTING and OUTPUT rules matching the service.
+// With no backend of positive weight the chain is empty, and connections
+// pass through it untranslated.
+type Backends struct {
+	ipt   *IPTables
+	chain string
+
+	mu       sync.Mutex
+	backends map[string]Backend
+}
+
+// NewBackends returns a backend pool owning the specified nat chain.
+func NewBackends(ipt *IPTables, chain string) *Backends {
+	return &Backends{
+		ipt:      ipt,
+		chain:    chain,
+		backends: make(map[string]Backend),
+	}
+}
+
+// checkBackend validates the backend and returns it with its address
+// normalized, which identifies it in the pool.
+func (b *Backends) checkBackend(backend Backend) (Backend, error) {
+	if backend.Weight < 0 {
+		return Backend{}, fmt.Errorf("negative weight %d of backend %s", backend.Weight, backend.Addr)
+	}
+	ip := net.ParseIP(backend.Addr)
+	if ip == nil {
+		return Backend{}, fmt.Errorf("invalid backend address %q", backend.Addr)
+	}
+	if (ip.To4() != nil) != (b.ipt.Proto() == ProtocolIPv4) {
+		return Backend{}, fmt.Errorf("%w: backend %s", ErrWrongFamily, backend.Addr)
+	}
+	backend.Addr = ip.String()
+	if _, err := backend.destination(); err != nil {
+		return Backend{}, err
+	}
+	return backend, nil
+}
+
+// Set adds the backend to the pool, or replaces the backend with the same
+// address, and updates the chain.
+func (b *Backends) Set(backend Backend) error {
+	backend, err := b.checkBackend(backend)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev, existed := b.backends[backend.Addr]
+	b.backends[backend.Addr] = backend
+	if err := b.sync(); err != nil {
+		if existed {
+			b.backends[backend.Addr] = prev
+		} else {
+			delete(b.backends, backend.Addr)
+		}
+		return err
+	}
+	return nil
+}
+
+// SetWeight changes the weight of the backend with the given address and
+// updates the chain.
+func (b *Backends) SetWeight(addr string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("negative weight %d of backend %s", weight, addr)
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("invalid backend address %q", addr)
+	}
+	addr = ip.String()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev, ok := b.backends[addr]
+	if !ok {
+		return fmt.Errorf("unknown backend %s", addr)
+	}
+	backend := prev
+	backend.Weight = weight
+	b.backends[addr] = backend
+	if err := b.sync(); err != nil {
+		b.backends[addr] = prev
+		return err
+	}
+	return nil
+}
+
+// Drain stops sending new connections to the backend with the given
+// address, by setting its weight to 0, while its established connections
+// carry on. The backend stays in the pool until Remove.
+func (b *Backends) Drain(addr string) error {
+	return b.SetWeight(addr, 0)
+}
+
+// Remove removes the backend with the given address from the pool and
+// updates the chain. Removing an unknown backend is not an error.
+func (b *Backends) Remove(addr string) error {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("invalid backend address %q", addr)
+	}
+	addr = ip.String()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev, ok := b.backends[addr]
+	if !ok {
+		return nil
+	}
+	delete(b.backends, addr)
+	if err := b.sync(); err != nil {
+		b.backends[addr] = prev
+		return err
+	}
+	return nil
+}
+
+// List returns the backends of the pool, ordered by address.
+func (b *Backends) List() []Backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.list()
+}
+
+func (b *Backends) list() []Backend {
+	addrs := make([]string, 0, len(b.backends))
+	for addr := range b.backends {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	backends := make([]Backend, 0, len(addrs))
+	for _, addr := range addrs {
+		backends = append(backends, b.backends[addr])
+	}
+	return backends
+}
+
+// Cleanup deletes the chain. The jumps to it must be removed first. The
+// backends are kept, so a later change recreates the chain with them.
+func (b *Backends) Cleanup() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.ipt.ClearChain("nat", b.chain); err != nil {
+		return err
+	}
+	return b.ipt.DeleteChain("nat", b.chain)
+}
+
+// sync rebuilds the chain from the backends in a single iptables-restore
+// transaction.
+func (b *Backends) sync() error {
+	snippet, err := b.snippet()
+	if err != nil {
+		return err
+	}
+	return b.ipt.RestoreChain("nat", b.chain, snippet, true)
+}
+
+// snippet renders the rules of BalanceDNAT for RestoreChain, or nothing if
+// no backend has a positive weight.
+func (b *Backends) snippet() (string, error) {
+	backends := b.list()
+	active := false
+	for _, backend := range backends {
+		active = active || backend.Weight > 0
+	}
+	if !active {
+		return "", nil
+	}
+	rules, err := BalanceDNAT(backends)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	for _, r := range rules {
+		args, err := r.ArgsFor(b.ipt.Proto())
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString("-A " + b.chain + " " + joinRule(args) + "\n")
+	}
+	return buf.String(), nil
+}
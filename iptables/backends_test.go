@@ -0,0 +1,93 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBackends(t *testing.T) {
+	// the chain exists, and the fake iptables-restore saves its input
+	ipt, _ := newFakeIPTables(t, "exit 0")
+	dir := filepath.Dir(ipt.path)
+	input := filepath.Join(dir, "restored")
+	script := "#!/bin/sh\ncat > " + input + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables-restore"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	restored := func() string {
+		data, _ := ioutil.ReadFile(input)
+		return string(data)
+	}
+
+	b := NewBackends(ipt, "SVC-WEB")
+	for _, backend := range []Backend{
+		{Addr: "10.0.0.1", Port: 8080, Weight: 1},
+		{Addr: "10.0.0.2", Port: 8080, Weight: 1},
+		{Addr: "10.0.0.3", Port: 8080, Weight: 2},
+	} {
+		if err := b.Set(backend); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	expected := "*nat\n-F SVC-WEB\n" +
+		"-A SVC-WEB -p tcp -m statistic --mode random --probability 0.25000000000 -j DNAT --to-destination 10.0.0.1:8080\n" +
+		"-A SVC-WEB -p tcp -m statistic --mode random --probability 0.33333333333 -j DNAT --to-destination 10.0.0.2:8080\n" +
+		"-A SVC-WEB -p tcp -j DNAT --to-destination 10.0.0.3:8080\n" +
+		"COMMIT\n"
+	if got := restored(); got != expected {
+		t.Fatalf("restored %q, want %q", got, expected)
+	}
+
+	if err := b.Drain("10.0.0.3"); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	expected = "*nat\n-F SVC-WEB\n" +
+		"-A SVC-WEB -p tcp -m statistic --mode random --probability 0.50000000000 -j DNAT --to-destination 10.0.0.1:8080\n" +
+		"-A SVC-WEB -p tcp -j DNAT --to-destination 10.0.0.2:8080\n" +
+		"COMMIT\n"
+	if got := restored(); got != expected {
+		t.Fatalf("restored %q after Drain, want %q", got, expected)
+	}
+
+	if err := b.Remove("10.0.0.1"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := b.Remove("10.0.0.2"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if got := restored(); got != "*nat\n-F SVC-WEB\nCOMMIT\n" {
+		t.Fatalf("restored %q without active backends", got)
+	}
+	want := []Backend{{Addr: "10.0.0.3", Port: 8080, Weight: 0}}
+	if got := b.List(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("List returned %+v, want %+v", got, want)
+	}
+
+	if err := b.Set(Backend{Addr: "2001:db8::1", Weight: 1}); err == nil {
+		t.Fatalf("Set accepted an IPv6 backend")
+	}
+	if err := b.SetWeight("10.0.0.9", 1); err == nil {
+		t.Fatalf("SetWeight of an unknown backend did not fail")
+	}
+}
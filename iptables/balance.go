@@ -0,0 +1,95 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Backend is a destination of BalanceDNAT.
+type Backend struct {
+	// Addr is the IP address of the backend.
+	Addr string
+	// Port optionally rewrites the destination port as well; it requires
+	// Protocol, which defaults to "tcp".
+	Port     int
+	Protocol string
+	// Weight is the share of new connections the backend gets, relative to
+	// the others. Backends of weight 0 get none, e.g. while being drained.
+	Weight int
+}
+
+// destination returns the --to-destination of the backend.
+func (b Backend) destination() (string, error) {
+	ip := net.ParseIP(b.Addr)
+	if ip == nil {
+		return "", fmt.Errorf("invalid backend address %q", b.Addr)
+	}
+	if b.Port == 0 {
+		return ip.String(), nil
+	}
+	if b.Port < 0 || b.Port > 65535 {
+		return "", fmt.Errorf("invalid backend port %d", b.Port)
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(b.Port)), nil
+}
+
+// BalanceDNAT returns the rules of a nat chain spreading connections over
+// the backends by weight, the usual poor man's load balancer: each rule but
+// the last DNATs to its backend with the probability of its weight among the
+// weights of the remaining rules, so every backend gets its share overall,
+// and the last one takes whatever is left. Jump to the chain from
+// PREROUTING and OUTPUT rules matching the service, e.g. its address and
+// port; as conntrack only sends the first packet of a connection through
+// the nat table, a connection sticks to its backend.
+func BalanceDNAT(backends []Backend) ([]*Rule, error) {
+	var active []Backend
+	total := 0
+	for _, b := range backends {
+		if b.Weight < 0 {
+			return nil, fmt.Errorf("negative weight %d of backend %s", b.Weight, b.Addr)
+		}
+		if b.Weight > 0 {
+			active = append(active, b)
+			total += b.Weight
+		}
+	}
+	if len(active) == 0 {
+		return nil, fmt.Errorf("no backend with a positive weight")
+	}
+
+	rules := make([]*Rule, 0, len(active))
+	for i, b := range active {
+		dst, err := b.destination()
+		if err != nil {
+			return nil, err
+		}
+		r := &Rule{Target: &DNAT{ToDestination: dst}}
+		if b.Port != 0 {
+			r.Protocol = b.Protocol
+			if r.Protocol == "" {
+				r.Protocol = "tcp"
+			}
+		}
+		if i < len(active)-1 {
+			r.Matches = []Match{&Statistic{Mode: StatisticRandom, Probability: float64(b.Weight) / float64(total)}}
+		}
+		total -= b.Weight
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBalanceDNAT(t *testing.T) {
+	rules, err := BalanceDNAT([]Backend{
+		{Addr: "10.0.0.1", Port: 8080, Weight: 1},
+		{Addr: "10.0.0.2", Port: 8080, Weight: 0},
+		{Addr: "10.0.0.3", Port: 8080, Weight: 1},
+		{Addr: "2001:db8::4", Port: 8080, Protocol: "udp", Weight: 2},
+	})
+	if err != nil {
+		t.Fatalf("BalanceDNAT failed: %v", err)
+	}
+	var got [][]string
+	for _, r := range rules {
+		args, err := r.Args()
+		if err != nil {
+			t.Fatalf("Args failed: %v", err)
+		}
+		got = append(got, args)
+	}
+	expected := [][]string{
+		{"-p", "tcp", "-m", "statistic", "--mode", "random", "--probability", "0.25000000000", "-j", "DNAT", "--to-destination", "10.0.0.1:8080"},
+		{"-p", "tcp", "-m", "statistic", "--mode", "random", "--probability", "0.33333333333", "-j", "DNAT", "--to-destination", "10.0.0.3:8080"},
+		{"-p", "udp", "-j", "DNAT", "--to-destination", "[2001:db8::4]:8080"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("BalanceDNAT mismatch: \ngot  %q \nneed %q", got, expected)
+	}
+
+	for _, backends := range [][]Backend{
+		nil,
+		{{Addr: "10.0.0.1", Weight: 0}},
+		{{Addr: "10.0.0.1", Weight: -1}},
+		{{Addr: "backend-1", Weight: 1}},
+		{{Addr: "10.0.0.1", Port: 70000, Weight: 1}},
+	} {
+		if _, err := BalanceDNAT(backends); err == nil {
+			t.Errorf("BalanceDNAT(%v) did not fail", backends)
+		}
+	}
+}
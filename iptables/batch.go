@@ -0,0 +1,195 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Batch collects rule operations to be run in order by ApplyBatch.
+type Batch struct {
+	ops []batchOp
+}
+
+// batchOp is a single -A, -I or -D operation of a Batch.
+type batchOp struct {
+	command  string
+	table    string
+	chain    string
+	pos      int
+	rulespec []string
+}
+
+func (op batchOp) args() []string {
+	args := []string{"-t", op.table, op.command, op.chain}
+	if op.command == "-I" {
+		args = append(args, strconv.Itoa(op.pos))
+	}
+	return append(args, op.rulespec...)
+}
+
+// Append adds an operation appending rulespec to the table/chain.
+func (b *Batch) Append(table, chain string, rulespec ...string) {
+	b.ops = append(b.ops, batchOp{"-A", table, chain, 0, rulespec})
+}
+
+// Insert adds an operation inserting rulespec at pos of the table/chain.
+func (b *Batch) Insert(table, chain string, pos int, rulespec ...string) {
+	b.ops = append(b.ops, batchOp{"-I", table, chain, pos, rulespec})
+}
+
+// Delete adds an operation deleting rulespec from the table/chain.
+func (b *Batch) Delete(table, chain string, rulespec ...string) {
+	b.ops = append(b.ops, batchOp{"-D", table, chain, 0, rulespec})
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// RuleError describes a rule that could not be applied.
+type RuleError struct {
+	Table string
+	Chain string
+	// Index is the 1-based position of the operation in the Batch, or of
+	// the rule in its RulesetChain; 0 if the failure is not tied to a rule.
+	Index    int
+	Rulespec []string
+	// Line is the line of the iptables-restore input reported as failing,
+	// if any.
+	Line int
+	// Stderr is the error output of the failed command.
+	Stderr string
+	Err    error
+}
+
+func (e *RuleError) Error() string {
+	var where string
+	switch {
+	case e.Index > 0 && e.Chain != "":
+		where = fmt.Sprintf("rule %d (%s) in %s/%s", e.Index, joinRule(e.Rulespec), e.Table, e.Chain)
+	case e.Index > 0:
+		where = fmt.Sprintf("operation %d", e.Index)
+	case e.Line > 0:
+		where = fmt.Sprintf("table %s, restore line %d", e.Table, e.Line)
+	default:
+		where = "table " + e.Table
+	}
+	return fmt.Sprintf("%s: %v", where, e.Err)
+}
+
+// ErrorPolicy selects how ApplyBatch and ApplyRuleset handle failures.
+type ErrorPolicy int
+
+const (
+	// ContinueAndReport attempts every operation and reports all failures.
+	ContinueAndReport ErrorPolicy = iota
+	// FailFast stops at the first failure, leaving earlier operations applied.
+	FailFast
+	// RollbackAll stops at the first failure and restores the tables
+	// involved to their state before the call, counters included.
+	RollbackAll
+)
+
+func (p ErrorPolicy) String() string {
+	switch p {
+	case ContinueAndReport:
+		return "ContinueAndReport"
+	case FailFast:
+		return "FailFast"
+	case RollbackAll:
+		return "RollbackAll"
+	}
+	return fmt.Sprintf("ErrorPolicy(%d)", int(p))
+}
+
+// OnError sets the failure handling of ApplyBatch and ApplyRuleset; the
+// default is ContinueAndReport.
+func OnError(policy ErrorPolicy) Option {
+	return func(ipt *IPTables) {
+		ipt.errorPolicy = policy
+	}
+}
+
+// ApplyError is returned by ApplyBatch and ApplyRuleset if some of the rules
+// could not be applied. Unless RolledBack is set, everything not listed in
+// Failed was applied, up to the first failure under FailFast.
+type ApplyError struct {
+	// Applied counts the batch operations, or the ruleset tables, applied.
+	Applied int
+	Failed  []*RuleError
+	// RolledBack is set if the RollbackAll policy undid the applied
+	// operations; RollbackErr holds the error if that failed.
+	RolledBack  bool
+	RollbackErr error
+}
+
+func (e *ApplyError) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d failed, %d applied", len(e.Failed), e.Applied)
+	switch {
+	case e.RollbackErr != nil:
+		fmt.Fprintf(&buf, ", rollback failed: %v", e.RollbackErr)
+	case e.RolledBack:
+		buf.WriteString(", rolled back")
+	}
+	for _, f := range e.Failed {
+		buf.WriteString("\n\t" + f.Error())
+	}
+	return buf.String()
+}
+
+// applySteps runs the steps in order under the handle's ErrorPolicy. Each
+// step returns nil on success. tables lists the tables the steps modify, for
+// RollbackAll.
+func (ipt *IPTables) applySteps(tables []string, steps []func() *RuleError) error {
+	return ipt.applyGraph(tables, steps, nil, 1, nil)
+}
+
+// newRuleError wraps the error of a command, keeping its stderr.
+func newRuleError(table, chain string, index int, rulespec []string, err error) *RuleError {
+	re := &RuleError{Table: table, Chain: chain, Index: index, Rulespec: rulespec, Err: err}
+	if e, ok := err.(*Error); ok {
+		re.Stderr = strings.TrimSpace(e.msg)
+	}
+	return re
+}
+
+// ApplyBatch runs the operations of the batch in order. Failures are handled
+// as selected with OnError and reported in an *ApplyError; by default the
+// remaining operations are still attempted.
+func (ipt *IPTables) ApplyBatch(b *Batch) error {
+	var (
+		tables []string
+		steps  []func() *RuleError
+	)
+	for i, op := range b.ops {
+		i, op := i, op
+		if !containsString(tables, op.table) {
+			tables = append(tables, op.table)
+		}
+		steps = append(steps, func() *RuleError {
+			if err := ipt.run(op.args()...); err != nil {
+				return newRuleError(op.table, op.chain, i+1, op.rulespec, err)
+			}
+			return nil
+		})
+	}
+	return ipt.applySteps(tables, steps)
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyBatch(t *testing.T) {
+	ipt, log := newFakeIPTables(t, `case "$*" in *BAD*) echo "Bad argument BAD" >&2; exit 2;; esac`)
+
+	b := &Batch{}
+	b.Append("filter", "INPUT", "-j", "ACCEPT")
+	b.Insert("filter", "INPUT", 1, "-j", "BAD")
+	b.Delete("filter", "OUTPUT", "-j", "DROP")
+
+	err := ipt.ApplyBatch(b)
+	applyErr, ok := err.(*ApplyError)
+	if !ok {
+		t.Fatalf("ApplyBatch returned %v, want *ApplyError", err)
+	}
+	if applyErr.Applied != 2 || len(applyErr.Failed) != 1 {
+		t.Fatalf("unexpected ApplyError: %v", applyErr)
+	}
+	failed := applyErr.Failed[0]
+	if failed.Index != 2 || failed.Chain != "INPUT" || failed.Stderr != "Bad argument BAD" {
+		t.Fatalf("unexpected RuleError: %+v", failed)
+	}
+	if !strings.Contains(err.Error(), "rule 2 (-j BAD) in filter/INPUT") {
+		t.Fatalf("ApplyError does not name the failed rule: %v", err)
+	}
+
+	expected := []string{
+		"--wait -t filter -A INPUT -j ACCEPT",
+		"--wait -t filter -I INPUT 1 -j BAD",
+		"--wait -t filter -D OUTPUT -j DROP",
+	}
+	if calls := fakeCalls(t, log); !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("calls mismatch: \ngot  %#v \nneed %#v", calls, expected)
+	}
+}
+
+func TestApplyBatchFailFast(t *testing.T) {
+	ipt, log := newFakeIPTables(t, `case "$*" in *BAD*) exit 2;; esac`)
+	OnError(FailFast)(ipt)
+
+	b := &Batch{}
+	b.Append("filter", "INPUT", "-j", "ACCEPT")
+	b.Append("filter", "INPUT", "-j", "BAD")
+	b.Append("filter", "INPUT", "-j", "DROP")
+
+	err := ipt.ApplyBatch(b)
+	applyErr, ok := err.(*ApplyError)
+	if !ok {
+		t.Fatalf("ApplyBatch returned %v, want *ApplyError", err)
+	}
+	if applyErr.Applied != 1 || len(applyErr.Failed) != 1 || applyErr.RolledBack {
+		t.Fatalf("unexpected ApplyError: %v", applyErr)
+	}
+	if calls := fakeCalls(t, log); len(calls) != 2 {
+		t.Fatalf("FailFast ran %d commands, want 2: %#v", len(calls), calls)
+	}
+}
+
+func TestApplyRulesetErrorLine(t *testing.T) {
+	ipt, _ := newFakeIPTables(t, `case "$*" in *"-t filter -S"*) printf -- '-P INPUT ACCEPT\n';; esac`)
+	dir := filepath.Dir(ipt.path)
+	script := "#!/bin/sh\necho 'iptables-restore: line 5 failed' >&2\nexit 1\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables-restore"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// the data is *filter, :SVC, -F INPUT, the INPUT rule and then the
+	// rules of SVC, so line 5 is the first rule of SVC
+	rs := &Ruleset{Tables: []RulesetTable{{
+		Name: "filter",
+		Chains: []RulesetChain{
+			{Name: "INPUT", Rules: []RulesetRule{{Jump: "SVC"}}},
+			{Name: "SVC", Rules: []RulesetRule{{Jump: "LOG"}, {Protocol: "tcp", Jump: "BOGUS"}}},
+		},
+	}}}
+	err := ipt.ApplyRuleset(rs)
+	applyErr, ok := err.(*ApplyError)
+	if !ok || len(applyErr.Failed) != 1 {
+		t.Fatalf("ApplyRuleset returned %v, want *ApplyError", err)
+	}
+	re := applyErr.Failed[0]
+	if re.Line != 5 || re.Chain != "SVC" || re.Index != 1 || !reflect.DeepEqual(re.Rulespec, []string{"-j", "LOG"}) {
+		t.Fatalf("unexpected RuleError %+v", re)
+	}
+	if !strings.Contains(err.Error(), "rule 1 (-j LOG) in filter/SVC") {
+		t.Fatalf("ApplyError does not name the failed rule: %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// blockListStateVersion is the version of the block list state format.
+const blockListStateVersion = 1
+
+// BlockEntry is a blocked address or network.
+type BlockEntry struct {
+	Addr string `json:"addr"`
+	// Expires is when the block is lifted; zero means never.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// blockListState is the persistence format of a BlockList.
+type blockListState struct {
+	Version int          `json:"version"`
+	Entries []BlockEntry `json:"entries"`
+}
+
+// BlockList maintains a dedicated chain dropping traffic from blocked
+// addresses, jumped to first from the hook chains, e.g. INPUT. Blocks can
+// have a time to live, after which Expire, or Run in the background, lifts
+// them, making it an embeddable fail2ban-lite.
+type BlockList struct {
+	ipt   *IPTables
+	table string
+	chain string
+	hooks []string
+
+	// Target is the target of the block rules, "DROP" if empty. Set it
+	// before the first Block.
+	Target string
+
+	// now returns the current time; replaced in tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+// NewBlockList returns a block list owning the specified table/chain, which
+// it creates on the first change and jumps to from each of hooks.
+func NewBlockList(ipt *IPTables, table, chain string, hooks ...string) *BlockList {
+	return &BlockList{
+		ipt:     ipt,
+		table:   table,
+		chain:   chain,
+		hooks:   hooks,
+		now:     time.Now,
+		entries: make(map[string]time.Time),
+	}
+}
+
+// blockAddr normalizes an address or CIDR of the handle's family, e.g.
+// "192.0.2.7" or "2001:db8::/64".
+func (b *BlockList) blockAddr(addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		var ipnet *net.IPNet
+		var err error
+		if ip, ipnet, err = net.ParseCIDR(addr); err != nil {
+			return "", fmt.Errorf("invalid address %q", addr)
+		}
+		addr = ipnet.String()
+	} else {
+		addr = ip.String()
+	}
+	if (ip.To4() != nil) != (b.ipt.Proto() == ProtocolIPv4) {
+		return "", fmt.Errorf("%w: address %s", ErrWrongFamily, addr)
+	}
+	return addr, nil
+}
+
+// Block blocks the address or network for ttl, or until Unblock if ttl is
+// zero, and updates the chain. Blocking an address again sets its new
+// expiry.
+func (b *BlockList) Block(addr string, ttl time.Duration) error {
+	addr, err := b.blockAddr(addr)
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		return fmt.Errorf("negative ttl %v", ttl)
+	}
+	var expires time.Time
+	if ttl > 0 {
+		expires = b.now().Add(ttl)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev, existed := b.entries[addr]
+	b.entries[addr] = expires
+	if err := b.sync(); err != nil {
+		if existed {
+			b.entries[addr] = prev
+		} else {
+			delete(b.entries, addr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Unblock lifts the block of the address or network and updates the chain.
+// Unblocking an address that is not blocked is not an error.
+func (b *BlockList) Unblock(addr string) error {
+	addr, err := b.blockAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	expires, ok := b.entries[addr]
+	if !ok {
+		return nil
+	}
+	delete(b.entries, addr)
+	if err := b.sync(); err != nil {
+		b.entries[addr] = expires
+		return err
+	}
+	return nil
+}
+
+// List returns the blocked addresses, ordered by address, including expired
+// ones that have not been lifted yet.
+func (b *BlockList) List() []BlockEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.list()
+}
+
+func (b *BlockList) list() []BlockEntry {
+	entries := make([]BlockEntry, 0, len(b.entries))
+	for _, addr := range b.addrs() {
+		entries = append(entries, BlockEntry{Addr: addr, Expires: b.entries[addr]})
+	}
+	return entries
+}
+
+func (b *BlockList) addrs() []string {
+	addrs := make([]string, 0, len(b.entries))
+	for addr := range b.entries {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Expire lifts the blocks that have expired, updating the chain if there
+// were any. It returns the number of blocks lifted.
+func (b *BlockList) Expire() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	expired := make(map[string]time.Time)
+	for addr, expires := range b.entries {
+		if !expires.IsZero() && !now.Before(expires) {
+			expired[addr] = expires
+			delete(b.entries, addr)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	if err := b.sync(); err != nil {
+		for addr, expires := range expired {
+			b.entries[addr] = expires
+		}
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// Run calls Expire every interval until the context is done, reporting
+// errors to onError if it is not nil.
+func (b *BlockList) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := b.Expire(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// Save writes the blocks as JSON, for Load after a restart.
+func (b *BlockList) Save(w io.Writer) error {
+	b.mu.Lock()
+	state := blockListState{Version: blockListStateVersion, Entries: b.list()}
+	b.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(state)
+}
+
+// Load replaces the blocks with those written by Save, leaving out the ones
+// that have expired since, and updates the chain.
+func (b *BlockList) Load(r io.Reader) error {
+	var state blockListState
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&state); err != nil {
+		return err
+	}
+	if state.Version != blockListStateVersion {
+		return fmt.Errorf("unsupported state version %d", state.Version)
+	}
+
+	now := b.now()
+	entries := make(map[string]time.Time)
+	for _, e := range state.Entries {
+		addr, err := b.blockAddr(e.Addr)
+		if err != nil {
+			return err
+		}
+		if e.Expires.IsZero() || now.Before(e.Expires) {
+			entries[addr] = e.Expires
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev := b.entries
+	b.entries = entries
+	if err := b.sync(); err != nil {
+		b.entries = prev
+		return err
+	}
+	return nil
+}
+
+// Cleanup removes the jumps to the chain and deletes it. The blocks are
+// kept, so a later change recreates the chain with them.
+func (b *BlockList) Cleanup() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, hook := range b.hooks {
+		if err := b.ipt.DeleteIfExists(b.table, hook, "-j", b.chain); err != nil {
+			return err
+		}
+	}
+	if err := b.ipt.ClearChain(b.table, b.chain); err != nil {
+		return err
+	}
+	return b.ipt.DeleteChain(b.table, b.chain)
+}
+
+// sync rebuilds the chain from the entries in a single iptables-restore
+// transaction and ensures the hooks jump to it.
+func (b *BlockList) sync() error {
+	if err := b.ipt.RestoreChain(b.table, b.chain, b.snippet(), true); err != nil {
+		return err
+	}
+	for _, hook := range b.hooks {
+		if err := b.ipt.EnsureJump(b.table, hook, b.chain, JumpFirst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snippet renders a rule per entry, ordered by address, for RestoreChain.
+func (b *BlockList) snippet() string {
+	target := b.Target
+	if target == "" {
+		target = "DROP"
+	}
+	var buf bytes.Buffer
+	for _, addr := range b.addrs() {
+		buf.WriteString("-A " + b.chain + " -s " + addr + " -j " + target + "\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newFakeBlockList returns a block list on a fake iptables and
+// iptables-restore, the latter saving its input to the file returned.
+func newFakeBlockList(t *testing.T) (*BlockList, string) {
+	ipt, _ := newFakeIPTables(t, "exit 0")
+	dir := filepath.Dir(ipt.path)
+	input := filepath.Join(dir, "restored")
+	script := "#!/bin/sh\ncat > " + input + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables-restore"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	b := NewBlockList(ipt, "filter", "BLOCK")
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+	return b, input
+}
+
+func TestBlockList(t *testing.T) {
+	b, input := newFakeBlockList(t)
+
+	if err := b.Block("192.0.2.7", time.Minute); err != nil {
+		t.Fatalf("Block failed: %v", err)
+	}
+	if err := b.Block("198.51.100.0/24", 0); err != nil {
+		t.Fatalf("Block failed: %v", err)
+	}
+	if err := b.Block("2001:db8::1", 0); err == nil {
+		t.Fatal("Block accepted an IPv6 address")
+	}
+	data, _ := ioutil.ReadFile(input)
+	expected := "*filter\n-F BLOCK\n-A BLOCK -s 192.0.2.7 -j DROP\n-A BLOCK -s 198.51.100.0/24 -j DROP\nCOMMIT\n"
+	if string(data) != expected {
+		t.Fatalf("restored %q, want %q", data, expected)
+	}
+
+	want := []BlockEntry{
+		{Addr: "192.0.2.7", Expires: b.now().Add(time.Minute)},
+		{Addr: "198.51.100.0/24"},
+	}
+	if got := b.List(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("List returned %+v, want %+v", got, want)
+	}
+
+	var saved bytes.Buffer
+	if err := b.Save(&saved); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	if n, err := b.Expire(); err != nil || n != 0 {
+		t.Fatalf("Expire = %d, %v; want 0", n, err)
+	}
+	later := b.now().Add(time.Hour)
+	b.now = func() time.Time { return later }
+	if n, err := b.Expire(); err != nil || n != 1 {
+		t.Fatalf("Expire = %d, %v; want 1", n, err)
+	}
+	if err := b.Unblock("198.51.100.0/24"); err != nil {
+		t.Fatalf("Unblock failed: %v", err)
+	}
+	if got := b.List(); len(got) != 0 {
+		t.Fatalf("List returned %+v after expiry and unblock", got)
+	}
+
+	// the expired block is not loaded again
+	if err := b.Load(&saved); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if got := b.List(); !reflect.DeepEqual(got, want[1:]) {
+		t.Fatalf("List after Load returned %+v, want %+v", got, want[1:])
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// limitUnits maps the rate units of the limit match to the ones the legacy
+// backend lists.
+var limitUnits = map[string]string{
+	"s": "sec", "sec": "sec", "second": "sec",
+	"m": "min", "min": "min", "minute": "min",
+	"h": "hour", "hour": "hour",
+	"d": "day", "day": "day",
+}
+
+// icmpTypeNumbers maps the ICMP type names some versions list to the
+// numbers others do.
+var icmpTypeNumbers = map[string]string{
+	"echo-reply":              "0",
+	"destination-unreachable": "3",
+	"source-quench":           "4",
+	"redirect":                "5",
+	"echo-request":            "8",
+	"router-advertisement":    "9",
+	"router-solicitation":     "10",
+	"time-exceeded":           "11",
+	"parameter-problem":       "12",
+	"timestamp-request":       "13",
+	"timestamp-reply":         "14",
+}
+
+// defaultRejectWith are the answers REJECT sends by default, which some
+// versions list and others leave out.
+var defaultRejectWith = map[string]bool{
+	"icmp-port-unreachable":  true,
+	"icmp6-port-unreachable": true,
+}
+
+// defaultLimitBurst is the burst of the limit match when none is given.
+const defaultLimitBurst = "5"
+
+// CanonicalListLine returns a line of "iptables -S" output in a canonical
+// form that stays the same across iptables versions and backends, so that
+// stored rules and fingerprints of them remain comparable after an OS
+// upgrade. Rules are normalized with NormalizeRule, which among others makes
+// implicit protocol matches such as "-m tcp" explicit and gives addresses
+// their mask, and besides:
+//
+//   - whitespace is collapsed and arguments are quoted only where needed
+//   - rate units of the limit match are abbreviated, e.g. "5/minute" becomes
+//     "5/min", and the default "--limit-burst 5" is left out
+//   - ICMP type names are replaced by their numbers, e.g. "echo-request" by "8"
+//   - the default "--reject-with icmp-port-unreachable" of REJECT is left out
+//
+// The canonical form is meant for comparisons, not to be applied. Lines
+// other than rules have their whitespace collapsed.
+func CanonicalListLine(line string) string {
+	args, err := splitRule(strings.TrimSpace(line))
+	if err != nil || len(args) < 2 || args[0] != "-A" {
+		return strings.Join(strings.Fields(line), " ")
+	}
+	spec := canonicalRuleSpec(NormalizeRule(args[2:]))
+	return "-A " + args[1] + " " + joinRule(spec)
+}
+
+// RuleFingerprint returns a hex SHA-256 hash of the canonical form of a line
+// of "iptables -S" output, see CanonicalListLine.
+func RuleFingerprint(line string) string {
+	sum := sha256.Sum256([]byte(CanonicalListLine(line)))
+	return hex.EncodeToString(sum[:])
+}
+
+// ListCanonical lists the rules in specified table/chain like List, in the
+// form of CanonicalListLine.
+func (ipt *IPTables) ListCanonical(table, chain string) ([]string, error) {
+	rules, err := ipt.List(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		rules[i] = CanonicalListLine(rule)
+	}
+	return rules, nil
+}
+
+// canonicalRuleSpec applies the canonicalizations of CanonicalListLine that
+// NormalizeRule does not to a normalized rulespec.
+func canonicalRuleSpec(spec []string) []string {
+	var out []string
+	for i := 0; i < len(spec); i++ {
+		arg := spec[i]
+		if i+1 >= len(spec) {
+			out = append(out, arg)
+			continue
+		}
+		value := spec[i+1]
+		switch arg {
+		case "--comment", "--log-prefix", "--nflog-prefix":
+			// free text, which might look like an option
+			out = append(out, arg, value)
+			i++
+			continue
+		case "--limit":
+			if n := strings.Index(value, "/"); n >= 0 {
+				if unit, ok := limitUnits[value[n+1:]]; ok {
+					value = value[:n+1] + unit
+				}
+			}
+		case "--limit-burst":
+			if value == defaultLimitBurst {
+				i++
+				continue
+			}
+		case "--icmp-type":
+			if n, ok := icmpTypeNumbers[value]; ok {
+				value = n
+			}
+		case "-j":
+			if value == "REJECT" && len(spec) == i+4 && spec[i+2] == "--reject-with" && defaultRejectWith[spec[i+3]] {
+				return append(out, arg, value)
+			}
+		default:
+			out = append(out, arg)
+			continue
+		}
+		out = append(out, arg, value)
+		i++
+	}
+	return out
+}
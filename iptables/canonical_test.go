@@ -0,0 +1,70 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"testing"
+)
+
+func TestCanonicalListLine(t *testing.T) {
+	for _, tt := range []struct {
+		in, out string
+	}{
+		{"-P INPUT  ACCEPT", "-P INPUT ACCEPT"},
+		{
+			"-A INPUT  -s 192.0.2.1 -p tcp --dport 22 -j ACCEPT",
+			"-A INPUT -s 192.0.2.1/32 -p tcp -m tcp --dport 22 -j ACCEPT",
+		},
+		{
+			`-A INPUT -m comment --comment "ssh" -j ACCEPT`,
+			"-A INPUT -m comment --comment ssh -j ACCEPT",
+		},
+		{
+			"-A INPUT -m limit --limit 5/minute --limit-burst 5 -j LOG",
+			"-A INPUT -m limit --limit 5/min -j LOG",
+		},
+		{
+			"-A INPUT -m limit --limit 1/s --limit-burst 10 -j LOG",
+			"-A INPUT -m limit --limit 1/sec --limit-burst 10 -j LOG",
+		},
+		{
+			"-A INPUT -p icmp -m icmp --icmp-type echo-request -j ACCEPT",
+			"-A INPUT -p icmp -m icmp --icmp-type 8 -j ACCEPT",
+		},
+		{
+			"-A INPUT -j REJECT --reject-with icmp-port-unreachable",
+			"-A INPUT -j REJECT",
+		},
+		{
+			"-A INPUT -j REJECT --reject-with tcp-reset",
+			"-A INPUT -j REJECT --reject-with tcp-reset",
+		},
+		{
+			`-A INPUT -m comment --comment "--limit-burst 5" -j ACCEPT`,
+			`-A INPUT -m comment --comment "--limit-burst 5" -j ACCEPT`,
+		},
+	} {
+		if got := CanonicalListLine(tt.in); got != tt.out {
+			t.Errorf("CanonicalListLine(%q) = %q, want %q", tt.in, got, tt.out)
+		}
+	}
+
+	// legacy and nft listings of the same rule
+	legacy := "-A INPUT -s 10.0.0.0/8 -p icmp -m icmp --icmp-type 8 -m limit --limit 1/sec --limit-burst 5 -j ACCEPT"
+	nft := "-A INPUT -s 10.0.0.0/8 -p icmp --icmp-type echo-request -m limit --limit 1/second -j ACCEPT"
+	if RuleFingerprint(legacy) != RuleFingerprint(nft) {
+		t.Errorf("fingerprints differ: %s and %s", CanonicalListLine(legacy), CanonicalListLine(nft))
+	}
+}
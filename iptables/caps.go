@@ -0,0 +1,72 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// binaryCaps is the detected version of an iptables binary.
+type binaryCaps struct {
+	v1, v2, v3 int
+	mode       string
+	// modTime and size identify the file the version was detected from
+	modTime time.Time
+	size    int64
+}
+
+// capsCache holds the detected version of every iptables binary by path, so
+// creating many handles runs "--version" once per binary.
+var capsCache = struct {
+	sync.Mutex
+	caps map[string]binaryCaps
+}{caps: make(map[string]binaryCaps)}
+
+// InvalidateCaps drops the cached capabilities of all iptables binaries, so
+// handles created afterwards detect them again. Replacing a binary is noticed
+// by its modification time and size, so this is only needed if a binary
+// changes in a way that preserves both.
+func InvalidateCaps() {
+	capsCache.Lock()
+	defer capsCache.Unlock()
+	capsCache.caps = make(map[string]binaryCaps)
+}
+
+// cachedIptablesVersion returns the version and mode of the binary at path
+// like getIptablesVersion, from the cache if the file has not changed since.
+func cachedIptablesVersion(path string) (int, int, int, string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, 0, "", err
+	}
+
+	capsCache.Lock()
+	c, ok := capsCache.caps[path]
+	capsCache.Unlock()
+	if ok && c.modTime.Equal(fi.ModTime()) && c.size == fi.Size() {
+		return c.v1, c.v2, c.v3, c.mode, nil
+	}
+
+	v1, v2, v3, mode, err := getIptablesVersion(path)
+	if err != nil {
+		return 0, 0, 0, "", err
+	}
+	capsCache.Lock()
+	capsCache.caps[path] = binaryCaps{v1: v1, v2: v2, v3: v3, mode: mode, modTime: fi.ModTime(), size: fi.Size()}
+	capsCache.Unlock()
+	return v1, v2, v3, mode, nil
+}
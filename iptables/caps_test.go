@@ -0,0 +1,98 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCachedIptablesVersion(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "iptables")
+	log := filepath.Join(dir, "calls")
+	write := func(version string) {
+		script := "#!/bin/sh\necho \"$*\" >> " + log + "\necho 'iptables " + version + " (nf_tables)'\n"
+		if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+			t.Fatalf("writing fake iptables: %v", err)
+		}
+	}
+	calls := func() int {
+		data, _ := ioutil.ReadFile(log)
+		return strings.Count(string(data), "--version")
+	}
+	check := func(v1, v2, v3 int) {
+		a, b, c, mode, err := cachedIptablesVersion(path)
+		if err != nil || a != v1 || b != v2 || c != v3 || mode != "nf_tables" {
+			t.Fatalf("cachedIptablesVersion returned %d.%d.%d %s, %v", a, b, c, mode, err)
+		}
+	}
+
+	write("v1.8.7")
+	check(1, 8, 7)
+	check(1, 8, 7)
+	if n := calls(); n != 1 {
+		t.Fatalf("version detected %d times, want once", n)
+	}
+
+	InvalidateCaps()
+	check(1, 8, 7)
+	if n := calls(); n != 2 {
+		t.Fatalf("version detected %d times after InvalidateCaps, want twice", n)
+	}
+
+	// an upgrade changing the file is noticed
+	write("v1.8.10")
+	check(1, 8, 10)
+	if n := calls(); n != 3 {
+		t.Fatalf("version detected %d times after an upgrade, want 3 times", n)
+	}
+}
+
+func TestEmbeddedIptables(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\ncase \"$*\" in\n--version) echo 'iptables: unrecognized option: --version' >&2; exit 2;;\n" +
+		"*-L*) printf 'Chain INPUT (policy ACCEPT 0 packets, 0 bytes)\\n pkts bytes target prot opt in out source destination\\n 0 0 ACCEPT all -- lo * 0.0.0.0/0 0.0.0.0/0\\n';;\nesac\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables"), []byte(script), 0755); err != nil {
+		t.Fatalf("writing fake iptables: %v", err)
+	}
+	t.Setenv("PATH", dir)
+
+	ipt, err := New()
+	if err != nil {
+		t.Fatalf("New failed for an embedded iptables: %v", err)
+	}
+	if ipt.hasWait || ipt.hasCheck || ipt.hasRestoreWait || !ipt.noListRules || ipt.mode != "legacy" {
+		t.Fatalf("embedded iptables detected as %+v", ipt)
+	}
+	rules, err := ipt.List("filter", "INPUT")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	expected := []string{"-P INPUT ACCEPT", "-A INPUT -i lo -j ACCEPT"}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("List mismatch: \ngot  %q \nneed %q", rules, expected)
+	}
+	exists, err := ipt.Exists("filter", "INPUT", "-i", "lo", "-j", "ACCEPT")
+	if err != nil || !exists {
+		t.Fatalf("Exists returned %v, %v", exists, err)
+	}
+}
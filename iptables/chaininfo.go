@@ -0,0 +1,134 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ChainInfo summarizes a chain.
+type ChainInfo struct {
+	Name    string
+	Builtin bool
+	// Policy and its counters are only set for built-in chains.
+	Policy        string
+	PolicyPackets uint64
+	PolicyBytes   uint64
+	// Packets and Bytes are the sums of the rule counters.
+	Packets uint64
+	Bytes   uint64
+	Rules   int
+	// References is the number of rules jumping to a user-defined chain.
+	References int
+}
+
+var (
+	builtinChainHeader = regexp.MustCompile(`^Chain (\S+) \(policy (\S+) ([0-9]+) packets, ([0-9]+) bytes\)$`)
+	userChainHeader    = regexp.MustCompile(`^Chain (\S+) \(([0-9]+) references\)$`)
+)
+
+// ChainInfo returns the policy, counters, rule count and reference count of
+// the specified table/chain, e.g. to check a chain is unused before DeleteChain.
+func (ipt *IPTables) ChainInfo(table, chain string) (*ChainInfo, error) {
+	lines, err := ipt.ExecuteList([]string{"-t", table, "-L", chain, "-n", "-v", "-x"})
+	if err != nil {
+		return nil, err
+	}
+	return parseChainInfo(lines)
+}
+
+// parseChainInfo parses the output of "iptables -L <chain> -n -v -x".
+func parseChainInfo(lines []string) (*ChainInfo, error) {
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("unexpected chain listing: %q", lines)
+	}
+
+	info := &ChainInfo{}
+	if m := builtinChainHeader.FindStringSubmatch(lines[0]); m != nil {
+		info.Name = m[1]
+		info.Builtin = true
+		info.Policy = m[2]
+		info.PolicyPackets, _ = strconv.ParseUint(m[3], 10, 64)
+		info.PolicyBytes, _ = strconv.ParseUint(m[4], 10, 64)
+	} else if m := userChainHeader.FindStringSubmatch(lines[0]); m != nil {
+		info.Name = m[1]
+		info.References, _ = strconv.Atoi(m[2])
+	} else {
+		return nil, fmt.Errorf("unexpected chain header: %q", lines[0])
+	}
+
+	// lines[1] holds the column headings
+	for _, line := range lines[2:] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		pkts, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected packet counter in rule: %q", line)
+		}
+		bytes, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected byte counter in rule: %q", line)
+		}
+		info.Packets += pkts
+		info.Bytes += bytes
+		info.Rules++
+	}
+	return info, nil
+}
+
+// ListChainsInfo returns the ChainInfo of every chain in the specified table,
+// from a single listing of the table.
+func (ipt *IPTables) ListChainsInfo(table string) ([]ChainInfo, error) {
+	lines, err := ipt.ExecuteList([]string{"-t", table, "-L", "-n", "-v", "-x"})
+	if err != nil {
+		return nil, err
+	}
+	return parseTableChainInfo(lines)
+}
+
+// parseTableChainInfo parses the output of "iptables -L -n -v -x", which
+// lists the chains one after the other, separated by empty lines.
+func parseTableChainInfo(lines []string) ([]ChainInfo, error) {
+	var infos []ChainInfo
+	start := -1
+	flush := func(end int) error {
+		if start < 0 {
+			return nil
+		}
+		info, err := parseChainInfo(lines[start:end])
+		if err != nil {
+			return err
+		}
+		infos = append(infos, *info)
+		return nil
+	}
+	for i, line := range lines {
+		if strings.HasPrefix(line, "Chain ") {
+			if err := flush(i); err != nil {
+				return nil, err
+			}
+			start = i
+		}
+	}
+	if err := flush(len(lines)); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
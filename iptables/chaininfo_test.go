@@ -0,0 +1,98 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseChainInfo(t *testing.T) {
+	builtin := `Chain INPUT (policy DROP 12 packets, 3456 bytes)
+    pkts      bytes target     prot opt in     out     source               destination
+     100    20000 ACCEPT     all  --  lo     *       0.0.0.0/0            0.0.0.0/0
+       5      300 TEST       tcp  --  *      *       0.0.0.0/0            0.0.0.0/0            tcp dpt:22`
+	info, err := parseChainInfo(strings.Split(builtin, "\n"))
+	if err != nil {
+		t.Fatalf("parseChainInfo failed: %v", err)
+	}
+	expected := &ChainInfo{
+		Name:          "INPUT",
+		Builtin:       true,
+		Policy:        "DROP",
+		PolicyPackets: 12,
+		PolicyBytes:   3456,
+		Packets:       105,
+		Bytes:         20300,
+		Rules:         2,
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("parseChainInfo mismatch: \ngot  %#v \nneed %#v", info, expected)
+	}
+
+	user := `Chain TEST (1 references)
+    pkts      bytes target     prot opt in     out     source               destination`
+	info, err = parseChainInfo(strings.Split(user, "\n"))
+	if err != nil {
+		t.Fatalf("parseChainInfo failed: %v", err)
+	}
+	expected = &ChainInfo{Name: "TEST", References: 1}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("parseChainInfo mismatch: \ngot  %#v \nneed %#v", info, expected)
+	}
+}
+
+func TestParseTableChainInfo(t *testing.T) {
+	listing := `Chain INPUT (policy ACCEPT 1 packets, 60 bytes)
+    pkts      bytes target     prot opt in     out     source               destination
+       3      180 TEST       all  --  *      *       0.0.0.0/0            0.0.0.0/0
+
+Chain OUTPUT (policy ACCEPT 0 packets, 0 bytes)
+    pkts      bytes target     prot opt in     out     source               destination
+
+Chain TEST (1 references)
+    pkts      bytes target     prot opt in     out     source               destination
+       2      120            all  --  *      *       0.0.0.0/0            0.0.0.0/0`
+	infos, err := parseTableChainInfo(strings.Split(listing, "\n"))
+	if err != nil {
+		t.Fatalf("parseTableChainInfo failed: %v", err)
+	}
+	expected := []ChainInfo{
+		{Name: "INPUT", Builtin: true, Policy: "ACCEPT", PolicyPackets: 1, PolicyBytes: 60, Packets: 3, Bytes: 180, Rules: 1},
+		{Name: "OUTPUT", Builtin: true, Policy: "ACCEPT"},
+		{Name: "TEST", References: 1, Packets: 2, Bytes: 120, Rules: 1},
+	}
+	if !reflect.DeepEqual(infos, expected) {
+		t.Fatalf("parseTableChainInfo mismatch: \ngot  %#v \nneed %#v", infos, expected)
+	}
+}
+
+func TestParseChainNames(t *testing.T) {
+	// the nft backend may list chain declarations after rules
+	lines := []string{
+		"-P INPUT ACCEPT",
+		"-P FORWARD DROP",
+		"-A INPUT -j A",
+		"-N A",
+		"-A A -j RETURN",
+		"-N B",
+		"-N A",
+	}
+	expected := []string{"INPUT", "FORWARD", "A", "B"}
+	if got := parseChainNames(lines); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("parseChainNames returned %v, want %v", got, expected)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Built-in chains. Which of them exist depends on the table; see BuiltinChains.
+const (
+	ChainPrerouting  = "PREROUTING"
+	ChainInput       = "INPUT"
+	ChainForward     = "FORWARD"
+	ChainOutput      = "OUTPUT"
+	ChainPostrouting = "POSTROUTING"
+)
+
+// ErrBuiltinChain is returned by NewChain when asked to create a chain that
+// is built into the table.
+var ErrBuiltinChain = errors.New("iptables: chain is built in")
+
+// builtinChains are the built-in chains of each table, in packet traversal order.
+var builtinChains = map[string][]string{
+	"filter":   {ChainInput, ChainForward, ChainOutput},
+	"nat":      {ChainPrerouting, ChainInput, ChainOutput, ChainPostrouting},
+	"mangle":   {ChainPrerouting, ChainInput, ChainForward, ChainOutput, ChainPostrouting},
+	"raw":      {ChainPrerouting, ChainOutput},
+	"security": {ChainInput, ChainForward, ChainOutput},
+}
+
+// BuiltinChains returns the built-in chains of the given table, or nil if the
+// table is unknown.
+func BuiltinChains(table string) []string {
+	chains := builtinChains[table]
+	if chains == nil {
+		return nil
+	}
+	return append([]string(nil), chains...)
+}
+
+// IsBuiltinChain reports whether chain is built into the given table.
+func IsBuiltinChain(table, chain string) bool {
+	return containsString(builtinChains[table], chain)
+}
+
+// checkNewChain refuses to create a built-in chain of the table.
+func checkNewChain(table, chain string) error {
+	if IsBuiltinChain(table, chain) {
+		return fmt.Errorf("%w: %s in table %s", ErrBuiltinChain, chain, table)
+	}
+	return nil
+}
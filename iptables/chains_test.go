@@ -0,0 +1,46 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBuiltinChains(t *testing.T) {
+	if got := BuiltinChains("nat"); !reflect.DeepEqual(got, []string{"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"}) {
+		t.Fatalf("unexpected nat chains %v", got)
+	}
+	if got := BuiltinChains("bogus"); got != nil {
+		t.Fatalf("unexpected chains for unknown table %v", got)
+	}
+	BuiltinChains("raw")[0] = "X"
+	if BuiltinChains("raw")[0] != ChainPrerouting {
+		t.Fatalf("BuiltinChains returned shared storage")
+	}
+
+	if !IsBuiltinChain("filter", ChainForward) || IsBuiltinChain("raw", ChainInput) || IsBuiltinChain("filter", "DOCKER") {
+		t.Fatalf("IsBuiltinChain mismatch")
+	}
+
+	ipt := &IPTables{}
+	if err := ipt.NewChain("filter", "INPUT"); !errors.Is(err, ErrBuiltinChain) {
+		t.Fatalf("NewChain of a builtin chain returned %v, want ErrBuiltinChain", err)
+	}
+	if err := ipt.NewChainWithWait("mangle", "POSTROUTING"); !errors.Is(err, ErrBuiltinChain) {
+		t.Fatalf("NewChainWithWait of a builtin chain returned %v, want ErrBuiltinChain", err)
+	}
+}
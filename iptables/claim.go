@@ -0,0 +1,139 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ChainClaimedError is returned by ClaimChain when another owner claimed
+// the chain.
+type ChainClaimedError struct {
+	Table string
+	Chain string
+	// Owner is the owner holding the claim.
+	Owner string
+}
+
+func (e *ChainClaimedError) Error() string {
+	return fmt.Sprintf("iptables: chain %s in table %s is claimed by %s", e.Chain, e.Table, e.Owner)
+}
+
+// ClaimChain claims the chain in the specified table for owner, creating it
+// if needed, so two controllers configured to manage the same chain fail
+// instead of fighting over its rules. The claim is an advisory marker rule
+// at the top of the chain, with the comment "claim=<owner>" and no target,
+// so it survives restarts of the owner and does not affect packets. Claiming
+// a chain again is a no-op for its owner and fails with a *ChainClaimedError
+// for any other; controllers should claim their chains before managing them.
+// The owner must be valid as a RuleTags value.
+func (ipt *IPTables) ClaimChain(table, chain, owner string) error {
+	marker, err := claimMarker(owner)
+	if err != nil {
+		return err
+	}
+	exists, err := ipt.ChainExists(table, chain)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := ipt.NewChain(table, chain); err != nil {
+			return err
+		}
+	}
+
+	claims, err := ipt.chainClaims(table, chain)
+	if err != nil {
+		return err
+	}
+	for _, c := range claims {
+		if c != owner {
+			return &ChainClaimedError{Table: table, Chain: chain, Owner: c}
+		}
+	}
+	if len(claims) > 0 {
+		return nil
+	}
+	if err := ipt.Insert(table, chain, 1, marker...); err != nil {
+		return err
+	}
+
+	// another owner may have claimed the chain meanwhile; both back off
+	claims, err = ipt.chainClaims(table, chain)
+	if err != nil {
+		return err
+	}
+	for _, c := range claims {
+		if c != owner {
+			if err := ipt.Delete(table, chain, marker...); err != nil {
+				return err
+			}
+			return &ChainClaimedError{Table: table, Chain: chain, Owner: c}
+		}
+	}
+	return nil
+}
+
+// ReleaseChain removes the claim of owner on the chain in the specified
+// table, if any. The rules of the chain are left in place.
+func (ipt *IPTables) ReleaseChain(table, chain, owner string) error {
+	marker, err := claimMarker(owner)
+	if err != nil {
+		return err
+	}
+	return ipt.DeleteIfExists(table, chain, marker...)
+}
+
+// ChainOwner returns the owner that claimed the chain in the specified
+// table with ClaimChain, or "" if the chain is unclaimed.
+func (ipt *IPTables) ChainOwner(table, chain string) (string, error) {
+	claims, err := ipt.chainClaims(table, chain)
+	if err != nil || len(claims) == 0 {
+		return "", err
+	}
+	return claims[0], nil
+}
+
+// claimMarker returns the rulespec of the claim marker of owner.
+func claimMarker(owner string) ([]string, error) {
+	if !validTag(owner) {
+		return nil, fmt.Errorf("invalid chain owner %q", owner)
+	}
+	return tagged(RuleTags{"claim": owner}, nil)
+}
+
+// chainClaims returns the owners of the claim markers in the chain, in
+// order. All rules are listed, as claims are shared between handle owners.
+func (ipt *IPTables) chainClaims(table, chain string) ([]string, error) {
+	rules, err := ipt.ExecuteList([]string{"-t", table, "-S", chain})
+	if err != nil {
+		return nil, err
+	}
+	var claims []string
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule, "-A ") || !strings.Contains(rule, "claim=") {
+			continue
+		}
+		r, err := ParseRule(rule)
+		if err != nil {
+			continue
+		}
+		if c, ok := r.Tags()["claim"]; ok {
+			claims = append(claims, c)
+		}
+	}
+	return claims, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestClaimChain(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "claimed")
+	ipt, log := newFakeIPTables(t, `case "$*" in
+*"-S SVC 1"*) printf -- '-A SVC -m comment --comment claim=b\n';;
+*"-I SVC 1"*) touch `+state+`;;
+*"-S SVC"*) printf -- '-N SVC\n'; [ -e `+state+` ] && printf -- '-A SVC -m comment --comment claim=a\n'; printf -- '-A SVC -m comment --comment claim=b\n';;
+*"-S OWNED"*) printf -- '-N OWNED\n-A OWNED -m comment --comment claim=a\n-A OWNED -j ACCEPT\n';;
+esac`)
+
+	if err := ipt.ClaimChain("filter", "OWNED", "a"); err != nil {
+		t.Fatalf("ClaimChain of an owned chain failed: %v", err)
+	}
+	owner, err := ipt.ChainOwner("filter", "OWNED")
+	if err != nil || owner != "a" {
+		t.Fatalf("ChainOwner returned %q, %v", owner, err)
+	}
+
+	err = ipt.ClaimChain("filter", "SVC", "b")
+	if err != nil {
+		t.Fatalf("ClaimChain of an owned chain failed: %v", err)
+	}
+	err = ipt.ClaimChain("filter", "SVC", "a")
+	if cerr, ok := err.(*ChainClaimedError); !ok || cerr.Owner != "b" {
+		t.Fatalf("ClaimChain of a chain claimed by another owner returned %v", err)
+	}
+	if err := ipt.ClaimChain("filter", "SVC", "bad owner"); err == nil {
+		t.Fatalf("ClaimChain with a space in the owner did not fail")
+	}
+
+	expectedCalls := []string{
+		"--wait -t filter -S OWNED 1",
+		"--wait -t filter -S OWNED",
+		"--wait -t filter -S OWNED",
+		"--wait -t filter -S SVC 1",
+		"--wait -t filter -S SVC",
+		"--wait -t filter -S SVC 1",
+		"--wait -t filter -S SVC",
+	}
+	if calls := fakeCalls(t, log); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("calls mismatch: \ngot  %q \nneed %q", calls, expectedCalls)
+	}
+}
+
+func TestClaimChainRace(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "claimed")
+	// the chain is unclaimed when first listed, but claimed by b as a is
+	// inserting its marker
+	ipt, log := newFakeIPTables(t, `case "$*" in
+*"-S SVC 1"*) printf -- '-A SVC -j ACCEPT\n';;
+*"-I SVC 1"*) touch `+state+`;;
+*"-S SVC"*) printf -- '-N SVC\n'; [ -e `+state+` ] && printf -- '-A SVC -m comment --comment claim=a\n-A SVC -m comment --comment claim=b\n'; printf -- '-A SVC -j ACCEPT\n';;
+esac`)
+
+	err := ipt.ClaimChain("filter", "SVC", "a")
+	if cerr, ok := err.(*ChainClaimedError); !ok || cerr.Owner != "b" {
+		t.Fatalf("ClaimChain racing with another owner returned %v", err)
+	}
+
+	expectedCalls := []string{
+		"--wait -t filter -S SVC 1",
+		"--wait -t filter -S SVC",
+		"--wait -t filter -I SVC 1 -m comment --comment claim=a",
+		"--wait -t filter -S SVC",
+		"--wait -t filter -D SVC -m comment --comment claim=a",
+	}
+	if calls := fakeCalls(t, log); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("calls mismatch: \ngot  %q \nneed %q", calls, expectedCalls)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// cleanupRegistry holds the cleanups run by RunCleanups and on the signals
+// given to CleanupOnSignal.
+var cleanupRegistry struct {
+	mu       sync.Mutex
+	next     int
+	cleanups []registeredCleanup
+	signals  map[os.Signal]bool
+}
+
+type registeredCleanup struct {
+	id  int
+	ipt *IPTables
+	fn  func()
+}
+
+// RegisterCleanup registers fn, which removes rules created through ipt, to
+// be run by RunCleanups, e.g. when the process is terminated by a signal
+// handled with CleanupOnSignal, so short-lived tools do not leave stale rules
+// behind. Cleanups run in reverse order of registration; those of read-only
+// handles are skipped. The returned function unregisters fn, for when the
+// rules are removed by other means.
+func RegisterCleanup(ipt *IPTables, fn func()) (unregister func()) {
+	cleanupRegistry.mu.Lock()
+	defer cleanupRegistry.mu.Unlock()
+	cleanupRegistry.next++
+	id := cleanupRegistry.next
+	cleanupRegistry.cleanups = append(cleanupRegistry.cleanups, registeredCleanup{id, ipt, fn})
+	return func() {
+		cleanupRegistry.mu.Lock()
+		defer cleanupRegistry.mu.Unlock()
+		for i, c := range cleanupRegistry.cleanups {
+			if c.id == id {
+				cleanupRegistry.cleanups = append(cleanupRegistry.cleanups[:i], cleanupRegistry.cleanups[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// RunCleanups runs and unregisters every registered cleanup.
+func RunCleanups() {
+	cleanupRegistry.mu.Lock()
+	cleanups := cleanupRegistry.cleanups
+	cleanupRegistry.cleanups = nil
+	cleanupRegistry.mu.Unlock()
+
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		if c := cleanups[i]; c.ipt == nil || !c.ipt.readOnly {
+			c.fn()
+		}
+	}
+}
+
+// CleanupOnSignal runs the registered cleanups when the process receives one
+// of the signals, SIGINT and SIGTERM by default, and then raises the signal
+// again to let it take its default effect, normally terminating the process.
+// Calling it again adds signals.
+//
+// Handlers the program registers with signal.Notify are left in place and
+// receive the signal as usual, but then also receive it a second time, after
+// the cleanups, and the process is not terminated. Such programs should call
+// RunCleanups from their own handler instead.
+func CleanupOnSignal(signals ...os.Signal) {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	cleanupRegistry.mu.Lock()
+	defer cleanupRegistry.mu.Unlock()
+	if cleanupRegistry.signals == nil {
+		cleanupRegistry.signals = make(map[os.Signal]bool)
+	}
+	var added []os.Signal
+	for _, sig := range signals {
+		if !cleanupRegistry.signals[sig] {
+			cleanupRegistry.signals[sig] = true
+			added = append(added, sig)
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, added...)
+	go func() {
+		sig := <-ch
+		RunCleanups()
+		// stop handling the signals here, restoring the default disposition
+		// unless the program handles them too, and deliver this one again
+		signal.Stop(ch)
+		cleanupRegistry.mu.Lock()
+		for _, s := range added {
+			delete(cleanupRegistry.signals, s)
+		}
+		cleanupRegistry.mu.Unlock()
+		if p, err := os.FindProcess(os.Getpid()); err == nil && p.Signal(sig) == nil {
+			return
+		}
+		os.Exit(1)
+	}()
+}
+
+// CleanupOnSignal registers Cleanup of the manager with RegisterCleanup and
+// runs it on the signals, as with the package-level CleanupOnSignal. The
+// returned function unregisters the cleanup.
+func (m *ChainManager) CleanupOnSignal(signals ...os.Signal) (unregister func()) {
+	unregister = RegisterCleanup(m.ipt, func() { m.Cleanup() })
+	CleanupOnSignal(signals...)
+	return unregister
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCleanupOnSignalKeepsHandlers(t *testing.T) {
+	// the program's own handler keeps the signal from terminating the test
+	own := make(chan os.Signal, 2)
+	signal.Notify(own, syscall.SIGUSR1)
+	defer signal.Stop(own)
+
+	ran := make(chan bool, 1)
+	unregister := RegisterCleanup(&IPTables{}, func() { ran <- true })
+	defer unregister()
+	CleanupOnSignal(syscall.SIGUSR1)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cleanup not run")
+	}
+	// once as sent, and once more raised after the cleanups
+	for i := 0; i < 2; i++ {
+		select {
+		case <-own:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handler received the signal %d times, want 2", i)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRunCleanups(t *testing.T) {
+	var ran []string
+	RegisterCleanup(&IPTables{}, func() { ran = append(ran, "first") })
+	unregister := RegisterCleanup(&IPTables{}, func() { ran = append(ran, "unregistered") })
+	RegisterCleanup(&IPTables{readOnly: true}, func() { ran = append(ran, "read-only") })
+	RegisterCleanup(&IPTables{}, func() { ran = append(ran, "last") })
+	unregister()
+
+	RunCleanups()
+	if expected := []string{"last", "first"}; !reflect.DeepEqual(ran, expected) {
+		t.Fatalf("ran %v, want %v", ran, expected)
+	}
+
+	// cleanups run once
+	RunCleanups()
+	if len(ran) != 2 {
+		t.Fatalf("cleanups ran again: %v", ran)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import "fmt"
+
+// MaxCommentLen is the longest comment the comment match accepts, in bytes.
+const MaxCommentLen = 255
+
+// ValidateComment checks that comment can be used with the comment match:
+// iptables rejects comments longer than MaxCommentLen, and control characters
+// such as newlines would break iptables-save and iptables-restore data.
+func ValidateComment(comment string) error {
+	if len(comment) > MaxCommentLen {
+		return fmt.Errorf("comment longer than %d bytes: %.20q...", MaxCommentLen, comment)
+	}
+	for _, c := range comment {
+		if c < ' ' || c == 0x7f {
+			return fmt.Errorf("comment contains control character %q: %q", c, comment)
+		}
+	}
+	return nil
+}
+
+// WithComment returns rulespec with a comment match added ahead of its
+// target, where iptables lists it. The comment is passed as a single
+// argument, so it needs no quoting.
+func WithComment(rulespec []string, comment string) ([]string, error) {
+	if err := ValidateComment(comment); err != nil {
+		return nil, err
+	}
+	return withMatch(rulespec, []string{"-m", "comment", "--comment", comment}), nil
+}
+
+// withMatch returns rulespec with the match arguments inserted ahead of the
+// target, or appended if there is none.
+func withMatch(rulespec, match []string) []string {
+	for i, arg := range rulespec {
+		if arg == "-j" || arg == "-g" || arg == "--jump" || arg == "--goto" {
+			return append(append(append([]string{}, rulespec[:i]...), match...), rulespec[i:]...)
+		}
+	}
+	return append(append([]string{}, rulespec...), match...)
+}
+
+// checkComments validates the comments of iptables arguments.
+func checkComments(args []string) error {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "--comment" {
+			if err := ValidateComment(args[i+1]); err != nil {
+				return err
+			}
+			i++
+		}
+	}
+	return nil
+}
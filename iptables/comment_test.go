@@ -0,0 +1,52 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWithComment(t *testing.T) {
+	got, err := WithComment([]string{"-p", "tcp", "-j", "ACCEPT"}, `say "hi"`)
+	if err != nil {
+		t.Fatalf("WithComment failed: %v", err)
+	}
+	expected := []string{"-p", "tcp", "-m", "comment", "--comment", `say "hi"`, "-j", "ACCEPT"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %q, want %q", got, expected)
+	}
+	if got, _ := WithComment([]string{"-s", "10.0.0.1"}, "x"); !reflect.DeepEqual(got, []string{"-s", "10.0.0.1", "-m", "comment", "--comment", "x"}) {
+		t.Fatalf("unexpected rulespec without target %q", got)
+	}
+
+	for _, c := range []string{strings.Repeat("x", MaxCommentLen+1), "two\nlines", "tab\there"} {
+		if _, err := WithComment(nil, c); err == nil {
+			t.Errorf("WithComment accepted %q", c)
+		}
+	}
+	if err := ValidateComment(strings.Repeat("é", MaxCommentLen/2)); err != nil {
+		t.Errorf("ValidateComment rejected a comment within the limit: %v", err)
+	}
+}
+
+func TestCheckComments(t *testing.T) {
+	ipt := &IPTables{}
+	err := ipt.Append("filter", "INPUT", "-m", "comment", "--comment", strings.Repeat("x", 300), "-j", "ACCEPT")
+	if err == nil || !strings.Contains(err.Error(), "longer than 255") {
+		t.Fatalf("Append with an overlong comment returned %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, spec := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* * 0 * *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) did not fail", spec)
+		}
+	}
+
+	// 2020-01-01 is a Wednesday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2020, 1, day, hour, min, 0, 0, time.UTC)
+	}
+	for _, tt := range []struct {
+		spec    string
+		t       time.Time
+		matches bool
+	}{
+		{"0 9 * * 1-5", at(1, 9, 0), true},
+		{"0 9 * * 1-5", at(1, 9, 1), false},
+		{"0 9 * * 1-5", at(4, 9, 0), false},
+		{"*/15 * * * *", at(1, 3, 45), true},
+		{"*/15 * * * *", at(1, 3, 50), false},
+		{"0 0 * * 0", at(5, 0, 0), true},
+		{"0 0 * * 7", at(5, 0, 0), true},
+		{"30 2-4/2 * * *", at(1, 4, 30), true},
+		{"30 2-4/2 * * *", at(1, 3, 30), false},
+		{"0 0 1,15 1 *", at(15, 0, 0), true},
+		// both day fields restricted: either matches
+		{"0 0 13 * 3", at(1, 0, 0), true},
+		{"0 0 13 * 3", at(2, 0, 0), false},
+	} {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("parseCron(%q) failed: %v", tt.spec, err)
+		}
+		if got := c.matches(tt.t); got != tt.matches {
+			t.Errorf("%q matches %v: got %v, want %v", tt.spec, tt.t, got, tt.matches)
+		}
+	}
+
+	c, _ := parseCron("0 9 * * *")
+	if start, ok := c.lastWithin(at(1, 16, 59), 8*time.Hour); !ok || !start.Equal(at(1, 9, 0)) {
+		t.Errorf("lastWithin returned %v, %v", start, ok)
+	}
+	if _, ok := c.lastWithin(at(1, 17, 0), 8*time.Hour); ok {
+		t.Errorf("lastWithin found a window that closed")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDeleteMatchingRules(t *testing.T) {
+	ipt, log := newFakeIPTables(t, `case "$*" in
+*-S*) printf -- '-N CNI-HOSTPORT-DNAT\n-A CNI-HOSTPORT-DNAT -p tcp -m tcp --dport 8080 -m comment --comment "dnat name: pod-a" -j DNAT --to-destination 10.0.0.2:80\n-A CNI-HOSTPORT-DNAT -p tcp -m tcp --dport 8081 -j DNAT --to-destination 10.0.0.3:80\n';;
+esac`)
+	// the restore fails the first time, as if a rule had vanished meanwhile
+	dir := filepath.Dir(ipt.path)
+	input := filepath.Join(dir, "restored")
+	script := "#!/bin/sh\nif [ ! -e " + input + " ]; then cat > " + input + "; echo 'iptables-restore: line 2 failed' >&2; exit 1; fi\ncat >> " + input + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables-restore"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	n, err := ipt.DeleteMatchingRules("nat", "CNI-HOSTPORT-DNAT", ByComment("pod-a"))
+	if err != nil {
+		t.Fatalf("DeleteMatchingRules failed: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("DeleteMatchingRules deleted %d rules, want 1", n)
+	}
+	data, _ := ioutil.ReadFile(input)
+	txn := "*nat\n-D CNI-HOSTPORT-DNAT -p tcp -m tcp --dport 8080 -m comment --comment \"dnat name: pod-a\" -j DNAT --to-destination 10.0.0.2:80\nCOMMIT\n"
+	if string(data) != txn+txn {
+		t.Fatalf("restored %q, want %q twice", data, txn)
+	}
+	expectedCalls := []string{
+		"--wait -t nat -S CNI-HOSTPORT-DNAT",
+		"--wait -t nat -S CNI-HOSTPORT-DNAT",
+	}
+	if calls := fakeCalls(t, log); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("calls mismatch: \ngot  %q \nneed %q", calls, expectedCalls)
+	}
+
+	n, err = ipt.DeleteMatchingRules("nat", "CNI-HOSTPORT-DNAT", ByComment("pod-b"))
+	if err != nil || n != 0 {
+		t.Fatalf("DeleteMatchingRules without matches returned %d, %v", n, err)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DynamicRule is a rule whose address is given as a DNS name. It expands to
+// one rule per address the name resolves to, of the handle's family.
+type DynamicRule struct {
+	Host string
+	// Destination matches the addresses with "-d" instead of "-s".
+	Destination bool
+	// Rulespec holds the rest of the rule, e.g. "-p", "tcp", "-j", "ACCEPT".
+	Rulespec []string
+}
+
+// DynamicRules keeps a dedicated chain in sync with the DNS resolution of
+// the hosts of its rules. The chain is rebuilt in a single iptables-restore
+// transaction whenever a resolution changes.
+type DynamicRules struct {
+	ipt   *IPTables
+	table string
+	chain string
+
+	// lookup resolves a host; it is replaced in tests
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	// refreshMu serializes Refresh calls; mu guards the rules and is not
+	// held while hosts are resolved.
+	refreshMu sync.Mutex
+	mu        sync.Mutex
+	rules     map[string]*dynamicEntry
+	dirty     bool
+}
+
+// dynamicEntry is a rule with the addresses it currently expands to.
+type dynamicEntry struct {
+	rule  DynamicRule
+	addrs []string
+}
+
+// NewDynamicRules returns a manager for the rules of the specified
+// table/chain, which it creates on the first Refresh and then owns.
+func NewDynamicRules(ipt *IPTables, table, chain string) *DynamicRules {
+	return &DynamicRules{
+		ipt:    ipt,
+		table:  table,
+		chain:  chain,
+		lookup: net.DefaultResolver.LookupIPAddr,
+		rules:  make(map[string]*dynamicEntry),
+		dirty:  true,
+	}
+}
+
+// Set adds or replaces the rule with the given key. It takes effect on the
+// next Refresh. A replaced rule for the same host keeps its addresses until
+// then.
+func (d *DynamicRules) Set(key string, rule DynamicRule) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e := &dynamicEntry{rule: rule}
+	if old, ok := d.rules[key]; ok && old.rule.Host == rule.Host {
+		e.addrs = old.addrs
+	}
+	d.rules[key] = e
+	d.dirty = true
+}
+
+// Remove removes the rule with the given key. It takes effect on the next
+// Refresh.
+func (d *DynamicRules) Remove(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.rules[key]; ok {
+		delete(d.rules, key)
+		d.dirty = true
+	}
+}
+
+// Refresh resolves the hosts of all rules and rebuilds the chain if any rule
+// or resolution changed. A host that fails to resolve keeps its previous
+// addresses, so a DNS outage does not remove its rules; the failures are
+// returned after the chain has been updated.
+func (d *DynamicRules) Refresh(ctx context.Context) error {
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
+
+	errs := d.resolveAll(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dirty {
+		if err := d.ipt.RestoreChain(d.table, d.chain, d.snippet(), true); err != nil {
+			return err
+		}
+		d.dirty = false
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("resolving hosts: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Run calls Refresh every interval until the context is done, reporting
+// errors to onError if it is not nil.
+func (d *DynamicRules) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.Refresh(ctx); err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resolveAll updates the addresses of all rules, marking the chain dirty if
+// any changed, and returns the resolution failures. The hosts are resolved
+// without holding d.mu; a rule changed meanwhile by Set or Remove is left
+// to the next Refresh unless it still has the same host.
+func (d *DynamicRules) resolveAll(ctx context.Context) []string {
+	d.mu.Lock()
+	keys := d.keys()
+	hosts := make([]string, len(keys))
+	for i, key := range keys {
+		hosts[i] = d.rules[key].rule.Host
+	}
+	d.mu.Unlock()
+
+	var errs []string
+	resolved := make([][]string, len(keys))
+	failed := make([]bool, len(keys))
+	for i, key := range keys {
+		addrs, err := d.resolve(ctx, hosts[i])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+			failed[i] = true
+			continue
+		}
+		resolved[i] = addrs
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, key := range keys {
+		e, ok := d.rules[key]
+		if !ok || e.rule.Host != hosts[i] || failed[i] {
+			continue
+		}
+		if !equalStrings(resolved[i], e.addrs) {
+			e.addrs = resolved[i]
+			d.dirty = true
+		}
+	}
+	return errs
+}
+
+// resolve returns the sorted addresses of host of the handle's family.
+func (d *DynamicRules) resolve(ctx context.Context, host string) ([]string, error) {
+	ipaddrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, a := range ipaddrs {
+		is4 := a.IP.To4() != nil
+		if is4 != (d.ipt.Proto() == ProtocolIPv4) {
+			continue
+		}
+		addrs = append(addrs, a.IP.String())
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+func (d *DynamicRules) keys() []string {
+	keys := make([]string, 0, len(d.rules))
+	for key := range d.rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// snippet renders the rules of the chain, ordered by key, for RestoreChain.
+func (d *DynamicRules) snippet() string {
+	var buf bytes.Buffer
+	for _, key := range d.keys() {
+		e := d.rules[key]
+		opt := "-s"
+		if e.rule.Destination {
+			opt = "-d"
+		}
+		for _, addr := range e.addrs {
+			args := append([]string{opt, addr}, e.rule.Rulespec...)
+			buf.WriteString("-A " + d.chain + " " + joinRule(args) + "\n")
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestDynamicRules(t *testing.T) {
+	answers := map[string][]net.IPAddr{
+		"db.example.com":  {{IP: net.ParseIP("192.0.2.20")}, {IP: net.ParseIP("192.0.2.10")}, {IP: net.ParseIP("2001:db8::1")}},
+		"api.example.com": {{IP: net.ParseIP("198.51.100.1")}},
+	}
+	d := NewDynamicRules(&IPTables{proto: ProtocolIPv4}, "filter", "DYN")
+	d.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if addrs, ok := answers[host]; ok {
+			return addrs, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	d.Set("a-db", DynamicRule{Host: "db.example.com", Destination: true, Rulespec: []string{"-p", "tcp", "--dport", "5432", "-j", "ACCEPT"}})
+	d.Set("b-api", DynamicRule{Host: "api.example.com", Rulespec: []string{"-j", "ACCEPT"}})
+
+	if errs := d.resolveAll(context.Background()); len(errs) != 0 {
+		t.Fatalf("resolveAll failed: %v", errs)
+	}
+	expected := `-A DYN -d 192.0.2.10 -p tcp --dport 5432 -j ACCEPT
+-A DYN -d 192.0.2.20 -p tcp --dport 5432 -j ACCEPT
+-A DYN -s 198.51.100.1 -j ACCEPT
+`
+	if snippet := d.snippet(); snippet != expected {
+		t.Fatalf("snippet mismatch: \ngot  %s \nneed %s", snippet, expected)
+	}
+
+	// unchanged resolution does not require an update
+	d.dirty = false
+	d.resolveAll(context.Background())
+	if d.dirty {
+		t.Fatalf("unchanged resolution marked the chain dirty")
+	}
+
+	// a failed resolution keeps the previous addresses
+	delete(answers, "api.example.com")
+	if errs := d.resolveAll(context.Background()); len(errs) != 1 {
+		t.Fatalf("expected one resolution failure, got %v", errs)
+	}
+	if d.dirty || d.snippet() != expected {
+		t.Fatalf("failed resolution changed the rules: %s", d.snippet())
+	}
+}
+
+func TestDynamicRulesSetKeepsAddrs(t *testing.T) {
+	d := NewDynamicRules(&IPTables{proto: ProtocolIPv4}, "filter", "DYN")
+	d.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.10")}}, nil
+	}
+	d.Set("db", DynamicRule{Host: "db.example.com", Rulespec: []string{"-j", "ACCEPT"}})
+	d.resolveAll(context.Background())
+
+	// a new rulespec for the same host keeps the resolved addresses
+	d.Set("db", DynamicRule{Host: "db.example.com", Rulespec: []string{"-j", "DROP"}})
+	if snippet, want := d.snippet(), "-A DYN -s 192.0.2.10 -j DROP\n"; snippet != want {
+		t.Fatalf("got %q, want %q", snippet, want)
+	}
+
+	// a new host starts without addresses until resolved
+	d.Set("db", DynamicRule{Host: "other.example.com", Rulespec: []string{"-j", "DROP"}})
+	if snippet := d.snippet(); snippet != "" {
+		t.Fatalf("got %q, want no rules", snippet)
+	}
+}
+
+func TestDynamicRulesResolveUnlocked(t *testing.T) {
+	d := NewDynamicRules(&IPTables{proto: ProtocolIPv4}, "filter", "DYN")
+	d.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		// Set and Remove must not block on a slow lookup
+		d.Set("other", DynamicRule{Host: "other.example.com"})
+		d.Remove("gone")
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.10")}}, nil
+	}
+	d.Set("db", DynamicRule{Host: "db.example.com", Rulespec: []string{"-j", "ACCEPT"}})
+	d.Set("gone", DynamicRule{Host: "gone.example.com", Rulespec: []string{"-j", "ACCEPT"}})
+	d.resolveAll(context.Background())
+
+	if _, ok := d.rules["gone"]; ok {
+		t.Fatal("removed rule came back")
+	}
+	if snippet, want := d.snippet(), "-A DYN -s 192.0.2.10 -j ACCEPT\n"; snippet != want {
+		t.Fatalf("got %q, want %q", snippet, want)
+	}
+}
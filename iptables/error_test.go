@@ -0,0 +1,57 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// exitError runs a shell that prints msg to stderr and exits with status.
+func exitError(t *testing.T, msg, status string) *Error {
+	path, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skipf("sh not found: %v", err)
+	}
+	err = runCommand(path, []string{"sh", "-c", `echo "$1" >&2; exit "$2"`, "sh", msg, status}, nil, nil)
+	eerr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected *Error, got %#v", err)
+	}
+	return eerr
+}
+
+func TestErrorPermission(t *testing.T) {
+	err := exitError(t, "iptables v1.8.7 (legacy): can't initialize iptables table `filter': Permission denied (you must be root)", "3")
+	if !errors.Is(err, ErrPermission) {
+		t.Fatalf("errors.Is(%v, ErrPermission) = false", err)
+	}
+	if err.ExitStatus() != 3 {
+		t.Fatalf("expected exit status 3, got %d", err.ExitStatus())
+	}
+	if !strings.Contains(err.Error(), "CAP_NET_ADMIN") {
+		t.Fatalf("error lacks guidance: %v", err)
+	}
+
+	err = exitError(t, "iptables: Bad rule (does a matching rule exist in that chain?).", "1")
+	if errors.Is(err, ErrPermission) {
+		t.Fatalf("errors.Is(%v, ErrPermission) = true", err)
+	}
+}
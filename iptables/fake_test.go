@@ -0,0 +1,53 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFakeIPTables returns an IPTables running a shell script in place of
+// iptables, with script as its body. Every invocation first logs its
+// arguments as one line to the file returned; see fakeCalls.
+func newFakeIPTables(t *testing.T, script string) (*IPTables, string) {
+	dir := t.TempDir()
+	fakeLockFiles(t, dir)
+	log := filepath.Join(dir, "calls")
+	path := filepath.Join(dir, "iptables")
+	data := "#!/bin/sh\necho \"$*\" >> " + log + "\n" + script + "\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0755); err != nil {
+		t.Fatalf("writing fake iptables: %v", err)
+	}
+	return &IPTables{path: path, hasWait: true, hasCheck: true}, log
+}
+
+// fakeCalls returns the arguments of every invocation of a fake iptables.
+func fakeCalls(t *testing.T, log string) []string {
+	data, err := ioutil.ReadFile(log)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("reading fake iptables log: %v", err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrWrongFamily is returned, wrapped, by handles created with StrictFamily
+// for rules of the other IP family.
+var ErrWrongFamily = errors.New("iptables: rule is for the other IP family")
+
+// StrictFamily makes rule commands fail with ErrWrongFamily, without running
+// iptables, if the rule uses addresses or ICMP types of the other family
+// than the handle, e.g. an IPv4 source given to an ip6tables handle. Host
+// names are not checked.
+func StrictFamily() Option {
+	return func(ipt *IPTables) {
+		ipt.strictFamily = true
+	}
+}
+
+// ruleCommands are the iptables commands taking a rulespec.
+var ruleCommands = map[string]bool{
+	"-A": true, "--append": true,
+	"-I": true, "--insert": true,
+	"-D": true, "--delete": true,
+	"-R": true, "--replace": true,
+	"-C": true, "--check": true,
+}
+
+// familyAddressOptions are the options taking addresses, possibly as a
+// comma-separated list of addresses or networks.
+var familyAddressOptions = map[string]bool{
+	"-s": true, "--source": true, "--src": true,
+	"-d": true, "--destination": true, "--dst": true,
+	"--to-destination": true, "--to-source": true, "--to": true,
+	"--src-range": true, "--dst-range": true,
+}
+
+// checkFamily returns an error if the iptables arguments of a rule command
+// use addresses or ICMP types of the other family than proto.
+func checkFamily(proto Protocol, args []string) error {
+	i := ruleCommandIndex(args)
+	if i < 0 {
+		return nil
+	}
+
+	family, other := "IPv4", "IPv6"
+	if proto == ProtocolIPv6 {
+		family, other = other, family
+	}
+	for ; i < len(args); i++ {
+		opt := args[i]
+		if i+1 >= len(args) {
+			break
+		}
+		value := args[i+1]
+		switch {
+		case opt == "--comment":
+			i++
+		case familyAddressOptions[opt]:
+			// lists of addresses, networks and ranges
+			for _, addr := range strings.FieldsFunc(value, func(c rune) bool { return c == ',' || c == '-' }) {
+				if v6, ok := addressFamily(addr); ok && v6 != (proto == ProtocolIPv6) {
+					return fmt.Errorf("%w: %s address %s given to %s in an %s rule", ErrWrongFamily, other, addr, opt, family)
+				}
+			}
+		case opt == "-p" || opt == "--protocol":
+			switch strings.ToLower(value) {
+			case "icmp":
+				if proto == ProtocolIPv6 {
+					return fmt.Errorf("%w: protocol %s in an %s rule, use icmpv6", ErrWrongFamily, value, family)
+				}
+			case "icmpv6", "ipv6-icmp":
+				if proto == ProtocolIPv4 {
+					return fmt.Errorf("%w: protocol %s in an %s rule, use icmp", ErrWrongFamily, value, family)
+				}
+			}
+		case opt == "--icmp-type" && proto == ProtocolIPv6:
+			return fmt.Errorf("%w: %s in an %s rule, use --icmpv6-type", ErrWrongFamily, opt, family)
+		case opt == "--icmpv6-type" && proto == ProtocolIPv4:
+			return fmt.Errorf("%w: %s in an %s rule, use --icmp-type", ErrWrongFamily, opt, family)
+		case opt == "--reject-with" && strings.HasPrefix(value, "icmp6-") && proto == ProtocolIPv4,
+			opt == "--reject-with" && strings.HasPrefix(value, "icmp-") && proto == ProtocolIPv6:
+			return fmt.Errorf("%w: REJECT answer %s in an %s rule", ErrWrongFamily, value, family)
+		}
+	}
+	return nil
+}
+
+// addressFamily reports whether an address, network or address:port, as
+// given to an iptables option, is IPv6. It returns false if the value is not
+// an address, e.g. a host name or a port.
+func addressFamily(value string) (v6 bool, ok bool) {
+	if i := strings.IndexByte(value, '/'); i >= 0 {
+		value = value[:i]
+	}
+	if net.ParseIP(value) == nil {
+		// "[2001:db8::1]:80" or "192.0.2.1:80", as in --to-destination
+		host, _, err := net.SplitHostPort(value)
+		if err != nil {
+			host = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+		}
+		if net.ParseIP(host) == nil {
+			return false, false
+		}
+		value = host
+	}
+	// IPv4-mapped IPv6 addresses are IPv6 as far as ip6tables is concerned
+	return strings.Contains(value, ":"), true
+}
+
+// FamilySpecific is implemented by matches and targets whose arguments
+// depend on the IP family, such as ICMP and Reject. Rule.ArgsFor uses it in
+// place of Args.
+type FamilySpecific interface {
+	ArgsFor(proto Protocol) ([]string, error)
+}
+
+// IsIPv6 reports whether the handle runs ip6tables.
+func (ipt *IPTables) IsIPv6() bool {
+	return ipt.proto == ProtocolIPv6
+}
+
+// familyProtocol translates the ICMP protocol names to those of proto,
+// e.g. "icmp" to "ipv6-icmp" for IPv6. Other protocols are returned as is.
+func familyProtocol(protocol string, proto Protocol) string {
+	switch strings.ToLower(protocol) {
+	case "icmp", "icmpv6", "ipv6-icmp":
+		if proto == ProtocolIPv6 {
+			return "ipv6-icmp"
+		}
+		return "icmp"
+	}
+	return protocol
+}
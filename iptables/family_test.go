@@ -0,0 +1,54 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckFamily(t *testing.T) {
+	for _, tt := range []struct {
+		proto Protocol
+		args  []string
+		ok    bool
+	}{
+		{ProtocolIPv4, []string{"-t", "filter", "-A", "INPUT", "-s", "192.0.2.0/24,198.51.100.1", "-j", "ACCEPT"}, true},
+		{ProtocolIPv6, []string{"-t", "filter", "-A", "INPUT", "-s", "192.0.2.0/24", "-j", "ACCEPT"}, false},
+		{ProtocolIPv4, []string{"-A", "INPUT", "-d", "2001:db8::/32", "-j", "ACCEPT"}, false},
+		{ProtocolIPv6, []string{"-A", "INPUT", "-d", "::ffff:192.0.2.1", "-j", "ACCEPT"}, true},
+		{ProtocolIPv4, []string{"-A", "INPUT", "-s", "example.com", "-j", "ACCEPT"}, true},
+		{ProtocolIPv6, []string{"-A", "INPUT", "-p", "icmp", "-j", "ACCEPT"}, false},
+		{ProtocolIPv4, []string{"-A", "INPUT", "-p", "ipv6-icmp", "-j", "ACCEPT"}, false},
+		{ProtocolIPv6, []string{"-A", "INPUT", "-p", "icmpv6", "--icmpv6-type", "echo-request", "-j", "ACCEPT"}, true},
+		{ProtocolIPv6, []string{"-A", "INPUT", "-p", "icmpv6", "--icmp-type", "echo-request", "-j", "ACCEPT"}, false},
+		{ProtocolIPv6, []string{"-t", "nat", "-A", "PREROUTING", "-j", "DNAT", "--to-destination", "[2001:db8::1]:80-90"}, true},
+		{ProtocolIPv6, []string{"-t", "nat", "-A", "PREROUTING", "-j", "DNAT", "--to-destination", "192.0.2.1:80"}, false},
+		{ProtocolIPv4, []string{"-A", "INPUT", "-m", "iprange", "--src-range", "192.0.2.1-192.0.2.9", "-j", "ACCEPT"}, true},
+		{ProtocolIPv4, []string{"-A", "INPUT", "-m", "comment", "--comment", "-s", "2001:db8::1", "-j", "ACCEPT"}, true},
+		{ProtocolIPv6, []string{"-N", "192.0.2.1"}, true},
+		{ProtocolIPv4, []string{"-A", "INPUT", "-j", "REJECT", "--reject-with", "icmp6-adm-prohibited"}, false},
+		{ProtocolIPv6, []string{"-A", "INPUT", "-j", "REJECT", "--reject-with", "icmp-host-prohibited"}, false},
+		{ProtocolIPv6, []string{"-A", "INPUT", "-p", "tcp", "-j", "REJECT", "--reject-with", "tcp-reset"}, true},
+	} {
+		err := checkFamily(tt.proto, tt.args)
+		if tt.ok && err != nil {
+			t.Errorf("checkFamily(%v, %q) failed: %v", tt.proto, tt.args, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrWrongFamily) {
+			t.Errorf("checkFamily(%v, %q) returned %v, want ErrWrongFamily", tt.proto, tt.args, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// RuleFilter selects rules for ListMatching.
+type RuleFilter func(r *ParsedRule) bool
+
+// ListMatching lists the rules of the specified table/chain for which match
+// returns true. Rules are filtered as the listing is read, so only the
+// matching rules are held in memory.
+func (ipt *IPTables) ListMatching(table, chain string, match RuleFilter) ([]ParsedRule, error) {
+	var rules []ParsedRule
+	err := ipt.ListParsedFunc(table, chain, func(r *ParsedRule) error {
+		if match(r) {
+			rules = append(rules, *r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// deleteMatchingAttempts bounds how often DeleteMatchingRules retries a
+// deletion that failed because the chain changed meanwhile.
+const deleteMatchingAttempts = 3
+
+// DeleteMatchingRules deletes the rules of the specified table/chain for
+// which match returns true, and returns how many were deleted. The rules are
+// deleted by rulespec rather than by position, in a single iptables-restore
+// transaction, so rules inserted or deleted concurrently, e.g. by another
+// CNI plugin tearing down its port mappings, cannot shift the wrong rule
+// under it as with List followed by DeleteById. If a selected rule vanishes
+// before the transaction commits, nothing is deleted; the chain is then
+// listed again and the deletion retried a few times.
+//
+// The listing and the deletion run under AcquireSequenceLock, so other users
+// of this package, and with iptables binaries without --wait any other
+// program, cannot change the chain in between.
+func (ipt *IPTables) DeleteMatchingRules(table, chain string, match RuleFilter) (int, error) {
+	l, err := ipt.AcquireSequenceLock(context.Background())
+	switch {
+	case err == nil:
+		defer l.Release()
+	case err != ErrNotSupported:
+		return 0, err
+	}
+
+	for attempt := 0; attempt < deleteMatchingAttempts; attempt++ {
+		var rules []ParsedRule
+		rules, err = ipt.ListMatching(table, chain, match)
+		if err != nil || len(rules) == 0 {
+			return 0, err
+		}
+		var buf bytes.Buffer
+		buf.WriteString("*" + table + "\n")
+		for _, r := range rules {
+			buf.WriteString("-D " + chain + " " + r.Spec + "\n")
+		}
+		buf.WriteString("COMMIT\n")
+		err = ipt.Restore(buf.String(), RestoreOptions{NoFlush: true})
+		if err == nil {
+			return len(rules), nil
+		}
+		var e *Error
+		if !errors.As(err, &e) {
+			return 0, err
+		}
+	}
+	return 0, err
+}
+
+// ByTarget selects rules jumping to the given target, e.g. "DROP" or a chain name.
+func ByTarget(target string) RuleFilter {
+	return func(r *ParsedRule) bool {
+		return r.Target == target
+	}
+}
+
+// ByComment selects rules with a comment containing substr.
+func ByComment(substr string) RuleFilter {
+	return func(r *ParsedRule) bool {
+		for _, c := range r.Matches["--comment"] {
+			if strings.Contains(c, substr) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ByDestination selects rules whose destination ("-d") lies within network,
+// e.g. a rule for 10.1.0.0/16 or 10.1.2.3/32 is selected by 10.0.0.0/8.
+// Rules without a destination, or with a negated one, are not selected.
+func ByDestination(network *net.IPNet) RuleFilter {
+	netOnes, netBits := network.Mask.Size()
+	return func(r *ParsedRule) bool {
+		for _, d := range r.Matches["-d"] {
+			ip, n, err := net.ParseCIDR(d)
+			if err != nil {
+				ip = net.ParseIP(d)
+				if ip == nil {
+					continue
+				}
+				bits := 8 * net.IPv4len
+				if ip.To4() == nil {
+					bits = 8 * net.IPv6len
+				}
+				n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			}
+			ones, bits := n.Mask.Size()
+			if bits == netBits && ones >= netOnes && network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// AllOf selects rules selected by every one of filters.
+func AllOf(filters ...RuleFilter) RuleFilter {
+	return func(r *ParsedRule) bool {
+		for _, f := range filters {
+			if !f(r) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// AnyOf selects rules selected by at least one of filters.
+func AnyOf(filters ...RuleFilter) RuleFilter {
+	return func(r *ParsedRule) bool {
+		for _, f := range filters {
+			if f(r) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestRuleFilters(t *testing.T) {
+	var rules []*ParsedRule
+	for _, line := range []string{
+		`-A FORWARD -d 10.1.0.0/16 -m comment --comment "tenant a" -j ACCEPT`,
+		`-A FORWARD -d 10.1.2.3/32 -j DROP`,
+		`-A FORWARD -d 192.168.0.0/16 -m comment --comment "tenant b" -j DROP`,
+		`-A FORWARD ! -d 10.0.0.0/8 -j DROP`,
+		`-A FORWARD -d 0.0.0.0/0 -j LOG`,
+	} {
+		r, err := ParseRule(line)
+		if err != nil {
+			t.Fatalf("ParseRule(%q) failed: %v", line, err)
+		}
+		rules = append(rules, r)
+	}
+
+	_, tenNet, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, tt := range []struct {
+		name     string
+		filter   RuleFilter
+		expected []int
+	}{
+		{"target", ByTarget("DROP"), []int{1, 2, 3}},
+		{"comment", ByComment("tenant"), []int{0, 2}},
+		{"destination", ByDestination(tenNet), []int{0, 1}},
+		{"all", AllOf(ByDestination(tenNet), ByTarget("DROP")), []int{1}},
+		{"any", AnyOf(ByComment("tenant b"), ByTarget("LOG")), []int{2, 4}},
+	} {
+		var got []int
+		for i, r := range rules {
+			if tt.filter(r) {
+				got = append(got, i)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: selected %v, want %v", tt.name, got, tt.expected)
+		}
+	}
+}
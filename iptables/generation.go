@@ -0,0 +1,96 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// generationOwnerTag is the tag key of the owner of a generation. It is not
+// "owner", the key of the Owner option, so generation rules are not taken for
+// those of an Owner handle of the same name.
+const generationOwnerTag = "gen-owner"
+
+// GenerationRule returns rulespec tagged with the owner and generation, as
+// "gen=<gen>,gen-owner=<owner>" in a comment match.
+func GenerationRule(owner, gen string, rulespec ...string) ([]string, error) {
+	return tagged(RuleTags{generationOwnerTag: owner, "gen": gen}, rulespec)
+}
+
+// AppendGeneration appends rulespec tagged with the owner and generation to
+// the table/chain, unless it is already present. Since the generation is part
+// of the rule, a restarted process installing the same generation again does
+// not duplicate its rules.
+func (ipt *IPTables) AppendGeneration(table, chain, owner, gen string, rulespec ...string) error {
+	spec, err := GenerationRule(owner, gen, rulespec...)
+	if err != nil {
+		return err
+	}
+	return ipt.AppendUnique(table, chain, spec...)
+}
+
+// RotateGeneration deletes every rule of the owner in the table that belongs
+// to a generation other than newGen, in a single iptables-restore transaction.
+// The rules of the new generation must be installed first, e.g. with
+// AppendGeneration, so traffic is never left without the owner's rules; to
+// guard against a failed install, RotateGeneration fails without deleting
+// anything if the table holds no rule of the new generation.
+func (ipt *IPTables) RotateGeneration(table, owner, newGen string) error {
+	current, err := ipt.listTable(table)
+	if err != nil {
+		return err
+	}
+	data, err := rotateGenerationData(table, owner, newGen, current)
+	if err != nil || data == "" {
+		return err
+	}
+	return ipt.Restore(data, RestoreOptions{NoFlush: true})
+}
+
+// rotateGenerationData returns the restore data deleting the old generations
+// of the owner, or "" if there are none.
+func rotateGenerationData(table, owner, newGen string, current *tableRules) (string, error) {
+	var (
+		buf   bytes.Buffer
+		found bool
+		stale int
+	)
+	buf.WriteString("*" + table + "\n")
+	for _, chain := range current.chains {
+		for _, r := range current.rules[chain] {
+			tags := r.Tags()
+			gen, ok := tags["gen"]
+			if !ok || tags[generationOwnerTag] != owner {
+				continue
+			}
+			if gen == newGen {
+				found = true
+				continue
+			}
+			buf.WriteString("-D " + chain + " " + r.Spec + "\n")
+			stale++
+		}
+	}
+	buf.WriteString("COMMIT\n")
+
+	if !found {
+		return "", fmt.Errorf("no rules of generation %s of owner %s in table %s", newGen, owner, table)
+	}
+	if stale == 0 {
+		return "", nil
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRuleTags(t *testing.T) {
+	spec, err := GenerationRule("dns-agent", "42", "-s", "192.0.2.1/32", "-j", "ACCEPT")
+	if err != nil {
+		t.Fatalf("GenerationRule failed: %v", err)
+	}
+	expected := []string{"-s", "192.0.2.1/32", "-m", "comment", "--comment", "gen=42,gen-owner=dns-agent", "-j", "ACCEPT"}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("GenerationRule mismatch: \ngot  %#v \nneed %#v", spec, expected)
+	}
+
+	if _, err := GenerationRule("dns agent", "42", "-j", "ACCEPT"); err == nil {
+		t.Fatalf("GenerationRule with a space in the owner did not fail")
+	}
+
+	r, err := ParseRule(`-A INPUT -m comment --comment "not tags" -m comment --comment gen=42,gen-owner=dns-agent -j ACCEPT`)
+	if err != nil {
+		t.Fatalf("ParseRule failed: %v", err)
+	}
+	if tags := r.Tags(); !reflect.DeepEqual(tags, RuleTags{"gen": "42", "gen-owner": "dns-agent"}) {
+		t.Fatalf("Tags mismatch: %#v", tags)
+	}
+}
+
+func TestRotateGenerationData(t *testing.T) {
+	current, err := parseTableRules([]string{
+		"-P INPUT ACCEPT",
+		"-N SVC",
+		"-A INPUT -s 192.0.2.1/32 -m comment --comment gen=1,gen-owner=a -j ACCEPT",
+		"-A INPUT -s 192.0.2.2/32 -m comment --comment gen=2,gen-owner=a -j ACCEPT",
+		"-A INPUT -s 192.0.2.3/32 -m comment --comment gen=1,gen-owner=b -j ACCEPT",
+		"-A SVC -m comment --comment gen=0,gen-owner=a -j RETURN",
+	})
+	if err != nil {
+		t.Fatalf("parseTableRules failed: %v", err)
+	}
+
+	data, err := rotateGenerationData("filter", "a", "2", current)
+	if err != nil {
+		t.Fatalf("rotateGenerationData failed: %v", err)
+	}
+	expected := `*filter
+-D INPUT -s 192.0.2.1/32 -m comment --comment gen=1,gen-owner=a -j ACCEPT
+-D SVC -m comment --comment gen=0,gen-owner=a -j RETURN
+COMMIT
+`
+	if data != expected {
+		t.Fatalf("rotateGenerationData mismatch: \ngot  %s \nneed %s", data, expected)
+	}
+
+	if _, err := rotateGenerationData("filter", "a", "3", current); err == nil {
+		t.Fatalf("rotateGenerationData without rules of the new generation did not fail")
+	}
+	data, err = rotateGenerationData("filter", "b", "1", current)
+	if err != nil || data != "" {
+		t.Fatalf("rotateGenerationData without stale rules returned %q, %v", data, err)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpcapi implements the Firewall service of iptables.proto, for
+// node agents receiving rulesets from a central controller.
+//
+// The package does not depend on gRPC: Server works on the plain Go
+// messages below, which mirror those of iptables.proto field by field. An
+// agent generates the stubs with protoc-gen-go and protoc-gen-go-grpc,
+// registers an adapter converting between the generated messages and these,
+// and maps an *Error to a status with status.Error(codes.Code(e.Code), e.Message).
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Firewall is the part of *iptables.IPTables served by a Server.
+type Firewall interface {
+	DiffRuleset(rs *iptables.Ruleset) ([]iptables.ChainDiff, error)
+	ApplyRulesetProgress(rs *iptables.Ruleset, progress func(table string, err *iptables.RuleError)) error
+}
+
+// Code is a gRPC status code.
+type Code uint32
+
+// The status codes returned by a Server, with their gRPC values.
+const (
+	Canceled           Code = 1
+	InvalidArgument    Code = 3
+	FailedPrecondition Code = 9
+	Internal           Code = 13
+)
+
+// Error is the status a call fails with.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("grpcapi: code %d: %s", e.Code, e.Message)
+}
+
+// Stage is ApplyProgress.Stage.
+type Stage int32
+
+const (
+	StageUnspecified Stage = iota
+	StagePlanned
+	StageTableApplied
+	StageTableFailed
+	StageDone
+)
+
+// DiffRequest is the request of Diff.
+type DiffRequest struct {
+	// Ruleset is the JSON encoded iptables.Ruleset.
+	Ruleset []byte
+}
+
+// DiffResponse is the response of Diff.
+type DiffResponse struct {
+	Diffs []*ChainDiff
+}
+
+// ChainDiff mirrors iptables.ChainDiff.
+type ChainDiff struct {
+	Table     string
+	Chain     string
+	Create    bool
+	OldPolicy string
+	NewPolicy string
+	Added     []string
+	Removed   []string
+	Reordered bool
+}
+
+// ApplyRequest is the request of Apply.
+type ApplyRequest struct {
+	// Ruleset is the JSON encoded iptables.Ruleset.
+	Ruleset []byte
+	// DryRun stops after reporting the planned changes.
+	DryRun bool
+}
+
+// ApplyProgress is streamed by Apply.
+type ApplyProgress struct {
+	Stage   Stage
+	Table   string
+	Diffs   []*ChainDiff
+	Failure *RuleFailure
+	Result  *ApplyResult
+}
+
+// RuleFailure mirrors iptables.RuleError.
+type RuleFailure struct {
+	Table    string
+	Chain    string
+	Index    int32
+	Rulespec []string
+	Stderr   string
+	Message  string
+}
+
+// ApplyResult is the outcome of Apply.
+type ApplyResult struct {
+	Applied       int32
+	Failed        int32
+	RolledBack    bool
+	RollbackError string
+}
+
+// ApplyStream is the server side of an Apply call. It has the methods used
+// of the Firewall_ApplyServer interface generated by protoc-gen-go-grpc.
+type ApplyStream interface {
+	Send(*ApplyProgress) error
+	Context() context.Context
+}
+
+// Server implements the Firewall service.
+type Server struct {
+	fw Firewall
+}
+
+// NewServer returns a Server managing fw, typically an *iptables.IPTables.
+func NewServer(fw Firewall) *Server {
+	return &Server{fw: fw}
+}
+
+// Diff returns the chains that Apply would change.
+func (s *Server) Diff(ctx context.Context, req *DiffRequest) (*DiffResponse, error) {
+	rs, err := decodeRuleset(req.Ruleset)
+	if err != nil {
+		return nil, err
+	}
+	diffs, err := s.fw.DiffRuleset(rs)
+	if err != nil {
+		return nil, &Error{FailedPrecondition, err.Error()}
+	}
+	return &DiffResponse{Diffs: chainDiffs(diffs)}, nil
+}
+
+// Apply applies the ruleset, sending the planned changes, then a message
+// for every table as soon as it is applied or failed, and finally the result. Rules rejected
+// by iptables do not fail the call, they are reported in the stream.
+func (s *Server) Apply(req *ApplyRequest, stream ApplyStream) error {
+	rs, err := decodeRuleset(req.Ruleset)
+	if err != nil {
+		return err
+	}
+	diffs, err := s.fw.DiffRuleset(rs)
+	if err != nil {
+		return &Error{FailedPrecondition, err.Error()}
+	}
+	if err := stream.Send(&ApplyProgress{Stage: StagePlanned, Diffs: chainDiffs(diffs)}); err != nil {
+		return err
+	}
+	if req.DryRun || len(diffs) == 0 {
+		return stream.Send(&ApplyProgress{Stage: StageDone, Result: &ApplyResult{}})
+	}
+	if err := stream.Context().Err(); err != nil {
+		return &Error{Canceled, err.Error()}
+	}
+
+	// tables are reported as they are done; a failed table once, even if
+	// the error policy reports it again
+	var sendErr error
+	failed := make(map[string]bool)
+	send := func(p *ApplyProgress) {
+		if sendErr == nil {
+			sendErr = stream.Send(p)
+		}
+	}
+	err = s.fw.ApplyRulesetProgress(rs, func(table string, re *iptables.RuleError) {
+		switch {
+		case re == nil:
+			send(&ApplyProgress{Stage: StageTableApplied, Table: table})
+		case !failed[table]:
+			failed[table] = true
+			send(&ApplyProgress{Stage: StageTableFailed, Table: table, Failure: ruleFailure(re)})
+		}
+	})
+	if sendErr != nil {
+		return sendErr
+	}
+	result, err := applyResult(len(rs.Tables), err)
+	if err != nil {
+		return err
+	}
+	return stream.Send(&ApplyProgress{Stage: StageDone, Result: result})
+}
+
+// applyResult turns the error of applying a ruleset of the given number of
+// tables into the result.
+func applyResult(tables int, err error) (*ApplyResult, error) {
+	if err == nil {
+		return &ApplyResult{Applied: int32(tables)}, nil
+	}
+	var applyErr *iptables.ApplyError
+	if !errors.As(err, &applyErr) {
+		return nil, &Error{Internal, err.Error()}
+	}
+	result := &ApplyResult{
+		Applied:    int32(applyErr.Applied),
+		Failed:     int32(len(applyErr.Failed)),
+		RolledBack: applyErr.RolledBack,
+	}
+	if applyErr.RollbackErr != nil {
+		result.RollbackError = applyErr.RollbackErr.Error()
+	}
+	return result, nil
+}
+
+func decodeRuleset(data []byte) (*iptables.Ruleset, error) {
+	rs, err := iptables.LoadRulesetJSON(bytes.NewReader(data))
+	if err != nil {
+		return nil, &Error{InvalidArgument, err.Error()}
+	}
+	return rs, nil
+}
+
+func chainDiffs(diffs []iptables.ChainDiff) []*ChainDiff {
+	out := make([]*ChainDiff, 0, len(diffs))
+	for _, d := range diffs {
+		out = append(out, &ChainDiff{
+			Table:     d.Table,
+			Chain:     d.Chain,
+			Create:    d.Create,
+			OldPolicy: d.OldPolicy,
+			NewPolicy: d.NewPolicy,
+			Added:     d.Added,
+			Removed:   d.Removed,
+			Reordered: d.Reordered,
+		})
+	}
+	return out
+}
+
+func ruleFailure(re *iptables.RuleError) *RuleFailure {
+	f := &RuleFailure{
+		Table:    re.Table,
+		Chain:    re.Chain,
+		Index:    int32(re.Index),
+		Rulespec: re.Rulespec,
+		Stderr:   re.Stderr,
+	}
+	if re.Err != nil {
+		f.Message = re.Err.Error()
+	}
+	return f
+}
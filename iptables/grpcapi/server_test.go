@@ -0,0 +1,173 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// report is a table result passed to the progress callback.
+type report struct {
+	table string
+	re    *iptables.RuleError
+}
+
+// fakeFirewall returns canned results.
+type fakeFirewall struct {
+	diffs    []iptables.ChainDiff
+	reports  []report
+	applyErr error
+	applied  int
+	// stream and sent record how many messages were sent after each report
+	stream *fakeStream
+	sent   []int
+}
+
+func (f *fakeFirewall) DiffRuleset(rs *iptables.Ruleset) ([]iptables.ChainDiff, error) {
+	return f.diffs, nil
+}
+
+func (f *fakeFirewall) ApplyRulesetProgress(rs *iptables.Ruleset, progress func(string, *iptables.RuleError)) error {
+	f.applied++
+	for _, r := range f.reports {
+		progress(r.table, r.re)
+		if f.stream != nil {
+			f.sent = append(f.sent, len(f.stream.sent))
+		}
+	}
+	return f.applyErr
+}
+
+// fakeStream collects the sent messages.
+type fakeStream struct {
+	ctx  context.Context
+	sent []*ApplyProgress
+}
+
+func (s *fakeStream) Send(p *ApplyProgress) error {
+	s.sent = append(s.sent, p)
+	return nil
+}
+
+func (s *fakeStream) Context() context.Context {
+	return s.ctx
+}
+
+const ruleset = `{"tables": [{"name": "filter", "chains": [{"name": "INPUT", "policy": "DROP"}]}, {"name": "nat"}]}`
+
+func stages(sent []*ApplyProgress) []string {
+	var out []string
+	for _, p := range sent {
+		s := map[Stage]string{StagePlanned: "planned", StageTableApplied: "applied", StageTableFailed: "failed", StageDone: "done"}[p.Stage]
+		if p.Table != "" {
+			s += " " + p.Table
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func TestDiff(t *testing.T) {
+	fw := &fakeFirewall{diffs: []iptables.ChainDiff{{Table: "filter", Chain: "INPUT", OldPolicy: "ACCEPT", NewPolicy: "DROP"}}}
+	s := NewServer(fw)
+	resp, err := s.Diff(context.Background(), &DiffRequest{Ruleset: []byte(ruleset)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*ChainDiff{{Table: "filter", Chain: "INPUT", OldPolicy: "ACCEPT", NewPolicy: "DROP"}}
+	if !reflect.DeepEqual(resp.Diffs, expected) {
+		t.Errorf("got %+v, want %+v", resp.Diffs, expected)
+	}
+
+	_, err = s.Diff(context.Background(), &DiffRequest{Ruleset: []byte(`{"tables": [{}]}`)})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != InvalidArgument {
+		t.Errorf("invalid ruleset failed with %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	diffs := []iptables.ChainDiff{{Table: "filter", Chain: "INPUT", OldPolicy: "ACCEPT", NewPolicy: "DROP"}}
+	natErr := &iptables.RuleError{Table: "nat", Stderr: "iptables-restore: line 2 failed", Err: errors.New("exit status 1")}
+	for _, tt := range []struct {
+		name     string
+		diffs    []iptables.ChainDiff
+		reports  []report
+		applyErr error
+		dryRun   bool
+		stages   []string
+		result   ApplyResult
+	}{
+		{"unchanged", nil, nil, nil, false, []string{"planned", "done"}, ApplyResult{}},
+		{"dry run", diffs, nil, nil, true, []string{"planned", "done"}, ApplyResult{}},
+		{
+			"applied", diffs, []report{{"filter", nil}, {"nat", nil}}, nil,
+			false, []string{"planned", "applied filter", "applied nat", "done"}, ApplyResult{Applied: 2},
+		},
+		{
+			"failed", diffs, []report{{"nat", natErr}, {"nat", natErr}, {"filter", nil}},
+			&iptables.ApplyError{Applied: 1, Failed: []*iptables.RuleError{natErr}},
+			false, []string{"planned", "failed nat", "applied filter", "done"}, ApplyResult{Applied: 1, Failed: 1},
+		},
+		{
+			"rolled back", diffs, []report{{"nat", natErr}},
+			&iptables.ApplyError{Failed: []*iptables.RuleError{natErr}, RolledBack: true},
+			false, []string{"planned", "failed nat", "done"}, ApplyResult{Failed: 1, RolledBack: true},
+		},
+	} {
+		stream := &fakeStream{ctx: context.Background()}
+		fw := &fakeFirewall{diffs: tt.diffs, reports: tt.reports, applyErr: tt.applyErr, stream: stream}
+		if err := NewServer(fw).Apply(&ApplyRequest{Ruleset: []byte(ruleset), DryRun: tt.dryRun}, stream); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := stages(stream.sent); !reflect.DeepEqual(got, tt.stages) {
+			t.Errorf("%s: got stages %q, want %q", tt.name, got, tt.stages)
+			continue
+		}
+		if got := *stream.sent[len(stream.sent)-1].Result; got != tt.result {
+			t.Errorf("%s: got result %+v, want %+v", tt.name, got, tt.result)
+		}
+		// every table is sent before the apply returns
+		if len(tt.reports) > 0 && fw.sent[len(fw.sent)-1] != len(stream.sent)-1 {
+			t.Errorf("%s: %d messages sent while applying, want %d", tt.name, fw.sent[len(fw.sent)-1], len(stream.sent)-1)
+		}
+	}
+
+	failure := &iptables.RuleError{Table: "nat", Chain: "POSTROUTING", Index: 2, Rulespec: []string{"-j", "BOGUS"}, Stderr: "no such target", Err: errors.New("exit status 2")}
+	fw := &fakeFirewall{reports: []report{{"nat", failure}}, applyErr: &iptables.ApplyError{Failed: []*iptables.RuleError{failure}}, diffs: diffs}
+	stream := &fakeStream{ctx: context.Background()}
+	if err := NewServer(fw).Apply(&ApplyRequest{Ruleset: []byte(ruleset)}, stream); err != nil {
+		t.Fatal(err)
+	}
+	expected := &RuleFailure{Table: "nat", Chain: "POSTROUTING", Index: 2, Rulespec: []string{"-j", "BOGUS"}, Stderr: "no such target", Message: "exit status 2"}
+	if got := stream.sent[1].Failure; !reflect.DeepEqual(got, expected) {
+		t.Errorf("got failure %+v, want %+v", got, expected)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fw = &fakeFirewall{diffs: diffs}
+	err := NewServer(fw).Apply(&ApplyRequest{Ruleset: []byte(ruleset)}, &fakeStream{ctx: ctx})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != Canceled || fw.applied != 0 {
+		t.Errorf("canceled call failed with %v, applied %d times", err, fw.applied)
+	}
+}
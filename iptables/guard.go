@@ -0,0 +1,185 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// GuardRule protects traffic from being dropped by changes made through the
+// handle; see Guard.
+type GuardRule struct {
+	// Name describes the traffic in errors, e.g. "ssh session".
+	Name string
+	// Packet is the protected traffic. Its Table defaults to "filter" and
+	// its Chain, which must be built-in, to "INPUT".
+	Packet PacketSpec
+	// Warn, if set, is called with the *GuardError instead of refusing the
+	// operation.
+	Warn func(error)
+}
+
+// GuardError is returned for operations that would drop guarded traffic.
+type GuardError struct {
+	Guard GuardRule
+	// Steps is the simulated path of the packet after the operation.
+	Steps []TraceStep
+}
+
+func (e *GuardError) Error() string {
+	last := e.Steps[len(e.Steps)-1]
+	where := "policy of " + last.Chain
+	if last.Rule > 0 {
+		where = fmt.Sprintf("rule %d of %s (%s)", last.Rule, last.Chain, last.RuleSpec)
+	}
+	return fmt.Sprintf("iptables: operation would %s protected traffic %q at %s", last.Target, e.Guard.Name, where)
+}
+
+// Guard makes mutating operations, including restores, check that they do
+// not make the protected traffic dropped or rejected. The effect of each
+// operation is simulated against the current rules, as parsed from listings,
+// with Trace; rules Trace cannot evaluate are assumed not to match. An
+// operation that would drop the traffic fails with *GuardError without
+// being run, unless the GuardRule has a Warn function.
+func Guard(protect []GuardRule) Option {
+	return func(ipt *IPTables) {
+		for _, g := range protect {
+			if g.Packet.Table == "" {
+				g.Packet.Table = "filter"
+			}
+			if g.Packet.Chain == "" {
+				g.Packet.Chain = "INPUT"
+			}
+			ipt.guards = append(ipt.guards, g)
+		}
+	}
+}
+
+// SSHSessionGuard returns a GuardRule protecting the SSH session the process
+// runs in, as described by the SSH_CONNECTION environment variable, and
+// false if there is none.
+func SSHSessionGuard() (GuardRule, bool) {
+	fields := strings.Fields(os.Getenv("SSH_CONNECTION"))
+	if len(fields) != 4 {
+		return GuardRule{}, false
+	}
+	client, server := net.ParseIP(fields[0]), net.ParseIP(fields[2])
+	clientPort, err1 := strconv.Atoi(fields[1])
+	serverPort, err2 := strconv.Atoi(fields[3])
+	if client == nil || server == nil || err1 != nil || err2 != nil {
+		return GuardRule{}, false
+	}
+	return GuardRule{
+		Name: "ssh session",
+		Packet: PacketSpec{
+			Chain:           "INPUT",
+			Protocol:        "tcp",
+			Source:          client,
+			Destination:     server,
+			SourcePort:      clientPort,
+			DestinationPort: serverPort,
+			State:           "ESTABLISHED",
+		},
+	}, true
+}
+
+// checkGuards simulates the iptables command given by args against the
+// guarded tables.
+func (ipt *IPTables) checkGuards(args []string) error {
+	table := "filter"
+	if len(args) >= 2 && (args[0] == "-t" || args[0] == "--table") {
+		table, args = args[1], args[2:]
+	}
+	return ipt.checkGuardsWith(table, func(t *tableRules) error {
+		return t.simulate(args)
+	})
+}
+
+// checkGuardsRestore simulates restore data against the guarded tables.
+func (ipt *IPTables) checkGuardsRestore(data string, noflush bool) error {
+	tables, order, err := splitRestoreData(data)
+	if err != nil {
+		return err
+	}
+	for _, table := range order {
+		lines := tables[table]
+		err := ipt.checkGuardsWith(table, func(t *tableRules) error {
+			return t.simulateRestore(lines, noflush)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkGuardsWith checks the guards of the table against the result of
+// applying change to its current rules.
+func (ipt *IPTables) checkGuardsWith(table string, change func(*tableRules) error) error {
+	var guards []GuardRule
+	for _, g := range ipt.guards {
+		if g.Packet.Table == table {
+			guards = append(guards, g)
+		}
+	}
+	if len(guards) == 0 {
+		return nil
+	}
+
+	before, err := ipt.listTable(table)
+	if err != nil {
+		return err
+	}
+	after := before.clone()
+	if err := change(after); err != nil {
+		// let iptables report the problem
+		return nil
+	}
+	for _, g := range guards {
+		if err := checkGuard(g, before, after); err != nil {
+			if g.Warn == nil {
+				return err
+			}
+			g.Warn(err)
+		}
+	}
+	return nil
+}
+
+// checkGuard returns a *GuardError if the packet of the guard is dropped
+// after, but was not before.
+func checkGuard(g GuardRule, before, after *tableRules) error {
+	steps, err := traceTableRules(after, g.Packet)
+	if err != nil || !droppingStep(steps) {
+		return nil
+	}
+	if prev, err := traceTableRules(before, g.Packet); err == nil && droppingStep(prev) {
+		// dropped already, the operation does not change that
+		return nil
+	}
+	return &GuardError{Guard: g, Steps: steps}
+}
+
+func droppingStep(steps []TraceStep) bool {
+	if len(steps) == 0 {
+		return false
+	}
+	target := steps[len(steps)-1].Target
+	return target == "DROP" || target == "REJECT"
+}
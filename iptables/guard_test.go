@@ -0,0 +1,126 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	ipt, log := newFakeIPTables(t, `case "$*" in
+"--wait -t filter -S") printf -- '-P INPUT DROP\n-A INPUT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT\n-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT\n';;
+esac`)
+	ssh := GuardRule{
+		Name: "ssh session",
+		Packet: PacketSpec{
+			Protocol:        "tcp",
+			Source:          net.ParseIP("198.51.100.7"),
+			Destination:     net.ParseIP("192.0.2.1"),
+			SourcePort:      50000,
+			DestinationPort: 22,
+			State:           "NEW",
+		},
+	}
+	Guard([]GuardRule{ssh})(ipt)
+
+	// inserting a rule dropping the client is refused
+	err := ipt.Insert("filter", "INPUT", 1, "-s", "198.51.100.0/24", "-j", "DROP")
+	guardErr, ok := err.(*GuardError)
+	if !ok {
+		t.Fatalf("Insert returned %v, want *GuardError", err)
+	}
+	if last := guardErr.Steps[len(guardErr.Steps)-1]; last.Rule != 1 || last.Target != "DROP" {
+		t.Fatalf("unexpected deciding step: %+v", last)
+	}
+
+	// deleting the ssh rule leaves the packet to the DROP policy
+	err = ipt.Delete("filter", "INPUT", "-p", "tcp", "--dport", "22", "-j", "ACCEPT")
+	if _, ok := err.(*GuardError); !ok {
+		t.Fatalf("Delete returned %v, want *GuardError", err)
+	}
+
+	// unrelated changes and other tables pass
+	if err := ipt.Append("filter", "INPUT", "-s", "203.0.113.0/24", "-j", "DROP"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := ipt.Append("nat", "POSTROUTING", "-j", "MASQUERADE"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	// restores are simulated too
+	err = ipt.checkGuardsRestore("*filter\n:INPUT DROP [0:0]\nCOMMIT\n", false)
+	if _, ok := err.(*GuardError); !ok {
+		t.Fatalf("checkGuardsRestore returned %v, want *GuardError", err)
+	}
+	err = ipt.checkGuardsRestore("*filter\n-I INPUT 1 -s 203.0.113.9 -j DROP\nCOMMIT\n", true)
+	if err != nil {
+		t.Fatalf("checkGuardsRestore of unrelated change failed: %v", err)
+	}
+
+	var warned error
+	ssh.Warn = func(err error) { warned = err }
+	ipt.guards = nil
+	Guard([]GuardRule{ssh})(ipt)
+	if err := ipt.Insert("filter", "INPUT", 1, "-j", "DROP"); err != nil {
+		t.Fatalf("Insert with a warning guard failed: %v", err)
+	}
+	if _, ok := warned.(*GuardError); !ok {
+		t.Fatalf("Warn called with %v, want *GuardError", warned)
+	}
+
+	expected := []string{
+		"--wait -t filter -S",
+		"--wait -t filter -S",
+		"--wait -t filter -S",
+		"--wait -t filter -A INPUT -s 203.0.113.0/24 -j DROP",
+		"--wait -t nat -A POSTROUTING -j MASQUERADE",
+		"--wait -t filter -S",
+		"--wait -t filter -S",
+		"--wait -t filter -S",
+		"--wait -t filter -I INPUT 1 -j DROP",
+	}
+	calls := fakeCalls(t, log)
+	if len(calls) != len(expected) {
+		t.Fatalf("calls mismatch: \ngot  %#v \nneed %#v", calls, expected)
+	}
+	for i := range calls {
+		if calls[i] != expected[i] {
+			t.Fatalf("calls mismatch: \ngot  %#v \nneed %#v", calls, expected)
+		}
+	}
+}
+
+func TestSSHSessionGuard(t *testing.T) {
+	defer os.Setenv("SSH_CONNECTION", os.Getenv("SSH_CONNECTION"))
+
+	os.Setenv("SSH_CONNECTION", "198.51.100.7 50000 192.0.2.1 22")
+	g, ok := SSHSessionGuard()
+	if !ok {
+		t.Fatalf("SSHSessionGuard found no session")
+	}
+	if !g.Packet.Source.Equal(net.ParseIP("198.51.100.7")) || g.Packet.DestinationPort != 22 || g.Packet.State != "ESTABLISHED" {
+		t.Fatalf("unexpected guard: %+v", g)
+	}
+
+	os.Setenv("SSH_CONNECTION", "")
+	if _, ok := SSHSessionGuard(); ok {
+		t.Fatalf("SSHSessionGuard found a session without SSH_CONNECTION")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// localNetworkOf returns the network of the local interface that ip is on;
+// replaced in tests.
+var localNetworkOf = interfaceNetworkOf
+
+// hairpinRule is one rule of the hairpin NAT rule set.
+type hairpinRule struct {
+	chain    string
+	rulespec []string
+}
+
+// hairpinRules returns the nat table rules that forward port on extIP to
+// intIP, with lan being the network intIP is on.
+func hairpinRules(extIP, intIP net.IP, lan *net.IPNet, port int, proto string) []hairpinRule {
+	p := strconv.Itoa(port)
+	dst := net.JoinHostPort(intIP.String(), p)
+	return []hairpinRule{
+		// traffic for the external address, from outside and from the LAN
+		{"PREROUTING", []string{"-d", extIP.String(), "-p", proto, "-m", proto, "--dport", p, "-j", "DNAT", "--to-destination", dst}},
+		// connections from the router itself
+		{"OUTPUT", []string{"-d", extIP.String(), "-p", proto, "-m", proto, "--dport", p, "-j", "DNAT", "--to-destination", dst}},
+		// LAN clients must see the replies come from the external address,
+		// not directly from the server, or they drop them
+		{"POSTROUTING", []string{"-s", lan.String(), "-d", intIP.String(), "-p", proto, "-m", proto, "--dport", p, "-j", "SNAT", "--to-source", extIP.String()}},
+	}
+}
+
+// hairpinSetup validates the arguments and returns the hairpin rule set.
+func (ipt *IPTables) hairpinSetup(extIP, intIP string, port int, proto string) ([]hairpinRule, error) {
+	ext, in := net.ParseIP(extIP), net.ParseIP(intIP)
+	switch {
+	case ext == nil:
+		return nil, fmt.Errorf("invalid external address %q", extIP)
+	case in == nil:
+		return nil, fmt.Errorf("invalid internal address %q", intIP)
+	case (ext.To4() != nil) != (in.To4() != nil):
+		return nil, fmt.Errorf("%w: %s and %s", ErrWrongFamily, extIP, intIP)
+	case (ext.To4() != nil) != (ipt.Proto() == ProtocolIPv4):
+		return nil, fmt.Errorf("%w: address %s", ErrWrongFamily, extIP)
+	case port <= 0 || port > 65535:
+		return nil, fmt.Errorf("invalid port %d", port)
+	}
+	switch proto {
+	case "tcp", "udp", "sctp", "dccp":
+	default:
+		return nil, fmt.Errorf("invalid protocol %q: must be one with ports", proto)
+	}
+	lan, err := localNetworkOf(in)
+	if err != nil {
+		return nil, err
+	}
+	return hairpinRules(ext, in, lan, port, proto), nil
+}
+
+// EnableHairpinNAT forwards port of proto on the external address extIP to
+// the internal server intIP, in a way that also works for clients on the
+// server's own LAN: besides the DNAT rules for PREROUTING and OUTPUT, it
+// SNATs LAN connections to the server to extIP, so the server's replies go
+// back through the router instead of straight to the client. The LAN is the
+// network of the local interface intIP is on. Rules already present are left
+// alone.
+func (ipt *IPTables) EnableHairpinNAT(extIP, intIP string, port int, proto string) error {
+	rules, err := ipt.hairpinSetup(extIP, intIP, port, proto)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if err := ipt.AppendUnique("nat", r.chain, r.rulespec...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DisableHairpinNAT removes the rules installed by EnableHairpinNAT.
+func (ipt *IPTables) DisableHairpinNAT(extIP, intIP string, port int, proto string) error {
+	rules, err := ipt.hairpinSetup(extIP, intIP, port, proto)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if err := ipt.DeleteIfExists("nat", r.chain, r.rulespec...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interfaceNetworkOf returns the network of the local interface address
+// whose network contains ip.
+func interfaceNetworkOf(ip net.IP) (*net.IPNet, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if ok && ipnet.Contains(ip) && !ipnet.IP.IsLoopback() {
+			return &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not on a local network", ip)
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHairpinSetup(t *testing.T) {
+	old := localNetworkOf
+	defer func() { localNetworkOf = old }()
+	localNetworkOf = func(ip net.IP) (*net.IPNet, error) {
+		_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+		return lan, nil
+	}
+
+	ipt := &IPTables{proto: ProtocolIPv4}
+	rules, err := ipt.hairpinSetup("203.0.113.5", "192.168.1.10", 443, "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range rules {
+		got = append(got, r.chain+" "+strings.Join(r.rulespec, " "))
+	}
+	want := []string{
+		"PREROUTING -d 203.0.113.5 -p tcp -m tcp --dport 443 -j DNAT --to-destination 192.168.1.10:443",
+		"OUTPUT -d 203.0.113.5 -p tcp -m tcp --dport 443 -j DNAT --to-destination 192.168.1.10:443",
+		"POSTROUTING -s 192.168.1.0/24 -d 192.168.1.10 -p tcp -m tcp --dport 443 -j SNAT --to-source 203.0.113.5",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, bad := range []struct {
+		ext, in string
+		port    int
+		proto   string
+	}{
+		{"203.0.113.5", "192.168.1.10", 0, "tcp"},
+		{"203.0.113.5", "192.168.1.10", 443, "icmp"},
+		{"2001:db8::1", "192.168.1.10", 443, "tcp"},
+		{"203.0.113.5", "host", 443, "tcp"},
+	} {
+		if _, err := ipt.hairpinSetup(bad.ext, bad.in, bad.port, bad.proto); err == nil {
+			t.Errorf("hairpinSetup(%q, %q, %d, %q) succeeded", bad.ext, bad.in, bad.port, bad.proto)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpapi exposes an IPTables handle over HTTP with JSON bodies, so
+// fleet dashboards can query the firewall state of a host without shelling
+// into it. The read endpoints are:
+//
+//	GET  /v1/tables/{table}/chains                 chain names
+//	GET  /v1/tables/{table}/chains/{chain}/rules   "-S" listing of a chain
+//	GET  /v1/tables/{table}/stats?chain={chain}    rule counters
+//	POST /v1/diff                                  ChainDiffs of a Ruleset
+//
+// The write endpoints are disabled unless Handler.AllowWrites is set:
+//
+//	POST   /v1/apply                               apply a Ruleset
+//	POST   /v1/tables/{table}/chains/{chain}/rules append {"rulespec": [...]}
+//	DELETE /v1/tables/{table}/chains/{chain}/rules delete {"rulespec": [...]}
+//
+// Every request is first passed to Handler.Authorize, if set, which should
+// authenticate the caller, e.g. by a client certificate or token, and
+// authorize reads and writes separately. Errors are answered as
+// {"error": "..."}.
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Firewall is the part of *iptables.IPTables served by a Handler.
+type Firewall interface {
+	ListChains(table string) ([]string, error)
+	List(table, chain string) ([]string, error)
+	Stats(table, chain string) ([]iptables.Stat, error)
+	DiffRuleset(rs *iptables.Ruleset) ([]iptables.ChainDiff, error)
+	ApplyRuleset(rs *iptables.Ruleset) error
+	Append(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+}
+
+// ErrUnauthenticated may be returned by Authorize to answer with 401
+// Unauthorized rather than 403 Forbidden.
+var ErrUnauthenticated = errors.New("httpapi: unauthenticated")
+
+// maxBodySize bounds the request bodies, i.e. rulesets and rulespecs.
+const maxBodySize = 4 << 20
+
+// Handler serves a Firewall over HTTP.
+type Handler struct {
+	fw     Firewall
+	routes []route
+
+	// Authorize is called for every request, with write set for the write
+	// endpoints; an error denies the request. If nil, all requests are
+	// allowed, which is only safe behind an authenticating proxy.
+	Authorize func(r *http.Request, write bool) error
+	// AllowWrites enables the write endpoints, which answer 403 Forbidden
+	// otherwise.
+	AllowWrites bool
+}
+
+// New returns a Handler serving fw, typically an *iptables.IPTables.
+func New(fw Firewall) *Handler {
+	h := &Handler{fw: fw}
+	h.routes = []route{
+		{"GET", "/v1/tables/{table}/chains", false, h.listChains},
+		{"GET", "/v1/tables/{table}/chains/{chain}/rules", false, h.listRules},
+		{"GET", "/v1/tables/{table}/stats", false, h.stats},
+		{"POST", "/v1/diff", false, h.diff},
+		{"POST", "/v1/apply", true, h.apply},
+		{"POST", "/v1/tables/{table}/chains/{chain}/rules", true, h.appendRule},
+		{"DELETE", "/v1/tables/{table}/chains/{chain}/rules", true, h.deleteRule},
+	}
+	return h
+}
+
+// endpoint serves a request, returning the response value or an error.
+type endpoint func(r *http.Request, p params) (interface{}, error)
+
+// params are the table and chain named in the request path.
+type params struct {
+	table, chain string
+}
+
+// route maps requests to an endpoint. In its path, "{table}" and "{chain}"
+// match any path segment.
+type route struct {
+	method string
+	path   string
+	write  bool
+	e      endpoint
+}
+
+// match reports whether the route matches the path segments, and extracts
+// the table and chain.
+func (rt route) match(segments []string) (params, bool) {
+	var p params
+	pattern := strings.Split(strings.Trim(rt.path, "/"), "/")
+	if len(pattern) != len(segments) {
+		return p, false
+	}
+	for i, seg := range pattern {
+		switch seg {
+		case "{table}":
+			p.table = segments[i]
+		case "{chain}":
+			p.chain = segments[i]
+		default:
+			if seg != segments[i] {
+				return p, false
+			}
+		}
+	}
+	return p, true
+}
+
+// check rejects the table and chain of the route path that are empty or
+// would be taken for an option by iptables, e.g. a chain named "-Z".
+func (p params) check(path string) error {
+	if strings.Contains(path, "{table}") {
+		if err := checkName("table", p.table); err != nil {
+			return err
+		}
+	}
+	if strings.Contains(path, "{chain}") {
+		if err := checkName("chain", p.chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkName rejects a table or chain name that is empty or starts with "-".
+func checkName(kind, name string) error {
+	if name == "" || strings.HasPrefix(name, "-") {
+		return badRequest(fmt.Errorf("invalid %s name %q", kind, name))
+	}
+	return nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	found := false
+	for _, rt := range h.routes {
+		p, ok := rt.match(segments)
+		if !ok {
+			continue
+		}
+		found = true
+		if rt.method == r.Method {
+			h.serve(w, r, rt, p)
+			return
+		}
+	}
+	if found {
+		writeError(w, &httpError{http.StatusMethodNotAllowed, errors.New("method not allowed")})
+		return
+	}
+	writeError(w, &httpError{http.StatusNotFound, errors.New("not found")})
+}
+
+// httpError is an error answered with its status code.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(err error) error {
+	return &httpError{http.StatusBadRequest, err}
+}
+
+// serve checks that the request is allowed and serves it with the route.
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request, rt route, p params) {
+	if rt.write && !h.AllowWrites {
+		writeError(w, &httpError{http.StatusForbidden, errors.New("writes are disabled")})
+		return
+	}
+	if h.Authorize != nil {
+		if err := h.Authorize(r, rt.write); err != nil {
+			status := http.StatusForbidden
+			if errors.Is(err, ErrUnauthenticated) {
+				status = http.StatusUnauthorized
+			}
+			writeError(w, &httpError{status, err})
+			return
+		}
+	}
+	if err := p.check(rt.path); err != nil {
+		writeError(w, err)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	v, err := rt.e(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if v == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var herr *httpError
+	if errors.As(err, &herr) {
+		status = herr.status
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (h *Handler) listChains(r *http.Request, p params) (interface{}, error) {
+	chains, err := h.fw.ListChains(p.table)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]string{"chains": chains}, nil
+}
+
+func (h *Handler) listRules(r *http.Request, p params) (interface{}, error) {
+	rules, err := h.fw.List(p.table, p.chain)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]string{"rules": rules}, nil
+}
+
+func (h *Handler) stats(r *http.Request, p params) (interface{}, error) {
+	chain := r.URL.Query().Get("chain")
+	if chain != "" {
+		if err := checkName("chain", chain); err != nil {
+			return nil, err
+		}
+	}
+	stats, err := h.fw.Stats(p.table, chain)
+	if err != nil {
+		return nil, err
+	}
+	if stats == nil {
+		stats = []iptables.Stat{}
+	}
+	return map[string][]iptables.Stat{"stats": stats}, nil
+}
+
+func (h *Handler) diff(r *http.Request, p params) (interface{}, error) {
+	rs, err := iptables.LoadRulesetJSON(r.Body)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	diffs, err := h.fw.DiffRuleset(rs)
+	if err != nil {
+		return nil, err
+	}
+	if diffs == nil {
+		diffs = []iptables.ChainDiff{}
+	}
+	return map[string][]iptables.ChainDiff{"diffs": diffs}, nil
+}
+
+func (h *Handler) apply(r *http.Request, p params) (interface{}, error) {
+	rs, err := iptables.LoadRulesetJSON(r.Body)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	return nil, h.fw.ApplyRuleset(rs)
+}
+
+// ruleRequest is the body of the rule endpoints.
+type ruleRequest struct {
+	Rulespec []string `json:"rulespec"`
+}
+
+func decodeRule(r *http.Request) ([]string, error) {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	var req ruleRequest
+	if err := dec.Decode(&req); err != nil {
+		return nil, badRequest(err)
+	}
+	if len(req.Rulespec) == 0 {
+		return nil, badRequest(errors.New("empty rulespec"))
+	}
+	return req.Rulespec, nil
+}
+
+func (h *Handler) appendRule(r *http.Request, p params) (interface{}, error) {
+	spec, err := decodeRule(r)
+	if err != nil {
+		return nil, err
+	}
+	return nil, h.fw.Append(p.table, p.chain, spec...)
+}
+
+func (h *Handler) deleteRule(r *http.Request, p params) (interface{}, error) {
+	spec, err := decodeRule(r)
+	if err != nil {
+		return nil, err
+	}
+	return nil, h.fw.Delete(p.table, p.chain, spec...)
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// fakeFirewall records the calls of a Handler.
+type fakeFirewall struct {
+	calls []string
+}
+
+func (f *fakeFirewall) ListChains(table string) ([]string, error) {
+	f.calls = append(f.calls, "ListChains "+table)
+	if table == "bogus" {
+		return nil, errors.New("table does not exist")
+	}
+	return []string{"INPUT", "FORWARD", "OUTPUT"}, nil
+}
+
+func (f *fakeFirewall) List(table, chain string) ([]string, error) {
+	f.calls = append(f.calls, "List "+table+" "+chain)
+	return []string{"-P INPUT ACCEPT", "-A INPUT -j DROP"}, nil
+}
+
+func (f *fakeFirewall) Stats(table, chain string) ([]iptables.Stat, error) {
+	f.calls = append(f.calls, "Stats "+table+" "+chain)
+	return []iptables.Stat{{Table: table, Chain: "INPUT", Rule: "-j DROP", Packets: 3, Bytes: 180}}, nil
+}
+
+func (f *fakeFirewall) DiffRuleset(rs *iptables.Ruleset) ([]iptables.ChainDiff, error) {
+	f.calls = append(f.calls, "DiffRuleset "+rs.Tables[0].Name)
+	return nil, nil
+}
+
+func (f *fakeFirewall) ApplyRuleset(rs *iptables.Ruleset) error {
+	f.calls = append(f.calls, "ApplyRuleset "+rs.Tables[0].Name)
+	return nil
+}
+
+func (f *fakeFirewall) Append(table, chain string, rulespec ...string) error {
+	f.calls = append(f.calls, "Append "+table+" "+chain+" "+strings.Join(rulespec, " "))
+	return nil
+}
+
+func (f *fakeFirewall) Delete(table, chain string, rulespec ...string) error {
+	f.calls = append(f.calls, "Delete "+table+" "+chain+" "+strings.Join(rulespec, " "))
+	return nil
+}
+
+func do(h http.Handler, method, path, body string) (int, string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code, strings.TrimSpace(rec.Body.String())
+}
+
+func TestHandler(t *testing.T) {
+	fw := &fakeFirewall{}
+	h := New(fw)
+	const ruleset = `{"tables": [{"name": "filter", "chains": [{"name": "INPUT", "policy": "DROP"}]}]}`
+
+	for _, tt := range []struct {
+		method, path, body string
+		status             int
+		response           string
+	}{
+		{"GET", "/v1/tables/filter/chains", "", 200, `{"chains":["INPUT","FORWARD","OUTPUT"]}`},
+		{"GET", "/v1/tables/filter/chains/INPUT/rules", "", 200, `{"rules":["-P INPUT ACCEPT","-A INPUT -j DROP"]}`},
+		{"GET", "/v1/tables/filter/stats?chain=INPUT", "", 200, `{"stats":[{"Table":"filter","Chain":"INPUT","Rule":"-j DROP","Packets":3,"Bytes":180}]}`},
+		{"POST", "/v1/diff", ruleset, 200, `{"diffs":[]}`},
+		{"POST", "/v1/diff", `{"tables": [{}]}`, 400, `{"error":"table without a name"}`},
+		{"GET", "/v1/tables/bogus/chains", "", 500, `{"error":"table does not exist"}`},
+		{"POST", "/v1/apply", ruleset, 403, `{"error":"writes are disabled"}`},
+		{"GET", "/v1/tables/filter", "", 404, `{"error":"not found"}`},
+		{"PUT", "/v1/tables/filter/chains", "", 405, `{"error":"method not allowed"}`},
+		{"GET", "/v1/tables/filter/stats?chain=-Z", "", 400, `{"error":"invalid chain name \"-Z\""}`},
+		{"GET", "/v1/tables/filter/chains/-F/rules", "", 400, `{"error":"invalid chain name \"-F\""}`},
+		{"GET", "/v1/tables/-Z/chains", "", 400, `{"error":"invalid table name \"-Z\""}`},
+		{"GET", "/v1/tables//chains", "", 400, `{"error":"invalid table name \"\""}`},
+	} {
+		status, response := do(h, tt.method, tt.path, tt.body)
+		if status != tt.status || response != tt.response {
+			t.Errorf("%s %s: got %d %s, want %d %s", tt.method, tt.path, status, response, tt.status, tt.response)
+		}
+	}
+
+	h.AllowWrites = true
+	h.Authorize = func(r *http.Request, write bool) error {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			return ErrUnauthenticated
+		}
+		if write && r.URL.Path == "/v1/apply" {
+			return errors.New("not allowed to apply rulesets")
+		}
+		return nil
+	}
+	for _, tt := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"POST", "/v1/apply", ruleset, 403},
+		{"POST", "/v1/tables/filter/chains/INPUT/rules", `{"rulespec": ["-s", "192.0.2.1", "-j", "DROP"]}`, 204},
+		{"DELETE", "/v1/tables/filter/chains/INPUT/rules", `{"rulespec": ["-s", "192.0.2.1", "-j", "DROP"]}`, 204},
+		{"DELETE", "/v1/tables/filter/chains/INPUT/rules", `{"rulespec": []}`, 400},
+	} {
+		if status, response := do(h, tt.method, tt.path, tt.body); status != tt.status {
+			t.Errorf("%s %s: got %d %s, want %d", tt.method, tt.path, status, response, tt.status)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/v1/tables/filter/chains", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request answered with %d", rec.Code)
+	}
+
+	expected := []string{
+		"ListChains filter",
+		"List filter INPUT",
+		"Stats filter INPUT",
+		"DiffRuleset filter",
+		"ListChains bogus",
+		"Append filter INPUT -s 192.0.2.1 -j DROP",
+		"Delete filter INPUT -s 192.0.2.1 -j DROP",
+	}
+	if !reflect.DeepEqual(fw.calls, expected) {
+		t.Errorf("calls mismatch: \ngot  %q \nneed %q", fw.calls, expected)
+	}
+}
+
+// IPTables implements Firewall.
+var _ Firewall = (*iptables.IPTables)(nil)
@@ -0,0 +1,204 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// InterfaceRule is a rule installed for every network interface whose name
+// matches Pattern, e.g. "tun*" for VPN devices. The arguments of Rulespec
+// are templates, with the interface name available as {{ .Iface }}.
+type InterfaceRule struct {
+	Table    string
+	Chain    string
+	Pattern  string
+	Rulespec []string
+}
+
+// InterfaceWatcher installs InterfaceRules for interfaces as they appear and
+// removes them when the interfaces go away.
+type InterfaceWatcher struct {
+	ipt   *IPTables
+	rules []InterfaceRule
+
+	// interfaces lists the current interface names; replaced in tests
+	interfaces func() ([]string, error)
+
+	mu        sync.Mutex
+	installed map[string]installedRule
+}
+
+// installedRule is a rule added by the watcher for one interface.
+type installedRule struct {
+	table, chain string
+	rulespec     []string
+}
+
+// NewInterfaceWatcher returns a watcher maintaining the given rules. It does
+// nothing until Sync or Run is called.
+func NewInterfaceWatcher(ipt *IPTables, rules ...InterfaceRule) (*InterfaceWatcher, error) {
+	for _, r := range rules {
+		if _, err := filepath.Match(r.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid interface pattern %q: %v", r.Pattern, err)
+		}
+		if _, err := expandInterfaceRule(r, "x"); err != nil {
+			return nil, err
+		}
+	}
+	return &InterfaceWatcher{
+		ipt:        ipt,
+		rules:      rules,
+		interfaces: interfaceNames,
+		installed:  make(map[string]installedRule),
+	}, nil
+}
+
+// Sync installs the rules of every present matching interface that are
+// missing and deletes those of interfaces that are gone.
+func (w *InterfaceWatcher) Sync() error {
+	names, err := w.interfaces()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	want := make(map[string]installedRule)
+	for i, r := range w.rules {
+		for _, name := range names {
+			if ok, _ := filepath.Match(r.Pattern, name); !ok {
+				continue
+			}
+			spec, err := expandInterfaceRule(r, name)
+			if err != nil {
+				return err
+			}
+			want[fmt.Sprintf("%d/%s", i, name)] = installedRule{r.Table, r.Chain, spec}
+		}
+	}
+
+	var errs []string
+	for _, key := range sortedKeys(w.installed) {
+		if _, ok := want[key]; ok {
+			continue
+		}
+		rule := w.installed[key]
+		if err := w.ipt.DeleteIfExists(rule.table, rule.chain, rule.rulespec...); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		delete(w.installed, key)
+	}
+	for _, key := range sortedKeys(want) {
+		rule := want[key]
+		if err := w.ipt.AppendUnique(rule.table, rule.chain, rule.rulespec...); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		w.installed[key] = rule
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("syncing interface rules: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Run syncs the rules, then again whenever a link is added or removed,
+// until the context is done. Errors of Sync are passed to onError if it is
+// not nil. On Linux, link events are received over rtnetlink.
+func (w *InterfaceWatcher) Run(ctx context.Context, onError func(error)) error {
+	resync := func() {
+		if err := w.Sync(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	resync()
+	return watchLinks(ctx, resync)
+}
+
+// Close deletes all rules installed by the watcher.
+func (w *InterfaceWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range sortedKeys(w.installed) {
+		rule := w.installed[key]
+		if err := w.ipt.DeleteIfExists(rule.table, rule.chain, rule.rulespec...); err != nil {
+			return err
+		}
+		delete(w.installed, key)
+	}
+	return nil
+}
+
+// DeleteIfExists deletes rulespec from the table/chain if it is present.
+func (ipt *IPTables) DeleteIfExists(table, chain string, rulespec ...string) error {
+	exists, err := ipt.Exists(table, chain, rulespec...)
+	if err != nil || !exists {
+		return err
+	}
+	return ipt.Delete(table, chain, rulespec...)
+}
+
+func expandInterfaceRule(r InterfaceRule, iface string) ([]string, error) {
+	data := struct{ Iface string }{iface}
+	spec := make([]string, len(r.Rulespec))
+	for i, arg := range r.Rulespec {
+		if !strings.Contains(arg, "{{") {
+			spec[i] = arg
+			continue
+		}
+		tmpl, err := template.New("rulespec").Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		spec[i] = buf.String()
+	}
+	return spec, nil
+}
+
+func interfaceNames() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(ifaces))
+	for i, iface := range ifaces {
+		names[i] = iface.Name
+	}
+	return names, nil
+}
+
+func sortedKeys(m map[string]installedRule) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
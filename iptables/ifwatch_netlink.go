@@ -0,0 +1,88 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"context"
+	"syscall"
+)
+
+// rtnetlink multicast groups
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+// watchLinks calls notify for every batch of rtnetlink link messages until
+// the context is done.
+func watchLinks(ctx context.Context, notify func()) error {
+	return watchNetlink(ctx, rtmgrpLink, notify)
+}
+
+// watchAddrs calls notify for every batch of rtnetlink address messages of
+// the protocol's family until the context is done.
+func watchAddrs(ctx context.Context, proto Protocol, notify func()) error {
+	if proto == ProtocolIPv6 {
+		return watchNetlink(ctx, rtmgrpIPv6IfAddr, notify)
+	}
+	return watchNetlink(ctx, rtmgrpIPv4IfAddr, notify)
+}
+
+// watchNetlink subscribes to the rtnetlink multicast groups and calls notify
+// for every batch of messages received, until the context is done.
+func watchNetlink(ctx context.Context, groups uint32, notify func()) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		return err
+	}
+	// wake up regularly to notice the context being done
+	tv := syscall.Timeval{Sec: 1}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1<<16)
+	for ctx.Err() == nil {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		switch err {
+		case nil:
+		case syscall.EAGAIN, syscall.EINTR:
+			continue
+		case syscall.ENOBUFS:
+			// events were dropped, so resync unconditionally
+			notify()
+			continue
+		default:
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		if len(msgs) > 0 {
+			notify()
+		}
+	}
+	return nil
+}
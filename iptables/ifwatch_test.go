@@ -0,0 +1,81 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+// statefulFakeScript makes a fake iptables keep the rules added with -A in
+// a file, so -C and -D behave like the real thing.
+const statefulFakeScript = `
+state="$(dirname "$0")/state"
+touch "$state"
+rule=$(echo "$*" | sed 's/^--wait //; s/^-t \([^ ]*\) -[ACD] /\1 /')
+case "$4" in
+-A) echo "$rule" >> "$state";;
+-C) grep -qxF -- "$rule" "$state" || exit 1;;
+-D) grep -qxF -- "$rule" "$state" || exit 1; grep -vxF -- "$rule" "$state" > "$state.new"; mv "$state.new" "$state";;
+esac`
+
+func TestInterfaceWatcher(t *testing.T) {
+	ipt, log := newFakeIPTables(t, statefulFakeScript)
+	w, err := NewInterfaceWatcher(ipt, InterfaceRule{
+		Table:    "filter",
+		Chain:    "FORWARD",
+		Pattern:  "tun*",
+		Rulespec: []string{"-i", "{{ .Iface }}", "-j", "ACCEPT"},
+	})
+	if err != nil {
+		t.Fatalf("NewInterfaceWatcher failed: %v", err)
+	}
+
+	present := []string{"lo", "eth0", "tun0", "tun1"}
+	w.interfaces = func() ([]string, error) { return present, nil }
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	// syncing again changes nothing
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	present = []string{"lo", "eth0", "tun1"}
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	expected := []string{
+		"--wait -t filter -C FORWARD -i tun0 -j ACCEPT",
+		"--wait -t filter -A FORWARD -i tun0 -j ACCEPT",
+		"--wait -t filter -C FORWARD -i tun1 -j ACCEPT",
+		"--wait -t filter -A FORWARD -i tun1 -j ACCEPT",
+		"--wait -t filter -C FORWARD -i tun0 -j ACCEPT",
+		"--wait -t filter -C FORWARD -i tun1 -j ACCEPT",
+		"--wait -t filter -C FORWARD -i tun0 -j ACCEPT",
+		"--wait -t filter -D FORWARD -i tun0 -j ACCEPT",
+		"--wait -t filter -C FORWARD -i tun1 -j ACCEPT",
+	}
+	if calls := fakeCalls(t, log); !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("calls mismatch: \ngot  %#v \nneed %#v", calls, expected)
+	}
+
+	if _, err := NewInterfaceWatcher(ipt, InterfaceRule{Pattern: "[", Rulespec: []string{"-j", "ACCEPT"}}); err == nil {
+		t.Fatalf("NewInterfaceWatcher with an invalid pattern did not fail")
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"time"
+)
+
+// Instrumentation receives an event before and after every command an
+// IPTables runs, e.g. to export latency and failure metrics.
+// The methods may be called concurrently and should return quickly.
+type Instrumentation interface {
+	// OnCommandStart is called before the command runs. args starts with the binary.
+	OnCommandStart(args []string)
+	// OnCommandEnd is called once the command finished, with the same args.
+	OnCommandEnd(args []string, stats CommandStats)
+}
+
+// CommandStats describes a finished command.
+type CommandStats struct {
+	// Duration is the total time taken, including LockWait.
+	Duration time.Duration
+	// LockWait is the time spent taking the xtables lock. It is zero when the
+	// binary waits for the lock itself (--wait), as that happens inside the command.
+	LockWait time.Duration
+	// Err is the error returned to the caller, if any.
+	Err error
+}
+
+// WithInstrumentation reports every command run by the IPTables to i.
+func WithInstrumentation(i Instrumentation) Option {
+	return func(ipt *IPTables) {
+		ipt.instrumentation = i
+	}
+}
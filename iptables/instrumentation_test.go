@@ -0,0 +1,87 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type recordingInstrumentation struct {
+	started []string
+	ended   []CommandStats
+}
+
+func (r *recordingInstrumentation) OnCommandStart(args []string) {
+	r.started = append(r.started, args...)
+}
+
+func (r *recordingInstrumentation) OnCommandEnd(args []string, stats CommandStats) {
+	r.ended = append(r.ended, stats)
+}
+
+func TestInstrumentation(t *testing.T) {
+	path, err := exec.LookPath("false")
+	if err != nil {
+		t.Skipf("false not found: %v", err)
+	}
+	rec := &recordingInstrumentation{}
+	// "false" stands in for iptables and fails every command
+	ipt := &IPTables{path: path, hasWait: true}
+	WithInstrumentation(rec)(ipt)
+
+	err = ipt.Append("filter", "INPUT", "-j", "ACCEPT")
+	if err == nil {
+		t.Fatalf("Append with false did not fail")
+	}
+
+	expected := []string{path, "--wait", "-t", "filter", "-A", "INPUT", "-j", "ACCEPT"}
+	if !reflect.DeepEqual(rec.started, expected) {
+		t.Fatalf("OnCommandStart mismatch: \ngot  %#v \nneed %#v", rec.started, expected)
+	}
+	if len(rec.ended) != 1 || rec.ended[0].Err != err || rec.ended[0].Duration <= 0 {
+		t.Fatalf("OnCommandEnd mismatch: %+v", rec.ended)
+	}
+}
+
+func TestInstrumentationSave(t *testing.T) {
+	ipt, _ := newFakeIPTables(t, "")
+	dir := filepath.Dir(ipt.path)
+	script := "#!/bin/sh\nprintf -- '*filter\\n:INPUT ACCEPT [0:0]\\nCOMMIT\\n'\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables-save"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	rec := &recordingInstrumentation{}
+	WithInstrumentation(rec)(ipt)
+
+	if _, err := ipt.SaveChain("filter", "INPUT"); err != nil {
+		t.Fatalf("SaveChain failed: %v", err)
+	}
+	expected := []string{"iptables-save", "-t", "filter"}
+	if !reflect.DeepEqual(rec.started, expected) {
+		t.Fatalf("OnCommandStart mismatch: \ngot  %#v \nneed %#v", rec.started, expected)
+	}
+	if len(rec.ended) != 1 || rec.ended[0].Err != nil {
+		t.Fatalf("OnCommandEnd mismatch: %+v", rec.ended)
+	}
+}
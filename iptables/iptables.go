@@ -16,15 +16,30 @@ package iptables
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// ErrNotSupported is returned by New and NewWithProtocol on platforms other than Linux.
+var ErrNotSupported = errors.New("iptables: only supported on Linux")
+
+// ErrPermission matches, via errors.Is, an *Error caused by missing privileges.
+var ErrPermission = errors.New("iptables: permission denied, CAP_NET_ADMIN is required (run as root or grant the capability)")
+
+// ErrListRulesUnsupported is returned for a "-S" listing that cannot be
+// emulated with "-L" on embedded and very old builds of iptables, which
+// lack -S.
+var ErrListRulesUnsupported = errors.New("iptables: listing rules (-S) is not supported by this iptables")
+
 // Adds the output of stderr to exec.ExitError
 type Error struct {
 	exec.ExitError
@@ -36,9 +51,26 @@ func (e *Error) ExitStatus() int {
 }
 
 func (e *Error) Error() string {
+	if e.IsPermission() {
+		return fmt.Sprintf("exit status %v: %v (%v)", e.ExitStatus(), strings.TrimSpace(e.msg), ErrPermission)
+	}
 	return fmt.Sprintf("exit status %v: %v", e.ExitStatus(), e.msg)
 }
 
+// IsPermission returns true if the command failed because the process lacks
+// the privileges to access the firewall, i.e. CAP_NET_ADMIN.
+func (e *Error) IsPermission() bool {
+	// legacy iptables exits with status 3, the nft backend with status 4,
+	// both with EPERM spelled out on stderr
+	return strings.Contains(e.msg, "Permission denied") ||
+		strings.Contains(e.msg, "Operation not permitted")
+}
+
+// Is makes errors.Is(err, ErrPermission) report permission failures.
+func (e *Error) Is(target error) bool {
+	return target == ErrPermission && e.IsPermission()
+}
+
 // Protocol to differentiate between IPv4 and IPv6
 type Protocol byte
 
@@ -48,36 +80,130 @@ const (
 )
 
 type IPTables struct {
-	path     string
-	proto    Protocol
-	hasCheck bool
-	hasWait  bool
-}
-
-// New creates a new IPTables.
+	path           string
+	proto          Protocol
+	hasCheck       bool
+	hasWait        bool
+	hasRestoreWait bool
+	// noListRules is set for binaries without -S, e.g. embedded builds
+	noListRules     bool
+	readOnly        bool
+	errorPolicy     ErrorPolicy
+	guards          []GuardRule
+	maxLineSize     int
+	resolveNames    bool
+	waitTimeout     time.Duration
+	waitInterval    time.Duration
+	strictFamily    bool
+	owner           string
+	audit           *auditLog
+	throttle        *throttle
+	parallelism     int
+	instrumentation Instrumentation
+	// reconcile maps chain names, or "" for the default, to the strategy
+	// of ReconcileChain
+	reconcile map[string]ReconcileStrategy
+	v1        int
+	v2        int
+	v3        int
+	// mode is the backend, either "legacy" or "nf_tables"
+	mode string
+	// lazy is set for handles created with NewWithProtocolLazy
+	lazy *lazyInit
+}
+
+// New creates a new IPTables configured with the given options.
 // For backwards compatibility, this always uses IPv4, i.e. "iptables".
-func New() (*IPTables, error) {
-	return NewWithProtocol(ProtocolIPv4)
+func New(opts ...Option) (*IPTables, error) {
+	return NewWithProtocol(ProtocolIPv4, opts...)
 }
 
-// New creates a new IPTables for the given proto.
+// New creates a new IPTables for the given proto, configured with the given options.
 // The proto will determine which command is used, either "iptables" or "ip6tables".
-func NewWithProtocol(proto Protocol) (*IPTables, error) {
+func NewWithProtocol(proto Protocol, opts ...Option) (*IPTables, error) {
+	if runtime.GOOS != "linux" {
+		return nil, ErrNotSupported
+	}
+	ipt := &IPTables{proto: proto}
+	if err := ipt.detect(opts); err != nil {
+		return nil, err
+	}
+	return ipt, nil
+}
+
+// NewWithProtocolLazy creates a new IPTables for the given proto like
+// NewWithProtocol, but defers looking up the binary and detecting its
+// capabilities until the handle is first used. If that fails, e.g. because
+// ip6tables is not installed, the method fails with the error and the next
+// use tries again. Dual-stack programs can check Available first, or degrade
+// when a command fails.
+func NewWithProtocolLazy(proto Protocol, opts ...Option) *IPTables {
+	return &IPTables{proto: proto, lazy: &lazyInit{opts: opts}}
+}
+
+// Available reports whether the iptables binary for proto is installed and runs.
+func Available(proto Protocol) bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
 	path, err := exec.LookPath(getIptablesCommand(proto))
 	if err != nil {
-		return nil, err
+		return false
 	}
-	checkPresent, waitPresent, err := getIptablesCommandSupport(path)
+	_, _, _, _, err = cachedIptablesVersion(path)
+	return err == nil
+}
+
+// lazyInit holds the pending detection of a handle created with
+// NewWithProtocolLazy.
+type lazyInit struct {
+	mu   sync.Mutex
+	done bool
+	opts []Option
+}
+
+// ready completes the detection of a lazily created handle. It must be
+// called before using any detected field.
+func (ipt *IPTables) ready() error {
+	if ipt.lazy == nil {
+		return nil
+	}
+	ipt.lazy.mu.Lock()
+	defer ipt.lazy.mu.Unlock()
+	if ipt.lazy.done {
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		return ErrNotSupported
+	}
+	if err := ipt.detect(ipt.lazy.opts); err != nil {
+		return err
+	}
+	ipt.lazy.done = true
+	return nil
+}
+
+// detect looks up the binary, detects its capabilities and applies opts.
+func (ipt *IPTables) detect(opts []Option) error {
+	path, err := exec.LookPath(getIptablesCommand(ipt.proto))
+	if err != nil {
+		return err
+	}
+	v1, v2, v3, mode, err := cachedIptablesVersion(path)
 	if err != nil {
-		return nil, fmt.Errorf("error checking iptables version: %v", err)
+		return fmt.Errorf("error checking iptables version: %v", err)
 	}
-	ipt := IPTables{
-		path:     path,
-		proto:    proto,
-		hasCheck: checkPresent,
-		hasWait:  waitPresent,
+	ipt.path = path
+	ipt.hasCheck = iptablesHasCheckCommand(v1, v2, v3)
+	ipt.hasWait = iptablesHasWaitCommand(v1, v2, v3)
+	ipt.hasRestoreWait = iptablesRestoreHasWaitCommand(v1, v2, v3)
+	ipt.noListRules = !iptablesHasListRulesCommand(v1, v2, v3)
+	ipt.v1, ipt.v2, ipt.v3 = v1, v2, v3
+	ipt.mode = mode
+	for _, opt := range opts {
+		opt(ipt)
 	}
-	return &ipt, nil
+	return nil
 }
 
 // Proto returns the protocol used by this IPTables.
@@ -87,21 +213,35 @@ func (ipt *IPTables) Proto() Protocol {
 
 // Wait returns if wait Present
 func (ipt *IPTables) Wait() bool {
+	ipt.ready()
 	return ipt.hasWait
 }
+
 // Exists checks if given rulespec in specified table/chain exists
 func (ipt *IPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	if err := ipt.ready(); err != nil {
+		return false, err
+	}
+	rulespec, err := ipt.owned(rulespec)
+	if err != nil {
+		return false, err
+	}
 	if !ipt.hasCheck {
-		return ipt.existsForOldIptables(table, chain, rulespec)
+		return ipt.existsByListing(table, chain, rulespec)
 
 	}
 	cmd := append([]string{"-t", table, "-C", chain}, rulespec...)
-	err := ipt.run(cmd...)
+	err = ipt.run(cmd...)
 	eerr, eok := err.(*Error)
 	switch {
 	case err == nil:
 		return true, nil
 	case eok && eerr.ExitStatus() == 1:
+		if ipt.mode == "nf_tables" {
+			// iptables-nft's -C misses some rules whose translation lists
+			// differently than given, so compare normalized listings instead
+			return ipt.existsByListing(table, chain, rulespec)
+		}
 		return false, nil
 	default:
 		return false, err
@@ -110,12 +250,20 @@ func (ipt *IPTables) Exists(table, chain string, rulespec ...string) (bool, erro
 
 // Insert inserts rulespec to specified table/chain (in specified pos)
 func (ipt *IPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	rulespec, err := ipt.owned(rulespec)
+	if err != nil {
+		return err
+	}
 	cmd := append([]string{"-t", table, "-I", chain, strconv.Itoa(pos)}, rulespec...)
 	return ipt.run(cmd...)
 }
 
 // Append appends rulespec to specified table/chain
 func (ipt *IPTables) Append(table, chain string, rulespec ...string) error {
+	rulespec, err := ipt.owned(rulespec)
+	if err != nil {
+		return err
+	}
 	cmd := append([]string{"-t", table, "-A", chain}, rulespec...)
 	return ipt.run(cmd...)
 }
@@ -136,6 +284,10 @@ func (ipt *IPTables) AppendUnique(table, chain string, rulespec ...string) error
 
 // Delete removes rulespec in specified table/chain
 func (ipt *IPTables) Delete(table, chain string, rulespec ...string) error {
+	rulespec, err := ipt.owned(rulespec)
+	if err != nil {
+		return err
+	}
 	cmd := append([]string{"-t", table, "-D", chain}, rulespec...)
 	return ipt.run(cmd...)
 }
@@ -143,12 +295,43 @@ func (ipt *IPTables) Delete(table, chain string, rulespec ...string) error {
 // List rules in specified table/chain
 func (ipt *IPTables) List(table, chain string) ([]string, error) {
 	args := []string{"-t", table, "-S", chain}
-	return ipt.ExecuteList(args)
+	return ipt.executeOwnedList(args)
 }
+
+// ListParsed lists the rules in specified table/chain, each tokenized into
+// its matches and target.
+func (ipt *IPTables) ListParsed(table, chain string) ([]ParsedRule, error) {
+	rules, err := ipt.List(table, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed []ParsedRule
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule, "-A ") {
+			// chain declaration or policy
+			continue
+		}
+		r, err := ParseRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, *r)
+	}
+	return parsed, nil
+}
+
+// ListWithCounters lists rules in specified table/chain, including the packet
+// and byte counters of each rule ("-c <pkts> <bytes>")
+func (ipt *IPTables) ListWithCounters(table, chain string) ([]string, error) {
+	args := []string{"-t", table, "-v", "-S", chain}
+	return ipt.executeOwnedList(args)
+}
+
 // ListWithWait rules in specified table/chain
 func (ipt *IPTables) ListWithWait(table, chain string) ([]string, error) {
 	args := []string{"-t", table, "-S", chain, "--wait"}
-	return ipt.ExecuteList(args)
+	return ipt.executeOwnedList(args)
 }
 
 // ListChains returns a slice containing the name of each chain in the specified table.
@@ -160,45 +343,109 @@ func (ipt *IPTables) ListChains(table string) ([]string, error) {
 		return nil, err
 	}
 
-	// Iterate over rules to find all default (-P) and user-specified (-N) chains.
-	// Chains definition always come before rules.
+	return parseChainNames(result), nil
+}
+
+// parseChainNames returns the chains declared in "iptables -S" output.
+func parseChainNames(lines []string) []string {
+	// Collect all default (-P) and user-specified (-N) chains.
+	// Legacy iptables lists chain definitions before rules, but the nft
+	// backend may interleave them, so the whole listing is scanned.
 	// Format is the following:
 	// -P OUTPUT ACCEPT
 	// -N Custom
 	var chains []string
-	for _, val := range result {
-		if strings.HasPrefix(val, "-P") || strings.HasPrefix(val, "-N") {
-			chains = append(chains, strings.Fields(val)[1])
-		} else {
-			break
+	seen := make(map[string]bool)
+	for _, val := range lines {
+		if strings.HasPrefix(val, "-P ") || strings.HasPrefix(val, "-N ") {
+			fields := strings.Fields(val)
+			if len(fields) > 1 && !seen[fields[1]] {
+				seen[fields[1]] = true
+				chains = append(chains, fields[1])
+			}
 		}
 	}
-	return chains, nil
+	return chains
 }
 
 func (ipt *IPTables) ExecuteList(args []string) ([]string, error) {
-	var stdout bytes.Buffer
-	if err := ipt.runWithOutput(args, &stdout); err != nil {
+	rules := []string{}
+	err := ipt.ExecuteListFunc(args, func(line string) error {
+		rules = append(rules, line)
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
+	return rules, nil
+}
 
-	rules := strings.Split(stdout.String(), "\n")
-	if len(rules) > 0 && rules[len(rules)-1] == "" {
-		rules = rules[:len(rules)-1]
+// ChainExists checks whether the chain exists in the specified table.
+// It lists at most the first rule ("-S <chain> 1"), so its cost does not
+// depend on the size of the chain.
+func (ipt *IPTables) ChainExists(table, chain string) (bool, error) {
+	_, exists, err := ipt.firstRule(table, chain)
+	return exists, err
+}
+
+// ChainEmpty checks whether the chain in the specified table has no rules.
+// It fails if the chain does not exist.
+func (ipt *IPTables) ChainEmpty(table, chain string) (bool, error) {
+	rule, exists, err := ipt.firstRule(table, chain)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, fmt.Errorf("chain %s does not exist in table %s", chain, table)
+	}
+	return rule == "", nil
+}
+
+// firstRule returns the first rule of the chain, or "" if it has none, and
+// whether the chain exists.
+func (ipt *IPTables) firstRule(table, chain string) (string, bool, error) {
+	// The legacy backend lists nothing for a missing rule 1 of an existing
+	// chain, while the nft backend fails just like for a missing chain.
+	rules, err := ipt.ExecuteList([]string{"-t", table, "-S", chain, "1"})
+	if err == nil {
+		if len(rules) > 0 {
+			return rules[0], true, nil
+		}
+		return "", true, nil
+	}
+	if eerr, eok := err.(*Error); !eok || eerr.ExitStatus() != 1 {
+		return "", false, err
 	}
 
-	return rules, nil
+	// either the chain or its first rule is missing; listing the whole chain
+	// tells them apart and is cheap, as it has no rules if it exists
+	_, err = ipt.List(table, chain)
+	eerr, eok := err.(*Error)
+	switch {
+	case err == nil:
+		return "", true, nil
+	case eok && eerr.ExitStatus() == 1:
+		return "", false, nil
+	default:
+		return "", false, err
+	}
 }
 
 // NewChain creates a new chain in the specified table.
 // If the chain already exists, it will result in an error.
 func (ipt *IPTables) NewChain(table, chain string) error {
+	if err := checkNewChain(table, chain); err != nil {
+		return err
+	}
 	return ipt.run("-t", table, "-N", chain)
 }
 
 // NewChainWithWait creates a new chain in the specified table.
 // If the chain already exists, it will result in an error.
 func (ipt *IPTables) NewChainWithWait(table, chain string) error {
+	if err := checkNewChain(table, chain); err != nil {
+		return err
+	}
 	return ipt.run("-t", table, "-N", chain, "--wait")
 }
 
@@ -211,13 +458,14 @@ func (ipt *IPTables) ClearChain(table, chain string) error {
 	switch {
 	case err == nil:
 		return nil
-	case eok && eerr.ExitStatus() == 1:
+	case eok && eerr.ExitStatus() == 1, errors.Is(err, ErrBuiltinChain):
 		// chain already exists. Flush (clear) it.
 		return ipt.run("-t", table, "-F", chain)
 	default:
 		return err
 	}
 }
+
 // ClearChainWithWait flushed (deletes all rules) in the specified table/chain.
 // If the chain does not exist, a new one will be created
 func (ipt *IPTables) ClearChainWithWait(table, chain string) error {
@@ -227,7 +475,7 @@ func (ipt *IPTables) ClearChainWithWait(table, chain string) error {
 	switch {
 	case err == nil:
 		return nil
-	case eok && eerr.ExitStatus() == 1:
+	case eok && eerr.ExitStatus() == 1, errors.Is(err, ErrBuiltinChain):
 		// chain already exists. Flush (clear) it.
 		return ipt.run("-t", table, "-F", chain, "--wait")
 	default:
@@ -239,6 +487,7 @@ func (ipt *IPTables) ClearChainWithWait(table, chain string) error {
 func (ipt *IPTables) RenameChain(table, oldChain, newChain string) error {
 	return ipt.run("-t", table, "-E", oldChain, newChain)
 }
+
 // RenameChainWithWait renames the old chain to the new one.
 func (ipt *IPTables) RenameChainWithWait(table, oldChain, newChain string) error {
 	return ipt.run("-t", table, "-E", oldChain, newChain, "--wait")
@@ -249,12 +498,32 @@ func (ipt *IPTables) RenameChainWithWait(table, oldChain, newChain string) error
 func (ipt *IPTables) DeleteChain(table, chain string) error {
 	return ipt.run("-t", table, "-X", chain)
 }
+
 // DeleteChainWithWait deletes the chain in the specified table.
 // The chain must be empty
 func (ipt *IPTables) DeleteChainWithWait(table, chain string) error {
 	return ipt.run("-t", table, "-X", chain, "--wait")
 }
 
+// Run runs iptables with the given arguments, for features the library does
+// not wrap. It takes the xtables lock like every other method, appending
+// "--wait" when supported, honors ReadOnly and Guard, and returns a non-zero
+// exit status as *Error. The arguments are passed as they are: rules added
+// with an Owner are not tagged, so they are not listed nor cleaned up as
+// the owner's.
+func (ipt *IPTables) Run(args ...string) error {
+	return ipt.run(args...)
+}
+
+// RunWithOutput acts like Run, and returns the standard output of iptables.
+func (ipt *IPTables) RunWithOutput(args []string) (string, error) {
+	var stdout bytes.Buffer
+	if err := ipt.runWithOutput(args, &stdout); err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
 // run runs an iptables command with the given arguments, ignoring
 // any stdout output
 func (ipt *IPTables) run(args ...string) error {
@@ -262,33 +531,110 @@ func (ipt *IPTables) run(args ...string) error {
 }
 
 // runWithOutput runs an iptables command with the given arguments,
-// writing any stdout output to the given writer
-func (ipt *IPTables) runWithOutput(args []string, stdout io.Writer) error {
-	args = append([]string{ipt.path}, args...)
-	if ipt.hasWait {
-		args = append(args, "--wait")
-	} else {
-		fmu, err := newXtablesFileLock()
-		if err != nil {
+// writing any stdout output to the given writer. Commands too long for the
+// command line are run through iptables-restore when possible.
+func (ipt *IPTables) runWithOutput(args []string, stdout io.Writer) (err error) {
+	if err := ipt.ready(); err != nil {
+		return err
+	}
+	if ipt.proto == ProtocolIPv6 {
+		if args, err = translateICMPv6(args); err != nil {
 			return err
 		}
-		ul, err := fmu.tryLock()
-		if err != nil {
+	}
+	if ipt.readOnly && isMutating(args) {
+		return ErrReadOnly
+	}
+	if ipt.audit != nil && isMutating(args) {
+		rec := ipt.auditCommand(args)
+		defer func() { ipt.audit.write(rec, err) }()
+	}
+	if isMutating(args) {
+		if err := checkComments(args); err != nil {
+			return err
+		}
+	}
+	if ipt.strictFamily {
+		if err := checkFamily(ipt.proto, args); err != nil {
 			return err
 		}
-		defer ul.Unlock()
 	}
+	if len(ipt.guards) > 0 && isMutating(args) {
+		if err := ipt.checkGuards(args); err != nil {
+			return err
+		}
+	}
+	if argvTooLong(args) {
+		// too long for the command line: feed it to iptables-restore on stdin
+		if data, ok := restoreCommandData(args); ok {
+			return ipt.runRestore(data, "--noflush")
+		}
+	}
+	args = append([]string{ipt.path}, args...)
+	return ipt.runLocked(ipt.path, args, ipt.waitArgs(), nil, stdout)
+}
+
+// runLocked runs the binary at path with the given arguments (including
+// argv[0]) under the xtables lock: if wait holds the flags making the binary
+// take the lock itself, they are placed right after argv[0], ahead of any
+// rule contents; otherwise the lock is taken here.
+// The command is reported to the configured Instrumentation, if any.
+func (ipt *IPTables) runLocked(path string, args []string, wait []string, stdin io.Reader, stdout io.Writer) error {
+	if wait != nil {
+		args = append(append(append([]string{}, args[0]), wait...), args[1:]...)
+	}
+	if ipt.throttle != nil {
+		ipt.throttle.wait()
+	}
+	if ipt.instrumentation != nil {
+		ipt.instrumentation.OnCommandStart(args)
+	}
+
+	var stats CommandStats
+	start := time.Now()
+	err := func() error {
+		if wait == nil {
+			fmu, err := newXtablesFileLock()
+			if err != nil {
+				return err
+			}
+			ul, err := fmu.tryLock()
+			if err != nil {
+				return err
+			}
+			defer ul.Unlock()
+			stats.LockWait = time.Since(start)
+		}
+		return runCommand(path, args, stdin, stdout)
+	}()
+
+	if ipt.instrumentation != nil {
+		stats.Duration = time.Since(start)
+		stats.Err = err
+		ipt.instrumentation.OnCommandEnd(args, stats)
+	}
+	return err
+}
 
+// runCommand runs the binary at path with the given arguments (including
+// argv[0]), reading stdin from and writing stdout to the given reader and
+// writer, which may be nil. A non-zero exit status is returned as *Error.
+func runCommand(path string, args []string, stdin io.Reader, stdout io.Writer) error {
 	var stderr bytes.Buffer
 	cmd := exec.Cmd{
-		Path:   ipt.path,
+		Path:   path,
 		Args:   args,
+		Stdin:  stdin,
 		Stdout: stdout,
 		Stderr: &stderr,
 	}
 
 	if err := cmd.Run(); err != nil {
-		return &Error{*(err.(*exec.ExitError)), stderr.String()}
+		eerr, ok := err.(*exec.ExitError)
+		if !ok {
+			return err
+		}
+		return &Error{*eerr, stderr.String()}
 	}
 
 	return nil
@@ -303,19 +649,44 @@ func getIptablesCommand(proto Protocol) string {
 	}
 }
 
-// Checks if iptables has the "-C" and "--wait" flag
-func getIptablesCommandSupport(path string) (bool, bool, error) {
+// getIptablesVersion runs the binary at path to find its version and backend.
+// Embedded variants, e.g. busybox or stripped-down OpenWrt builds, that do not
+// report a version are given version 0.0.0 of the legacy backend, so every
+// optional feature (-C, -S, --wait) is considered missing.
+func getIptablesVersion(path string) (int, int, int, string, error) {
 	vstring, err := getIptablesVersionString(path)
+	if _, ok := err.(*exec.ExitError); ok && isEmbeddedIptables(vstring) {
+		return 0, 0, 0, "legacy", nil
+	}
 	if err != nil {
-		return false, false, err
+		return 0, 0, 0, "", err
 	}
-
 	v1, v2, v3, err := extractIptablesVersion(vstring)
 	if err != nil {
-		return false, false, err
+		if isEmbeddedIptables(vstring) {
+			return 0, 0, 0, "legacy", nil
+		}
+		return 0, 0, 0, "", err
 	}
+	return v1, v2, v3, extractIptablesMode(vstring), nil
+}
 
-	return iptablesHasCheckCommand(v1, v2, v3), iptablesHasWaitCommand(v1, v2, v3), nil
+// isEmbeddedIptables reports whether the output of "iptables --version",
+// which either failed or reported no version, comes from an embedded
+// variant of iptables rather than an unrelated binary.
+func isEmbeddedIptables(out string) bool {
+	out = strings.ToLower(out)
+	return strings.Contains(out, "iptables") || strings.Contains(out, "busybox")
+}
+
+// extractIptablesMode returns the backend named in the version string,
+// e.g. "iptables v1.8.7 (nf_tables)" would return "nf_tables". Versions
+// before 1.8 do not name it, as they only have the legacy backend.
+func extractIptablesMode(str string) string {
+	if strings.Contains(str, "(nf_tables)") {
+		return "nf_tables"
+	}
+	return "legacy"
 }
 
 // getIptablesVersion returns the first three components of the iptables version.
@@ -345,14 +716,16 @@ func extractIptablesVersion(str string) (int, int, int, error) {
 	return v1, v2, v3, nil
 }
 
-// Runs "iptables --version" to get the version string
+// Runs "iptables --version" to get the version string. If it fails, the
+// error output is returned along with the standard output.
 func getIptablesVersionString(path string) (string, error) {
 	cmd := exec.Command(path, "--version")
-	var out bytes.Buffer
+	var out, stderr bytes.Buffer
 	cmd.Stdout = &out
+	cmd.Stderr = &stderr
 	err := cmd.Run()
 	if err != nil {
-		return "", err
+		return out.String() + stderr.String(), err
 	}
 	return out.String(), nil
 }
@@ -371,6 +744,20 @@ func iptablesHasCheckCommand(v1 int, v2 int, v3 int) bool {
 	return false
 }
 
+// Checks if an iptables version is after 1.4.1, when -S was added
+func iptablesHasListRulesCommand(v1 int, v2 int, v3 int) bool {
+	if v1 > 1 {
+		return true
+	}
+	if v1 == 1 && v2 > 4 {
+		return true
+	}
+	if v1 == 1 && v2 == 4 && v3 >= 1 {
+		return true
+	}
+	return false
+}
+
 // Checks if an iptables version is after 1.4.20, when --wait was added
 func iptablesHasWaitCommand(v1 int, v2 int, v3 int) bool {
 	if v1 > 1 {
@@ -385,14 +772,42 @@ func iptablesHasWaitCommand(v1 int, v2 int, v3 int) bool {
 	return false
 }
 
-// Checks if a rule specification exists for a table
-func (ipt *IPTables) existsForOldIptables(table, chain string, rulespec []string) (bool, error) {
-	rs := strings.Join(append([]string{"-A", chain}, rulespec...), " ")
-	args := []string{"-t", table, "-S"}
-	var stdout bytes.Buffer
-	err := ipt.runWithOutput(args, &stdout)
-	if err != nil {
+// Checks if a rule specification exists in a chain by comparing it to the
+// listed rules with RulesEqual, for iptables without -C or with an unreliable one
+func (ipt *IPTables) existsByListing(table, chain string, rulespec []string) (bool, error) {
+	rules, err := ipt.List(table, chain)
+	eerr, eok := err.(*Error)
+	switch {
+	case err == nil:
+	case eok && eerr.ExitStatus() == 1:
+		// the chain does not exist
+		return false, nil
+	default:
 		return false, err
 	}
-	return strings.Contains(stdout.String(), rs), nil
+
+	for _, rule := range rules {
+		args, err := splitRule(rule)
+		if err != nil || len(args) < 2 || args[0] != "-A" {
+			continue
+		}
+		if RulesEqual(args[2:], rulespec) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Checks if an iptables version is after 1.6.2, when --wait was added to iptables-restore
+func iptablesRestoreHasWaitCommand(v1 int, v2 int, v3 int) bool {
+	if v1 > 1 {
+		return true
+	}
+	if v1 == 1 && v2 > 6 {
+		return true
+	}
+	if v1 == 1 && v2 == 6 && v3 >= 2 {
+		return true
+	}
+	return false
 }
@@ -120,6 +120,22 @@ func runChainTests(t *testing.T, ipt *IPTables) {
 		t.Fatalf("ClearChain (of missing) failed: %v", err)
 	}
 
+	exists, err := ipt.ChainExists("filter", chain)
+	if err != nil {
+		t.Fatalf("ChainExists failed: %v", err)
+	}
+	if !exists {
+		t.Fatalf("ChainExists doesn't find the new chain %v", chain)
+	}
+
+	empty, err := ipt.ChainEmpty("filter", chain)
+	if err != nil {
+		t.Fatalf("ChainEmpty failed: %v", err)
+	}
+	if !empty {
+		t.Fatalf("ChainEmpty of new chain %v returned false", chain)
+	}
+
 	// chain should be in listChain
 	listChain, err := ipt.ListChains("filter")
 	if err != nil {
@@ -141,6 +157,14 @@ func runChainTests(t *testing.T, ipt *IPTables) {
 		t.Fatalf("Append failed: %v", err)
 	}
 
+	empty, err = ipt.ChainEmpty("filter", chain)
+	if err != nil {
+		t.Fatalf("ChainEmpty failed: %v", err)
+	}
+	if empty {
+		t.Fatalf("ChainEmpty of non-empty chain %v returned true", chain)
+	}
+
 	// can't delete non-empty chain
 	err = ipt.DeleteChain("filter", chain)
 	if err == nil {
@@ -170,6 +194,14 @@ func runChainTests(t *testing.T, ipt *IPTables) {
 	if err != nil {
 		t.Fatalf("ListChains failed: %v", err)
 	}
+	exists, err = ipt.ChainExists("filter", newChain)
+	if err != nil {
+		t.Fatalf("ChainExists failed: %v", err)
+	}
+	if exists {
+		t.Fatalf("ChainExists finds deleted chain %v", newChain)
+	}
+
 	if !reflect.DeepEqual(originaListChain, listChain) {
 		t.Fatalf("ListChains mismatch: \ngot  %#v \nneed %#v", originaListChain, listChain)
 	}
@@ -267,6 +299,28 @@ func runRulesTests(t *testing.T, ipt *IPTables) {
 		t.Fatalf("ListWithCounters mismatch: \ngot  %#v \nneed %#v", rules, expected)
 	}
 
+	// move the last rule to the top
+	err = ipt.Move("filter", chain, 3, 1)
+	if err != nil {
+		t.Fatalf("Move failed: %v", err)
+	}
+
+	rules, err = ipt.List("filter", chain)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	expected = []string{
+		"-N " + chain,
+		"-A " + chain + " -s " + subnet2 + " -d " + address1 + " -j ACCEPT",
+		"-A " + chain + " -s " + subnet1 + " -d " + address1 + " -j ACCEPT",
+		"-A " + chain + " -s " + subnet2 + " -d " + address2 + " -j ACCEPT",
+	}
+
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("List after Move mismatch: \ngot  %#v \nneed %#v", rules, expected)
+	}
+
 	// Clear the chain that was created.
 	err = ipt.ClearChain("filter", chain)
 	if err != nil {
@@ -279,3 +333,102 @@ func runRulesTests(t *testing.T, ipt *IPTables) {
 		t.Fatalf("Failed to delete test chain: %v", err)
 	}
 }
+
+func TestChainManager(t *testing.T) {
+	ipt, err := New()
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	hook := randChain(t)
+	userChain := randChain(t)
+	managed := randChain(t)
+
+	// a chain standing in for a built-in one
+	err = ipt.NewChain("filter", hook)
+	if err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	defer ipt.DeleteChain("filter", hook)
+	err = ipt.Append("filter", hook, "-j", "ACCEPT")
+	if err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	m := NewChainManager(ipt, "filter")
+	err = m.EnableUserChain(userChain, hook)
+	if err != nil {
+		t.Fatalf("EnableUserChain failed: %v", err)
+	}
+	defer func() {
+		ipt.ClearChain("filter", userChain)
+		ipt.DeleteChain("filter", userChain)
+	}()
+
+	err = m.Hook(hook, managed)
+	if err != nil {
+		t.Fatalf("Hook failed: %v", err)
+	}
+	err = m.SetRules(managed, [][]string{
+		{"-s", "192.0.2.0/24", "-m", "comment", "--comment", "managed rule", "-j", "ACCEPT"},
+	})
+	if err != nil {
+		t.Fatalf("SetRules failed: %v", err)
+	}
+
+	err = m.SetRules(userChain, nil)
+	if err != ErrUserChain {
+		t.Fatalf("SetRules of user chain returned %v, want ErrUserChain", err)
+	}
+
+	rules, err := ipt.List("filter", hook)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	expected := []string{
+		"-N " + hook,
+		"-A " + hook + " -j " + userChain,
+		"-A " + hook + " -j " + managed,
+		"-A " + hook + " -j ACCEPT",
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("List mismatch: \ngot  %#v \nneed %#v", rules, expected)
+	}
+
+	rules, err = ipt.List("filter", managed)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	expected = []string{
+		"-N " + managed,
+		"-A " + managed + " -s 192.0.2.0/24 -m comment --comment \"managed rule\" -j ACCEPT",
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("List mismatch: \ngot  %#v \nneed %#v", rules, expected)
+	}
+
+	err = m.Cleanup()
+	if err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	exists, err := ipt.ChainExists("filter", managed)
+	if err != nil {
+		t.Fatalf("ChainExists failed: %v", err)
+	}
+	if exists {
+		t.Fatalf("managed chain %s still exists after Cleanup", managed)
+	}
+	exists, err = ipt.ChainExists("filter", userChain)
+	if err != nil {
+		t.Fatalf("ChainExists failed: %v", err)
+	}
+	if !exists {
+		t.Fatalf("user chain %s was removed by Cleanup", userChain)
+	}
+
+	// drop the jump to the user chain so the deferred deletes succeed
+	err = ipt.ClearChain("filter", hook)
+	if err != nil {
+		t.Fatalf("ClearChain failed: %v", err)
+	}
+}
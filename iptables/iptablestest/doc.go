@@ -0,0 +1,37 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package iptablestest provides helpers for running go-iptables integration
+// tests inside a throwaway network namespace, so that tests exercise a real
+// kernel without touching the host firewall.
+//
+// A typical test looks like:
+//
+//	func TestMyRules(t *testing.T) {
+//		ns := iptablestest.NewNamespace(t)
+//		err := ns.Do(func() error {
+//			ipt, err := iptables.New()
+//			if err != nil {
+//				return err
+//			}
+//			return ipt.Append("filter", "INPUT", "-j", "ACCEPT")
+//		})
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//	}
+//
+// Creating namespaces requires root (CAP_SYS_ADMIN) and the iproute2 "ip"
+// binary; NewNamespace skips the test when either is missing.
+package iptablestest
@@ -0,0 +1,182 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptablestest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+const (
+	// namePrefix is prepended to every namespace created by this package,
+	// which makes leftovers of crashed test runs easy to spot.
+	namePrefix  = "iptablestest-"
+	netnsRunDir = "/var/run/netns"
+)
+
+// setns(2) is not exported by the syscall package on every architecture.
+var setnsTrap = map[string]uintptr{
+	"386":      346,
+	"amd64":    308,
+	"arm":      375,
+	"arm64":    268,
+	"loong64":  268,
+	"mips":     4344,
+	"mipsle":   4344,
+	"mips64":   5303,
+	"mips64le": 5303,
+	"ppc64":    350,
+	"ppc64le":  350,
+	"riscv64":  268,
+	"s390x":    339,
+}
+
+// Namespace is a named network namespace created for the duration of a test.
+type Namespace struct {
+	// Name is the namespace name as understood by "ip netns".
+	Name string
+	path string
+}
+
+// NewNamespace creates a fresh network namespace and registers its removal
+// with tb.Cleanup. The test is skipped if the process is not running as root
+// or if the "ip" binary cannot be found; any other failure is fatal.
+func NewNamespace(tb testing.TB) *Namespace {
+	tb.Helper()
+	if os.Geteuid() != 0 {
+		tb.Skip("iptablestest: network namespaces require root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		tb.Skip("iptablestest: ip binary not found")
+	}
+	if _, ok := setnsTrap[runtime.GOARCH]; !ok {
+		tb.Skipf("iptablestest: setns is not supported on %s", runtime.GOARCH)
+	}
+
+	ns, err := Create()
+	if err != nil {
+		tb.Fatalf("iptablestest: %v", err)
+	}
+	tb.Cleanup(func() {
+		if err := ns.Close(); err != nil {
+			tb.Errorf("iptablestest: %v", err)
+		}
+	})
+	return ns
+}
+
+// Create creates a network namespace with a random name. The caller is
+// responsible for calling Close.
+func Create() (*Namespace, error) {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	name := namePrefix + hex.EncodeToString(buf)
+	if err := runIP("netns", "add", name); err != nil {
+		return nil, err
+	}
+	ns := &Namespace{Name: name, path: filepath.Join(netnsRunDir, name)}
+	// A new namespace only has a down loopback interface; bring it up so
+	// rules matching on lo behave as they would on a host.
+	if err := runIP("-n", name, "link", "set", "lo", "up"); err != nil {
+		ns.Close()
+		return nil, err
+	}
+	return ns, nil
+}
+
+// Do runs fn with the calling thread switched into the namespace. Commands
+// started by fn, including the iptables binaries invoked by go-iptables,
+// inherit the namespace. fn must not start goroutines that expect to run
+// inside the namespace, as those may be scheduled on other threads.
+func (ns *Namespace) Do(fn func() error) error {
+	errc := make(chan error, 1)
+	// Run on a dedicated goroutine: if switching back fails the thread is
+	// left locked and exits with the goroutine instead of being reused.
+	go func() {
+		errc <- ns.do(fn)
+	}()
+	return <-errc
+}
+
+func (ns *Namespace) do(fn func() error) error {
+	runtime.LockOSThread()
+
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+
+	target, err := os.Open(ns.path)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer target.Close()
+
+	if err := setns(target.Fd()); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("entering namespace %s: %v", ns.Name, err)
+	}
+
+	fnErr := fn()
+
+	if err := setns(origin.Fd()); err != nil {
+		// Keep the thread locked so it is torn down with the goroutine.
+		return fmt.Errorf("leaving namespace %s: %v", ns.Name, err)
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
+
+// Command returns an *exec.Cmd that runs name with args inside the
+// namespace via "ip netns exec".
+func (ns *Namespace) Command(name string, args ...string) *exec.Cmd {
+	return exec.Command("ip", append([]string{"netns", "exec", ns.Name, name}, args...)...)
+}
+
+// Close deletes the namespace, discarding every rule created in it.
+func (ns *Namespace) Close() error {
+	return runIP("netns", "delete", ns.Name)
+}
+
+func setns(fd uintptr) error {
+	_, _, errno := syscall.RawSyscall(setnsTrap[runtime.GOARCH], fd, syscall.CLONE_NEWNET, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func runIP(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %v: %v: %s", args, err, out)
+	}
+	return nil
+}
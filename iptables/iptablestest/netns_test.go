@@ -0,0 +1,80 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptablestest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func currentNetns() (string, error) {
+	return os.Readlink(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+}
+
+func TestNamespaceDo(t *testing.T) {
+	ns := NewNamespace(t)
+	if !strings.HasPrefix(ns.Name, namePrefix) {
+		t.Fatalf("unexpected namespace name %q", ns.Name)
+	}
+
+	host, err := currentNetns()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var inside string
+	err = ns.Do(func() error {
+		var err error
+		inside, err = currentNetns()
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if inside == host {
+		t.Fatalf("Do did not switch namespace (still %s)", host)
+	}
+
+	out, err := ns.Command("ip", "-o", "link", "show", "lo").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Command failed: %v: %s", err, out)
+	}
+	if !strings.Contains(string(out), "UP") {
+		t.Fatalf("loopback is not up inside namespace: %s", out)
+	}
+}
+
+func TestNamespaceClose(t *testing.T) {
+	ns := NewNamespace(t)
+	other, err := Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(other.path); !os.IsNotExist(err) {
+		t.Fatalf("namespace %s still present after Close", other.Name)
+	}
+	if _, err := os.Stat(ns.path); err != nil {
+		t.Fatalf("unrelated namespace %s vanished: %v", ns.Name, err)
+	}
+}
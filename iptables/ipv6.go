@@ -0,0 +1,207 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// icmpTypesV4 and icmpTypesV6 map the ICMP type names iptables and
+// ip6tables accept to their numbers.
+var (
+	icmpTypesV4 = map[string]string{
+		"echo-reply":              "0",
+		"destination-unreachable": "3",
+		"source-quench":           "4",
+		"redirect":                "5",
+		"echo-request":            "8",
+		"router-advertisement":    "9",
+		"router-solicitation":     "10",
+		"time-exceeded":           "11",
+		"parameter-problem":       "12",
+		"timestamp-request":       "13",
+		"timestamp-reply":         "14",
+		"address-mask-request":    "17",
+		"address-mask-reply":      "18",
+	}
+	icmpTypesV6 = map[string]string{
+		"destination-unreachable": "1",
+		"packet-too-big":          "2",
+		"time-exceeded":           "3",
+		"parameter-problem":       "4",
+		"echo-request":            "128",
+		"echo-reply":              "129",
+		"router-solicitation":     "133",
+		"router-advertisement":    "134",
+		"neighbour-solicitation":  "135",
+		"neighbor-solicitation":   "135",
+		"neighbour-advertisement": "136",
+		"neighbor-advertisement":  "136",
+		"redirect":                "137",
+	}
+)
+
+// icmpTypeV4ToV6 maps the numbers of ICMP types to those of their ICMPv6
+// counterparts.
+var icmpTypeV4ToV6 = map[string]string{
+	"0":  "129",
+	"3":  "1",
+	"8":  "128",
+	"11": "3",
+	"12": "4",
+}
+
+// icmpTypeNumber returns the number of an ICMP type given to --icmp-type,
+// or --icmpv6-type if v6 is set, without any "/code" suffix.
+func icmpTypeNumber(value string, v6 bool) string {
+	value = strings.ToLower(value)
+	if i := strings.IndexByte(value, '/'); i >= 0 {
+		value = value[:i]
+	}
+	types := icmpTypesV4
+	if v6 {
+		types = icmpTypesV6
+	}
+	if n, ok := types[value]; ok {
+		return n
+	}
+	return value
+}
+
+// ruleCommandIndex returns the index of the command in the iptables
+// arguments if it takes a rulespec, or -1.
+func ruleCommandIndex(args []string) int {
+	i := 0
+	for i < len(args) && (args[i] == "-t" || args[i] == "--table") {
+		i += 2
+	}
+	if i >= len(args) || !ruleCommands[args[i]] {
+		return -1
+	}
+	return i
+}
+
+// translateICMPv6 rewrites the IPv4 ICMP options of a rule command for
+// ip6tables: "-p icmp" becomes "-p ipv6-icmp", "-m icmp --icmp-type" becomes
+// "-m icmp6 --icmpv6-type" with the type translated, and the ICMP answers of
+// REJECT become their ICMPv6 counterparts. ICMP types and answers that
+// ICMPv6 has no counterpart for are an error wrapping ErrWrongFamily.
+// Other arguments, and those of other commands, are returned unchanged.
+func translateICMPv6(args []string) ([]string, error) {
+	i := ruleCommandIndex(args)
+	if i < 0 {
+		return args, nil
+	}
+	var out []string
+	set := func(j int, v string) {
+		if out == nil {
+			out = append([]string{}, args...)
+		}
+		out[j] = v
+	}
+	for ; i+1 < len(args); i++ {
+		opt, value := args[i], args[i+1]
+		switch {
+		case opt == "--comment":
+		case (opt == "-p" || opt == "--protocol") && (strings.ToLower(value) == "icmp" || value == "1"):
+			set(i+1, "ipv6-icmp")
+		case (opt == "-m" || opt == "--match") && value == "icmp":
+			set(i+1, "icmp6")
+		case opt == "--icmp-type":
+			t := value
+			if _, named := icmpTypesV6[strings.ToLower(value)]; !named {
+				v6, ok := icmpTypeV4ToV6[icmpTypeNumber(value, false)]
+				if !ok {
+					return nil, fmt.Errorf("%w: ICMP type %s has no ICMPv6 counterpart", ErrWrongFamily, value)
+				}
+				t = v6
+			}
+			set(i, "--icmpv6-type")
+			set(i+1, t)
+		case opt == "--reject-with" && strings.HasPrefix(value, "icmp-"):
+			v6, ok := rejectWithFamily[RejectWith(value)]
+			if !ok {
+				return nil, fmt.Errorf("%w: REJECT answer %s has no ICMPv6 counterpart", ErrWrongFamily, value)
+			}
+			set(i+1, string(v6))
+		default:
+			continue
+		}
+		// skip the value
+		i++
+	}
+	if out == nil {
+		return args, nil
+	}
+	return out, nil
+}
+
+// neighborDiscoveryTypes are the ICMPv6 types of neighbor discovery (RFC
+// 4861) that hosts exchange on their links, router messages first.
+var neighborDiscoveryTypes = []struct{ name, icmpType string }{
+	{"router solicitation", "133"},
+	{"router advertisement", "134"},
+	{"neighbor solicitation", "135"},
+	{"neighbor advertisement", "136"},
+}
+
+// NeighborDiscoveryGuards returns GuardRules protecting IPv6 neighbor
+// solicitations and advertisements in the INPUT and OUTPUT chains of the
+// filter table. Without them, hosts cannot resolve each other's link-layer
+// addresses and IPv6 stops working on the link, which a default DROP policy
+// does as soon as it is set ahead of the rules accepting ICMPv6.
+func NeighborDiscoveryGuards() []GuardRule {
+	var guards []GuardRule
+	for _, chain := range []string{"INPUT", "OUTPUT"} {
+		// neighbor solicitations and advertisements
+		for _, t := range neighborDiscoveryTypes[2:] {
+			guards = append(guards, GuardRule{
+				Name: t.name + " in " + chain,
+				Packet: PacketSpec{
+					Table:    "filter",
+					Chain:    chain,
+					Protocol: "ipv6-icmp",
+					ICMPType: t.icmpType,
+				},
+			})
+		}
+	}
+	return guards
+}
+
+// CheckNeighborDiscovery returns a *GuardError if the current filter rules of
+// an IPv6 handle drop neighbor discovery; see NeighborDiscoveryGuards. Rules
+// using matches Trace cannot evaluate are assumed not to match. It returns
+// nil for IPv4 handles.
+func (ipt *IPTables) CheckNeighborDiscovery() error {
+	if !ipt.IsIPv6() {
+		return nil
+	}
+	t, err := ipt.listTable("filter")
+	if err != nil {
+		return err
+	}
+	for _, g := range NeighborDiscoveryGuards() {
+		steps, err := traceTableRules(t, g.Packet)
+		if err != nil {
+			return err
+		}
+		if droppingStep(steps) {
+			return &GuardError{Guard: g, Steps: steps}
+		}
+	}
+	return nil
+}
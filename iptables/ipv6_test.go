@@ -0,0 +1,99 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTranslateICMPv6(t *testing.T) {
+	for _, tt := range []struct {
+		args, expected []string
+	}{
+		{
+			[]string{"-t", "filter", "-A", "INPUT", "-p", "icmp", "-m", "icmp", "--icmp-type", "8", "-j", "ACCEPT"},
+			[]string{"-t", "filter", "-A", "INPUT", "-p", "ipv6-icmp", "-m", "icmp6", "--icmpv6-type", "128", "-j", "ACCEPT"},
+		},
+		{
+			[]string{"-A", "INPUT", "-p", "icmp", "--icmp-type", "echo-request", "-j", "ACCEPT"},
+			[]string{"-A", "INPUT", "-p", "ipv6-icmp", "--icmpv6-type", "echo-request", "-j", "ACCEPT"},
+		},
+		{
+			[]string{"-A", "INPUT", "-j", "REJECT", "--reject-with", "icmp-port-unreachable"},
+			[]string{"-A", "INPUT", "-j", "REJECT", "--reject-with", "icmp6-port-unreachable"},
+		},
+		{
+			[]string{"-A", "INPUT", "-m", "comment", "--comment", "-p", "-j", "ACCEPT"},
+			[]string{"-A", "INPUT", "-m", "comment", "--comment", "-p", "-j", "ACCEPT"},
+		},
+		{
+			[]string{"-N", "icmp"},
+			[]string{"-N", "icmp"},
+		},
+	} {
+		got, err := translateICMPv6(tt.args)
+		if err != nil {
+			t.Errorf("translateICMPv6(%q) failed: %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("translateICMPv6(%q) = %q, want %q", tt.args, got, tt.expected)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-A", "INPUT", "-p", "icmp", "--icmp-type", "timestamp-request", "-j", "ACCEPT"},
+		{"-A", "INPUT", "-j", "REJECT", "--reject-with", "icmp-proto-unreachable"},
+	} {
+		if _, err := translateICMPv6(args); !errors.Is(err, ErrWrongFamily) {
+			t.Errorf("translateICMPv6(%q) returned %v, want ErrWrongFamily", args, err)
+		}
+	}
+}
+
+func TestNeighborDiscoveryGuards(t *testing.T) {
+	blocked, err := parseTableRules([]string{
+		"-P INPUT DROP",
+		"-P OUTPUT ACCEPT",
+		"-A INPUT -p ipv6-icmp -m icmp6 --icmpv6-type 128 -j ACCEPT",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, err := parseTableRules([]string{
+		"-P INPUT DROP",
+		"-P OUTPUT ACCEPT",
+		"-A INPUT -p ipv6-icmp -m icmp6 --icmpv6-type neighbour-solicitation -j ACCEPT",
+		"-A INPUT -p ipv6-icmp -m icmp6 --icmpv6-type 136 -j ACCEPT",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, g := range NeighborDiscoveryGuards() {
+		if steps, err := traceTableRules(allowed, g.Packet); err != nil || droppingStep(steps) {
+			t.Errorf("%s: dropped by allowing rules: %+v, %v", g.Name, steps, err)
+		}
+		steps, err := traceTableRules(blocked, g.Packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dropped := droppingStep(steps); dropped != (g.Packet.Chain == "INPUT") {
+			t.Errorf("%s: dropped = %v with the INPUT policy DROP", g.Name, dropped)
+		}
+	}
+}
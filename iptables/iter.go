@@ -0,0 +1,79 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.23
+// +build go1.23
+
+package iptables
+
+import (
+	"errors"
+	"iter"
+)
+
+// errStopIteration ends a listing early when the range loop breaks.
+var errStopIteration = errors.New("iptables: iteration stopped")
+
+// Rules returns an iterator over the rules of the specified table/chain,
+// together with their index, for use with range-over-func:
+//
+//	rules, errf := ipt.Rules("filter", "INPUT")
+//	for i, r := range rules {
+//		...
+//	}
+//	if err := errf(); err != nil {
+//		...
+//	}
+//
+// The listing runs when the iteration starts, and each rule is parsed only
+// when it is reached, so no slice of the whole chain is built. Breaking out
+// of the loop stops processing the rest of the output. Listing and parsing
+// errors end the iteration and are returned by errf, which reports the
+// outcome of the latest iteration.
+func (ipt *IPTables) Rules(table, chain string) (iter.Seq2[int, ParsedRule], func() error) {
+	return ipt.rules([]string{"-t", table, "-S", chain})
+}
+
+// All returns an iterator over the rules of every chain in the specified
+// table, in the order iptables lists them. It behaves like Rules.
+func (ipt *IPTables) All(table string) (iter.Seq[ParsedRule], func() error) {
+	rules, errf := ipt.rules([]string{"-t", table, "-S"})
+	seq := func(yield func(ParsedRule) bool) {
+		for _, r := range rules {
+			if !yield(r) {
+				return
+			}
+		}
+	}
+	return seq, errf
+}
+
+// rules implements Rules and All for the given "-S" listing arguments.
+func (ipt *IPTables) rules(args []string) (iter.Seq2[int, ParsedRule], func() error) {
+	var err error
+	seq := func(yield func(int, ParsedRule) bool) {
+		i := 0
+		err = ipt.executeParsedFunc(args, func(r *ParsedRule) error {
+			if !yield(i, *r) {
+				return errStopIteration
+			}
+			i++
+			return nil
+		})
+		if err == errStopIteration {
+			err = nil
+		}
+	}
+	return seq, func() error { return err }
+}
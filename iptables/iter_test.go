@@ -0,0 +1,73 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && go1.23
+// +build linux,go1.23
+
+package iptables
+
+import "testing"
+
+func TestRulesIterator(t *testing.T) {
+	ipt, log := newFakeIPTables(t, `case "$*" in
+*"-S INPUT"*) printf -- '-P INPUT ACCEPT\n-A INPUT -i lo -j ACCEPT\n-A INPUT -p tcp -j DROP\n-A INPUT -j LOG\n';;
+*) printf -- '-P INPUT ACCEPT\n-N X\n-A INPUT -j X\n-A X -j RETURN\n';;
+esac`)
+
+	rules, errf := ipt.Rules("filter", "INPUT")
+	var targets []string
+	for i, r := range rules {
+		if i != len(targets) {
+			t.Fatalf("unexpected index %d", i)
+		}
+		targets = append(targets, r.Target)
+		if i == 1 {
+			break
+		}
+	}
+	if err := errf(); err != nil {
+		t.Fatalf("Rules failed: %v", err)
+	}
+	if len(targets) != 2 || targets[0] != "ACCEPT" || targets[1] != "DROP" {
+		t.Fatalf("unexpected targets %v", targets)
+	}
+
+	all, errf := ipt.All("filter")
+	var chains []string
+	for r := range all {
+		chains = append(chains, r.Chain)
+	}
+	if err := errf(); err != nil {
+		t.Fatalf("All failed: %v", err)
+	}
+	if len(chains) != 2 || chains[0] != "INPUT" || chains[1] != "X" {
+		t.Fatalf("unexpected chains %v", chains)
+	}
+
+	calls := fakeCalls(t, log)
+	if len(calls) != 2 || calls[0] != "--wait -t filter -S INPUT" || calls[1] != "--wait -t filter -S" {
+		t.Fatalf("unexpected calls %#v", calls)
+	}
+}
+
+func TestRulesIteratorError(t *testing.T) {
+	ipt, _ := newFakeIPTables(t, `echo "iptables: No chain/target/match by that name." >&2; exit 1`)
+	rules, errf := ipt.Rules("filter", "MISSING")
+	for range rules {
+		t.Fatalf("unexpected rule")
+	}
+	if err := errf(); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+)
+
+// JumpPosition selects where EnsureJump keeps a jump rule.
+type JumpPosition int
+
+const (
+	// JumpFirst keeps the jump at the top of the chain.
+	JumpFirst JumpPosition = iota
+	// JumpLast keeps the jump at the bottom of the chain.
+	JumpLast
+)
+
+// EnsureJump makes "-j toChain" the first or last rule of fromChain,
+// removing any other jump to toChain. If the jump has been pushed away from
+// its position, e.g. by another agent inserting rules at the top, it is
+// moved back in a single iptables-restore transaction, so the chain is never
+// seen without it. Calling it periodically keeps the jump in place. With an
+// Owner, the jump is tagged with the owner, and only tagged jumps count.
+func (ipt *IPTables) EnsureJump(table, fromChain, toChain string, position JumpPosition) error {
+	rules, err := ipt.ExecuteList([]string{"-t", table, "-S", fromChain})
+	if err != nil {
+		return err
+	}
+	data, err := ipt.ensureJumpData(table, fromChain, toChain, position, rules)
+	if err != nil || data == "" {
+		return err
+	}
+	return ipt.Restore(data, RestoreOptions{NoFlush: true})
+}
+
+// ensureJumpData returns the restore data moving the jump into position
+// given the "-S" listing of the chain, or "" if it is in place already.
+func (ipt *IPTables) ensureJumpData(table, from, to string, position JumpPosition, rules []string) (string, error) {
+	spec, err := ipt.owned([]string{"-j", to})
+	if err != nil {
+		return "", err
+	}
+	jump := "-A " + from + " " + joinRule(spec)
+	var count int
+	for _, rule := range rules {
+		if rule == jump {
+			count++
+		}
+	}
+	// rules[0] is the policy or chain declaration
+	if count == 1 && len(rules) > 1 {
+		if position == JumpFirst && rules[1] == jump {
+			return "", nil
+		}
+		if position == JumpLast && rules[len(rules)-1] == jump {
+			return "", nil
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("*" + table + "\n")
+	for i := 0; i < count; i++ {
+		buf.WriteString("-D " + from + " " + joinRule(spec) + "\n")
+	}
+	if position == JumpFirst {
+		buf.WriteString("-I " + from + " 1 " + joinRule(spec) + "\n")
+	} else {
+		buf.WriteString(jump + "\n")
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.String(), nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"testing"
+)
+
+func TestEnsureJumpData(t *testing.T) {
+	tests := []struct {
+		name     string
+		position JumpPosition
+		rules    []string
+		expected string
+	}{
+		{
+			name:     "first in place",
+			position: JumpFirst,
+			rules:    []string{"-P FORWARD DROP", "-A FORWARD -j MINE", "-A FORWARD -j DOCKER"},
+		},
+		{
+			name:     "last in place",
+			position: JumpLast,
+			rules:    []string{"-P FORWARD DROP", "-A FORWARD -j DOCKER", "-A FORWARD -j MINE"},
+		},
+		{
+			name:     "missing",
+			position: JumpFirst,
+			rules:    []string{"-P FORWARD DROP", "-A FORWARD -j DOCKER"},
+			expected: "*filter\n-I FORWARD 1 -j MINE\nCOMMIT\n",
+		},
+		{
+			name:     "pushed down",
+			position: JumpFirst,
+			rules:    []string{"-P FORWARD DROP", "-A FORWARD -j DOCKER", "-A FORWARD -j MINE"},
+			expected: "*filter\n-D FORWARD -j MINE\n-I FORWARD 1 -j MINE\nCOMMIT\n",
+		},
+		{
+			name:     "duplicated",
+			position: JumpLast,
+			rules:    []string{"-P FORWARD DROP", "-A FORWARD -j MINE", "-A FORWARD -j MINE"},
+			expected: "*filter\n-D FORWARD -j MINE\n-D FORWARD -j MINE\n-A FORWARD -j MINE\nCOMMIT\n",
+		},
+	}
+	ipt := &IPTables{}
+	for _, tt := range tests {
+		data, err := ipt.ensureJumpData("filter", "FORWARD", "MINE", tt.position, tt.rules)
+		if err != nil || data != tt.expected {
+			t.Fatalf("%s: ensureJumpData mismatch: \ngot  %q, %v \nneed %q", tt.name, data, err, tt.expected)
+		}
+	}
+}
+
+func TestEnsureJumpDataOwner(t *testing.T) {
+	ipt := &IPTables{}
+	Owner("agent")(ipt)
+	jump := "-m comment --comment owner=agent,id=" + ruleID([]string{"-j", "MINE"}) + " -j MINE"
+
+	// an untagged jump belongs to someone else
+	data, err := ipt.ensureJumpData("filter", "FORWARD", "MINE", JumpFirst, []string{"-P FORWARD DROP", "-A FORWARD -j MINE"})
+	if expected := "*filter\n-I FORWARD 1 " + jump + "\nCOMMIT\n"; err != nil || data != expected {
+		t.Fatalf("ensureJumpData mismatch: \ngot  %q, %v \nneed %q", data, err, expected)
+	}
+	data, err = ipt.ensureJumpData("filter", "FORWARD", "MINE", JumpFirst, []string{"-P FORWARD DROP", "-A FORWARD " + jump, "-A FORWARD -j MINE"})
+	if err != nil || data != "" {
+		t.Fatalf("ensureJumpData moved a tagged jump in place: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// KillSwitchChain is the filter table chain holding the kill switch rules.
+const KillSwitchChain = "KILLSWITCH"
+
+// KillSwitchConfig describes the traffic a VPN kill switch lets out.
+type KillSwitchConfig struct {
+	// Interface is the VPN interface, e.g. "wg0"; all traffic through it is
+	// allowed.
+	Interface string
+	// LANs are networks reachable directly, e.g. "192.168.1.0/24".
+	LANs []string
+	// Endpoints are the VPN servers, which must be reachable outside of the
+	// tunnel to establish it.
+	Endpoints []KillSwitchEndpoint
+}
+
+// KillSwitchEndpoint is a VPN server address.
+type KillSwitchEndpoint struct {
+	Addr string
+	Port int
+	// Protocol defaults to "udp", as used by WireGuard.
+	Protocol string
+}
+
+// killSwitchRules returns the rules of the kill switch chain: loopback, the
+// VPN interface, the LANs and the endpoints are let out, as is neighbor
+// discovery for IPv6, without which the link breaks; everything else is
+// rejected, so applications fail fast instead of timing out.
+func (ipt *IPTables) killSwitchRules(cfg KillSwitchConfig) ([][]string, error) {
+	if err := ValidateInterface(cfg.Interface); err != nil {
+		return nil, fmt.Errorf("kill switch: %v", err)
+	}
+	if len(cfg.Endpoints) == 0 {
+		return nil, fmt.Errorf("kill switch: no VPN endpoint, the tunnel could never be established")
+	}
+	rules := [][]string{
+		{"-o", "lo", "-j", "RETURN"},
+		{"-o", cfg.Interface, "-j", "RETURN"},
+	}
+	if ipt.IsIPv6() {
+		for _, t := range neighborDiscoveryTypes {
+			rules = append(rules, []string{"-p", "ipv6-icmp", "-m", "icmp6", "--icmpv6-type", t.icmpType, "-j", "RETURN"})
+		}
+	}
+	for _, lan := range cfg.LANs {
+		if _, _, err := net.ParseCIDR(lan); err != nil {
+			return nil, fmt.Errorf("kill switch: LAN %v", err)
+		}
+		rules = append(rules, []string{"-d", lan, "-j", "RETURN"})
+	}
+	for _, ep := range cfg.Endpoints {
+		if net.ParseIP(ep.Addr) == nil {
+			return nil, fmt.Errorf("kill switch: invalid endpoint address %q", ep.Addr)
+		}
+		if ep.Port <= 0 || ep.Port > 65535 {
+			return nil, fmt.Errorf("kill switch: invalid endpoint port %d", ep.Port)
+		}
+		proto := ep.Protocol
+		if proto == "" {
+			proto = "udp"
+		}
+		rules = append(rules, []string{"-d", ep.Addr, "-p", proto, "-m", proto, "--dport", strconv.Itoa(ep.Port), "-j", "RETURN"})
+	}
+	reject, err := (&Reject{With: "icmp-admin-prohibited"}).ArgsFor(ipt.proto)
+	if err != nil {
+		return nil, err
+	}
+	return append(rules, reject), nil
+}
+
+// InstallKillSwitch makes sure no traffic leaves the host outside of the VPN
+// tunnel: the KillSwitchChain chain, jumped to first from OUTPUT, rejects
+// everything but the traffic of cfg. The chain is rebuilt in a single
+// iptables-restore transaction, so calling it again with a new
+// configuration never lets traffic out in between. Install it on both the
+// IPv4 and the IPv6 handle, or IPv6 traffic bypasses the switch.
+func (ipt *IPTables) InstallKillSwitch(cfg KillSwitchConfig) error {
+	rules, err := ipt.killSwitchRules(cfg)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, rule := range rules {
+		// an address of the other family would fail the whole restore
+		if err := checkFamily(ipt.proto, append([]string{"-A", KillSwitchChain}, rule...)); err != nil {
+			return fmt.Errorf("kill switch: %w", err)
+		}
+		buf.WriteString("-A " + KillSwitchChain + " " + joinRule(rule) + "\n")
+	}
+	if err := ipt.RestoreChain("filter", KillSwitchChain, buf.String(), true); err != nil {
+		return err
+	}
+	return ipt.EnsureJump("filter", "OUTPUT", KillSwitchChain, JumpFirst)
+}
+
+// RemoveKillSwitch removes the jump to the kill switch chain and deletes
+// the chain, letting all traffic out again. It does nothing if the kill
+// switch is not installed.
+func (ipt *IPTables) RemoveKillSwitch() error {
+	exists, err := ipt.ChainExists("filter", KillSwitchChain)
+	if err != nil || !exists {
+		return err
+	}
+	if err := ipt.DeleteIfExists("filter", "OUTPUT", "-j", KillSwitchChain); err != nil {
+		return err
+	}
+	if err := ipt.ClearChain("filter", KillSwitchChain); err != nil {
+		return err
+	}
+	return ipt.DeleteChain("filter", KillSwitchChain)
+}
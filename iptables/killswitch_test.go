@@ -0,0 +1,82 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKillSwitchRules(t *testing.T) {
+	cfg := KillSwitchConfig{
+		Interface: "wg0",
+		LANs:      []string{"192.168.1.0/24"},
+		Endpoints: []KillSwitchEndpoint{{Addr: "198.51.100.7", Port: 51820}},
+	}
+	ipt := &IPTables{proto: ProtocolIPv4}
+	rules, err := ipt.killSwitchRules(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range rules {
+		got = append(got, strings.Join(r, " "))
+	}
+	expected := []string{
+		"-o lo -j RETURN",
+		"-o wg0 -j RETURN",
+		"-d 192.168.1.0/24 -j RETURN",
+		"-d 198.51.100.7 -p udp -m udp --dport 51820 -j RETURN",
+		"-j REJECT --reject-with icmp-admin-prohibited",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %q, want %q", got, expected)
+	}
+
+	ipt6 := &IPTables{proto: ProtocolIPv6}
+	rules, err = ipt6.killSwitchRules(KillSwitchConfig{
+		Interface: "wg0",
+		Endpoints: []KillSwitchEndpoint{{Addr: "2001:db8::7", Port: 51820}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, r := range rules {
+		got = append(got, strings.Join(r, " "))
+	}
+	expected = []string{
+		"-o lo -j RETURN",
+		"-o wg0 -j RETURN",
+		"-p ipv6-icmp -m icmp6 --icmpv6-type 133 -j RETURN",
+		"-p ipv6-icmp -m icmp6 --icmpv6-type 134 -j RETURN",
+		"-p ipv6-icmp -m icmp6 --icmpv6-type 135 -j RETURN",
+		"-p ipv6-icmp -m icmp6 --icmpv6-type 136 -j RETURN",
+		"-d 2001:db8::7 -p udp -m udp --dport 51820 -j RETURN",
+		"-j REJECT --reject-with icmp6-adm-prohibited",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %q, want %q", got, expected)
+	}
+
+	if err := ipt6.InstallKillSwitch(cfg); !errors.Is(err, ErrWrongFamily) {
+		t.Errorf("InstallKillSwitch with IPv4 addresses on IPv6 returned %v, want ErrWrongFamily", err)
+	}
+	if _, err := ipt.killSwitchRules(KillSwitchConfig{Interface: "wg0"}); err == nil {
+		t.Error("expected error without endpoints")
+	}
+}
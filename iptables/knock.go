@@ -0,0 +1,192 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// maxChainNameLen is XT_EXTENSION_MAXNAMELEN minus the trailing NUL.
+const maxChainNameLen = 28
+
+// PortKnock describes a port knocking setup: Port stays closed until a
+// source has sent packets to the Sequence ports in order, each within
+// StepTimeout seconds of the previous one. The source may then connect for
+// OpenTimeout seconds. Knocks are dropped, so the knock ports look closed
+// too, and a knock out of order starts the sequence over.
+type PortKnock struct {
+	// Name prefixes the chains and the recent lists of the setup.
+	Name string
+	// Port is the protected port, of Protocol, "tcp" if empty.
+	Port     int
+	Protocol string
+	// Sequence are the knock ports, of KnockProtocol, "tcp" if empty.
+	Sequence      []int
+	KnockProtocol string
+	// StepTimeout and OpenTimeout are in seconds; zero means 10 and 30.
+	StepTimeout int
+	OpenTimeout int
+}
+
+func (k *PortKnock) stepChain(i int) string {
+	return k.Name + "-STEP" + strconv.Itoa(i)
+}
+
+func (k *PortKnock) resetChain() string {
+	return k.Name + "-RESET"
+}
+
+// list returns the recent list of sources that completed step i, or the
+// list of sources the port is open for if i is the last step.
+func (k *PortKnock) list(i int) string {
+	if i == len(k.Sequence) {
+		return k.Name + "-OPEN"
+	}
+	return k.Name + "-" + strconv.Itoa(i)
+}
+
+func (k *PortKnock) validate() error {
+	switch {
+	case k.Name == "":
+		return fmt.Errorf("port knock: empty name")
+	case len(k.stepChain(len(k.Sequence))) > maxChainNameLen:
+		return fmt.Errorf("port knock: name %q too long for chain %s", k.Name, k.stepChain(len(k.Sequence)))
+	case len(k.Sequence) == 0:
+		return fmt.Errorf("port knock: empty knock sequence")
+	case k.StepTimeout < 0 || k.OpenTimeout < 0:
+		return fmt.Errorf("port knock: timeouts must not be negative")
+	}
+	for _, p := range append([]int{k.Port}, k.Sequence...) {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("port knock: invalid port %d", p)
+		}
+	}
+	for _, p := range k.Sequence {
+		if p == k.Port && k.protocol() == k.knockProtocol() {
+			return fmt.Errorf("port knock: protected port %d in the knock sequence", p)
+		}
+	}
+	return nil
+}
+
+func (k *PortKnock) protocol() string {
+	if k.Protocol == "" {
+		return "tcp"
+	}
+	return k.Protocol
+}
+
+func (k *PortKnock) knockProtocol() string {
+	if k.KnockProtocol == "" {
+		return "tcp"
+	}
+	return k.KnockProtocol
+}
+
+// Chains returns the rules of the setup's chains, by chain name. The chain
+// named Name is the entry point; Install hooks it into INPUT.
+func (k *PortKnock) Chains() (map[string][][]string, error) {
+	if err := k.validate(); err != nil {
+		return nil, err
+	}
+	step, open := k.StepTimeout, k.OpenTimeout
+	if step == 0 {
+		step = 10
+	}
+	if open == 0 {
+		open = 30
+	}
+	recent := func(cmd RecentCommand, name string, seconds int) []string {
+		args, _ := (&Recent{Command: cmd, Name: name, Seconds: seconds}).Args()
+		return args
+	}
+	port := func(proto string, p int) []string {
+		return []string{"-p", proto, "-m", proto, "--dport", strconv.Itoa(p)}
+	}
+	rule := func(parts ...[]string) []string {
+		var r []string
+		for _, p := range parts {
+			r = append(r, p...)
+		}
+		return r
+	}
+	n := len(k.Sequence)
+	chains := make(map[string][][]string, n+2)
+
+	main := [][]string{
+		rule(port(k.protocol(), k.Port), recent(RecentRCheck, k.list(n), open), []string{"-j", "ACCEPT"}),
+		rule(port(k.protocol(), k.Port), []string{"-j", "DROP"}),
+	}
+	// later steps first, so a knock completing a step wins over one starting
+	// the sequence over on a repeated port
+	for i := n - 1; i > 0; i-- {
+		main = append(main, rule(port(k.knockProtocol(), k.Sequence[i]), recent(RecentRCheck, k.list(i), step), []string{"-j", k.stepChain(i + 1)}))
+	}
+	main = append(main, rule(port(k.knockProtocol(), k.Sequence[0]), []string{"-j", k.stepChain(1)}))
+	seen := make(map[int]bool)
+	for _, p := range k.Sequence[1:] {
+		if !seen[p] && p != k.Sequence[0] {
+			main = append(main, rule(port(k.knockProtocol(), p), []string{"-j", k.resetChain()}))
+		}
+		seen[p] = true
+	}
+	chains[k.Name] = main
+
+	for i := 1; i <= n; i++ {
+		var rules [][]string
+		// restarting the sequence forgets any progress
+		for j := 1; j < n; j++ {
+			if j != i {
+				rules = append(rules, recent(RecentRemove, k.list(j), 0))
+			}
+		}
+		rules = append(rules, recent(RecentSet, k.list(i), 0), []string{"-j", "DROP"})
+		chains[k.stepChain(i)] = rules
+	}
+
+	var reset [][]string
+	for j := 1; j < n; j++ {
+		reset = append(reset, recent(RecentRemove, k.list(j), 0))
+	}
+	chains[k.resetChain()] = append(reset, []string{"-j", "DROP"})
+	return chains, nil
+}
+
+// Install creates the setup's chains in the filter table of the manager and
+// hooks the entry chain into INPUT. Remove the setup with the manager's
+// Cleanup.
+func (k *PortKnock) Install(m *ChainManager) error {
+	chains, err := k.Chains()
+	if err != nil {
+		return err
+	}
+	if m.Table() != "filter" {
+		return fmt.Errorf("port knock: chains belong in the filter table, not %s", m.Table())
+	}
+	// targets first, so every jump resolves
+	for i := len(k.Sequence); i >= 1; i-- {
+		if err := m.SetRules(k.stepChain(i), chains[k.stepChain(i)]); err != nil {
+			return err
+		}
+	}
+	if err := m.SetRules(k.resetChain(), chains[k.resetChain()]); err != nil {
+		return err
+	}
+	if err := m.SetRules(k.Name, chains[k.Name]); err != nil {
+		return err
+	}
+	return m.Hook("INPUT", k.Name)
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPortKnockChains(t *testing.T) {
+	k := &PortKnock{Name: "KNOCK", Port: 22, Sequence: []int{7000, 8000, 9000}, KnockProtocol: "udp"}
+	chains, err := k.Chains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func(chain string) []string {
+		var out []string
+		for _, r := range chains[chain] {
+			out = append(out, strings.Join(r, " "))
+		}
+		return out
+	}
+
+	expected := map[string][]string{
+		"KNOCK": {
+			"-p tcp -m tcp --dport 22 -m recent --rcheck --seconds 30 --name KNOCK-OPEN --rsource -j ACCEPT",
+			"-p tcp -m tcp --dport 22 -j DROP",
+			"-p udp -m udp --dport 9000 -m recent --rcheck --seconds 10 --name KNOCK-2 --rsource -j KNOCK-STEP3",
+			"-p udp -m udp --dport 8000 -m recent --rcheck --seconds 10 --name KNOCK-1 --rsource -j KNOCK-STEP2",
+			"-p udp -m udp --dport 7000 -j KNOCK-STEP1",
+			"-p udp -m udp --dport 8000 -j KNOCK-RESET",
+			"-p udp -m udp --dport 9000 -j KNOCK-RESET",
+		},
+		"KNOCK-STEP1": {
+			"-m recent --remove --name KNOCK-2 --rsource",
+			"-m recent --set --name KNOCK-1 --rsource",
+			"-j DROP",
+		},
+		"KNOCK-STEP2": {
+			"-m recent --remove --name KNOCK-1 --rsource",
+			"-m recent --set --name KNOCK-2 --rsource",
+			"-j DROP",
+		},
+		"KNOCK-STEP3": {
+			"-m recent --remove --name KNOCK-1 --rsource",
+			"-m recent --remove --name KNOCK-2 --rsource",
+			"-m recent --set --name KNOCK-OPEN --rsource",
+			"-j DROP",
+		},
+		"KNOCK-RESET": {
+			"-m recent --remove --name KNOCK-1 --rsource",
+			"-m recent --remove --name KNOCK-2 --rsource",
+			"-j DROP",
+		},
+	}
+	if len(chains) != len(expected) {
+		t.Errorf("got %d chains, want %d", len(chains), len(expected))
+	}
+	for chain, want := range expected {
+		if got := render(chain); !reflect.DeepEqual(got, want) {
+			t.Errorf("chain %s:\ngot  %q\nwant %q", chain, got, want)
+		}
+	}
+}
+
+func TestPortKnockValidate(t *testing.T) {
+	for _, k := range []*PortKnock{
+		{Port: 22, Sequence: []int{1000}},
+		{Name: "KNOCK", Port: 22},
+		{Name: "KNOCK", Port: 22, Sequence: []int{22}},
+		{Name: "KNOCK", Port: 0, Sequence: []int{1000}},
+		{Name: "KNOCK-WITH-A-VERY-LONG-NAME", Port: 22, Sequence: []int{1000}},
+	} {
+		if _, err := k.Chains(); err == nil {
+			t.Errorf("%+v: expected error", k)
+		}
+	}
+}
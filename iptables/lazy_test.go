@@ -0,0 +1,63 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewWithProtocolLazy(t *testing.T) {
+	dir := t.TempDir()
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	ipt := NewWithProtocolLazy(ProtocolIPv6, ReadOnly())
+	if Available(ProtocolIPv6) {
+		t.Fatalf("Available reported a missing ip6tables")
+	}
+	_, err := ipt.List("filter", "INPUT")
+	var notFound *exec.Error
+	if !errors.As(err, &notFound) {
+		t.Fatalf("List without ip6tables returned %v, want *exec.Error", err)
+	}
+
+	// installing the binary makes the handle usable
+	script := "#!/bin/sh\ncase \"$1\" in --version) echo 'ip6tables v1.8.7 (legacy)';; *) echo '-P INPUT ACCEPT';; esac\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "ip6tables"), []byte(script), 0755); err != nil {
+		t.Fatalf("writing fake ip6tables: %v", err)
+	}
+	if !Available(ProtocolIPv6) {
+		t.Fatalf("Available did not find ip6tables")
+	}
+	rules, err := ipt.List("filter", "INPUT")
+	if err != nil || len(rules) != 1 || rules[0] != "-P INPUT ACCEPT" {
+		t.Fatalf("List returned %q, %v", rules, err)
+	}
+	if !ipt.Wait() || !ipt.IsIPv6() {
+		t.Fatalf("capabilities not detected")
+	}
+	// options are applied on detection
+	if err := ipt.Append("filter", "INPUT", "-j", "ACCEPT"); err != ErrReadOnly {
+		t.Fatalf("Append returned %v, want ErrReadOnly", err)
+	}
+}
@@ -0,0 +1,577 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// listRulesFallback emulates the "-S" listing args with "-L -n -v -x" for
+// binaries without -S, calling fn with every line of the listing translated
+// to "-S" format, so List, Exists and the other listing methods keep working
+// on embedded and very old builds. The basic options and the common matches
+// and targets are translated; a rule using any other extension fails the
+// listing, as its "-L" output cannot be turned back into options reliably.
+func (ipt *IPTables) listRulesFallback(args []string, fn func(line string) error) error {
+	table, chain, rulenum, counters, rest, err := parseListRulesArgs(args)
+	if err != nil {
+		return err
+	}
+	largs := []string{"-t", table, "-L"}
+	if chain != "" {
+		largs = append(largs, chain)
+	}
+	largs = append(append(largs, "-n", "-v", "-x"), rest...)
+
+	tr := &listTranslator{proto: ipt.proto, rulenum: rulenum, counters: counters}
+	return ipt.ExecuteListFunc(largs, func(line string) error {
+		out, ok, err := tr.translate(line)
+		if err != nil || !ok {
+			return err
+		}
+		return fn(out)
+	})
+}
+
+// parseListRulesArgs splits the arguments of a "-S" listing into the table,
+// the chain and rule number listed, if any, whether counters are listed, and
+// the other arguments, e.g. "--wait".
+func parseListRulesArgs(args []string) (table, chain string, rulenum int, counters bool, rest []string, err error) {
+	table = "filter"
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-t", "--table":
+			if i+1 >= len(args) {
+				return "", "", 0, false, nil, ErrListRulesUnsupported
+			}
+			i++
+			table = args[i]
+		case "-S", "--list-rules":
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				chain = args[i]
+			}
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				rulenum, err = strconv.Atoi(args[i])
+				if err != nil || rulenum < 1 {
+					return "", "", 0, false, nil, ErrListRulesUnsupported
+				}
+			}
+		case "-v", "--verbose":
+			counters = true
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return table, chain, rulenum, counters, rest, nil
+}
+
+// listTranslator translates "iptables -L -n -v -x" output to "-S" format,
+// one line at a time.
+type listTranslator struct {
+	proto Protocol
+	// rulenum selects a single rule of the chain, as "-S <chain> <rulenum>"
+	// does; 0 lists the chain declarations and all rules
+	rulenum  int
+	counters bool
+
+	chain string
+	n     int
+}
+
+// translate returns the "-S" line for a line of "-L" output, and false if it
+// has none, e.g. for the column headers.
+func (tr *listTranslator) translate(line string) (string, bool, error) {
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 0:
+		return "", false, nil
+	case fields[0] == "Chain" && len(fields) >= 3:
+		tr.chain, tr.n = fields[1], 0
+		if tr.rulenum > 0 {
+			return "", false, nil
+		}
+		return chainHeaderLine(fields, tr.counters)
+	case fields[0] == "pkts":
+		return "", false, nil
+	case tr.chain == "":
+		return "", false, fmt.Errorf("unexpected line in iptables -L output: %q", line)
+	}
+
+	tr.n++
+	if tr.rulenum > 0 && tr.n != tr.rulenum {
+		return "", false, nil
+	}
+	args, err := translateListRule(line, tr.proto, tr.counters)
+	if err != nil {
+		return "", false, fmt.Errorf("%v in iptables -L output of chain %s: %q", err, tr.chain, line)
+	}
+	if len(args) == 0 {
+		return "-A " + tr.chain, true, nil
+	}
+	return "-A " + tr.chain + " " + joinRule(args), true, nil
+}
+
+// chainHeaderLine translates a "Chain ..." header of "-L" output, either
+// "Chain INPUT (policy ACCEPT 0 packets, 0 bytes)" of a built-in chain or
+// "Chain FOO (1 references)" of a user-defined one.
+func chainHeaderLine(fields []string, counters bool) (string, bool, error) {
+	if fields[2] != "(policy" {
+		return "-N " + fields[1], true, nil
+	}
+	if len(fields) < 4 {
+		return "", false, fmt.Errorf("unexpected chain header in iptables -L output: %q", strings.Join(fields, " "))
+	}
+	line := "-P " + fields[1] + " " + strings.TrimSuffix(fields[3], ")")
+	if counters && len(fields) >= 8 {
+		line += " -c " + fields[4] + " " + fields[6]
+	}
+	return line, true, nil
+}
+
+// translateListRule translates a rule line of "-L -n -v -x" output, e.g.
+// "0 0 ACCEPT tcp -- eth0 * 10.0.0.0/8 0.0.0.0/0 tcp dpt:22", to a rulespec.
+func translateListRule(line string, proto Protocol, counters bool) ([]string, error) {
+	fields := strings.Fields(line)
+	// the source and destination are the first two addresses after the
+	// counters; they locate the other columns, as the target may be empty
+	// and ip6tables lists no "opt" column
+	s := -1
+	for i := 4; i+1 < len(fields); i++ {
+		if isListAddr(fields[i]) && isListAddr(fields[i+1]) {
+			s = i
+			break
+		}
+	}
+	if s < 0 {
+		return nil, fmt.Errorf("no source and destination")
+	}
+	head := fields[2 : s-2]
+	opt := ""
+	if n := len(head); n > 0 && isListOpt(head[n-1]) {
+		opt, head = head[n-1], head[:n-1]
+	}
+	var target, prot string
+	switch len(head) {
+	case 1:
+		prot = head[0]
+	case 2:
+		target, prot = head[0], head[1]
+	default:
+		return nil, fmt.Errorf("unexpected columns")
+	}
+
+	var args []string
+	add := func(opt, value string) {
+		if strings.HasPrefix(value, "!") {
+			args = append(args, "!")
+			value = value[1:]
+		}
+		args = append(args, opt, value)
+	}
+	for _, a := range []struct{ opt, value string }{{"-s", fields[s]}, {"-d", fields[s+1]}} {
+		value := a.value
+		neg := strings.HasPrefix(value, "!")
+		value = normalizeAddress(strings.TrimPrefix(value, "!"))
+		if !neg && (value == "0.0.0.0/0" || value == "::/0") {
+			continue
+		}
+		if neg {
+			value = "!" + value
+		}
+		add(a.opt, value)
+	}
+	if in := fields[s-2]; in != "*" {
+		add("-i", in)
+	}
+	if out := fields[s-1]; out != "*" {
+		add("-o", out)
+	}
+	if prot != "all" && prot != "0" {
+		add("-p", prot)
+	}
+	switch opt {
+	case "-f":
+		args = append(args, "-f")
+	case "!f":
+		args = append(args, "!", "-f")
+	}
+
+	tokens, err := splitListExtras(skipFields(line, s+2))
+	if err != nil {
+		return nil, err
+	}
+	matches, targetArgs, gotoTarget, err := translateListExtras(tokens, target)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, matches...)
+	if counters {
+		args = append(args, "-c", fields[0], fields[1])
+	}
+	if target != "" {
+		jump := "-j"
+		if gotoTarget {
+			jump = "-g"
+		}
+		args = append(append(args, jump, target), targetArgs...)
+	}
+	return args, nil
+}
+
+// isListAddr reports whether a column of "-L -n" output is an address,
+// possibly negated.
+func isListAddr(s string) bool {
+	s = strings.TrimPrefix(s, "!")
+	if strings.Contains(s, "/") {
+		_, _, err := net.ParseCIDR(s)
+		return err == nil
+	}
+	return net.ParseIP(s) != nil
+}
+
+// isListOpt reports whether a column of "-L" output is the "opt" column
+// of iptables, which shows fragment matching.
+func isListOpt(s string) bool {
+	return s == "--" || s == "-f" || s == "!f"
+}
+
+// skipFields returns s without its first n whitespace-separated fields.
+func skipFields(s string, n int) string {
+	for ; n > 0; n-- {
+		s = strings.TrimLeft(s, " \t")
+		i := strings.IndexAny(s, " \t")
+		if i < 0 {
+			return ""
+		}
+		s = s[i:]
+	}
+	return strings.TrimSpace(s)
+}
+
+// splitListExtras splits the match and target details of a rule of "-L"
+// output into words. Comments ("/* ... */") are kept as one word, and quoted
+// strings, e.g. LOG prefixes, are unquoted.
+func splitListExtras(s string) ([]string, error) {
+	var tokens []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		switch {
+		case s == "":
+			return tokens, nil
+		case strings.HasPrefix(s, "/*"):
+			end := strings.Index(s[2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment")
+			}
+			tokens = append(tokens, s[:end+4])
+			s = s[end+4:]
+		case s[0] == '"' || s[0] == '`':
+			closing := byte('"')
+			if s[0] == '`' {
+				closing = '\''
+			}
+			end := strings.IndexByte(s[1:], closing)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			tokens = append(tokens, s[1:end+1])
+			s = s[end+2:]
+		default:
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			tokens = append(tokens, s[:end])
+			s = s[end:]
+		}
+	}
+}
+
+// tcpFlagBits are the bits of the TCP flags in "-L" output of --tcp-flags.
+var tcpFlagBits = map[TCPFlag]uint64{
+	TCPFlagFIN: 0x01,
+	TCPFlagSYN: 0x02,
+	TCPFlagRST: 0x04,
+	TCPFlagPSH: 0x08,
+	TCPFlagACK: 0x10,
+	TCPFlagURG: 0x20,
+}
+
+// logFlagOptions are the options of the LOG target by their bit in "-L" output.
+var logFlagOptions = []struct {
+	bit    uint64
+	option string
+}{
+	{0x01, "--log-tcp-sequence"},
+	{0x02, "--log-tcp-options"},
+	{0x04, "--log-ip-options"},
+	{0x08, "--log-uid"},
+}
+
+// translateListExtras translates the match and target details of a rule of
+// "-L" output to the match options and the target options.
+func translateListExtras(tokens []string, target string) (matches, targetArgs []string, gotoTarget bool, err error) {
+	i := 0
+	next := func() (string, bool) {
+		if i+1 >= len(tokens) {
+			return "", false
+		}
+		i++
+		return tokens[i], true
+	}
+	// negated splits a leading "!" off a value, as "-L" shows negations
+	negated := func(opt, value string) []string {
+		if strings.HasPrefix(value, "!") {
+			return []string{"!", opt, value[1:]}
+		}
+		return []string{opt, value}
+	}
+	unsupported := func() error {
+		return fmt.Errorf("untranslatable %q", strings.Join(tokens[i:], " "))
+	}
+
+	for ; i < len(tokens); i++ {
+		tok := tokens[i]
+		switch {
+		case strings.HasPrefix(tok, "/*"):
+			matches = append(matches, "-m", "comment", "--comment", strings.TrimSpace(tok[2:len(tok)-2]))
+		case tok == "[goto]":
+			gotoTarget = true
+		case tok == "tcp" || tok == "udp":
+			matches = append(matches, "-m", tok)
+			for i+1 < len(tokens) {
+				opts, ok := translatePortOption(tokens[i+1])
+				if !ok {
+					break
+				}
+				matches = append(matches, opts...)
+				i++
+			}
+		case tok == "icmptype" || tok == "ipv6-icmptype" || tok == "icmp" || tok == "ipv6-icmp":
+			name, option := "icmp", "--icmp-type"
+			if strings.HasPrefix(tok, "ipv6") {
+				name, option = "icmp6", "--icmpv6-type"
+			}
+			if tok == "icmp" || tok == "ipv6-icmp" {
+				// newer releases print "icmp type 8" instead of "icmptype 8"
+				t, ok := next()
+				if !ok || (t != "type" && t != "!type") {
+					return nil, nil, false, unsupported()
+				}
+				if t == "!type" {
+					option = "!" + option
+				}
+			}
+			value, ok := next()
+			if !ok {
+				return nil, nil, false, unsupported()
+			}
+			if i+2 < len(tokens) && tokens[i+1] == "code" {
+				value += "/" + tokens[i+2]
+				i += 2
+			}
+			matches = append(matches, "-m", name)
+			if strings.HasPrefix(option, "!") {
+				matches = append(matches, "!", option[1:], value)
+			} else {
+				matches = append(matches, option, value)
+			}
+		case tok == "state" || tok == "ctstate":
+			value, ok := next()
+			if !ok {
+				return nil, nil, false, unsupported()
+			}
+			if tok == "state" {
+				matches = append(append(matches, "-m", "state"), negated("--state", value)...)
+			} else {
+				matches = append(append(matches, "-m", "conntrack"), negated("--ctstate", value)...)
+			}
+		case tok == "multiport":
+			kind, ok1 := next()
+			value, ok2 := next()
+			if !ok1 || !ok2 || (kind != "dports" && kind != "sports" && kind != "ports") {
+				return nil, nil, false, unsupported()
+			}
+			matches = append(append(matches, "-m", "multiport"), negated("--"+kind, value)...)
+		case tok == "mark":
+			m, ok1 := next()
+			value, ok2 := next()
+			if !ok1 || !ok2 || m != "match" {
+				return nil, nil, false, unsupported()
+			}
+			matches = append(append(matches, "-m", "mark"), negated("--mark", value)...)
+		case tok == "limit:":
+			avg, ok1 := next()
+			rate, ok2 := next()
+			burst, ok3 := next()
+			n, ok4 := next()
+			if !ok1 || !ok2 || !ok3 || !ok4 || avg != "avg" || burst != "burst" {
+				return nil, nil, false, unsupported()
+			}
+			matches = append(matches, "-m", "limit", "--limit", rate, "--limit-burst", n)
+		case tok == "MAC":
+			value, ok := next()
+			if !ok {
+				return nil, nil, false, unsupported()
+			}
+			matches = append(append(matches, "-m", "mac"), negated("--mac-source", value)...)
+		case tok == "match-set":
+			name, ok1 := next()
+			dirs, ok2 := next()
+			if !ok1 || !ok2 {
+				return nil, nil, false, unsupported()
+			}
+			matches = append(matches, "-m", "set", "--match-set", name, dirs)
+		case tok == "reject-with":
+			value, ok := next()
+			if !ok {
+				return nil, nil, false, unsupported()
+			}
+			targetArgs = append(targetArgs, "--reject-with", value)
+		case tok == "LOG":
+			args, err := translateLogTarget(tokens[i+1:])
+			if err != nil {
+				return nil, nil, false, err
+			}
+			targetArgs = append(targetArgs, args...)
+			i = len(tokens)
+		case strings.HasPrefix(tok, "to:"):
+			switch target {
+			case "DNAT":
+				targetArgs = append(targetArgs, "--to-destination", tok[3:])
+			case "SNAT":
+				targetArgs = append(targetArgs, "--to-source", tok[3:])
+			default:
+				return nil, nil, false, unsupported()
+			}
+		case tok == "masq" || tok == "redir":
+			ports, ok1 := next()
+			value, ok2 := next()
+			if !ok1 || !ok2 || strings.TrimSuffix(ports, ":") != "ports" {
+				return nil, nil, false, unsupported()
+			}
+			targetArgs = append(targetArgs, "--to-ports", value)
+		case tok == "MARK":
+			op, ok1 := next()
+			value, ok2 := next()
+			switch {
+			case ok1 && ok2 && op == "set":
+				targetArgs = append(targetArgs, "--set-xmark", value+"/"+fullMarkMask)
+			case ok1 && ok2 && op == "xset":
+				targetArgs = append(targetArgs, "--set-xmark", value)
+			default:
+				return nil, nil, false, unsupported()
+			}
+		case tok == "TCPMSS":
+			op, ok := next()
+			switch {
+			case ok && op == "set" && i+1 < len(tokens):
+				i++
+				targetArgs = append(targetArgs, "--set-mss", tokens[i])
+			case ok && op == "clamp" && i+2 < len(tokens) && tokens[i+1] == "to" && tokens[i+2] == "PMTU":
+				i += 2
+				targetArgs = append(targetArgs, "--clamp-mss-to-pmtu")
+			default:
+				return nil, nil, false, unsupported()
+			}
+		default:
+			return nil, nil, false, unsupported()
+		}
+	}
+	return matches, targetArgs, gotoTarget, nil
+}
+
+// translatePortOption translates an option of the tcp or udp match in "-L"
+// output, e.g. "dpt:22", "spts:1024:65535" or "flags:0x17/0x02".
+func translatePortOption(tok string) ([]string, bool) {
+	i := strings.IndexAny(tok, ":=")
+	if i < 0 {
+		return nil, false
+	}
+	name, value := tok[:i], tok[i+1:]
+	var args []string
+	if strings.HasPrefix(value, "!") {
+		args = append(args, "!")
+		value = value[1:]
+	}
+	switch name {
+	case "spt", "spts":
+		return append(args, "--sport", value), true
+	case "dpt", "dpts":
+		return append(args, "--dport", value), true
+	case "option":
+		return append(args, "--tcp-option", value), true
+	case "flags":
+		parts := strings.SplitN(value, "/", 2)
+		if len(parts) != 2 {
+			return nil, false
+		}
+		mask, err1 := strconv.ParseUint(parts[0], 0, 8)
+		comp, err2 := strconv.ParseUint(parts[1], 0, 8)
+		if err1 != nil || err2 != nil {
+			return nil, false
+		}
+		return append(args, "--tcp-flags", tcpFlagNames(mask), tcpFlagNames(comp)), true
+	}
+	return nil, false
+}
+
+// tcpFlagNames returns the names of the TCP flags set in bits, as listed.
+func tcpFlagNames(bits uint64) string {
+	var names []string
+	for _, f := range tcpFlagOrder {
+		if bits&tcpFlagBits[f] != 0 {
+			names = append(names, string(f))
+		}
+	}
+	if len(names) == 0 {
+		return string(TCPFlagNone)
+	}
+	return strings.Join(names, ",")
+}
+
+// translateLogTarget translates the details of the LOG target in "-L"
+// output, "flags <n> level <n> [prefix <prefix>]".
+func translateLogTarget(tokens []string) ([]string, error) {
+	if len(tokens) < 4 || tokens[0] != "flags" || tokens[2] != "level" {
+		return nil, fmt.Errorf("untranslatable LOG %q", strings.Join(tokens, " "))
+	}
+	flags, err := strconv.ParseUint(tokens[1], 0, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LOG flags %q", tokens[1])
+	}
+	var args []string
+	switch {
+	case len(tokens) == 6 && tokens[4] == "prefix":
+		args = append(args, "--log-prefix", tokens[5])
+	case len(tokens) != 4:
+		return nil, fmt.Errorf("untranslatable LOG %q", strings.Join(tokens, " "))
+	}
+	// the default level is not listed by "-S"
+	if tokens[3] != "4" {
+		args = append(args, "--log-level", tokens[3])
+	}
+	for _, f := range logFlagOptions {
+		if flags&f.bit != 0 {
+			args = append(args, f.option)
+		}
+	}
+	return args, nil
+}
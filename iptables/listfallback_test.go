@@ -0,0 +1,91 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListTranslator(t *testing.T) {
+	output := []string{
+		"Chain INPUT (policy DROP 10 packets, 600 bytes)",
+		"    pkts      bytes target     prot opt in     out     source               destination",
+		"       3      180 ACCEPT     all  --  lo     *       0.0.0.0/0            0.0.0.0/0",
+		"      42     3360 ACCEPT     tcp  --  eth0   *       192.0.2.0/24         0.0.0.0/0            tcp dpt:22 /* ssh from lan */",
+		"       0        0 ACCEPT     all  --  *      *       0.0.0.0/0            0.0.0.0/0            ctstate RELATED,ESTABLISHED",
+		"       0        0 DROP       tcp  --  *      *       0.0.0.0/0            0.0.0.0/0            tcp flags:!0x17/0x02 ctstate NEW",
+		"       0        0 ACCEPT     icmp --  *      *       0.0.0.0/0            0.0.0.0/0            icmptype 8 limit: avg 1/sec burst 5",
+		"       0        0            all  --  !eth1  *       !10.0.0.1            0.0.0.0/0",
+		"       0        0 LOG-DROP   udp  -f  *      *       0.0.0.0/0            198.51.100.7         [goto] ",
+		"",
+		"Chain LOG-DROP (1 references)",
+		"    pkts      bytes target     prot opt in     out     source               destination",
+		"       0        0 LOG        all  --  *      *       0.0.0.0/0            0.0.0.0/0            LOG flags 1 level 6 prefix \"dropped: \"",
+		"       0        0 REJECT     tcp  --  *      *       0.0.0.0/0            0.0.0.0/0            multiport dports 80,443 reject-with tcp-reset",
+	}
+	translate := func(tr *listTranslator, output []string) []string {
+		var lines []string
+		for _, line := range output {
+			out, ok, err := tr.translate(line)
+			if err != nil {
+				t.Fatalf("translate failed: %v", err)
+			}
+			if ok {
+				lines = append(lines, out)
+			}
+		}
+		return lines
+	}
+
+	expected := []string{
+		"-P INPUT DROP",
+		"-A INPUT -i lo -j ACCEPT",
+		`-A INPUT -s 192.0.2.0/24 -i eth0 -p tcp -m tcp --dport 22 -m comment --comment "ssh from lan" -j ACCEPT`,
+		"-A INPUT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"-A INPUT -p tcp -m tcp ! --tcp-flags FIN,SYN,RST,ACK SYN -m conntrack --ctstate NEW -j DROP",
+		"-A INPUT -p icmp -m icmp --icmp-type 8 -m limit --limit 1/sec --limit-burst 5 -j ACCEPT",
+		"-A INPUT ! -s 10.0.0.1/32 ! -i eth1",
+		"-A INPUT -d 198.51.100.7/32 -p udp -f -g LOG-DROP",
+		"-N LOG-DROP",
+		`-A LOG-DROP -j LOG --log-prefix "dropped: " --log-level 6 --log-tcp-sequence`,
+		"-A LOG-DROP -p tcp -m multiport --dports 80,443 -j REJECT --reject-with tcp-reset",
+	}
+	if got := translate(&listTranslator{}, output); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("translation mismatch: \ngot  %q \nneed %q", got, expected)
+	}
+
+	// "-S INPUT 1" lists a single chain
+	expected = []string{"-A INPUT -i lo -c 3 180 -j ACCEPT"}
+	if got := translate(&listTranslator{rulenum: 1, counters: true}, output[:9]); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("translation of rule 1 mismatch: \ngot  %q \nneed %q", got, expected)
+	}
+
+	tr := &listTranslator{}
+	tr.translate("Chain FOO (0 references)")
+	if _, _, err := tr.translate("0 0 ACCEPT all -- * * 0.0.0.0/0 0.0.0.0/0 u32 0x0>>0x16&0x3c@0x4=0x1"); err == nil {
+		t.Fatalf("translate of an unknown extension did not fail")
+	}
+}
+
+func TestListTranslatorIPv6(t *testing.T) {
+	tr := &listTranslator{proto: ProtocolIPv6}
+	tr.translate("Chain INPUT (policy ACCEPT 0 packets, 0 bytes)")
+	out, ok, err := tr.translate("       0        0 ACCEPT     ipv6-icmp    *      *       ::/0                 2001:db8::/32        ipv6-icmptype 135")
+	expected := "-A INPUT -d 2001:db8::/32 -p ipv6-icmp -m icmp6 --icmpv6-type 135 -j ACCEPT"
+	if err != nil || !ok || out != expected {
+		t.Fatalf("translate returned %q, %v, %v; want %q", out, ok, err, expected)
+	}
+}
@@ -12,15 +12,22 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build linux
+// +build linux
+
 package iptables
 
 import (
+	"context"
 	"os"
 	"sync"
 	"syscall"
+	"time"
 )
 
-const (
+// The lockfiles are variables so tests can point them at a temporary
+// directory.
+var (
 	// In earlier versions of iptables, the xtables lock was implemented
 	// via a Unix socket, but now flock is used via this lockfile:
 	// http://git.netfilter.org/iptables/commit/?id=aa562a660d1555b13cffbac1e744033e91f82707
@@ -28,7 +35,16 @@ const (
 	// distributions, so assume "/var" is symlinked
 	xtablesLockFilePath = "/var/run/xtables.lock"
 
+	// coordinationLockFilePath is locked by AcquireSequenceLock instead of the
+	// xtables lockfile when iptables takes the latter itself for every invocation
+	coordinationLockFilePath = "/var/run/xtables.go-iptables.lock"
+)
+
+const (
 	defaultFilePerm = 0600
+
+	// lockRetryInterval is how often AcquireSequenceLock retries a busy lock
+	lockRetryInterval = 20 * time.Millisecond
 )
 
 type Unlocker interface {
@@ -82,3 +98,67 @@ func newXtablesFileLock() (*fileLock, error) {
 	}
 	return &fileLock{fd: fd}, nil
 }
+
+// SequenceLock is an exclusive lock held across several iptables commands,
+// returned by AcquireSequenceLock.
+type SequenceLock struct {
+	mu sync.Mutex
+	fd int
+}
+
+// AcquireSequenceLock blocks until it holds an exclusive lock for a multi-step
+// read-modify-write sequence (e.g. List followed by Insert at a computed
+// position), or until ctx is done. The lock is held until Release is called.
+//
+// It replaces the requested AcquireXtablesLock, which cannot be provided:
+// iptables binaries with --wait take the xtables lock for every invocation,
+// so holding it across commands would block them. The lock therefore only
+// coordinates the users of this package: a lockfile of this package is
+// locked instead, which excludes every holder of a SequenceLock, in this
+// process or others, but not iptables run by other programs. For binaries
+// without --wait, the xtables lock itself is taken, and commands run
+// meanwhile by any IPTables of this process proceed without taking it again.
+func (ipt *IPTables) AcquireSequenceLock(ctx context.Context) (*SequenceLock, error) {
+	if err := ipt.ready(); err != nil {
+		return nil, err
+	}
+	path := xtablesLockFilePath
+	if ipt.hasWait {
+		path = coordinationLockFilePath
+	}
+	fd, err := syscall.Open(path, os.O_CREATE, defaultFilePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err := syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+		switch err {
+		case nil:
+			return &SequenceLock{fd: fd}, nil
+		case syscall.EWOULDBLOCK:
+		default:
+			syscall.Close(fd)
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			syscall.Close(fd)
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// Release unlocks the lock. Calling it more than once has no effect.
+func (l *SequenceLock) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fd < 0 {
+		return nil
+	}
+	err := syscall.Close(l.fd)
+	l.fd = -1
+	return err
+}
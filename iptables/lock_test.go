@@ -0,0 +1,65 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeLockFiles points the lockfiles at dir for the duration of the test.
+func fakeLockFiles(t *testing.T, dir string) {
+	oldXtables, oldCoordination := xtablesLockFilePath, coordinationLockFilePath
+	xtablesLockFilePath = filepath.Join(dir, "xtables.lock")
+	coordinationLockFilePath = filepath.Join(dir, "xtables.go-iptables.lock")
+	t.Cleanup(func() {
+		xtablesLockFilePath, coordinationLockFilePath = oldXtables, oldCoordination
+	})
+}
+
+func TestAcquireSequenceLock(t *testing.T) {
+	fakeLockFiles(t, t.TempDir())
+	ipt := &IPTables{hasWait: true}
+
+	l, err := ipt.AcquireSequenceLock(context.Background())
+	if err != nil {
+		t.Fatalf("AcquireSequenceLock failed: %v", err)
+	}
+
+	// a second holder must wait until the lock is released
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := ipt.AcquireSequenceLock(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("AcquireSequenceLock of held lock: expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	if err := l.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if err := l.Release(); err != nil {
+		t.Fatalf("second Release failed: %v", err)
+	}
+
+	l, err = ipt.AcquireSequenceLock(context.Background())
+	if err != nil {
+		t.Fatalf("AcquireSequenceLock after Release failed: %v", err)
+	}
+	l.Release()
+}
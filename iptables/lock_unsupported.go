@@ -0,0 +1,52 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package iptables
+
+import (
+	"context"
+)
+
+// Stubs so the package compiles on platforms without iptables. They are
+// unreachable in practice, as New fails with ErrNotSupported there.
+
+type Unlocker interface {
+	Unlock() error
+}
+
+type fileLock struct{}
+
+func (l *fileLock) tryLock() (Unlocker, error) {
+	return nil, ErrNotSupported
+}
+
+func newXtablesFileLock() (*fileLock, error) {
+	return nil, ErrNotSupported
+}
+
+// SequenceLock is an exclusive lock held across several iptables commands.
+type SequenceLock struct{}
+
+// AcquireSequenceLock always fails with ErrNotSupported on this platform.
+func (ipt *IPTables) AcquireSequenceLock(ctx context.Context) (*SequenceLock, error) {
+	return nil, ErrNotSupported
+}
+
+// Release has no effect on this platform.
+func (l *SequenceLock) Release() error {
+	return nil
+}
@@ -0,0 +1,274 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrUserChain is returned when a ChainManager is asked to modify the
+// contents of its user hook chain, which belongs to the administrator.
+var ErrUserChain = errors.New("iptables: chain is reserved for user rules")
+
+// ChainManager maintains chains owned by the program in a single table and
+// the jumps that hook them into built-in chains.
+//
+// Following the Docker DOCKER-USER pattern, a user hook chain can be enabled
+// with EnableUserChain. It is hooked ahead of every managed chain and never
+// flushed or deleted by the manager, so administrators can add rules that
+// override the program's own.
+type ChainManager struct {
+	ipt   *IPTables
+	table string
+
+	mu        sync.Mutex
+	chains    map[string]*managedChain
+	hooks     []chainHook
+	userChain string
+}
+
+// managedChain is the state of a chain created by a ChainManager.
+type managedChain struct {
+	// rules are the rulespecs last set with SetRules
+	rules [][]string
+	// protected is set by Protect
+	protected bool
+}
+
+// chainHook is a jump from a built-in chain into a managed chain.
+type chainHook struct {
+	from, to string
+}
+
+// NewChainManager returns a manager for chains in the specified table.
+func NewChainManager(ipt *IPTables, table string) *ChainManager {
+	return &ChainManager{
+		ipt:    ipt,
+		table:  table,
+		chains: make(map[string]*managedChain),
+	}
+}
+
+// Table returns the table the manager operates on.
+func (m *ChainManager) Table() string {
+	return m.table
+}
+
+// Chains returns the sorted names of the managed chains, not including the
+// user hook chain.
+func (m *ChainManager) Chains() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.chainNames()
+}
+
+func (m *ChainManager) chainNames() []string {
+	chains := make([]string, 0, len(m.chains))
+	for chain := range m.chains {
+		chains = append(chains, chain)
+	}
+	sort.Strings(chains)
+	return chains
+}
+
+// EnableUserChain creates the user hook chain if it does not exist yet,
+// with a single RETURN rule, and makes a jump to it the first rule of each
+// of the from chains. Existing rules of the user chain are kept.
+func (m *ChainManager) EnableUserChain(chain string, from ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.chains[chain] != nil {
+		return fmt.Errorf("chain %s is already managed", chain)
+	}
+	exists, err := m.ipt.ChainExists(m.table, chain)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := m.ipt.NewChain(m.table, chain); err != nil {
+			return err
+		}
+		if err := m.ipt.Append(m.table, chain, "-j", "RETURN"); err != nil {
+			return err
+		}
+	}
+	for _, f := range from {
+		if err := m.ipt.EnsureJump(m.table, f, chain, JumpFirst); err != nil {
+			return err
+		}
+	}
+	m.userChain = chain
+	return nil
+}
+
+// UserChain returns the name of the user hook chain, or "" if none is enabled.
+func (m *ChainManager) UserChain() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.userChain
+}
+
+// EnsureChain creates the chain if it does not exist and records it as managed.
+func (m *ChainManager) EnsureChain(chain string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ensureChain(chain)
+}
+
+func (m *ChainManager) ensureChain(chain string) error {
+	if chain == m.userChain {
+		return ErrUserChain
+	}
+	exists, err := m.ipt.ChainExists(m.table, chain)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := m.ipt.NewChain(m.table, chain); err != nil {
+			return err
+		}
+	}
+	if m.chains[chain] == nil {
+		m.chains[chain] = &managedChain{}
+	}
+	return nil
+}
+
+// Hook ensures the managed chain is jumped to from the given chain. A new
+// jump is inserted right after the jump to the user hook chain, or at the top
+// if there is none, so the user chain is always evaluated first.
+func (m *ChainManager) Hook(from, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.ensureChain(to); err != nil {
+		return err
+	}
+	rules, err := m.ipt.ExecuteList([]string{"-t", m.table, "-S", from})
+	if err != nil {
+		return err
+	}
+	// Insert tags the jump if the handle has an Owner
+	jump, err := m.ipt.owned([]string{"-j", to})
+	if err != nil {
+		return err
+	}
+	// EnableUserChain tags the user jump too, but it may predate the Owner
+	userJump, err := m.ipt.owned([]string{"-j", m.userChain})
+	if err != nil {
+		return err
+	}
+	pos := 1
+	for i, rule := range rules {
+		switch rule {
+		case "-A " + from + " " + joinRule(jump):
+			m.addHook(from, to)
+			return nil
+		case "-A " + from + " -j " + m.userChain, "-A " + from + " " + joinRule(userJump):
+			// rules[0] is the policy or chain declaration, so the index of
+			// the user jump is its position and i+1 the one right after it
+			pos = i + 1
+		}
+	}
+	if err := m.ipt.Insert(m.table, from, pos, "-j", to); err != nil {
+		return err
+	}
+	m.addHook(from, to)
+	return nil
+}
+
+func (m *ChainManager) addHook(from, to string) {
+	for _, h := range m.hooks {
+		if h.from == from && h.to == to {
+			return
+		}
+	}
+	m.hooks = append(m.hooks, chainHook{from, to})
+}
+
+// SetRules replaces the rules of a managed chain with the given rulespecs in
+// a single iptables-restore transaction, creating the chain if needed.
+// It fails with ErrUserChain for the user hook chain.
+func (m *ChainManager) SetRules(chain string, rules [][]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.ensureChain(chain); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if m.chains[chain].protected {
+		buf.WriteString("-A " + chain + " " + joinRule(protectMarker) + "\n")
+	}
+	for _, rule := range rules {
+		buf.WriteString("-A " + chain + " " + joinRule(rule) + "\n")
+	}
+	if err := m.ipt.RestoreChain(m.table, chain, buf.String(), true); err != nil {
+		return err
+	}
+	m.chains[chain].rules = rules
+	return nil
+}
+
+// Cleanup removes the hooks and deletes the managed chains. The user hook
+// chain and the jumps to it are left in place, as are protected chains and
+// the hooks to them.
+func (m *ChainManager) Cleanup() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []chainHook
+	for _, h := range m.hooks {
+		if m.chains[h.to] != nil && m.chains[h.to].protected {
+			kept = append(kept, h)
+			continue
+		}
+		exists, err := m.ipt.Exists(m.table, h.from, "-j", h.to)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := m.ipt.Delete(m.table, h.from, "-j", h.to); err != nil {
+				return err
+			}
+		}
+	}
+	m.hooks = kept
+
+	// flush everything first, as managed chains may jump to each other
+	for chain, c := range m.chains {
+		if c.protected {
+			continue
+		}
+		if err := m.ipt.ClearChain(m.table, chain); err != nil {
+			return err
+		}
+	}
+	for chain, c := range m.chains {
+		if c.protected {
+			continue
+		}
+		if err := m.ipt.DeleteChain(m.table, chain); err != nil {
+			return err
+		}
+		delete(m.chains, chain)
+	}
+	return nil
+}
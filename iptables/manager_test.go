@@ -0,0 +1,50 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChainManagerHookOwner(t *testing.T) {
+	userJump := "-m comment --comment owner=agent,id=" + ruleID([]string{"-j", "USER"}) + " -j USER"
+	ipt, log := newFakeIPTables(t, `case "$*" in
+*"-S USER"*) printf -- '-N USER\n-A USER -j RETURN\n';;
+*"-S MINE"*) printf -- '-N MINE\n';;
+*"-S FORWARD"*) printf -- '-P FORWARD ACCEPT\n-A FORWARD `+userJump+`\n-A FORWARD -j OTHER\n';;
+esac`)
+	Owner("agent")(ipt)
+	m := NewChainManager(ipt, "filter")
+
+	if err := m.EnableUserChain("USER", "FORWARD"); err != nil {
+		t.Fatalf("EnableUserChain failed: %v", err)
+	}
+	if err := m.Hook("FORWARD", "MINE"); err != nil {
+		t.Fatalf("Hook failed: %v", err)
+	}
+	// the managed jump goes right after the tagged user jump
+	want := "--wait -t filter -I FORWARD 2 -m comment --comment owner=agent,id=" + ruleID([]string{"-j", "MINE"}) + " -j MINE"
+	calls := fakeCalls(t, log)
+	for _, c := range calls {
+		if c == want {
+			return
+		}
+	}
+	t.Fatalf("calls %s, missing %q", strings.Join(calls, "\n"), want)
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"strings"
+)
+
+// ManagerInfo reports another firewall manager found to be active.
+type ManagerInfo struct {
+	// Name identifies the manager, e.g. "docker" or "firewalld".
+	Name string
+	// Evidence lists what was found, e.g. "filter: chain DOCKER-USER".
+	Evidence []string
+}
+
+// managerSignature describes the chains a firewall manager creates.
+type managerSignature struct {
+	name     string
+	chains   []string
+	prefixes []string
+}
+
+var managerSignatures = []managerSignature{
+	{"docker", []string{"DOCKER", "DOCKER-USER", "DOCKER-FORWARD"}, []string{"DOCKER-ISOLATION-"}},
+	{"firewalld", []string{"INPUT_direct", "INPUT_ZONES", "FORWARD_direct", "OUTPUT_direct"}, []string{"IN_public", "FWDI_", "FWDO_"}},
+	{"ufw", nil, []string{"ufw-", "ufw6-"}},
+	{"kube-proxy", []string{"KUBE-SERVICES", "KUBE-FORWARD"}, []string{"KUBE-SVC-", "KUBE-SEP-"}},
+	{"fail2ban", nil, []string{"f2b-"}},
+	{"libvirt", nil, []string{"LIBVIRT_"}},
+	{"cni", nil, []string{"CNI-"}},
+}
+
+// managerTables are the tables DetectManagers inspects.
+var managerTables = []string{"filter", "nat"}
+
+// DetectManagers recognizes the chains characteristic of other firewall
+// managers, such as Docker, firewalld, ufw and kube-proxy, in the filter and
+// nat tables, and reports which of them are active so a program can warn
+// about or adapt to them. Managers that only use nftables directly, like
+// recent firewalld versions, cannot be seen through iptables.
+func (ipt *IPTables) DetectManagers() ([]ManagerInfo, error) {
+	tables := make(map[string]*tableRules)
+	for _, table := range managerTables {
+		t, err := ipt.listTable(table)
+		if err != nil {
+			return nil, err
+		}
+		tables[table] = t
+	}
+	return detectManagers(tables), nil
+}
+
+func detectManagers(tables map[string]*tableRules) []ManagerInfo {
+	var infos []ManagerInfo
+	for _, sig := range managerSignatures {
+		var evidence []string
+		for _, table := range managerTables {
+			t := tables[table]
+			if t == nil {
+				continue
+			}
+			for _, chain := range t.chains {
+				if sig.matches(chain) {
+					evidence = append(evidence, table+": chain "+chain)
+				}
+			}
+		}
+		if len(evidence) == 0 {
+			continue
+		}
+		// Docker switches the FORWARD policy to DROP when it starts
+		if t := tables["filter"]; sig.name == "docker" && t != nil && t.policies["FORWARD"] == "DROP" {
+			evidence = append(evidence, "filter: FORWARD policy DROP")
+		}
+		infos = append(infos, ManagerInfo{Name: sig.name, Evidence: evidence})
+	}
+	return infos
+}
+
+func (sig managerSignature) matches(chain string) bool {
+	if containsString(sig.chains, chain) {
+		return true
+	}
+	for _, prefix := range sig.prefixes {
+		if strings.HasPrefix(chain, prefix) {
+			return true
+		}
+	}
+	return false
+}
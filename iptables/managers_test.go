@@ -0,0 +1,61 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDetectManagers(t *testing.T) {
+	filter, err := parseTableRules([]string{
+		"-P INPUT ACCEPT",
+		"-P FORWARD DROP",
+		"-P OUTPUT ACCEPT",
+		"-N DOCKER",
+		"-N DOCKER-ISOLATION-STAGE-1",
+		"-N DOCKER-USER",
+		"-N ufw-before-input",
+		"-N MY-CHAIN",
+		"-A FORWARD -j DOCKER-USER",
+	})
+	if err != nil {
+		t.Fatalf("parseTableRules failed: %v", err)
+	}
+	nat, err := parseTableRules([]string{
+		"-P PREROUTING ACCEPT",
+		"-N DOCKER",
+		"-N KUBE-SERVICES",
+	})
+	if err != nil {
+		t.Fatalf("parseTableRules failed: %v", err)
+	}
+
+	infos := detectManagers(map[string]*tableRules{"filter": filter, "nat": nat})
+	expected := []ManagerInfo{
+		{"docker", []string{
+			"filter: chain DOCKER",
+			"filter: chain DOCKER-ISOLATION-STAGE-1",
+			"filter: chain DOCKER-USER",
+			"nat: chain DOCKER",
+			"filter: FORWARD policy DROP",
+		}},
+		{"ufw", []string{"filter: chain ufw-before-input"}},
+		{"kube-proxy", []string{"nat: chain KUBE-SERVICES"}},
+	}
+	if !reflect.DeepEqual(infos, expected) {
+		t.Fatalf("detectManagers mismatch: \ngot  %#v \nneed %#v", infos, expected)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// managerStateVersion is the version of the state file format.
+const managerStateVersion = 1
+
+// managerState is the state file format of a ChainManager.
+type managerState struct {
+	Version   int                 `json:"version"`
+	Table     string              `json:"table"`
+	UserChain string              `json:"user_chain,omitempty"`
+	Chains    []managedChainState `json:"chains"`
+	Hooks     []chainHookState    `json:"hooks,omitempty"`
+}
+
+type managedChainState struct {
+	Name      string     `json:"name"`
+	Rules     [][]string `json:"rules,omitempty"`
+	Protected bool       `json:"protected,omitempty"`
+}
+
+type chainHookState struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ExportState writes the chains, rules and hooks the manager created as JSON,
+// so that a restarted process can ImportState and clean up or reconcile them
+// without relying on recognizing its rules by their comments.
+func (m *ChainManager) ExportState(w io.Writer) error {
+	m.mu.Lock()
+	state := managerState{
+		Version:   managerStateVersion,
+		Table:     m.table,
+		UserChain: m.userChain,
+		Chains:    []managedChainState{},
+	}
+	for _, name := range m.chainNames() {
+		state.Chains = append(state.Chains, managedChainState{name, m.chains[name].rules, m.chains[name].protected})
+	}
+	for _, h := range m.hooks {
+		state.Hooks = append(state.Hooks, chainHookState{h.from, h.to})
+	}
+	m.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(state)
+}
+
+// ImportState replaces the manager's record of what it created with state
+// written by ExportState. The firewall itself is not modified.
+func (m *ChainManager) ImportState(r io.Reader) error {
+	var state managerState
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&state); err != nil {
+		return err
+	}
+	if state.Version != managerStateVersion {
+		return fmt.Errorf("unsupported state version %d", state.Version)
+	}
+	if state.Table != m.table {
+		return fmt.Errorf("state is for table %s, not %s", state.Table, m.table)
+	}
+
+	chains := make(map[string]*managedChain)
+	for _, c := range state.Chains {
+		if c.Name == "" || c.Name == state.UserChain {
+			return fmt.Errorf("invalid managed chain %q in state", c.Name)
+		}
+		chains[c.Name] = &managedChain{rules: c.Rules, protected: c.Protected}
+	}
+	var hooks []chainHook
+	for _, h := range state.Hooks {
+		if chains[h.To] == nil {
+			return fmt.Errorf("state hooks %s to unmanaged chain %s", h.From, h.To)
+		}
+		hooks = append(hooks, chainHook{h.From, h.To})
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.chains = chains
+	m.hooks = hooks
+	m.userChain = state.UserChain
+	return nil
+}
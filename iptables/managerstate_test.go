@@ -0,0 +1,52 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChainManagerState(t *testing.T) {
+	m := NewChainManager(nil, "filter")
+	m.userChain = "MY-USER"
+	m.chains["MY-INPUT"] = &managedChain{rules: [][]string{{"-s", "192.0.2.0/24", "-j", "ACCEPT"}}}
+	m.chains["MY-FORWARD"] = &managedChain{}
+	m.hooks = []chainHook{{"INPUT", "MY-INPUT"}, {"FORWARD", "MY-FORWARD"}}
+
+	var buf bytes.Buffer
+	if err := m.ExportState(&buf); err != nil {
+		t.Fatalf("ExportState failed: %v", err)
+	}
+
+	imported := NewChainManager(nil, "filter")
+	if err := imported.ImportState(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("ImportState failed: %v", err)
+	}
+	if !reflect.DeepEqual(imported.chains, m.chains) || !reflect.DeepEqual(imported.hooks, m.hooks) || imported.userChain != m.userChain {
+		t.Fatalf("imported state differs: \ngot  %+v \nneed %+v", imported, m)
+	}
+
+	other := NewChainManager(nil, "nat")
+	if err := other.ImportState(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatalf("ImportState of another table's state did not fail")
+	}
+	err := imported.ImportState(strings.NewReader(`{"version": 1, "table": "filter", "chains": [], "hooks": [{"from": "INPUT", "to": "X"}]}`))
+	if err == nil {
+		t.Fatalf("ImportState with a hook to an unmanaged chain did not fail")
+	}
+}
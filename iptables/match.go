@@ -0,0 +1,626 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Match is a typed iptables match extension.
+// Args renders the match as rulespec arguments, including the leading "-m <name>".
+type Match interface {
+	Args() ([]string, error)
+}
+
+// MatchArgs renders the given matches, in order, into a single rulespec.
+func MatchArgs(matches ...Match) ([]string, error) {
+	var args []string
+	for _, m := range matches {
+		a, err := m.Args()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a...)
+	}
+	return args, nil
+}
+
+// Not negates a match: "!" is placed in front of the first option after
+// "-m <name>", e.g. "-m tcp ! --tcp-flags SYN,ACK SYN", so it only negates
+// that option. Negate matches with several options one option at a time.
+func Not(m Match) Match {
+	return &notMatch{m}
+}
+
+type notMatch struct {
+	m Match
+}
+
+func (n *notMatch) Args() ([]string, error) {
+	return negateMatch(n.m.Args())
+}
+
+func (n *notMatch) ArgsFor(proto Protocol) ([]string, error) {
+	if f, ok := n.m.(FamilySpecific); ok {
+		return negateMatch(f.ArgsFor(proto))
+	}
+	return n.Args()
+}
+
+func negateMatch(args []string, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 3 || args[0] != "-m" || !strings.HasPrefix(args[2], "-") {
+		return nil, fmt.Errorf("cannot negate match %q", args)
+	}
+	if args[2] == "!" {
+		return nil, fmt.Errorf("match %q is negated already", args)
+	}
+	return append(append(append([]string{}, args[:2]...), "!"), args[2:]...), nil
+}
+
+// RecentCommand is the action performed by the recent match.
+type RecentCommand string
+
+const (
+	RecentSet    RecentCommand = "--set"
+	RecentRCheck RecentCommand = "--rcheck"
+	RecentUpdate RecentCommand = "--update"
+	RecentRemove RecentCommand = "--remove"
+)
+
+// maxRecentNameLen is XT_RECENT_NAME_LEN minus the trailing NUL.
+const maxRecentNameLen = 199
+
+// Recent is the "-m recent" match, which keeps a named list of recently seen addresses.
+type Recent struct {
+	Command RecentCommand
+	// Name of the address list; the kernel uses "DEFAULT" when empty.
+	Name string
+	// Seconds and HitCount narrow RecentRCheck and RecentUpdate; zero means unset.
+	Seconds  int
+	HitCount int
+	// Dest tracks the destination address instead of the source.
+	Dest bool
+}
+
+func (r *Recent) Args() ([]string, error) {
+	switch r.Command {
+	case RecentSet, RecentRCheck, RecentUpdate, RecentRemove:
+	default:
+		return nil, fmt.Errorf("recent: invalid command %q", r.Command)
+	}
+	if len(r.Name) > maxRecentNameLen {
+		return nil, fmt.Errorf("recent: name %q longer than %d characters", r.Name, maxRecentNameLen)
+	}
+	if r.Seconds < 0 || r.HitCount < 0 {
+		return nil, fmt.Errorf("recent: seconds and hitcount must not be negative")
+	}
+	if (r.Seconds > 0 || r.HitCount > 0) && r.Command != RecentRCheck && r.Command != RecentUpdate {
+		return nil, fmt.Errorf("recent: seconds and hitcount require %s or %s", RecentRCheck, RecentUpdate)
+	}
+
+	args := []string{"-m", "recent", string(r.Command)}
+	if r.Seconds > 0 {
+		args = append(args, "--seconds", strconv.Itoa(r.Seconds))
+	}
+	if r.HitCount > 0 {
+		args = append(args, "--hitcount", strconv.Itoa(r.HitCount))
+	}
+	if r.Name != "" {
+		args = append(args, "--name", r.Name)
+	}
+	if r.Dest {
+		args = append(args, "--rdest")
+	} else {
+		args = append(args, "--rsource")
+	}
+	return args, nil
+}
+
+// ConnLimit is the "-m connlimit" match, which caps the number of concurrent
+// connections per group of hosts.
+type ConnLimit struct {
+	// Limit is the connection count; the match applies once it is exceeded.
+	Limit int
+	// Upto inverts the match to apply while the count is at most Limit.
+	Upto bool
+	// MaskLen groups hosts by prefix length; zero uses a single host (32 or 128 bits).
+	MaskLen int
+	// Global applies Limit to all hosts together, i.e. a mask of 0.
+	Global bool
+	// Dest groups by destination instead of source address.
+	Dest bool
+}
+
+// Args renders the match without knowing the family, allowing mask lengths
+// up to 128; see ArgsFor.
+func (c *ConnLimit) Args() ([]string, error) {
+	if c.Limit < 0 {
+		return nil, fmt.Errorf("connlimit: limit must not be negative")
+	}
+	if c.MaskLen < 0 || c.MaskLen > 128 {
+		return nil, fmt.Errorf("connlimit: invalid mask length %d", c.MaskLen)
+	}
+	if c.Global && c.MaskLen != 0 {
+		return nil, fmt.Errorf("connlimit: mask length cannot be combined with global")
+	}
+
+	args := []string{"-m", "connlimit"}
+	if c.Upto {
+		args = append(args, "--connlimit-upto", strconv.Itoa(c.Limit))
+	} else {
+		args = append(args, "--connlimit-above", strconv.Itoa(c.Limit))
+	}
+	switch {
+	case c.Global:
+		args = append(args, "--connlimit-mask", "0")
+	case c.MaskLen > 0:
+		args = append(args, "--connlimit-mask", strconv.Itoa(c.MaskLen))
+	}
+	if c.Dest {
+		args = append(args, "--connlimit-daddr")
+	}
+	return args, nil
+}
+
+// ArgsFor renders the match like Args, rejecting mask lengths over 32 in
+// IPv4 rules.
+func (c *ConnLimit) ArgsFor(proto Protocol) ([]string, error) {
+	if proto == ProtocolIPv4 && c.MaskLen > 32 {
+		return nil, fmt.Errorf("connlimit: invalid IPv4 mask length %d", c.MaskLen)
+	}
+	return c.Args()
+}
+
+// PhysDev is the "-m physdev" match, which matches the bridge ports a bridged
+// packet entered or leaves through.
+type PhysDev struct {
+	// In and Out are bridge port names; a trailing "+" matches any port with that prefix.
+	In  string
+	Out string
+	// IsIn and IsOut match if the packet entered or leaves through any bridge port.
+	IsIn  bool
+	IsOut bool
+	// IsBridged matches if the packet is being bridged rather than routed.
+	IsBridged bool
+}
+
+func (p *PhysDev) Args() ([]string, error) {
+	args := []string{"-m", "physdev"}
+	if p.In != "" {
+		if err := ValidateInterface(p.In); err != nil {
+			return nil, fmt.Errorf("physdev: %v", err)
+		}
+		args = append(args, "--physdev-in", p.In)
+	}
+	if p.Out != "" {
+		if err := ValidateInterface(p.Out); err != nil {
+			return nil, fmt.Errorf("physdev: %v", err)
+		}
+		args = append(args, "--physdev-out", p.Out)
+	}
+	if p.IsIn {
+		args = append(args, "--physdev-is-in")
+	}
+	if p.IsOut {
+		args = append(args, "--physdev-is-out")
+	}
+	if p.IsBridged {
+		args = append(args, "--physdev-is-bridged")
+	}
+	if len(args) == 2 {
+		return nil, fmt.Errorf("physdev: at least one option is required")
+	}
+	return args, nil
+}
+
+// CheckChain reports whether the match can work in the given built-in chain.
+// Locally generated packets have no input port, and since Linux 2.6.20 the
+// output port of routed packets is unknown in OUTPUT, FORWARD and POSTROUTING,
+// so Out is only usable there together with IsBridged.
+func (p *PhysDev) CheckChain(chain string) error {
+	if chain == "OUTPUT" && (p.In != "" || p.IsIn) {
+		return fmt.Errorf("physdev: input port cannot be matched in OUTPUT")
+	}
+	switch chain {
+	case "OUTPUT", "FORWARD", "POSTROUTING":
+		if (p.Out != "" || p.IsOut) && !p.IsBridged {
+			return fmt.Errorf("physdev: output port can only be matched in %s together with is-bridged", chain)
+		}
+	}
+	return nil
+}
+
+// RateLimitSSH appends the classic pair of recent rules to the filter table chain,
+// dropping new TCP connections to port from any source that opened hitcount or
+// more of them within the last seconds.
+// Note that hitcount may not exceed the ip_pkt_list_tot parameter of xt_recent (20 by default).
+func (ipt *IPTables) RateLimitSSH(chain string, port, seconds, hitcount int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	if seconds <= 0 || hitcount <= 0 {
+		return fmt.Errorf("seconds and hitcount must be positive")
+	}
+
+	name := fmt.Sprintf("SSH-%d", port)
+	base := []string{"-p", "tcp", "--dport", strconv.Itoa(port), "-m", "conntrack", "--ctstate", "NEW"}
+
+	set, err := (&Recent{Command: RecentSet, Name: name}).Args()
+	if err != nil {
+		return err
+	}
+	update, err := (&Recent{Command: RecentUpdate, Name: name, Seconds: seconds, HitCount: hitcount}).Args()
+	if err != nil {
+		return err
+	}
+
+	if err := ipt.AppendUnique("filter", chain, append(append([]string{}, base...), set...)...); err != nil {
+		return err
+	}
+	rule := append(append(append([]string{}, base...), update...), "-j", "DROP")
+	return ipt.AppendUnique("filter", chain, rule...)
+}
+
+// Quota is the "-m quota" match, which matches until Bytes bytes have gone
+// through the rule. The remaining quota is kept in the rule itself, so
+// re-creating or replacing the rule resets it; see QuotaManager.
+type Quota struct {
+	Bytes uint64
+}
+
+func (q *Quota) Args() ([]string, error) {
+	return []string{"-m", "quota", "--quota", strconv.FormatUint(q.Bytes, 10)}, nil
+}
+
+// ICMP is the "-m icmp" match, or "-m icmp6" for IPv6, on the ICMP type,
+// e.g. "echo-request", which both families name alike. It requires the
+// protocol to be ICMP of the rule's family; see Rule.ArgsFor.
+type ICMP struct {
+	Type string
+}
+
+// Args renders the IPv4 match.
+func (m *ICMP) Args() ([]string, error) {
+	return m.ArgsFor(ProtocolIPv4)
+}
+
+func (m *ICMP) ArgsFor(proto Protocol) ([]string, error) {
+	if m.Type == "" {
+		return nil, fmt.Errorf("icmp: empty type")
+	}
+	if proto == ProtocolIPv6 {
+		return []string{"-m", "icmp6", "--icmpv6-type", m.Type}, nil
+	}
+	return []string{"-m", "icmp", "--icmp-type", m.Type}, nil
+}
+
+// AddrType is an address type of the "-m addrtype" match, as classified by
+// the routing table.
+type AddrType string
+
+const (
+	AddrTypeUnspec      AddrType = "UNSPEC"
+	AddrTypeUnicast     AddrType = "UNICAST"
+	AddrTypeLocal       AddrType = "LOCAL"
+	AddrTypeBroadcast   AddrType = "BROADCAST"
+	AddrTypeAnycast     AddrType = "ANYCAST"
+	AddrTypeMulticast   AddrType = "MULTICAST"
+	AddrTypeBlackhole   AddrType = "BLACKHOLE"
+	AddrTypeUnreachable AddrType = "UNREACHABLE"
+	AddrTypeProhibit    AddrType = "PROHIBIT"
+	AddrTypeThrow       AddrType = "THROW"
+	AddrTypeNAT         AddrType = "NAT"
+	AddrTypeXResolve    AddrType = "XRESOLVE"
+)
+
+var addrTypes = map[AddrType]bool{
+	AddrTypeUnspec: true, AddrTypeUnicast: true, AddrTypeLocal: true,
+	AddrTypeBroadcast: true, AddrTypeAnycast: true, AddrTypeMulticast: true,
+	AddrTypeBlackhole: true, AddrTypeUnreachable: true, AddrTypeProhibit: true,
+	AddrTypeThrow: true, AddrTypeNAT: true, AddrTypeXResolve: true,
+}
+
+// AddrTypeMatch is the "-m addrtype" match on the types of the source and
+// destination addresses, e.g. a destination of type LOCAL to exclude traffic
+// to the host itself from NAT. A list matches any of its types.
+type AddrTypeMatch struct {
+	Src []AddrType
+	Dst []AddrType
+	// LimitIfaceIn and LimitIfaceOut only consider the routes of the
+	// incoming or outgoing interface.
+	LimitIfaceIn  bool
+	LimitIfaceOut bool
+}
+
+func (m *AddrTypeMatch) Args() ([]string, error) {
+	if len(m.Src) == 0 && len(m.Dst) == 0 {
+		return nil, fmt.Errorf("addrtype: source or destination type is required")
+	}
+	if m.LimitIfaceIn && m.LimitIfaceOut {
+		return nil, fmt.Errorf("addrtype: limit-iface-in and limit-iface-out are exclusive")
+	}
+	join := func(types []AddrType) (string, error) {
+		names := make([]string, len(types))
+		for i, t := range types {
+			if !addrTypes[t] {
+				return "", fmt.Errorf("addrtype: invalid address type %q", t)
+			}
+			names[i] = string(t)
+		}
+		return strings.Join(names, ","), nil
+	}
+
+	args := []string{"-m", "addrtype"}
+	if len(m.Src) > 0 {
+		src, err := join(m.Src)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--src-type", src)
+	}
+	if len(m.Dst) > 0 {
+		dst, err := join(m.Dst)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--dst-type", dst)
+	}
+	if m.LimitIfaceIn {
+		args = append(args, "--limit-iface-in")
+	}
+	if m.LimitIfaceOut {
+		args = append(args, "--limit-iface-out")
+	}
+	return args, nil
+}
+
+// CheckChain reports whether the match can work in the given built-in chain:
+// the incoming interface is only known in PREROUTING, INPUT and FORWARD, and
+// the outgoing one only in FORWARD, OUTPUT and POSTROUTING.
+func (m *AddrTypeMatch) CheckChain(chain string) error {
+	switch {
+	case m.LimitIfaceIn && (chain == "OUTPUT" || chain == "POSTROUTING"):
+		return fmt.Errorf("addrtype: limit-iface-in cannot be used in %s", chain)
+	case m.LimitIfaceOut && (chain == "PREROUTING" || chain == "INPUT"):
+		return fmt.Errorf("addrtype: limit-iface-out cannot be used in %s", chain)
+	}
+	return nil
+}
+
+// TCPFlag is a TCP flag of the "--tcp-flags" option.
+type TCPFlag string
+
+const (
+	TCPFlagFIN TCPFlag = "FIN"
+	TCPFlagSYN TCPFlag = "SYN"
+	TCPFlagRST TCPFlag = "RST"
+	TCPFlagPSH TCPFlag = "PSH"
+	TCPFlagACK TCPFlag = "ACK"
+	TCPFlagURG TCPFlag = "URG"
+	// TCPFlagAll stands for all of the flags above, TCPFlagNone for none.
+	TCPFlagAll  TCPFlag = "ALL"
+	TCPFlagNone TCPFlag = "NONE"
+)
+
+// tcpFlagOrder is the order iptables lists the flags in.
+var tcpFlagOrder = []TCPFlag{TCPFlagFIN, TCPFlagSYN, TCPFlagRST, TCPFlagPSH, TCPFlagACK, TCPFlagURG}
+
+// TCPFlags is the "--tcp-flags" option of the tcp match: it matches if, of
+// the flags in Mask, exactly those in Comp are set. It requires the protocol
+// to be "tcp".
+type TCPFlags struct {
+	Mask []TCPFlag
+	Comp []TCPFlag
+}
+
+// SYNOnly matches connection requests: SYN set, and RST, ACK and FIN clear.
+// It is what "--syn" stands for.
+func SYNOnly() *TCPFlags {
+	return &TCPFlags{
+		Mask: []TCPFlag{TCPFlagSYN, TCPFlagRST, TCPFlagACK, TCPFlagFIN},
+		Comp: []TCPFlag{TCPFlagSYN},
+	}
+}
+
+// XmasScan matches the packets of an Xmas scan, with FIN, PSH and URG set.
+func XmasScan() *TCPFlags {
+	return &TCPFlags{
+		Mask: []TCPFlag{TCPFlagAll},
+		Comp: []TCPFlag{TCPFlagFIN, TCPFlagPSH, TCPFlagURG},
+	}
+}
+
+// NullScan matches the packets of a NULL scan, without any flag set.
+func NullScan() *TCPFlags {
+	return &TCPFlags{
+		Mask: []TCPFlag{TCPFlagAll},
+		Comp: []TCPFlag{TCPFlagNone},
+	}
+}
+
+// tcpFlagSet returns the flags as a set, expanding ALL and NONE.
+func tcpFlagSet(flags []TCPFlag) (map[TCPFlag]bool, error) {
+	set := make(map[TCPFlag]bool)
+	for _, f := range flags {
+		switch f {
+		case TCPFlagAll:
+			for _, g := range tcpFlagOrder {
+				set[g] = true
+			}
+		case TCPFlagNone:
+		case TCPFlagFIN, TCPFlagSYN, TCPFlagRST, TCPFlagPSH, TCPFlagACK, TCPFlagURG:
+			set[f] = true
+		default:
+			return nil, fmt.Errorf("tcp-flags: invalid flag %q", f)
+		}
+	}
+	return set, nil
+}
+
+// renderTCPFlags lists the flags of the set in iptables' order.
+func renderTCPFlags(set map[TCPFlag]bool) string {
+	var names []string
+	for _, f := range tcpFlagOrder {
+		if set[f] {
+			names = append(names, string(f))
+		}
+	}
+	if len(names) == 0 {
+		return string(TCPFlagNone)
+	}
+	return strings.Join(names, ",")
+}
+
+// Args renders the flags in the order iptables lists them. Comp must be a
+// subset of Mask, as flags outside of the mask are never examined and the
+// rule could not match.
+func (f *TCPFlags) Args() ([]string, error) {
+	if len(f.Mask) == 0 {
+		return nil, fmt.Errorf("tcp-flags: empty mask")
+	}
+	if len(f.Comp) == 0 {
+		return nil, fmt.Errorf("tcp-flags: empty comparison, use %s for no flags set", TCPFlagNone)
+	}
+	mask, err := tcpFlagSet(f.Mask)
+	if err != nil {
+		return nil, err
+	}
+	comp, err := tcpFlagSet(f.Comp)
+	if err != nil {
+		return nil, err
+	}
+	if len(mask) == 0 {
+		return nil, fmt.Errorf("tcp-flags: mask examines no flags")
+	}
+	for flag := range comp {
+		if !mask[flag] {
+			return nil, fmt.Errorf("tcp-flags: %s is compared but not in the mask", flag)
+		}
+	}
+	return []string{"-m", "tcp", "--tcp-flags", renderTCPFlags(mask), renderTCPFlags(comp)}, nil
+}
+
+// BlockTCPScans appends rules to the filter table chain dropping the packets
+// of Xmas and NULL scans, unless they are present already.
+func (ipt *IPTables) BlockTCPScans(chain string) error {
+	for _, flags := range []*TCPFlags{XmasScan(), NullScan()} {
+		match, err := flags.Args()
+		if err != nil {
+			return err
+		}
+		rule := append(append([]string{"-p", "tcp"}, match...), "-j", "DROP")
+		if err := ipt.AppendUnique("filter", chain, rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fragment matches fragments of IP packets. For IPv4 it renders "-f", which
+// matches the second and further fragments of a packet. For IPv6 it renders
+// the "-m frag" match, which matches every packet with a fragment header,
+// including the first fragment, narrowed by the fields below, which only
+// IPv6 supports; see Rule.ArgsFor.
+type Fragment struct {
+	// ID is a fragment identification or "first:last" range.
+	ID string
+	// First, More and Last match the first fragment, fragments followed by
+	// more, and the last fragment.
+	First bool
+	More  bool
+	Last  bool
+}
+
+// Args renders the IPv4 match.
+func (f *Fragment) Args() ([]string, error) {
+	return f.ArgsFor(ProtocolIPv4)
+}
+
+func (f *Fragment) ArgsFor(proto Protocol) ([]string, error) {
+	if f.First && f.Last {
+		return nil, fmt.Errorf("frag: a fragment cannot be both first and last")
+	}
+	if proto == ProtocolIPv4 {
+		if f.ID != "" || f.First || f.More || f.Last {
+			return nil, fmt.Errorf("frag: only the IPv6 fragment header can be matched on id, first, more and last")
+		}
+		return []string{"-f"}, nil
+	}
+	args := []string{"-m", "frag"}
+	if f.ID != "" {
+		args = append(args, "--fragid", f.ID)
+	}
+	if f.First {
+		args = append(args, "--fragfirst")
+	}
+	if f.More {
+		args = append(args, "--fragmore")
+	}
+	if f.Last {
+		args = append(args, "--fraglast")
+	}
+	return args, nil
+}
+
+// StatisticMode selects how the statistic match picks packets.
+type StatisticMode string
+
+const (
+	// StatisticRandom matches each packet with a probability.
+	StatisticRandom StatisticMode = "random"
+	// StatisticNth matches one packet in every n, counted per rule.
+	StatisticNth StatisticMode = "nth"
+)
+
+// Statistic is the "-m statistic" match, which matches a share of the
+// packets: in random mode each one with Probability, in nth mode the Packet'th
+// (counting from 0) of every Every packets. It is typically combined with
+// "-m conntrack --ctstate NEW", or used in the nat table, so the share
+// applies to connections; see BalanceDNAT.
+type Statistic struct {
+	Mode        StatisticMode
+	Probability float64
+	Every       uint32
+	Packet      uint32
+}
+
+func (s *Statistic) Args() ([]string, error) {
+	switch s.Mode {
+	case StatisticRandom:
+		if s.Every != 0 || s.Packet != 0 {
+			return nil, fmt.Errorf("statistic: every and packet require nth mode")
+		}
+		if s.Probability <= 0 || s.Probability > 1 {
+			return nil, fmt.Errorf("statistic: probability %v out of range (0, 1]", s.Probability)
+		}
+		// iptables lists the probability with 11 decimals
+		return []string{"-m", "statistic", "--mode", "random", "--probability", strconv.FormatFloat(s.Probability, 'f', 11, 64)}, nil
+	case StatisticNth:
+		if s.Probability != 0 {
+			return nil, fmt.Errorf("statistic: probability requires random mode")
+		}
+		if s.Every < 1 || s.Packet >= s.Every {
+			return nil, fmt.Errorf("statistic: invalid packet %d of every %d", s.Packet, s.Every)
+		}
+		return []string{"-m", "statistic", "--mode", "nth", "--every", strconv.FormatUint(uint64(s.Every), 10),
+			"--packet", strconv.FormatUint(uint64(s.Packet), 10)}, nil
+	}
+	return nil, fmt.Errorf("statistic: invalid mode %q", s.Mode)
+}
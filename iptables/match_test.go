@@ -0,0 +1,135 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRecentArgs(t *testing.T) {
+	for _, tt := range []struct {
+		r        Recent
+		expected []string
+	}{
+		{
+			Recent{Command: RecentSet, Name: "SSH"},
+			[]string{"-m", "recent", "--set", "--name", "SSH", "--rsource"},
+		},
+		{
+			Recent{Command: RecentUpdate, Name: "SSH", Seconds: 60, HitCount: 4},
+			[]string{"-m", "recent", "--update", "--seconds", "60", "--hitcount", "4", "--name", "SSH", "--rsource"},
+		},
+		{
+			Recent{Command: RecentRemove, Dest: true},
+			[]string{"-m", "recent", "--remove", "--rdest"},
+		},
+	} {
+		args, err := tt.r.Args()
+		if err != nil {
+			t.Fatalf("Args of %+v failed: %v", tt.r, err)
+		}
+		if !reflect.DeepEqual(args, tt.expected) {
+			t.Fatalf("Args mismatch: \ngot  %#v \nneed %#v", args, tt.expected)
+		}
+	}
+}
+
+func TestRecentArgsInvalid(t *testing.T) {
+	long := make([]byte, maxRecentNameLen+1)
+	for i := range long {
+		long[i] = 'a'
+	}
+	for _, r := range []Recent{
+		{},
+		{Command: "--check"},
+		{Command: RecentSet, Name: string(long)},
+		{Command: RecentUpdate, Seconds: -1},
+		{Command: RecentSet, Seconds: 10},
+		{Command: RecentRemove, HitCount: 2},
+	} {
+		if _, err := r.Args(); err == nil {
+			t.Fatalf("Args of %+v succeeded, expected an error", r)
+		}
+	}
+}
+
+func TestConnLimitArgs(t *testing.T) {
+	for _, tt := range []struct {
+		c        ConnLimit
+		expected []string
+	}{
+		{
+			ConnLimit{Limit: 10},
+			[]string{"-m", "connlimit", "--connlimit-above", "10"},
+		},
+		{
+			ConnLimit{Limit: 2, Upto: true, MaskLen: 24, Dest: true},
+			[]string{"-m", "connlimit", "--connlimit-upto", "2", "--connlimit-mask", "24", "--connlimit-daddr"},
+		},
+		{
+			ConnLimit{Limit: 100, Global: true},
+			[]string{"-m", "connlimit", "--connlimit-above", "100", "--connlimit-mask", "0"},
+		},
+		{
+			ConnLimit{Limit: 5, MaskLen: 64},
+			[]string{"-m", "connlimit", "--connlimit-above", "5", "--connlimit-mask", "64"},
+		},
+	} {
+		args, err := tt.c.Args()
+		if err != nil {
+			t.Fatalf("Args of %+v failed: %v", tt.c, err)
+		}
+		if !reflect.DeepEqual(args, tt.expected) {
+			t.Fatalf("Args mismatch: \ngot  %#v \nneed %#v", args, tt.expected)
+		}
+	}
+}
+
+func TestConnLimitArgsInvalid(t *testing.T) {
+	for _, c := range []ConnLimit{
+		{Limit: -1},
+		{Limit: 1, MaskLen: -8},
+		{Limit: 1, MaskLen: 129},
+		{Limit: 1, MaskLen: 16, Global: true},
+	} {
+		if _, err := c.Args(); err == nil {
+			t.Fatalf("Args of %+v succeeded, expected an error", c)
+		}
+	}
+}
+
+func TestConnLimitArgsFor(t *testing.T) {
+	c := &ConnLimit{Limit: 5, MaskLen: 64}
+	if _, err := c.ArgsFor(ProtocolIPv4); err == nil {
+		t.Fatalf("ArgsFor of an IPv4 mask length of 64 succeeded, expected an error")
+	}
+	args, err := c.ArgsFor(ProtocolIPv6)
+	if err != nil {
+		t.Fatalf("ArgsFor failed: %v", err)
+	}
+	expected := []string{"-m", "connlimit", "--connlimit-above", "5", "--connlimit-mask", "64"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("ArgsFor mismatch: \ngot  %#v \nneed %#v", args, expected)
+	}
+
+	r := &Rule{Matches: []Match{&ConnLimit{Limit: 5, MaskLen: 33}}, Target: Jump("DROP")}
+	if _, err := r.ArgsFor(ProtocolIPv4); err == nil {
+		t.Fatalf("Rule.ArgsFor of an IPv4 mask length of 33 succeeded, expected an error")
+	}
+	if _, err := (&ConnLimit{Limit: 5, MaskLen: 32}).ArgsFor(ProtocolIPv4); err != nil {
+		t.Fatalf("ArgsFor of an IPv4 mask length of 32 failed: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+)
+
+// ifaceAddr is an address assigned to an interface.
+type ifaceAddr struct {
+	IP net.IP
+	// Static is set for permanently configured addresses, as opposed to ones
+	// with a lifetime, such as DHCP leases and SLAAC addresses.
+	Static bool
+}
+
+// lookupIfaceAddrs returns the addresses of the interface; replaced in tests.
+var lookupIfaceAddrs = interfaceAddrs
+
+// SNAT is the "-j SNAT" target, which rewrites the source address to ToSource.
+type SNAT struct {
+	ToSource string
+}
+
+func (s *SNAT) Args() ([]string, error) {
+	if s.ToSource == "" {
+		return nil, fmt.Errorf("SNAT: empty source address")
+	}
+	return []string{"-j", "SNAT", "--to-source", s.ToSource}, nil
+}
+
+// DNAT is the "-j DNAT" target, which rewrites the destination address, and
+// optionally port, to ToDestination, e.g. "10.0.0.2" or "10.0.0.2:8080". A
+// port requires the rule to match a protocol with ports, e.g. "-p tcp".
+type DNAT struct {
+	ToDestination string
+}
+
+func (d *DNAT) Args() ([]string, error) {
+	if d.ToDestination == "" {
+		return nil, fmt.Errorf("DNAT: empty destination address")
+	}
+	return []string{"-j", "DNAT", "--to-destination", d.ToDestination}, nil
+}
+
+// Masquerade is the "-j MASQUERADE" target, which rewrites the source address
+// to whatever address the egress interface has when the connection starts.
+type Masquerade struct {
+	// ToPorts optionally restricts the source ports, e.g. "1024-65535".
+	ToPorts string
+}
+
+func (m *Masquerade) Args() ([]string, error) {
+	args := []string{"-j", "MASQUERADE"}
+	if m.ToPorts != "" {
+		args = append(args, "--to-ports", m.ToPorts)
+	}
+	return args, nil
+}
+
+// NATRuleFor returns the nat POSTROUTING rule that translates traffic from src
+// leaving through egressIface. If the interface has a static address of the
+// handle's family, the rule SNATs to that address, which is cheaper than
+// MASQUERADE and keeps connections across link flaps; if the address is
+// dynamic, e.g. a DHCP lease, the rule uses MASQUERADE so it follows address
+// changes. A nil src matches any source. On Linux, addresses and their flags
+// are read over rtnetlink; elsewhere every address counts as dynamic.
+func (ipt *IPTables) NATRuleFor(egressIface string, src *net.IPNet) (*Rule, error) {
+	if err := ValidateInterface(egressIface); err != nil {
+		return nil, err
+	}
+	rule := &Rule{Out: egressIface}
+	if src != nil {
+		if (src.IP.To4() != nil) != (ipt.Proto() == ProtocolIPv4) {
+			return nil, fmt.Errorf("%w: source %s", ErrWrongFamily, src)
+		}
+		rule.Source = src.String()
+	}
+
+	addrs, err := lookupIfaceAddrs(egressIface, ipt.Proto())
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("interface %s has no address", egressIface)
+	}
+	for _, a := range addrs {
+		if a.Static {
+			rule.Target = &SNAT{ToSource: a.IP.String()}
+			return rule, nil
+		}
+	}
+	rule.Target = &Masquerade{}
+	return rule, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// ifaFlags is the IFA_FLAGS attribute, which carries the full 32 bit address
+// flags on kernels since 3.14.
+const ifaFlags = 0x8
+
+// interfaceAddrs returns the global unicast addresses of the protocol's family
+// assigned to the interface, read over rtnetlink so the permanent flag is
+// known.
+func interfaceAddrs(iface string, proto Protocol) ([]ifaceAddr, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	family := syscall.AF_INET
+	if proto == ProtocolIPv6 {
+		family = syscall.AF_INET6
+	}
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, family)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []ifaceAddr
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWADDR || len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		ifam := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+		if int(ifam.Index) != ifi.Index {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, err
+		}
+		flags := uint32(ifam.Flags)
+		var ip net.IP
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.IFA_ADDRESS:
+				if ip == nil {
+					ip = net.IP(a.Value)
+				}
+			case syscall.IFA_LOCAL:
+				// the local address differs from IFA_ADDRESS on point to point links
+				ip = net.IP(a.Value)
+			case ifaFlags:
+				if len(a.Value) == 4 {
+					flags = *(*uint32)(unsafe.Pointer(&a.Value[0]))
+				}
+			}
+		}
+		if ip == nil || !ip.IsGlobalUnicast() {
+			continue
+		}
+		addrs = append(addrs, ifaceAddr{IP: ip, Static: flags&syscall.IFA_F_PERMANENT != 0})
+	}
+	return addrs, nil
+}
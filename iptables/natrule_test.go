@@ -0,0 +1,75 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNATRuleFor(t *testing.T) {
+	old := lookupIfaceAddrs
+	defer func() { lookupIfaceAddrs = old }()
+
+	_, src, _ := net.ParseCIDR("10.0.0.0/24")
+	ipt := &IPTables{proto: ProtocolIPv4}
+
+	tests := []struct {
+		name  string
+		addrs []ifaceAddr
+		want  []string
+	}{
+		{
+			"static",
+			[]ifaceAddr{{IP: net.ParseIP("198.51.100.7"), Static: true}},
+			[]string{"-s", "10.0.0.0/24", "-o", "eth0", "-j", "SNAT", "--to-source", "198.51.100.7"},
+		},
+		{
+			"dynamic",
+			[]ifaceAddr{{IP: net.ParseIP("198.51.100.7")}},
+			[]string{"-s", "10.0.0.0/24", "-o", "eth0", "-j", "MASQUERADE"},
+		},
+		{
+			"static preferred",
+			[]ifaceAddr{{IP: net.ParseIP("198.51.100.7")}, {IP: net.ParseIP("198.51.100.8"), Static: true}},
+			[]string{"-s", "10.0.0.0/24", "-o", "eth0", "-j", "SNAT", "--to-source", "198.51.100.8"},
+		},
+	}
+	for _, tt := range tests {
+		lookupIfaceAddrs = func(string, Protocol) ([]ifaceAddr, error) { return tt.addrs, nil }
+		rule, err := ipt.NATRuleFor("eth0", src)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		args, err := rule.Args()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(args, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, args, tt.want)
+		}
+	}
+
+	lookupIfaceAddrs = func(string, Protocol) ([]ifaceAddr, error) { return nil, nil }
+	if _, err := ipt.NATRuleFor("eth0", src); err == nil {
+		t.Error("expected error for interface without address")
+	}
+	_, src6, _ := net.ParseCIDR("2001:db8::/64")
+	if _, err := ipt.NATRuleFor("eth0", src6); !errors.Is(err, ErrWrongFamily) {
+		t.Errorf("got %v, want ErrWrongFamily", err)
+	}
+}
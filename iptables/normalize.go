@@ -0,0 +1,255 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// optionAliases maps long option names to the form iptables lists them in.
+var optionAliases = map[string]string{
+	"--source":           "-s",
+	"--src":              "-s",
+	"--destination":      "-d",
+	"--dst":              "-d",
+	"--in-interface":     "-i",
+	"--out-interface":    "-o",
+	"--protocol":         "-p",
+	"--fragment":         "-f",
+	"--match":            "-m",
+	"--source-port":      "--sport",
+	"--destination-port": "--dport",
+}
+
+// basicOptions are the options iptables matches regardless of their position
+// in the rulespec, in the order it lists them.
+var basicOptions = []string{"-s", "-d", "-i", "-o", "-p", "-f"}
+
+// protocolOptions lists the options of the implicit match loaded for each protocol.
+var protocolOptions = map[string]map[string]bool{
+	"tcp":       {"--sport": true, "--dport": true, "--tcp-flags": true, "--syn": true, "--tcp-option": true},
+	"udp":       {"--sport": true, "--dport": true},
+	"icmp":      {"--icmp-type": true},
+	"ipv6-icmp": {"--icmpv6-type": true},
+}
+
+// fullMarkMask is the mask iptables leaves out when listing marks.
+const fullMarkMask = "0xffffffff"
+
+// ctStateOrder is the order iptables lists connection tracking states in.
+var ctStateOrder = map[string]int{
+	"INVALID":     0,
+	"NEW":         1,
+	"RELATED":     2,
+	"ESTABLISHED": 3,
+	"UNTRACKED":   4,
+	"SNAT":        5,
+	"DNAT":        6,
+}
+
+// NormalizeRule returns the rulespec in the canonical form "iptables -S" lists
+// it in, so that rulespecs iptables considers equal (see Exists) are equal:
+// long options are shortened, addresses are masked and given a prefix length,
+// protocol numbers become names, the basic options are ordered, implicit
+// protocol matches such as "-m tcp" are made explicit, "--syn" is expanded and
+// conntrack states are ordered. Marks are listed in hex without a full mask,
+// and set by MARK with "--set-xmark", in the form both the legacy and the nft
+// backend list them. The order of the other matches is significant
+// to iptables and is kept. Rulespecs that cannot be tokenized are returned as is.
+func NormalizeRule(rulespec []string) []string {
+	r, err := parseRuleArgs(rulespec)
+	if err != nil {
+		return rulespec
+	}
+
+	var basic, matches []ruleClause
+	proto := ""
+	for _, c := range r.clauses {
+		if alias, ok := optionAliases[c.option]; ok {
+			c.option = alias
+		}
+		c.values = append([]string{}, c.values...)
+		switch c.option {
+		case "-s", "-d":
+			for i, v := range c.values {
+				c.values[i] = normalizeAddress(v)
+			}
+			if !c.negated && len(c.values) == 1 && (c.values[0] == "0.0.0.0/0" || c.values[0] == "::/0") {
+				continue
+			}
+		case "-p":
+			if len(c.values) == 1 {
+				c.values[0] = normalizeProtocol(c.values[0])
+				if !c.negated && (c.values[0] == "all" || c.values[0] == "0") {
+					continue
+				}
+				if !c.negated {
+					proto = c.values[0]
+				}
+			}
+		case "--syn":
+			c.option = "--tcp-flags"
+			c.values = []string{"FIN,SYN,RST,ACK", "SYN"}
+		case "--ctstate", "--state":
+			if len(c.values) == 1 {
+				c.values[0] = normalizeCtState(c.values[0])
+			}
+		case "--mark":
+			if len(c.values) == 1 {
+				c.values[0] = normalizeMark(c.values[0])
+			}
+		}
+		if isBasicOption(c.option) {
+			basic = append(basic, c)
+		} else {
+			matches = append(matches, c)
+		}
+	}
+
+	// iptables loads the protocol match implicitly on its first option
+	if opts := protocolOptions[proto]; opts != nil && !hasModule(matches, proto) {
+		for i, c := range matches {
+			if opts[c.option] {
+				load := ruleClause{option: "-m", values: []string{proto}}
+				matches = append(matches[:i], append([]ruleClause{load}, matches[i:]...)...)
+				break
+			}
+		}
+	}
+
+	var args []string
+	for _, opt := range basicOptions {
+		for _, c := range basic {
+			if c.option == opt {
+				args = appendClause(args, c)
+			}
+		}
+	}
+	for _, c := range matches {
+		args = appendClause(args, c)
+	}
+	if r.Target != "" {
+		if r.Goto {
+			args = append(args, "-g", r.Target)
+		} else {
+			args = append(args, "-j", r.Target)
+		}
+		args = append(args, normalizeTargetOptions(r.Target, r.TargetOptions)...)
+	}
+	return args
+}
+
+// normalizeTargetOptions canonicalizes the options of the MARK target.
+func normalizeTargetOptions(target string, opts []string) []string {
+	if target != "MARK" || len(opts) != 2 {
+		return opts
+	}
+	switch opts[0] {
+	case "--set-mark", "--set-xmark":
+		mark := normalizeMark(opts[1])
+		if !strings.Contains(mark, "/") {
+			mark += "/" + fullMarkMask
+		}
+		return []string{"--set-xmark", mark}
+	}
+	return opts
+}
+
+// RulesEqual reports whether the two rulespecs are equal after normalization
+// with NormalizeRule.
+func RulesEqual(a, b []string) bool {
+	return reflect.DeepEqual(NormalizeRule(a), NormalizeRule(b))
+}
+
+func appendClause(args []string, c ruleClause) []string {
+	if c.negated {
+		args = append(args, "!")
+	}
+	args = append(args, c.option)
+	return append(args, c.values...)
+}
+
+func isBasicOption(option string) bool {
+	for _, opt := range basicOptions {
+		if option == opt {
+			return true
+		}
+	}
+	return false
+}
+
+func hasModule(clauses []ruleClause, module string) bool {
+	for _, c := range clauses {
+		if c.option == "-m" && len(c.values) == 1 && c.values[0] == module {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeAddress gives addresses a prefix length and masks networks,
+// e.g. "192.0.2.1" becomes "192.0.2.1/32" and "192.0.2.1/24" "192.0.2.0/24".
+// Host names and address lists are returned as is.
+func normalizeAddress(addr string) string {
+	if !strings.Contains(addr, "/") {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return addr
+		}
+		if ip.To4() != nil {
+			return ip.String() + "/32"
+		}
+		return ip.String() + "/128"
+	}
+	_, n, err := net.ParseCIDR(addr)
+	if err != nil {
+		return addr
+	}
+	return n.String()
+}
+
+func normalizeCtState(states string) string {
+	list := strings.Split(strings.ToUpper(states), ",")
+	sort.SliceStable(list, func(i, j int) bool {
+		oi, iok := ctStateOrder[list[i]]
+		oj, jok := ctStateOrder[list[j]]
+		if !iok || !jok {
+			return iok && !jok
+		}
+		return oi < oj
+	})
+	return strings.Join(list, ",")
+}
+
+// normalizeMark formats decimal marks in hex and drops a full mask,
+// e.g. "16" becomes "0x10", "1/255" "0x1/0xff" and "1/0xffffffff" "0x1".
+func normalizeMark(mark string) string {
+	parts := strings.Split(mark, "/")
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 0, 32)
+		if err != nil {
+			return mark
+		}
+		parts[i] = "0x" + strconv.FormatUint(n, 16)
+	}
+	if len(parts) == 2 && parts[1] == fullMarkMask {
+		parts = parts[:1]
+	}
+	return strings.Join(parts, "/")
+}
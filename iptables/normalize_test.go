@@ -0,0 +1,79 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeRule(t *testing.T) {
+	for _, tt := range []struct {
+		in, out string
+	}{
+		{
+			"--protocol 6 --source 192.0.2.7/24 --dport 22 -j ACCEPT",
+			"-s 192.0.2.0/24 -p tcp -m tcp --dport 22 -j ACCEPT",
+		},
+		{
+			"-p tcp --syn -d 2001:db8::1 -s 0.0.0.0/0 -j DROP",
+			"-d 2001:db8::1/128 -p tcp -m tcp --tcp-flags FIN,SYN,RST,ACK SYN -j DROP",
+		},
+		{
+			"-m conntrack --ctstate ESTABLISHED,NEW,RELATED -m mark --mark 16/255 -j ACCEPT",
+			"-m conntrack --ctstate NEW,RELATED,ESTABLISHED -m mark --mark 0x10/0xff -j ACCEPT",
+		},
+		{
+			"-m mark --mark 0x1/0xffffffff -p 17 -j MARK --set-mark 2",
+			"-p udp -m mark --mark 0x1 -j MARK --set-xmark 0x2/0xffffffff",
+		},
+		{
+			"-p all ! -i lo -m comment --comment x -j LOG --log-prefix y",
+			"! -i lo -m comment --comment x -j LOG --log-prefix y",
+		},
+	} {
+		got := NormalizeRule(strings.Fields(tt.in))
+		if expected := strings.Fields(tt.out); !reflect.DeepEqual(got, expected) {
+			t.Errorf("NormalizeRule(%q) mismatch: \ngot  %#v \nneed %#v", tt.in, got, expected)
+		}
+	}
+}
+
+func TestRulesEqual(t *testing.T) {
+	a := []string{"-p", "tcp", "--dport", "22", "-s", "192.0.2.1", "-j", "ACCEPT"}
+	b := []string{"-s", "192.0.2.1/32", "-p", "tcp", "-m", "tcp", "--dport", "22", "-j", "ACCEPT"}
+	if !RulesEqual(a, b) {
+		t.Fatalf("RulesEqual(%q, %q) = false", a, b)
+	}
+
+	c := []string{"-m", "comment", "--comment", "x", "-m", "mark", "--mark", "1", "-j", "ACCEPT"}
+	d := []string{"-m", "mark", "--mark", "1", "-m", "comment", "--comment", "x", "-j", "ACCEPT"}
+	if RulesEqual(c, d) {
+		t.Fatalf("RulesEqual(%q, %q) = true, but match order differs", c, d)
+	}
+}
+
+func TestExtractIptablesMode(t *testing.T) {
+	for str, mode := range map[string]string{
+		"iptables v1.8.7 (nf_tables)\n": "nf_tables",
+		"iptables v1.8.7 (legacy)\n":    "legacy",
+		"iptables v1.4.21\n":            "legacy",
+	} {
+		if got := extractIptablesMode(str); got != mode {
+			t.Errorf("extractIptablesMode(%q) = %q, need %q", str, got, mode)
+		}
+	}
+}
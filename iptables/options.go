@@ -0,0 +1,114 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+)
+
+// ErrReadOnly is returned by mutating methods of an IPTables created with ReadOnly.
+var ErrReadOnly = errors.New("iptables: handle is read-only")
+
+// Option configures an IPTables; see New and NewWithProtocol.
+type Option func(*IPTables)
+
+// ReadOnly makes every method that would change the firewall fail with
+// ErrReadOnly without running any command, so tools that only inspect rules
+// can guarantee they never modify them.
+func ReadOnly() Option {
+	return func(ipt *IPTables) {
+		ipt.readOnly = true
+	}
+}
+
+// mutatingCommands are the iptables commands that change the firewall.
+var mutatingCommands = map[string]bool{
+	"-A": true, "--append": true,
+	"-I": true, "--insert": true,
+	"-D": true, "--delete": true,
+	"-R": true, "--replace": true,
+	"-N": true, "--new-chain": true,
+	"-X": true, "--delete-chain": true,
+	"-F": true, "--flush": true,
+	"-E": true, "--rename-chain": true,
+	"-P": true, "--policy": true,
+	"-Z": true, "--zero": true,
+}
+
+// freeTextOptions are the rulespec options whose value is free text, which
+// might look like a command.
+var freeTextOptions = map[string]bool{
+	"--comment":      true,
+	"--log-prefix":   true,
+	"--nflog-prefix": true,
+	"--string":       true,
+	"--hex-string":   true,
+}
+
+// isMutating reports whether the iptables arguments run a command that changes the firewall.
+// Every argument is considered, so neither options such as "--wait" ahead of the
+// command nor "-Z" combined with "-L" or "-S" hide it; the values of "-t" and of
+// free text options are skipped.
+func isMutating(args []string) bool {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-t" || args[i] == "--table" || freeTextOptions[args[i]]:
+			i++
+		case mutatingCommands[args[i]]:
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveNames lets "-L" listings run through ExecuteList print host,
+// network and service names. By default "-n" is added to them, because
+// reverse lookups can stall a listing for seconds and make its output
+// nondeterministic. "-S" output is always numeric.
+func ResolveNames() Option {
+	return func(ipt *IPTables) {
+		ipt.resolveNames = true
+	}
+}
+
+// numericArgs adds "-n" to the iptables arguments of a "-L" listing that
+// does not already ask for numeric output.
+func numericArgs(args []string) []string {
+	list := false
+	for _, arg := range args {
+		switch arg {
+		case "-n", "--numeric":
+			return args
+		case "-L", "--list":
+			list = true
+		}
+	}
+	if !list {
+		return args
+	}
+	return append(args[:len(args):len(args)], "-n")
+}
+
+// NoWait stops "--wait" from being passed to iptables and iptables-restore,
+// for callers coordinating access to the firewall themselves, or whose
+// binaries misbehave with it. Commands then take the xtables lock the way
+// they do for binaries predating "--wait": only if it is free, proceeding
+// without it otherwise.
+func NoWait() Option {
+	return func(ipt *IPTables) {
+		ipt.hasWait = false
+		ipt.hasRestoreWait = false
+	}
+}
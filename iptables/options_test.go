@@ -0,0 +1,86 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	// the path is never executed, since every call is refused up front
+	ipt := &IPTables{path: "/nonexistent/iptables", hasWait: true}
+	ReadOnly()(ipt)
+
+	if err := ipt.Append("filter", "INPUT", "-j", "ACCEPT"); err != ErrReadOnly {
+		t.Fatalf("Append on read-only handle: expected ErrReadOnly, got %v", err)
+	}
+	if err := ipt.NewChain("filter", "TEST"); err != ErrReadOnly {
+		t.Fatalf("NewChain on read-only handle: expected ErrReadOnly, got %v", err)
+	}
+	if err := ipt.Restore("*filter\nCOMMIT\n", RestoreOptions{}); err != ErrReadOnly {
+		t.Fatalf("Restore on read-only handle: expected ErrReadOnly, got %v", err)
+	}
+	if err := ipt.Run("-w", "-A", "INPUT", "-j", "ACCEPT"); err != ErrReadOnly {
+		t.Fatalf("Run of -A after -w on read-only handle: expected ErrReadOnly, got %v", err)
+	}
+	if err := ipt.Run("-t", "filter", "-v", "-S", "-Z"); err != ErrReadOnly {
+		t.Fatalf("Run of -S -Z on read-only handle: expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestIsMutating(t *testing.T) {
+	for _, args := range [][]string{
+		{"-t", "filter", "-A", "INPUT", "-j", "ACCEPT"},
+		{"--table", "nat", "--flush", "POSTROUTING"},
+		{"-P", "INPUT", "DROP"},
+		{"-w", "-A", "INPUT", "-j", "ACCEPT"},
+		{"--wait", "-F", "INPUT"},
+		{"-t", "filter", "-v", "-S", "-Z"},
+		{"-t", "filter", "-L", "INPUT", "-n", "-Z"},
+		{"-t", "filter", "-L", "-Z", "INPUT"},
+	} {
+		if !isMutating(args) {
+			t.Errorf("isMutating(%q) = false", args)
+		}
+	}
+	for _, args := range [][]string{
+		{"-t", "filter", "-S", "INPUT"},
+		{"-t", "filter", "-C", "INPUT", "-m", "comment", "--comment", "-A", "-j", "ACCEPT"},
+		{"-t", "filter", "-L", "INPUT", "-n", "-v"},
+		{"-w", "5", "-t", "filter", "-S"},
+		{"-t", "filter", "-C", "INPUT", "-j", "LOG", "--log-prefix", "-D"},
+	} {
+		if isMutating(args) {
+			t.Errorf("isMutating(%q) = true", args)
+		}
+	}
+}
+
+func TestNumericArgs(t *testing.T) {
+	for _, tt := range []struct {
+		args, expected []string
+	}{
+		{[]string{"-t", "nat", "-L", "PREROUTING", "-v"}, []string{"-t", "nat", "-L", "PREROUTING", "-v", "-n"}},
+		{[]string{"-t", "nat", "--list"}, []string{"-t", "nat", "--list", "-n"}},
+		{[]string{"-n", "-L", "INPUT"}, []string{"-n", "-L", "INPUT"}},
+		{[]string{"-L", "INPUT", "--numeric"}, []string{"-L", "INPUT", "--numeric"}},
+		{[]string{"-t", "filter", "-S", "INPUT"}, []string{"-t", "filter", "-S", "INPUT"}},
+	} {
+		if got := numericArgs(tt.args); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("numericArgs(%q) = %q, want %q", tt.args, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// ownerTag is the tag key of the owner of a rule.
+const ownerTag = "owner"
+
+// Owner tags every rule added, checked or deleted through the handle with
+// the comment "owner=<name>,id=<hash>", where the hash identifies the
+// rulespec, and restricts the rules returned by List, ListWithCounters,
+// ListParsed, ListFunc, ListParsedFunc, ListMatching and the iterators to
+// those of the owner. Rules written by RestoreChain, ApplyRuleset,
+// ReconcileChain, ChainManager.SetRules and EnsureJump are tagged too, and
+// ApplyRuleset and ReconcileChain then replace only the rules of the owner;
+// the raw arguments of Run are not tagged. Chain
+// declarations and policies are still listed. Agents sharing chains on a
+// node can thereby each manage their own rules. The name must be valid as
+// a RuleTags value.
+func Owner(name string) Option {
+	return func(ipt *IPTables) {
+		ipt.owner = name
+	}
+}
+
+// owned returns rulespec tagged with the owner of the handle, if any. A
+// rulespec already carrying the tag is returned as is.
+func (ipt *IPTables) owned(rulespec []string) ([]string, error) {
+	if ipt.owner == "" {
+		return rulespec, nil
+	}
+	for i := 0; i+1 < len(rulespec); i++ {
+		if rulespec[i] == "--comment" {
+			if tags, ok := ParseRuleTags(rulespec[i+1]); ok && tags[ownerTag] == ipt.owner {
+				return rulespec, nil
+			}
+		}
+	}
+	if !validTag(ipt.owner) {
+		return nil, fmt.Errorf("invalid owner %q", ipt.owner)
+	}
+	// written by hand rather than by RuleTags.String, which sorts the keys
+	comment := ownerTag + "=" + ipt.owner + ",id=" + ruleID(rulespec)
+	return withMatch(rulespec, []string{"-m", "comment", "--comment", comment}), nil
+}
+
+// mine reports whether a listed rule is managed through the handle: any rule
+// without an Owner, only those tagged with it otherwise.
+func (ipt *IPTables) mine(r *ParsedRule) bool {
+	return ipt.owner == "" || r.Tags()[ownerTag] == ipt.owner
+}
+
+// ownedRuleLine returns the "-A <chain> <rulespec>" restore line, possibly
+// prefixed with counters, with its rulespec tagged like owned.
+func (ipt *IPTables) ownedRuleLine(line string) (string, error) {
+	if ipt.owner == "" {
+		return line, nil
+	}
+	prefix := countersPrefix.FindString(line)
+	args, err := splitRule(line[len(prefix):])
+	if err != nil {
+		return "", err
+	}
+	if len(args) < 2 || args[0] != "-A" {
+		return "", fmt.Errorf("not a rule line: %q", line)
+	}
+	spec, err := ipt.owned(args[2:])
+	if err != nil {
+		return "", err
+	}
+	return prefix + "-A " + args[1] + " " + joinRule(spec), nil
+}
+
+// ruleID returns a short hash identifying a rulespec.
+func ruleID(rulespec []string) string {
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(rulespec, "\x00")))
+	return strconv.FormatUint(uint64(h.Sum32()), 16)
+}
+
+// ownedLine reports whether a line of "-S" output belongs to the owner of
+// the handle: rules must carry its tag, other lines always do.
+func (ipt *IPTables) ownedLine(line string) bool {
+	if ipt.owner == "" || !strings.HasPrefix(line, "-A ") {
+		return true
+	}
+	if !strings.Contains(line, ownerTag+"="+ipt.owner) {
+		return false
+	}
+	r, err := ParseRule(line)
+	return err == nil && r.Tags()[ownerTag] == ipt.owner
+}
+
+// executeOwnedList runs a "-S" listing like ExecuteList, keeping the lines
+// of the owner of the handle.
+func (ipt *IPTables) executeOwnedList(args []string) ([]string, error) {
+	rules := []string{}
+	err := ipt.ExecuteListFunc(args, func(line string) error {
+		if ipt.ownedLine(line) {
+			rules = append(rules, line)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
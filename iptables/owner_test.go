@@ -0,0 +1,171 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOwner(t *testing.T) {
+	ipt, log := newFakeIPTables(t, `case "$*" in
+*-S*) printf -- '-P INPUT ACCEPT\n-A INPUT -s 192.0.2.1/32 -m comment --comment owner=agent-a,id=1 -j ACCEPT\n-A INPUT -s 192.0.2.2/32 -m comment --comment owner=agent-b,id=2 -j ACCEPT\n-A INPUT -m comment --comment "owner=agent-a in text" -j DROP\n-A INPUT -m comment --comment gen=1,gen-owner=agent-a -j ACCEPT\n-A INPUT -j LOG\n';;
+esac`)
+	Owner("agent-a")(ipt)
+
+	if err := ipt.Append("filter", "INPUT", "-s", "192.0.2.1", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := ipt.Delete("filter", "INPUT", "-s", "192.0.2.1", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	rules, err := ipt.List("filter", "INPUT")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	expected := []string{
+		"-P INPUT ACCEPT",
+		"-A INPUT -s 192.0.2.1/32 -m comment --comment owner=agent-a,id=1 -j ACCEPT",
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("List mismatch: \ngot  %q \nneed %q", rules, expected)
+	}
+	parsed, err := ipt.ListParsed("filter", "INPUT")
+	if err != nil || len(parsed) != 1 || parsed[0].Tags()["id"] != "1" {
+		t.Fatalf("ListParsed returned %+v, %v", parsed, err)
+	}
+
+	id := ruleID([]string{"-s", "192.0.2.1", "-j", "ACCEPT"})
+	expectedCalls := []string{
+		"--wait -t filter -A INPUT -s 192.0.2.1 -m comment --comment owner=agent-a,id=" + id + " -j ACCEPT",
+		"--wait -t filter -D INPUT -s 192.0.2.1 -m comment --comment owner=agent-a,id=" + id + " -j ACCEPT",
+		"--wait -t filter -S INPUT",
+		"--wait -t filter -S INPUT",
+	}
+	if calls := fakeCalls(t, log); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("calls mismatch: \ngot  %q \nneed %q", calls, expectedCalls)
+	}
+}
+
+func TestOwnerWritePaths(t *testing.T) {
+	ipt, _ := newFakeIPTables(t, `case "$*" in
+*"-t filter -S") printf -- '-P INPUT ACCEPT\n-N SVC\n-A SVC -m comment --comment owner=agent-a,id=1 -j ACCEPT\n';;
+esac`)
+	dir := filepath.Dir(ipt.path)
+	input := filepath.Join(dir, "restored")
+	script := "#!/bin/sh\ncat >> " + input + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables-restore"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	Owner("agent-a")(ipt)
+
+	// already tagged rules are kept as they are
+	snippet := "-A SVC -j ACCEPT\n[1:60] -A SVC -j DROP\n-A SVC -m comment --comment owner=agent-a,id=1 -j LOG\n"
+	if err := ipt.RestoreChainWithCounters("filter", "SVC", snippet, true); err != nil {
+		t.Fatalf("RestoreChain failed: %v", err)
+	}
+	rs := &Ruleset{Tables: []RulesetTable{{Name: "filter", Chains: []RulesetChain{{Name: "SVC", Rules: []RulesetRule{{Jump: "RETURN"}}}}}}}
+	if err := ipt.ApplyRuleset(rs); err != nil {
+		t.Fatalf("ApplyRuleset failed: %v", err)
+	}
+	data, _ := ioutil.ReadFile(input)
+	for _, line := range []string{
+		"-A SVC -m comment --comment owner=agent-a,id=" + ruleID([]string{"-j", "ACCEPT"}) + " -j ACCEPT\n",
+		"[1:60] -A SVC -m comment --comment owner=agent-a,id=" + ruleID([]string{"-j", "DROP"}) + " -j DROP\n",
+		"-A SVC -m comment --comment owner=agent-a,id=1 -j LOG\n",
+		"-A SVC -m comment --comment owner=agent-a,id=" + ruleID([]string{"-j", "RETURN"}) + " -j RETURN\n",
+	} {
+		if !strings.Contains(string(data), line) {
+			t.Errorf("restored %q, missing %q", data, line)
+		}
+	}
+
+	// the diff compares the tagged rules
+	rs.Tables[0].Chains[0].Rules = []RulesetRule{{Comment: "x", Jump: "ACCEPT"}}
+	diffs, err := ipt.DiffRuleset(rs)
+	if err != nil || len(diffs) != 1 || len(diffs[0].Added) != 1 || !strings.Contains(diffs[0].Added[0], "owner=agent-a") {
+		t.Fatalf("DiffRuleset returned %+v, %v", diffs, err)
+	}
+}
+
+func TestOwnerSharedChain(t *testing.T) {
+	tag := func(owner string, spec ...string) string {
+		return "-m comment --comment owner=" + owner + ",id=" + ruleID(spec)
+	}
+	rules := "-A INPUT " + tag("agent-b", "-j", "ACCEPT") + " -j ACCEPT\\n-A INPUT " + tag("agent-a", "-j", "DROP") + " -j DROP\\n"
+	ipt, _ := newFakeIPTables(t, `case "$*" in
+*"-t filter -S") printf -- '-P INPUT ACCEPT\n`+rules+`';;
+*"-S INPUT"*) printf -- '-P INPUT ACCEPT\n`+rules+`';;
+esac`)
+	dir := filepath.Dir(ipt.path)
+	input := filepath.Join(dir, "restored")
+	script := "#!/bin/sh\ncat > " + input + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables-restore"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	Owner("agent-a")(ipt)
+
+	restored := func() string {
+		data, _ := ioutil.ReadFile(input)
+		return string(data)
+	}
+
+	rs := &Ruleset{Tables: []RulesetTable{{Name: "filter", Chains: []RulesetChain{{Name: "INPUT", Rules: []RulesetRule{{Jump: "RETURN"}}}}}}}
+	if err := ipt.ApplyRuleset(rs); err != nil {
+		t.Fatalf("ApplyRuleset failed: %v", err)
+	}
+	expected := "*filter\n-D INPUT " + tag("agent-a", "-j", "DROP") + " -j DROP\n" +
+		"-A INPUT " + tag("agent-a", "-j", "RETURN") + " -j RETURN\nCOMMIT\n"
+	if got := restored(); got != expected {
+		t.Errorf("ApplyRuleset restored %q, want %q", got, expected)
+	}
+
+	// the rules of agent-b keep their place between those of agent-a
+	for _, tt := range []struct {
+		rules    [][]string
+		expected string
+	}{
+		{[][]string{{"-j", "LOG"}, {"-j", "DROP"}}, "-I INPUT 2 " + tag("agent-a", "-j", "LOG") + " -j LOG\n"},
+		{[][]string{{"-j", "DROP"}, {"-j", "LOG"}}, "-I INPUT 3 " + tag("agent-a", "-j", "LOG") + " -j LOG\n"},
+		{nil, "-D INPUT " + tag("agent-a", "-j", "DROP") + " -j DROP\n"},
+	} {
+		if _, err := ipt.ReconcileChain("filter", "INPUT", tt.rules); err != nil {
+			t.Fatalf("ReconcileChain failed: %v", err)
+		}
+		if got, want := restored(), "*filter\n"+tt.expected+"COMMIT\n"; got != want {
+			t.Errorf("ReconcileChain(%q) restored %q, want %q", tt.rules, got, want)
+		}
+	}
+
+	WithReconcileStrategy(FlushAndRebuild)(ipt)
+	if _, err := ipt.ReconcileChain("filter", "INPUT", [][]string{{"-j", "LOG"}}); err != nil {
+		t.Fatalf("ReconcileChain failed: %v", err)
+	}
+	expected = "*filter\n-D INPUT " + tag("agent-a", "-j", "DROP") + " -j DROP\n" +
+		"-A INPUT " + tag("agent-a", "-j", "LOG") + " -j LOG\nCOMMIT\n"
+	if got := restored(); got != expected {
+		t.Errorf("FlushAndRebuild restored %q, want %q", got, expected)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ApplyParallelism lets ApplyRuleset apply up to n tables at a time; the
+// default is one. A table is only started once the tables it depends on are
+// applied, see RulesetTable.After. Reading the current rules of the tables
+// always overlaps; with the legacy backend, the xtables lock still
+// serializes the restores themselves.
+func ApplyParallelism(n int) Option {
+	return func(ipt *IPTables) {
+		ipt.parallelism = n
+	}
+}
+
+// markOptions are the match options that read marks set in another table,
+// typically mangle.
+var markOptions = map[string]bool{
+	"--mark":   true,
+	"--ctmark": true,
+}
+
+// rulesetDeps returns, for every table of the ruleset, the indexes of the
+// tables that must be applied before it: those listed in After, and the
+// mangle table for tables matching on marks, if the ruleset has one. It
+// fails on unknown tables and cycles.
+func rulesetDeps(rs *Ruleset) ([][]int, error) {
+	index := make(map[string]int, len(rs.Tables))
+	for i, t := range rs.Tables {
+		index[t.Name] = i
+	}
+	mangle, hasMangle := index["mangle"]
+
+	deps := make([][]int, len(rs.Tables))
+	for i, t := range rs.Tables {
+		for _, name := range t.After {
+			j, ok := index[name]
+			if !ok {
+				return nil, fmt.Errorf("table %s is applied after table %s, which is not in the ruleset", t.Name, name)
+			}
+			if j == i {
+				return nil, fmt.Errorf("table %s is applied after itself", t.Name)
+			}
+			deps[i] = appendUniqueInt(deps[i], j)
+		}
+		if hasMangle && i != mangle && rulesetTableUsesMarks(t) {
+			deps[i] = appendUniqueInt(deps[i], mangle)
+		}
+	}
+	if cycle := findDepCycle(deps); cycle >= 0 {
+		return nil, fmt.Errorf("table %s depends on itself through After", rs.Tables[cycle].Name)
+	}
+	return deps, nil
+}
+
+// rulesetTableUsesMarks reports whether a rule of the table matches on a
+// packet or connection mark.
+func rulesetTableUsesMarks(t RulesetTable) bool {
+	for _, c := range t.Chains {
+		for _, r := range c.Rules {
+			for _, m := range r.Matches {
+				if markOptions[m] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func appendUniqueInt(s []int, v int) []int {
+	for _, x := range s {
+		if x == v {
+			return s
+		}
+	}
+	return append(s, v)
+}
+
+// findDepCycle returns a node on a cycle of the dependency graph, or -1.
+func findDepCycle(deps [][]int) int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(deps))
+	var visit func(i int) int
+	visit = func(i int) int {
+		switch state[i] {
+		case visiting:
+			return i
+		case visited:
+			return -1
+		}
+		state[i] = visiting
+		for _, j := range deps[i] {
+			if c := visit(j); c >= 0 {
+				return c
+			}
+		}
+		state[i] = visited
+		return -1
+	}
+	for i := range deps {
+		if c := visit(i); c >= 0 {
+			return c
+		}
+	}
+	return -1
+}
+
+// stepResult is the outcome of the step at index i.
+type stepResult struct {
+	i  int
+	re *RuleError
+}
+
+// applyGraph runs the steps under the handle's ErrorPolicy, up to
+// parallelism at a time, each once the steps in deps[i] have succeeded.
+// A step whose dependency failed is not run and fails too. Ready steps are
+// started in order of their index, so with a parallelism of one and no
+// dependencies the steps run in order. tables lists the tables the steps
+// modify, for RollbackAll; if deps or progress is not nil, tables[i] must
+// be the table of step i. progress, if not nil, is called with the result
+// of each step as it finishes.
+func (ipt *IPTables) applyGraph(tables []string, steps []func() *RuleError, deps [][]int, parallelism int, progress func(table string, re *RuleError)) error {
+	var snapshot string
+	if ipt.errorPolicy == RollbackAll {
+		var err error
+		if snapshot, err = ipt.Snapshot(tables...); err != nil {
+			return fmt.Errorf("saving tables for rollback: %v", err)
+		}
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	n := len(steps)
+	waiting := make([]int, n)
+	dependents := make([][]int, n)
+	for i := 0; i < n && deps != nil; i++ {
+		waiting[i] = len(deps[i])
+		for _, j := range deps[i] {
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+	var ready []int
+	for i := 0; i < n; i++ {
+		if waiting[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	applyErr := &ApplyError{}
+	var failed []stepResult
+	blocked := make([]bool, n)
+	results := make(chan stepResult)
+	running := 0
+	stop := false
+
+	// finish records a result and releases or fails the dependents
+	var finish func(r stepResult)
+	finish = func(r stepResult) {
+		if progress != nil {
+			progress(tables[r.i], r.re)
+		}
+		if r.re == nil {
+			applyErr.Applied++
+		} else {
+			failed = append(failed, r)
+			if ipt.errorPolicy != ContinueAndReport {
+				stop = true
+			}
+		}
+		for _, d := range dependents[r.i] {
+			if r.re != nil {
+				blocked[d] = true
+			}
+			if waiting[d]--; waiting[d] > 0 {
+				continue
+			}
+			if !blocked[d] {
+				ready = append(ready, d)
+				sort.Ints(ready)
+				continue
+			}
+			if !stop {
+				re := newRuleError(tables[d], "", 0, nil, fmt.Errorf("not applied: a table it depends on failed"))
+				finish(stepResult{d, re})
+			}
+		}
+	}
+
+	for {
+		for !stop && running < parallelism && len(ready) > 0 {
+			i := ready[0]
+			ready = ready[1:]
+			running++
+			go func() {
+				results <- stepResult{i, steps[i]()}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+		r := <-results
+		running--
+		finish(r)
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Slice(failed, func(a, b int) bool { return failed[a].i < failed[b].i })
+	for _, f := range failed {
+		applyErr.Failed = append(applyErr.Failed, f.re)
+	}
+	if ipt.errorPolicy == RollbackAll {
+		applyErr.RollbackErr = ipt.Restore(snapshot, RestoreOptions{PreserveCounters: true})
+		applyErr.RolledBack = applyErr.RollbackErr == nil
+	}
+	return applyErr
+}
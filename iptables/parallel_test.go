@@ -0,0 +1,111 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRulesetDeps(t *testing.T) {
+	rs := &Ruleset{Tables: []RulesetTable{
+		{Name: "filter", Chains: []RulesetChain{{Name: "INPUT", Rules: []RulesetRule{{Matches: []string{"-m", "mark", "--mark", "0x1"}, Jump: "ACCEPT"}}}}},
+		{Name: "nat", After: []string{"raw"}},
+		{Name: "mangle"},
+		{Name: "raw"},
+	}}
+	deps, err := rulesetDeps(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]int{{2}, {3}, nil, nil}; !reflect.DeepEqual(deps, expected) {
+		t.Fatalf("got %v, want %v", deps, expected)
+	}
+
+	for _, tables := range [][]RulesetTable{
+		{{Name: "filter", After: []string{"nat"}}},
+		{{Name: "filter", After: []string{"filter"}}},
+		{{Name: "filter", After: []string{"nat"}}, {Name: "nat", After: []string{"filter"}}},
+	} {
+		if _, err := rulesetDeps(&Ruleset{Tables: tables}); err == nil {
+			t.Errorf("%+v: expected error", tables)
+		}
+	}
+}
+
+func TestApplyGraph(t *testing.T) {
+	var (
+		mu                 sync.Mutex
+		order              []int
+		running, maxActive int
+	)
+	step := func(i int, fail bool) func() *RuleError {
+		return func() *RuleError {
+			mu.Lock()
+			running++
+			if running > maxActive {
+				maxActive = running
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			order = append(order, i)
+			mu.Unlock()
+			if fail {
+				return newRuleError("t", "", 0, nil, errors.New("failed"))
+			}
+			return nil
+		}
+	}
+
+	// 0 and 1 are independent, 2 needs 0, 3 needs the failing 1
+	ipt := &IPTables{}
+	steps := []func() *RuleError{step(0, false), step(1, true), step(2, false), step(3, false)}
+	reported := make(map[string]bool)
+	progress := func(table string, re *RuleError) {
+		reported[table] = re == nil
+	}
+	err := ipt.applyGraph([]string{"a", "b", "c", "d"}, steps, [][]int{nil, nil, {0}, {1}}, 2, progress)
+	applyErr, ok := err.(*ApplyError)
+	if !ok {
+		t.Fatalf("applyGraph returned %v, want *ApplyError", err)
+	}
+	if applyErr.Applied != 2 || len(applyErr.Failed) != 2 || applyErr.Failed[1].Table != "d" {
+		t.Fatalf("unexpected ApplyError: %v", applyErr)
+	}
+	if !reflect.DeepEqual(reported, map[string]bool{"a": true, "b": false, "c": true, "d": false}) {
+		t.Errorf("unexpected progress reports: %v", reported)
+	}
+	if maxActive != 2 {
+		t.Errorf("ran %d steps at a time, want 2", maxActive)
+	}
+	if len(order) != 3 || order[2] != 2 {
+		t.Errorf("steps ran in order %v, want 2 last and 3 skipped", order)
+	}
+
+	// sequential without dependencies, stopping at the first failure
+	order, maxActive = nil, 0
+	ipt = &IPTables{errorPolicy: FailFast}
+	if err := ipt.applyGraph([]string{"t"}, steps, nil, 1, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if !reflect.DeepEqual(order, []int{0, 1}) || maxActive != 1 {
+		t.Errorf("steps ran in order %v, %d at a time", order, maxActive)
+	}
+}
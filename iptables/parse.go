@@ -0,0 +1,203 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables/restore"
+)
+
+// splitRule splits a line of "iptables -S" output into its arguments, undoing
+// the double quoting iptables applies to arguments containing spaces or quotes.
+func splitRule(line string) ([]string, error) {
+	var (
+		args    []string
+		cur     []byte
+		inArg   bool
+		inQuote bool
+	)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case inQuote && c == '\\' && i+1 < len(line):
+			i++
+			cur = append(cur, line[i])
+		case c == '"':
+			inQuote = !inQuote
+			inArg = true
+		case !inQuote && (c == ' ' || c == '\t'):
+			if inArg {
+				args = append(args, string(cur))
+				cur = cur[:0]
+				inArg = false
+			}
+		default:
+			cur = append(cur, c)
+			inArg = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote in rule: %s", line)
+	}
+	if inArg {
+		args = append(args, string(cur))
+	}
+	return args, nil
+}
+
+// joinRule is the inverse of splitRule: it joins arguments into a single
+// line, double quoting those that contain spaces or quotes, as expected by
+// iptables-restore.
+func joinRule(args []string) string {
+	return restore.Join(args)
+}
+
+// ruleClause is one option of a rulespec together with its values,
+// e.g. "--dport" with ["22"]. Negated is set for "! --dport 22".
+type ruleClause struct {
+	option  string
+	values  []string
+	negated bool
+}
+
+func (c ruleClause) equal(o ruleClause) bool {
+	if c.option != o.option || c.negated != o.negated || len(c.values) != len(o.values) {
+		return false
+	}
+	for i := range c.values {
+		if c.values[i] != o.values[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ParsedRule is a rule as listed by "iptables -S", tokenized into its matches
+// and target. Extension options are not interpreted, only split into fields.
+type ParsedRule struct {
+	Chain string
+	// Spec is the rulespec as listed, without the leading "-A <chain>".
+	Spec string
+	// Matches maps each match option to its values, e.g. "-s" to ["192.0.2.0/24"]
+	// or "--dport" to ["22"]. Options given more than once, such as "-m", collect
+	// all their values. Negated options are keyed with a "! " prefix, e.g. "! -s".
+	Matches map[string][]string
+	// Target is the jump target, e.g. "ACCEPT" or a chain name; empty if none.
+	Target        string
+	TargetOptions []string
+	// Goto is set if the target was given with -g instead of -j.
+	Goto bool
+
+	clauses []ruleClause
+}
+
+// ParseRule parses an "-A <chain> ..." line of "iptables -S" output.
+func ParseRule(line string) (*ParsedRule, error) {
+	args, err := splitRule(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 2 || args[0] != "-A" {
+		return nil, fmt.Errorf("not a rule: %s", line)
+	}
+	r, err := parseRuleArgs(args[2:])
+	if err != nil {
+		return nil, fmt.Errorf("%v in rule: %s", err, line)
+	}
+	r.Chain = args[1]
+	r.Spec = strings.TrimSpace(strings.TrimPrefix(line, "-A "+args[1]))
+	return r, nil
+}
+
+// parseRuleArgs tokenizes a rulespec into a ParsedRule without Chain and Spec.
+func parseRuleArgs(args []string) (*ParsedRule, error) {
+	r := &ParsedRule{Matches: make(map[string][]string)}
+	negate := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "!":
+			negate = true
+		case arg == "-j" || arg == "--jump" || arg == "-g" || arg == "--goto":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing target")
+			}
+			r.Goto = arg == "-g" || arg == "--goto"
+			r.Target = args[i+1]
+			r.TargetOptions = args[i+2:]
+			i = len(args)
+		case strings.HasPrefix(arg, "-"):
+			r.clauses = append(r.clauses, ruleClause{option: arg, negated: negate})
+			negate = false
+		case len(r.clauses) > 0:
+			last := &r.clauses[len(r.clauses)-1]
+			last.values = append(last.values, arg)
+		default:
+			return nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+	}
+
+	for _, c := range r.clauses {
+		key := c.option
+		if c.negated {
+			key = "! " + key
+		}
+		r.Matches[key] = append(r.Matches[key], c.values...)
+	}
+	return r, nil
+}
+
+// tableRules is the parsed "iptables -S" output of a whole table.
+type tableRules struct {
+	// chains lists the chains in the order they were declared
+	chains   []string
+	policies map[string]string
+	builtin  map[string]bool
+	rules    map[string][]*ParsedRule
+}
+
+// parseTableRules parses the "iptables -S" output of a table.
+func parseTableRules(lines []string) (*tableRules, error) {
+	t := &tableRules{
+		policies: make(map[string]string),
+		builtin:  make(map[string]bool),
+		rules:    make(map[string][]*ParsedRule),
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "-P":
+			t.chains = append(t.chains, fields[1])
+			t.builtin[fields[1]] = true
+			if len(fields) > 2 {
+				t.policies[fields[1]] = fields[2]
+			}
+		case "-N":
+			t.chains = append(t.chains, fields[1])
+		case "-A":
+			r, err := ParseRule(line)
+			if err != nil {
+				return nil, err
+			}
+			t.rules[r.Chain] = append(t.rules[r.Chain], r)
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// runIP runs the iproute2 ip command; replaced in tests.
+var runIP = func(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// PolicyRoute routes the traffic selected by Match through a dedicated
+// routing table: mangle rules MARK the packets, an "ip rule" sends marked
+// packets to Table, and Routes fill the table. The rules and the routes are
+// installed and removed together, since either half is useless without the
+// other. The routing side runs the iproute2 ip command.
+type PolicyRoute struct {
+	// Match selects the traffic, e.g. "-s", "10.0.0.0/24"; it is appended to
+	// the mangle chains as is.
+	Match []string
+	// Chains are the mangle chains to mark packets in: PREROUTING for
+	// forwarded traffic, OUTPUT for locally generated traffic. Empty means
+	// PREROUTING.
+	Chains []string
+	// Mark is the mark set on the packets, in the bits of Mask; a zero Mask
+	// means all bits.
+	Mark uint32
+	Mask uint32
+	// Table is the routing table, other than the main, local and default ones.
+	Table int
+	// Priority of the ip rule; zero lets the kernel pick one.
+	Priority int
+	Routes   []PolicyRouteEntry
+}
+
+// PolicyRouteEntry is a route of the table of a PolicyRoute.
+type PolicyRouteEntry struct {
+	// Destination is a network or "default".
+	Destination string
+	// Via is the gateway, Dev the outgoing interface; at least one is required.
+	Via string
+	Dev string
+}
+
+func (pr *PolicyRoute) validate() error {
+	switch {
+	case pr.Mark == 0:
+		return fmt.Errorf("policy route: zero mark")
+	case pr.Mask != 0 && pr.Mark&^pr.Mask != 0:
+		return fmt.Errorf("policy route: mark %#x outside of mask %#x", pr.Mark, pr.Mask)
+	case pr.Table <= 0 || pr.Table >= 253:
+		// 253-255 are the default, main and local tables
+		return fmt.Errorf("policy route: invalid routing table %d", pr.Table)
+	case pr.Priority < 0:
+		return fmt.Errorf("policy route: negative priority")
+	case len(pr.Routes) == 0:
+		return fmt.Errorf("policy route: no routes")
+	}
+	for _, r := range pr.Routes {
+		if r.Destination == "" || (r.Via == "" && r.Dev == "") {
+			return fmt.Errorf("policy route: route %+v needs a destination and a gateway or device", r)
+		}
+	}
+	return nil
+}
+
+// fwmark returns the mark and mask as "ip rule" and MARK take them.
+func (pr *PolicyRoute) fwmark() string {
+	mask := pr.Mask
+	if mask == 0 {
+		mask = 0xffffffff
+	}
+	return fmt.Sprintf("%#x/%#x", pr.Mark, mask)
+}
+
+func (pr *PolicyRoute) chains() []string {
+	if len(pr.Chains) == 0 {
+		return []string{"PREROUTING"}
+	}
+	return pr.Chains
+}
+
+func (pr *PolicyRoute) markRule() []string {
+	return append(append([]string{}, pr.Match...), "-j", "MARK", "--set-xmark", pr.fwmark())
+}
+
+// ipArgs returns the ip command arguments for the handle's family.
+func (ipt *IPTables) ipArgs(args ...string) []string {
+	if ipt.proto == ProtocolIPv6 {
+		return append([]string{"-6"}, args...)
+	}
+	return append([]string{"-4"}, args...)
+}
+
+func (pr *PolicyRoute) ruleArgs(cmd string) []string {
+	args := []string{"rule", cmd, "fwmark", pr.fwmark(), "table", strconv.Itoa(pr.Table)}
+	if pr.Priority > 0 {
+		args = append(args, "priority", strconv.Itoa(pr.Priority))
+	}
+	return args
+}
+
+func (pr *PolicyRoute) routeArgs(cmd string, r PolicyRouteEntry) []string {
+	args := []string{"route", cmd, r.Destination}
+	if r.Via != "" {
+		args = append(args, "via", r.Via)
+	}
+	if r.Dev != "" {
+		args = append(args, "dev", r.Dev)
+	}
+	return append(args, "table", strconv.Itoa(pr.Table))
+}
+
+// InstallPolicyRoute installs the routes, the ip rule and the mangle rules of
+// the policy route, in that order, so marked packets always find their
+// table populated. It can be called again to repair a partial installation.
+func (ipt *IPTables) InstallPolicyRoute(pr PolicyRoute) error {
+	if err := pr.validate(); err != nil {
+		return err
+	}
+	if ipt.readOnly {
+		return ErrReadOnly
+	}
+	for _, r := range pr.Routes {
+		if err := runIP(ipt.ipArgs(pr.routeArgs("replace", r)...)...); err != nil {
+			return err
+		}
+	}
+	// ip rule add does not check for duplicates
+	runIP(ipt.ipArgs(pr.ruleArgs("del")...)...)
+	if err := runIP(ipt.ipArgs(pr.ruleArgs("add")...)...); err != nil {
+		return err
+	}
+	for _, chain := range pr.chains() {
+		if err := ipt.AppendUnique("mangle", chain, pr.markRule()...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemovePolicyRoute removes what InstallPolicyRoute installed, in reverse
+// order. Parts that are missing are skipped.
+func (ipt *IPTables) RemovePolicyRoute(pr PolicyRoute) error {
+	if err := pr.validate(); err != nil {
+		return err
+	}
+	if ipt.readOnly {
+		return ErrReadOnly
+	}
+	for _, chain := range pr.chains() {
+		if err := ipt.DeleteIfExists("mangle", chain, pr.markRule()...); err != nil {
+			return err
+		}
+	}
+	// the rule and routes may be gone already; there is nothing to report
+	// for a missing one
+	runIP(ipt.ipArgs(pr.ruleArgs("del")...)...)
+	for _, r := range pr.Routes {
+		runIP(ipt.ipArgs(pr.routeArgs("del", r)...)...)
+	}
+	return nil
+}
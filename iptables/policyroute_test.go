@@ -0,0 +1,73 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInstallPolicyRoute(t *testing.T) {
+	var ipCalls []string
+	old := runIP
+	defer func() { runIP = old }()
+	runIP = func(args ...string) error {
+		ipCalls = append(ipCalls, strings.Join(args, " "))
+		return nil
+	}
+	// the mark rule does not exist yet
+	ipt, log := newFakeIPTables(t, `case "$*" in *-C*) exit 1;; esac`)
+
+	pr := PolicyRoute{
+		Match:    []string{"-s", "10.0.0.0/24"},
+		Mark:     0x10,
+		Mask:     0xf0,
+		Table:    100,
+		Priority: 1000,
+		Routes:   []PolicyRouteEntry{{Destination: "default", Via: "192.0.2.1", Dev: "wan1"}},
+	}
+	if err := ipt.InstallPolicyRoute(pr); err != nil {
+		t.Fatalf("InstallPolicyRoute failed: %v", err)
+	}
+	expectedIP := []string{
+		"-4 route replace default via 192.0.2.1 dev wan1 table 100",
+		"-4 rule del fwmark 0x10/0xf0 table 100 priority 1000",
+		"-4 rule add fwmark 0x10/0xf0 table 100 priority 1000",
+	}
+	if !reflect.DeepEqual(ipCalls, expectedIP) {
+		t.Errorf("ip calls %q, want %q", ipCalls, expectedIP)
+	}
+	expected := []string{
+		"--wait -t mangle -C PREROUTING -s 10.0.0.0/24 -j MARK --set-xmark 0x10/0xf0",
+		"--wait -t mangle -A PREROUTING -s 10.0.0.0/24 -j MARK --set-xmark 0x10/0xf0",
+	}
+	if calls := fakeCalls(t, log); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("iptables calls %q, want %q", calls, expected)
+	}
+
+	for _, bad := range []PolicyRoute{
+		{Mark: 0x100, Mask: 0xf0, Table: 100, Routes: pr.Routes},
+		{Mark: 0x10, Table: 254, Routes: pr.Routes},
+		{Mark: 0x10, Table: 100},
+	} {
+		if err := ipt.InstallPolicyRoute(bad); err == nil {
+			t.Errorf("InstallPolicyRoute accepted %+v", bad)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"time"
+)
+
+// ChainEvent reports the rules of a chain polled by PollChain, after they
+// changed or, for the first event, as initially listed.
+type ChainEvent struct {
+	Time  time.Time
+	Table string
+	Chain string
+	// Rules are the rulespecs of the chain, as listed without "-A <chain>".
+	Rules []string
+	// Added and Removed hold the rules that appeared and disappeared since
+	// the previous event; the first event has all rules added.
+	Added   []string
+	Removed []string
+	// Reordered is set if rules present before and after changed order.
+	Reordered bool
+	// Err is set if the chain could not be listed, e.g. because it was
+	// deleted; the other fields describe the last successful listing.
+	Err error
+}
+
+// PollChain lists the chain in the specified table every interval and sends
+// an event on the returned channel when its rules changed, e.g. for UIs
+// displaying the live firewall state. The first event reports the initial
+// rules. A failed listing is reported as an event with Err set, and polling
+// continues. The channel is closed once ctx is done; events must be received
+// promptly, as polling waits for each one to be delivered.
+func (ipt *IPTables) PollChain(ctx context.Context, table, chain string, interval time.Duration) <-chan ChainEvent {
+	events := make(chan ChainEvent)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var prev []string
+		first := true
+		for {
+			ev := ChainEvent{Time: time.Now(), Table: table, Chain: chain}
+			rules, err := ipt.chainRuleSpecs(table, chain)
+			send := true
+			switch {
+			case err != nil:
+				ev.Rules, ev.Err = prev, err
+			default:
+				ev.Rules = rules
+				ev.Added, ev.Removed, ev.Reordered = diffRules(prev, rules)
+				send = first || len(ev.Added) > 0 || len(ev.Removed) > 0 || ev.Reordered
+				prev, first = rules, false
+			}
+			if send {
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// chainRuleSpecs lists the rulespecs of the chain, without "-A <chain>".
+func (ipt *IPTables) chainRuleSpecs(table, chain string) ([]string, error) {
+	parsed, err := ipt.ListParsed(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]string, 0, len(parsed))
+	for _, r := range parsed {
+		rules = append(rules, r.Spec)
+	}
+	return rules, nil
+}
+
+// diffRules compares two listings of a chain. Rules listed several times
+// count as often as they are listed.
+func diffRules(prev, cur []string) (added, removed []string, reordered bool) {
+	counts := make(map[string]int)
+	for _, r := range prev {
+		counts[r]++
+	}
+	// kept are the rules of cur also in prev, in their new order
+	var kept []string
+	for _, r := range cur {
+		if counts[r] > 0 {
+			counts[r]--
+			kept = append(kept, r)
+		} else {
+			added = append(added, r)
+		}
+	}
+
+	left := make(map[string]int)
+	for _, r := range kept {
+		left[r]++
+	}
+	// before are the same rules, in their previous order
+	var before []string
+	for _, r := range prev {
+		if left[r] > 0 {
+			left[r]--
+			before = append(before, r)
+		} else {
+			removed = append(removed, r)
+		}
+	}
+	for i := range before {
+		if before[i] != kept[i] {
+			reordered = true
+			break
+		}
+	}
+	return added, removed, reordered
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffRules(t *testing.T) {
+	for _, tt := range []struct {
+		prev, cur      []string
+		added, removed []string
+		reordered      bool
+	}{
+		{nil, []string{"a", "b"}, []string{"a", "b"}, nil, false},
+		{[]string{"a", "b", "c"}, []string{"a", "c", "d"}, []string{"d"}, []string{"b"}, false},
+		{[]string{"a", "b", "c"}, []string{"c", "a", "b"}, nil, nil, true},
+		{[]string{"a", "a", "b"}, []string{"a", "b"}, nil, []string{"a"}, false},
+		{[]string{"a", "b"}, []string{"a", "b"}, nil, nil, false},
+	} {
+		added, removed, reordered := diffRules(tt.prev, tt.cur)
+		if !reflect.DeepEqual(added, tt.added) || !reflect.DeepEqual(removed, tt.removed) || reordered != tt.reordered {
+			t.Errorf("diffRules(%q, %q) = %q, %q, %v; want %q, %q, %v",
+				tt.prev, tt.cur, added, removed, reordered, tt.added, tt.removed, tt.reordered)
+		}
+	}
+}
+
+func TestPollChain(t *testing.T) {
+	// the fake lists the rules in the file, and fails once it is removed
+	rules := filepath.Join(t.TempDir(), "rules")
+	// replace the file atomically, so the fake never lists a partial one
+	write := func(data string) {
+		if err := ioutil.WriteFile(rules+".new", []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(rules+".new", rules); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("-N SVC\n-A SVC -j ACCEPT\n")
+	ipt, _ := newFakeIPTables(t, "cat "+rules+" || exit 1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := ipt.PollChain(ctx, "filter", "SVC", time.Millisecond)
+	next := func() ChainEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return ChainEvent{}
+	}
+
+	ev := next()
+	if ev.Err != nil || !reflect.DeepEqual(ev.Added, []string{"-j ACCEPT"}) || ev.Table != "filter" || ev.Chain != "SVC" {
+		t.Fatalf("initial event %+v", ev)
+	}
+
+	write("-N SVC\n-A SVC -s 192.0.2.1/32 -j DROP\n-A SVC -j ACCEPT\n")
+	ev = next()
+	if ev.Err != nil || !reflect.DeepEqual(ev.Added, []string{"-s 192.0.2.1/32 -j DROP"}) || ev.Removed != nil ||
+		!reflect.DeepEqual(ev.Rules, []string{"-s 192.0.2.1/32 -j DROP", "-j ACCEPT"}) {
+		t.Fatalf("event after adding a rule %+v", ev)
+	}
+
+	write("-N SVC\n-A SVC -j ACCEPT\n-A SVC -s 192.0.2.1/32 -j DROP\n")
+	ev = next()
+	if ev.Err != nil || !ev.Reordered || ev.Added != nil || ev.Removed != nil {
+		t.Fatalf("event after reordering %+v", ev)
+	}
+
+	write("-N SVC\n")
+	ev = next()
+	if ev.Err != nil || !reflect.DeepEqual(ev.Removed, []string{"-j ACCEPT", "-s 192.0.2.1/32 -j DROP"}) {
+		t.Fatalf("event after flushing %+v", ev)
+	}
+
+	if err := os.Remove(rules); err != nil {
+		t.Fatal(err)
+	}
+	ev = next()
+	if ev.Err == nil || len(ev.Rules) != 0 {
+		t.Fatalf("event after deleting the chain %+v", ev)
+	}
+
+	cancel()
+	for range events {
+	}
+}
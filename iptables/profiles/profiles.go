@@ -0,0 +1,216 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package profiles provides vetted rule set templates for common host
+// roles, to install with Install or to customize and apply with
+// iptables.ApplyRuleset, instead of copying security-critical rules around.
+//
+// Every profile declares its chains completely: applying it replaces the
+// rules of those chains, and leaves all other chains alone. Profiles are for
+// IPv4 handles.
+package profiles
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Var is a template variable of a profile, referenced in its rules as
+// {{ .Name }}.
+type Var struct {
+	Name        string
+	Description string
+	// Default is used if the variable is not given; variables without a
+	// default are required.
+	Default string
+}
+
+// Hook is a jump into a chain of the profile, added by Install.
+type Hook struct {
+	Table, From, To string
+}
+
+// Profile is a rule set template for a host role.
+type Profile struct {
+	Name        string
+	Description string
+	Vars        []Var
+	// Hooks are the jumps from built-in chains to the profile's own chains,
+	// for profiles that do not take over the built-in chains themselves.
+	Hooks []Hook
+
+	ruleset *iptables.Ruleset
+}
+
+// Ruleset returns the profile's rule set with the variables expanded. vars
+// overrides the defaults; unknown variables are an error, to catch typos.
+func (p *Profile) Ruleset(vars map[string]string) (*iptables.Ruleset, error) {
+	data := make(map[string]string, len(p.Vars))
+	for _, v := range p.Vars {
+		if v.Default != "" {
+			data[v.Name] = v.Default
+		}
+	}
+	for name, val := range vars {
+		if !p.hasVar(name) {
+			return nil, fmt.Errorf("profile %s has no variable %s", p.Name, name)
+		}
+		data[name] = val
+	}
+	for _, v := range p.Vars {
+		if data[v.Name] == "" {
+			return nil, fmt.Errorf("profile %s: variable %s is required: %s", p.Name, v.Name, v.Description)
+		}
+	}
+	return p.ruleset.Expand(data)
+}
+
+func (p *Profile) hasVar(name string) bool {
+	for _, v := range p.Vars {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Install applies the profile's rule set with the variables expanded, then
+// makes the jumps of its Hooks the first rules of their chains.
+func (p *Profile) Install(ipt *iptables.IPTables, vars map[string]string) error {
+	rs, err := p.Ruleset(vars)
+	if err != nil {
+		return err
+	}
+	if err := ipt.ApplyRuleset(rs); err != nil {
+		return err
+	}
+	for _, h := range p.Hooks {
+		if err := ipt.EnsureJump(h.Table, h.From, h.To, iptables.JumpFirst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the profile with the given name, or nil.
+func Get(name string) *Profile {
+	for _, p := range all {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Names returns the sorted names of the profiles.
+func Names() []string {
+	names := make([]string, 0, len(all))
+	for _, p := range all {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var all = []*Profile{BasicHost, DockerHost, KubernetesNode}
+
+var sshVar = Var{Name: "SSHPort", Description: "TCP port of the SSH server", Default: "22"}
+
+// baseInput are the first rules of every INPUT chain: loopback, replies and
+// ICMP are accepted, invalid packets dropped, and SSH stays reachable.
+func baseInput() []iptables.RulesetRule {
+	return []iptables.RulesetRule{
+		{InInterface: "lo", Jump: "ACCEPT"},
+		{State: []string{"ESTABLISHED", "RELATED"}, Jump: "ACCEPT"},
+		{State: []string{"INVALID"}, Jump: "DROP"},
+		{Protocol: "icmp", Jump: "ACCEPT"},
+		{Protocol: "tcp", DestinationPort: "{{ .SSHPort }}", State: []string{"NEW"}, Jump: "ACCEPT"},
+	}
+}
+
+// BasicHost is a stateful firewall for a standalone host: incoming
+// connections are dropped except SSH, nothing is forwarded, and outgoing
+// traffic is unrestricted.
+var BasicHost = &Profile{
+	Name:        "basic-host",
+	Description: "stateful host firewall allowing only SSH in",
+	Vars:        []Var{sshVar},
+	ruleset: &iptables.Ruleset{Tables: []iptables.RulesetTable{{
+		Name: "filter",
+		Chains: []iptables.RulesetChain{
+			{Name: "INPUT", Policy: "DROP", Rules: baseInput()},
+			{Name: "FORWARD", Policy: "DROP"},
+			{Name: "OUTPUT", Policy: "ACCEPT"},
+		},
+	}}},
+}
+
+// DockerHost hardens a Docker host: INPUT is locked down like BasicHost, and
+// the DOCKER-USER chain limits access to published container ports from
+// the external interface to AllowedCIDR. FORWARD is left to Docker.
+var DockerHost = &Profile{
+	Name:        "docker-host",
+	Description: "Docker host with published ports restricted to a network",
+	Vars: []Var{
+		sshVar,
+		{Name: "ExternalIface", Description: "interface facing untrusted networks"},
+		{Name: "AllowedCIDR", Description: "network allowed to reach published ports from the external interface"},
+	},
+	ruleset: &iptables.Ruleset{Tables: []iptables.RulesetTable{{
+		Name: "filter",
+		Chains: []iptables.RulesetChain{
+			{Name: "INPUT", Policy: "DROP", Rules: baseInput()},
+			{Name: "DOCKER-USER", Rules: []iptables.RulesetRule{
+				{State: []string{"ESTABLISHED", "RELATED"}, Jump: "RETURN"},
+				{InInterface: "{{ .ExternalIface }}", Source: "{{ .AllowedCIDR }}", Jump: "RETURN"},
+				{InInterface: "{{ .ExternalIface }}", Jump: "DROP"},
+				{Jump: "RETURN"},
+			}},
+		},
+	}}},
+}
+
+// KubernetesNode is a baseline for Kubernetes worker nodes. As kube-proxy
+// and the network plugin maintain their own rules in INPUT and FORWARD, the
+// baseline lives in the K8S-NODE-INPUT chain, jumped to first from INPUT:
+// it admits SSH, the kubelet API from the control plane, NodePorts, traffic
+// from pods and the VXLAN overlay from other nodes, and drops any other new
+// connection.
+var KubernetesNode = &Profile{
+	Name:        "k8s-node",
+	Description: "Kubernetes worker node baseline",
+	Vars: []Var{
+		sshVar,
+		{Name: "ControlPlaneCIDR", Description: "network of the control plane nodes"},
+		{Name: "NodeCIDR", Description: "network of the cluster nodes"},
+		{Name: "PodCIDR", Description: "network of the cluster pods"},
+		{Name: "NodePortRange", Description: "NodePort service range", Default: "30000:32767"},
+	},
+	Hooks: []Hook{{Table: "filter", From: "INPUT", To: "K8S-NODE-INPUT"}},
+	ruleset: &iptables.Ruleset{Tables: []iptables.RulesetTable{{
+		Name: "filter",
+		Chains: []iptables.RulesetChain{
+			{Name: "K8S-NODE-INPUT", Rules: append(baseInput(),
+				iptables.RulesetRule{Source: "{{ .ControlPlaneCIDR }}", Protocol: "tcp", DestinationPort: "10250", Jump: "ACCEPT", Comment: "kubelet API"},
+				iptables.RulesetRule{Protocol: "tcp", DestinationPort: "{{ .NodePortRange }}", Jump: "ACCEPT", Comment: "NodePort services"},
+				iptables.RulesetRule{Protocol: "udp", DestinationPort: "{{ .NodePortRange }}", Jump: "ACCEPT", Comment: "NodePort services"},
+				iptables.RulesetRule{Source: "{{ .PodCIDR }}", Jump: "ACCEPT", Comment: "pods"},
+				iptables.RulesetRule{Source: "{{ .NodeCIDR }}", Protocol: "udp", DestinationPort: "8472", Jump: "ACCEPT", Comment: "VXLAN overlay"},
+				iptables.RulesetRule{State: []string{"NEW"}, Jump: "DROP"},
+			)},
+		},
+	}}},
+}
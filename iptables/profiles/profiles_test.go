@@ -0,0 +1,74 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiles
+
+import (
+	"testing"
+)
+
+// testVars has a value for every required variable of any profile.
+var testVars = map[string]map[string]string{
+	"basic-host": {},
+	"docker-host": {
+		"ExternalIface": "eth0",
+		"AllowedCIDR":   "192.0.2.0/24",
+	},
+	"k8s-node": {
+		"ControlPlaneCIDR": "10.0.0.0/28",
+		"NodeCIDR":         "10.0.0.0/16",
+		"PodCIDR":          "10.244.0.0/16",
+	},
+}
+
+func TestProfilesRender(t *testing.T) {
+	for _, name := range Names() {
+		p := Get(name)
+		rs, err := p.Ruleset(testVars[name])
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		for _, table := range rs.Tables {
+			for _, chain := range table.Chains {
+				for i := range chain.Rules {
+					if _, err := chain.Rules[i].Args(); err != nil {
+						t.Errorf("%s: rule %d of %s: %v", name, i+1, chain.Name, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestProfileVars(t *testing.T) {
+	rs, err := BasicHost.Ruleset(map[string]string{"SSHPort": "2222"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssh := rs.Tables[0].Chains[0].Rules[4]
+	if ssh.DestinationPort != "2222" {
+		t.Errorf("SSH rule has port %q, want 2222", ssh.DestinationPort)
+	}
+
+	if _, err := DockerHost.Ruleset(nil); err == nil {
+		t.Error("expected error for missing required variables")
+	}
+	if _, err := BasicHost.Ruleset(map[string]string{"SshPort": "22"}); err == nil {
+		t.Error("expected error for unknown variable")
+	}
+	if Get("no-such-profile") != nil {
+		t.Error("Get returned a profile for an unknown name")
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrProtectedChain is returned when a ChainManager is asked to flush or
+// delete a protected chain.
+var ErrProtectedChain = errors.New("iptables: chain is protected")
+
+// protectMarker is the rule marking a protected chain, kept first in it.
+var protectMarker = []string{"-m", "comment", "--comment", "protected"}
+
+// Protect marks the managed chain as protected, creating it if needed:
+// FlushChain and DeleteChain refuse to wipe it, Cleanup leaves it and its
+// hooks in place, and SetRules keeps the marker. The marker is a rule with
+// the comment "protected", inserted first in the chain, so other managers
+// see it too; a restarted program calls Protect again, or imports its state.
+func (m *ChainManager) Protect(chain string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.ensureChain(chain); err != nil {
+		return err
+	}
+	marked, err := m.hasProtectMarker(chain)
+	if err != nil {
+		return err
+	}
+	if !marked {
+		if err := m.ipt.Insert(m.table, chain, 1, protectMarker...); err != nil {
+			return err
+		}
+	}
+	m.chains[chain].protected = true
+	return nil
+}
+
+// Unprotect removes the protection of the managed chain.
+func (m *ChainManager) Unprotect(chain string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := m.chains[chain]
+	if c == nil {
+		return nil
+	}
+	if err := m.ipt.DeleteIfExists(m.table, chain, protectMarker...); err != nil {
+		return err
+	}
+	c.protected = false
+	return nil
+}
+
+// Protected reports whether the chain is protected, by Protect or by a
+// marker found in the chain.
+func (m *ChainManager) Protected(chain string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.protected(chain)
+}
+
+func (m *ChainManager) protected(chain string) (bool, error) {
+	if c := m.chains[chain]; c != nil && c.protected {
+		return true, nil
+	}
+	return m.hasProtectMarker(chain)
+}
+
+// hasProtectMarker reports whether the chain holds the protect marker,
+// whichever owner added it.
+func (m *ChainManager) hasProtectMarker(chain string) (bool, error) {
+	rules, err := m.ipt.ExecuteList([]string{"-t", m.table, "-S", chain})
+	if err != nil {
+		return false, err
+	}
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule, "-A ") {
+			continue
+		}
+		r, err := ParseRule(rule)
+		if err != nil {
+			return false, err
+		}
+		if r.Target == "" && containsString(r.Matches["--comment"], "protected") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// FlushChain deletes all rules of the managed chain. It fails with
+// ErrProtectedChain if the chain is protected, and with ErrUserChain for
+// the user hook chain.
+func (m *ChainManager) FlushChain(chain string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkWipe(chain); err != nil {
+		return err
+	}
+	if err := m.ipt.ClearChain(m.table, chain); err != nil {
+		return err
+	}
+	if c := m.chains[chain]; c != nil {
+		c.rules = nil
+	}
+	return nil
+}
+
+// DeleteChain removes the hooks to the managed chain and deletes it. It
+// fails with ErrProtectedChain if the chain is protected, and with
+// ErrUserChain for the user hook chain.
+func (m *ChainManager) DeleteChain(chain string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkWipe(chain); err != nil {
+		return err
+	}
+	var kept []chainHook
+	for _, h := range m.hooks {
+		if h.to != chain {
+			kept = append(kept, h)
+			continue
+		}
+		if err := m.ipt.DeleteIfExists(m.table, h.from, "-j", h.to); err != nil {
+			return err
+		}
+	}
+	m.hooks = kept
+	if err := m.ipt.ClearChain(m.table, chain); err != nil {
+		return err
+	}
+	if err := m.ipt.DeleteChain(m.table, chain); err != nil {
+		return err
+	}
+	delete(m.chains, chain)
+	return nil
+}
+
+// checkWipe returns an error if the chain must not be flushed or deleted.
+func (m *ChainManager) checkWipe(chain string) error {
+	if chain == m.userChain {
+		return ErrUserChain
+	}
+	protected, err := m.protected(chain)
+	if err != nil {
+		return err
+	}
+	if protected {
+		return ErrProtectedChain
+	}
+	return nil
+}
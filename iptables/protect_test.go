@@ -0,0 +1,83 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProtectChain(t *testing.T) {
+	ipt, log := newFakeIPTables(t, `marker="$(dirname "$0")/marker"
+case "$*" in
+*"-S SVC"*) printf -- '-N SVC\n'; test -e "$marker" && printf -- '-A SVC -m comment --comment protected\n'; printf -- '-A SVC -j ACCEPT\n';;
+*"-S OTHER"*) printf -- '-N OTHER\n-A OTHER -m comment --comment "owner=someone" -m comment --comment protected\n';;
+*"-I SVC 1"*) touch "$marker";;
+*"-C SVC"*) test -e "$marker";;
+*"-D SVC -m comment"*) rm "$marker";;
+esac`)
+	m := NewChainManager(ipt, "filter")
+
+	if err := m.Protect("SVC"); err != nil {
+		t.Fatalf("Protect failed: %v", err)
+	}
+	// protecting again does not insert a second marker
+	if err := m.Protect("SVC"); err != nil {
+		t.Fatalf("Protect failed: %v", err)
+	}
+	if err := m.FlushChain("SVC"); err != ErrProtectedChain {
+		t.Fatalf("FlushChain returned %v, want ErrProtectedChain", err)
+	}
+	if err := m.DeleteChain("SVC"); err != ErrProtectedChain {
+		t.Fatalf("DeleteChain returned %v, want ErrProtectedChain", err)
+	}
+	// chains protected by someone else are recognized by their marker
+	if err := m.EnsureChain("OTHER"); err != nil {
+		t.Fatalf("EnsureChain failed: %v", err)
+	}
+	if err := m.FlushChain("OTHER"); err != ErrProtectedChain {
+		t.Fatalf("FlushChain returned %v, want ErrProtectedChain", err)
+	}
+	if err := m.Unprotect("SVC"); err != nil {
+		t.Fatalf("Unprotect failed: %v", err)
+	}
+	if protected, err := m.Protected("SVC"); err != nil || protected {
+		t.Fatalf("Protected returned %v, %v", protected, err)
+	}
+	if err := m.FlushChain("SVC"); err != nil {
+		t.Fatalf("FlushChain failed: %v", err)
+	}
+
+	expectedCalls := []string{
+		"--wait -t filter -S SVC 1",
+		"--wait -t filter -S SVC",
+		"--wait -t filter -I SVC 1 -m comment --comment protected",
+		"--wait -t filter -S SVC 1",
+		"--wait -t filter -S SVC",
+		"--wait -t filter -S OTHER 1",
+		"--wait -t filter -S OTHER",
+		"--wait -t filter -C SVC -m comment --comment protected",
+		"--wait -t filter -D SVC -m comment --comment protected",
+		"--wait -t filter -S SVC",
+		"--wait -t filter -S SVC",
+		"--wait -t filter -N SVC",
+	}
+	if calls := fakeCalls(t, log); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("calls mismatch: \ngot  %q \nneed %q", calls, expectedCalls)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// QuotaRule is a data cap on the traffic matched by Rulespec, e.g.
+// "-s", "192.168.1.10". Traffic within the quota returns from the quota
+// chain; once it is used up, Over is applied instead.
+type QuotaRule struct {
+	Rulespec []string
+	Bytes    uint64
+	// Over is the target applied to traffic over the quota, e.g.
+	// "-j", "DROP". It defaults to dropping the traffic.
+	Over []string
+}
+
+// QuotaStatus is the state of a quota.
+type QuotaStatus struct {
+	// Used is the number of bytes counted against the quota.
+	Used uint64
+	// Exhausted is set once traffic has been seen over the quota.
+	Exhausted bool
+}
+
+// QuotaManager maintains a dedicated chain of quota rules, two per quota:
+// one with the quota match returning from the chain, and one applying the
+// over-quota target. A quota is exhausted once its second rule matches.
+type QuotaManager struct {
+	ipt   *IPTables
+	table string
+	chain string
+
+	mu     sync.Mutex
+	quotas map[string]QuotaRule
+}
+
+// NewQuotaManager returns a manager for the quotas in the specified
+// table/chain, which Sync creates and then owns. Jumping to the chain is
+// left to the caller.
+func NewQuotaManager(ipt *IPTables, table, chain string) *QuotaManager {
+	return &QuotaManager{
+		ipt:    ipt,
+		table:  table,
+		chain:  chain,
+		quotas: make(map[string]QuotaRule),
+	}
+}
+
+// Set adds or replaces the quota with the given name. The name must be valid
+// as a RuleTags value. It takes effect on the next Sync.
+func (m *QuotaManager) Set(name string, rule QuotaRule) error {
+	if !validTag(name) {
+		return fmt.Errorf("invalid quota name %q", name)
+	}
+	if rule.Bytes == 0 {
+		return fmt.Errorf("quota %s: no bytes", name)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.quotas[name] = rule
+	return nil
+}
+
+// Remove removes the quota with the given name. It takes effect on the next Sync.
+func (m *QuotaManager) Remove(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.quotas, name)
+}
+
+// Sync brings the chain in line with the quotas in a single iptables-restore
+// transaction. Only the rules of added, changed or removed quotas are
+// touched, so the remaining quotas keep their state.
+func (m *QuotaManager) Sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	exists, err := m.ipt.ChainExists(m.table, m.chain)
+	if err != nil {
+		return err
+	}
+	var current []Stat
+	if exists {
+		if current, err = m.ipt.Stats(m.table, m.chain); err != nil {
+			return err
+		}
+	}
+	snippet, err := m.syncData(current)
+	if err != nil {
+		return err
+	}
+	if exists && snippet == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString("*" + m.table + "\n")
+	if !exists {
+		buf.WriteString(":" + m.chain + " - [0:0]\n")
+	}
+	buf.WriteString(snippet)
+	buf.WriteString("COMMIT\n")
+	return m.ipt.Restore(buf.String(), RestoreOptions{NoFlush: true})
+}
+
+// Status returns the state of every quota in the chain, by name.
+func (m *QuotaManager) Status() (map[string]QuotaStatus, error) {
+	stats, err := m.ipt.Stats(m.table, m.chain)
+	if err != nil {
+		return nil, err
+	}
+	status := make(map[string]QuotaStatus)
+	for _, s := range stats {
+		tags := quotaTags(m.chain, s.Rule)
+		if tags == nil {
+			continue
+		}
+		st := status[tags["quota"]]
+		if tags["state"] == "within" {
+			st.Used += s.Bytes
+		} else if s.Packets > 0 {
+			st.Exhausted = true
+		}
+		status[tags["quota"]] = st
+	}
+	return status, nil
+}
+
+// Exhausted returns the names of the quotas that have been used up, sorted.
+func (m *QuotaManager) Exhausted() ([]string, error) {
+	status, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name, st := range status {
+		if st.Exhausted {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Reset restores the full quota of the named quotas, replacing their rules
+// in place in a single iptables-restore transaction.
+func (m *QuotaManager) Reset(names ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats, err := m.ipt.Stats(m.table, m.chain)
+	if err != nil {
+		return err
+	}
+	reset := make(map[string]bool)
+	for _, name := range names {
+		if _, ok := m.quotas[name]; !ok {
+			return fmt.Errorf("unknown quota %s", name)
+		}
+		reset[name] = true
+	}
+	var buf bytes.Buffer
+	buf.WriteString("*" + m.table + "\n")
+	for i, s := range stats {
+		tags := quotaTags(m.chain, s.Rule)
+		if tags == nil || !reset[tags["quota"]] {
+			continue
+		}
+		args, err := m.ruleArgs(tags["quota"], m.quotas[tags["quota"]], tags["state"])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "-R %s %d %s\n", m.chain, i+1, joinRule(args))
+	}
+	buf.WriteString("COMMIT\n")
+	return m.ipt.Restore(buf.String(), RestoreOptions{NoFlush: true})
+}
+
+// Rotate resets every quota, e.g. at the start of a new billing period.
+func (m *QuotaManager) Rotate() error {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.quotas))
+	for name := range m.quotas {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	return m.Reset(names...)
+}
+
+// syncData returns the restore lines deleting the rules of stale quotas and
+// appending those of new ones, given the counters listing of the chain.
+func (m *QuotaManager) syncData(current []Stat) (string, error) {
+	var buf bytes.Buffer
+	present := make(map[string]bool)
+	for i := len(current) - 1; i >= 0; i-- {
+		tags := quotaTags(m.chain, current[i].Rule)
+		if tags != nil {
+			if q, ok := m.quotas[tags["quota"]]; ok && tags["spec"] == quotaSpec(q) {
+				present[tags["quota"]] = true
+				continue
+			}
+		}
+		fmt.Fprintf(&buf, "-D %s %d\n", m.chain, i+1)
+	}
+
+	names := make([]string, 0, len(m.quotas))
+	for name := range m.quotas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if present[name] {
+			continue
+		}
+		for _, state := range []string{"within", "over"} {
+			args, err := m.ruleArgs(name, m.quotas[name], state)
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString("-A " + m.chain + " " + joinRule(args) + "\n")
+		}
+	}
+	return buf.String(), nil
+}
+
+// ruleArgs renders the rule of a quota for the "within" or "over" state.
+func (m *QuotaManager) ruleArgs(name string, q QuotaRule, state string) ([]string, error) {
+	args := append([]string{}, q.Rulespec...)
+	if state == "within" {
+		quota, _ := (&Quota{Bytes: q.Bytes}).Args()
+		args = append(append(args, quota...), "-j", "RETURN")
+	} else if len(q.Over) > 0 {
+		args = append(args, q.Over...)
+	} else {
+		args = append(args, "-j", "DROP")
+	}
+	return tagged(RuleTags{"quota": name, "state": state, "spec": quotaSpec(q)}, args)
+}
+
+// quotaSpec summarizes a quota in a tag value, so Sync can tell whether the
+// quota of a rule changed.
+func quotaSpec(q QuotaRule) string {
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(q.Rulespec, "\x00") + "\x01" + strings.Join(q.Over, "\x00")))
+	return strconv.FormatUint(q.Bytes, 10) + "-" + strconv.FormatUint(uint64(h.Sum32()), 16)
+}
+
+// quotaTags returns the tags of a listed rule of the quota chain, or nil if
+// it was not created by QuotaManager.
+func quotaTags(chain, rule string) RuleTags {
+	r, err := ParseRule("-A " + chain + " " + rule)
+	if err != nil {
+		return nil
+	}
+	tags := r.Tags()
+	if tags["quota"] == "" || (tags["state"] != "within" && tags["state"] != "over") {
+		return nil
+	}
+	return tags
+}
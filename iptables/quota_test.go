@@ -0,0 +1,75 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQuotaSyncData(t *testing.T) {
+	m := NewQuotaManager(&IPTables{}, "filter", "QUOTA")
+	if err := m.Set("alice", QuotaRule{Rulespec: []string{"-s", "192.168.1.10"}, Bytes: 1000}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := m.Set("bob", QuotaRule{Rulespec: []string{"-s", "192.168.1.20"}, Bytes: 2000, Over: []string{"-j", "REJECT"}}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := m.Set("carol", QuotaRule{Rulespec: []string{"-s", "192.168.1.30"}}); err == nil {
+		t.Fatalf("Set accepted a quota without bytes")
+	}
+
+	// alice is in place, bob's limit changed and dave is gone
+	current := []Stat{
+		{Rule: "-s 192.168.1.10/32 -m quota --quota 1000 -m comment --comment quota=alice,spec=1000-280549fd,state=within -j RETURN"},
+		{Rule: "-s 192.168.1.10/32 -m comment --comment quota=alice,spec=1000-280549fd,state=over -j DROP"},
+		{Rule: "-s 192.168.1.20/32 -m quota --quota 500 -m comment --comment quota=bob,spec=500-a76de0ac,state=within -j RETURN"},
+		{Rule: "-s 192.168.1.20/32 -m comment --comment quota=bob,spec=500-a76de0ac,state=over -j DROP"},
+		{Rule: "-s 192.168.1.40/32 -m quota --quota 10 -m comment --comment quota=dave,spec=10-0,state=within -j RETURN"},
+	}
+	data, err := m.syncData(current)
+	if err != nil {
+		t.Fatalf("syncData failed: %v", err)
+	}
+	expected := `-D QUOTA 5
+-D QUOTA 4
+-D QUOTA 3
+-A QUOTA -s 192.168.1.20 -m quota --quota 2000 -m comment --comment quota=bob,spec=2000-1cab228a,state=within -j RETURN
+-A QUOTA -s 192.168.1.20 -m comment --comment quota=bob,spec=2000-1cab228a,state=over -j REJECT
+`
+	if data != expected {
+		t.Fatalf("syncData mismatch: \ngot  %s \nneed %s", data, expected)
+	}
+}
+
+func TestQuotaStatus(t *testing.T) {
+	ipt, _ := newFakeIPTables(t, `printf -- '-N QUOTA\n-A QUOTA -s 192.168.1.10/32 -m quota --quota 1000 -m comment --comment quota=alice,spec=x,state=within -j RETURN -c 8 990\n-A QUOTA -s 192.168.1.10/32 -m comment --comment quota=alice,spec=x,state=over -j DROP -c 2 120\n-A QUOTA -s 192.168.1.20/32 -m quota --quota 2000 -m comment --comment quota=bob,spec=y,state=within -j RETURN -c 1 60\n-A QUOTA -s 192.168.1.20/32 -m comment --comment quota=bob,spec=y,state=over -j DROP -c 0 0\n'`)
+	m := NewQuotaManager(ipt, "filter", "QUOTA")
+
+	status, err := m.Status()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	expected := map[string]QuotaStatus{"alice": {Used: 990, Exhausted: true}, "bob": {Used: 60}}
+	if !reflect.DeepEqual(status, expected) {
+		t.Fatalf("Status returned %+v, want %+v", status, expected)
+	}
+	if names, err := m.Exhausted(); err != nil || !reflect.DeepEqual(names, []string{"alice"}) {
+		t.Fatalf("Exhausted returned %v, %v", names, err)
+	}
+}
@@ -0,0 +1,401 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ReconcileStrategy selects how ReconcileChain updates a chain.
+type ReconcileStrategy int
+
+const (
+	// MinimalEdit deletes and inserts only the rules that differ, keeping
+	// the counters of the others, in one transaction. It lists the chain
+	// and diffs it first, which takes longest on big chains.
+	MinimalEdit ReconcileStrategy = iota
+	// FlushAndRebuild flushes the chain and appends the rules in one
+	// transaction, as RestoreChain does. It is the fastest, but resets
+	// all counters.
+	FlushAndRebuild
+	// StagingSwap builds the rules in a staging chain, named after the
+	// chain with a "-STG" suffix, then in one transaction points the jumps
+	// to the chain at the staging chain, deletes the old chain and renames
+	// the staging chain in its place. Big rule sets are loaded and checked
+	// by the kernel before the live chain is touched. Counters are reset.
+	// It does not apply to built-in chains.
+	StagingSwap
+)
+
+func (s ReconcileStrategy) String() string {
+	switch s {
+	case MinimalEdit:
+		return "MinimalEdit"
+	case FlushAndRebuild:
+		return "FlushAndRebuild"
+	case StagingSwap:
+		return "StagingSwap"
+	}
+	return fmt.Sprintf("ReconcileStrategy(%d)", int(s))
+}
+
+// WithReconcileStrategy selects the strategy of ReconcileChain for the
+// named chains, in every table, or the default one if no chains are given.
+// The default is MinimalEdit.
+func WithReconcileStrategy(s ReconcileStrategy, chains ...string) Option {
+	return func(ipt *IPTables) {
+		if ipt.reconcile == nil {
+			ipt.reconcile = make(map[string]ReconcileStrategy)
+		}
+		if len(chains) == 0 {
+			ipt.reconcile[""] = s
+		}
+		for _, chain := range chains {
+			ipt.reconcile[chain] = s
+		}
+	}
+}
+
+// reconcileStrategy returns the strategy selected for the chain.
+func (ipt *IPTables) reconcileStrategy(chain string) ReconcileStrategy {
+	if s, ok := ipt.reconcile[chain]; ok {
+		return s
+	}
+	return ipt.reconcile[""]
+}
+
+// stagingSuffix is appended to the name of a chain to name its staging
+// chain under StagingSwap.
+const stagingSuffix = "-STG"
+
+// maxEditScriptCells bounds the size of the table computing the longest
+// common subsequence of the rules; beyond it, the differing middle of the
+// chain is replaced as a whole.
+const maxEditScriptCells = 1 << 22
+
+// ChainEdit is an operation of an edit script turning a chain into another.
+type ChainEdit struct {
+	// Delete is set to delete the rule Rulespec at Pos, and unset to insert
+	// Rulespec at Pos.
+	Delete   bool
+	Pos      int
+	Rulespec []string
+}
+
+func (e ChainEdit) String() string {
+	if e.Delete {
+		return "-D " + strconv.Itoa(e.Pos) + " " + joinRule(e.Rulespec)
+	}
+	return "-I " + strconv.Itoa(e.Pos) + " " + joinRule(e.Rulespec)
+}
+
+// ReconcileChain makes the rules of the table/chain those given, in order,
+// creating the chain if needed, with the strategy selected for the chain
+// with WithReconcileStrategy. Without an Owner, any other rules in the
+// chain are deleted; with one, only the rules of the owner are replaced and
+// those of other owners are kept where they are, or, under StagingSwap,
+// copied ahead of the rules of the owner.
+//
+// With the default MinimalEdit strategy, it computes a minimal edit script
+// from the longest common subsequence of the current and desired rules,
+// compared with RulesEqual, and only deletes and inserts the rules that
+// differ, in one iptables-restore transaction. Rules that are kept keep
+// their counters, and are never missing from the chain. It returns the
+// edits made, at their positions in the whole chain, which other strategies
+// do not report.
+func (ipt *IPTables) ReconcileChain(table, chain string, rules [][]string) ([]ChainEdit, error) {
+	// every strategy writes the rules tagged with the owner of the handle
+	desired := make([][]string, len(rules))
+	for i, rule := range rules {
+		spec, err := ipt.owned(rule)
+		if err != nil {
+			return nil, err
+		}
+		desired[i] = spec
+	}
+
+	switch s := ipt.reconcileStrategy(chain); s {
+	case MinimalEdit:
+		return ipt.reconcileMinimal(table, chain, desired)
+	case FlushAndRebuild:
+		var buf bytes.Buffer
+		for _, rule := range desired {
+			buf.WriteString("-A " + chain + " " + joinRule(rule) + "\n")
+		}
+		return nil, ipt.RestoreChain(table, chain, buf.String(), true)
+	case StagingSwap:
+		return nil, ipt.reconcileStaging(table, chain, desired)
+	default:
+		return nil, fmt.Errorf("unknown reconcile strategy %v", s)
+	}
+}
+
+func (ipt *IPTables) reconcileMinimal(table, chain string, desired [][]string) ([]ChainEdit, error) {
+	exists, err := ipt.ChainExists(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		all, current [][]string
+		mine         []bool
+	)
+	if exists {
+		if all, mine, err = ipt.chainRulespecs(table, chain); err != nil {
+			return nil, err
+		}
+	}
+	for i, spec := range all {
+		if mine[i] {
+			current = append(current, spec)
+		}
+	}
+	edits := editScript(current, desired)
+	if exists && len(edits) == 0 {
+		return nil, nil
+	}
+	edits = chainPositions(mine, edits)
+
+	var buf bytes.Buffer
+	buf.WriteString("*" + table + "\n")
+	if !exists {
+		buf.WriteString(":" + chain + " - [0:0]\n")
+	}
+	for _, e := range edits {
+		if e.Delete {
+			// by rulespec rather than position, so that the transaction fails
+			// instead of deleting another rule if the chain changed since it
+			// was listed
+			buf.WriteString("-D " + chain + " " + joinRule(e.Rulespec) + "\n")
+		} else {
+			buf.WriteString("-I " + chain + " " + strconv.Itoa(e.Pos) + " " + joinRule(e.Rulespec) + "\n")
+		}
+	}
+	buf.WriteString("COMMIT\n")
+	if err := ipt.Restore(buf.String(), RestoreOptions{NoFlush: true}); err != nil {
+		return nil, err
+	}
+	return edits, nil
+}
+
+func (ipt *IPTables) reconcileStaging(table, chain string, rules [][]string) error {
+	staging := chain + stagingSuffix
+	if len(staging) > maxChainNameLen {
+		return fmt.Errorf("chain name %s too long for a staging chain", chain)
+	}
+	current, err := ipt.listTable(table)
+	if err != nil {
+		return err
+	}
+	if current.builtin[chain] {
+		return fmt.Errorf("cannot swap built-in chain %s", chain)
+	}
+	var buf bytes.Buffer
+	for _, r := range current.rules[chain] {
+		if !ipt.mine(r) {
+			buf.WriteString("-A " + staging + " " + r.Spec + "\n")
+		}
+	}
+	for _, rule := range rules {
+		buf.WriteString("-A " + staging + " " + joinRule(rule) + "\n")
+	}
+	if err := ipt.RestoreChain(table, staging, buf.String(), true); err != nil {
+		return err
+	}
+	data, err := stagingSwapData(table, chain, current)
+	if err != nil {
+		return err
+	}
+	return ipt.Restore(data, RestoreOptions{NoFlush: true})
+}
+
+// stagingSwapData returns the restore data replacing the chain by its
+// staging chain: the jumps to the chain are redirected, the chain is
+// deleted and the staging chain renamed.
+func stagingSwapData(table, chain string, current *tableRules) (string, error) {
+	staging := chain + stagingSuffix
+	var buf bytes.Buffer
+	buf.WriteString("*" + table + "\n")
+	exists := false
+	for _, c := range current.chains {
+		if c == chain {
+			exists = true
+		}
+		for i, r := range current.rules[c] {
+			if r.Target != chain || c == chain {
+				continue
+			}
+			spec, err := splitRule(r.Spec)
+			if err != nil {
+				return "", err
+			}
+			// the target precedes its options, if any
+			spec[len(spec)-len(r.TargetOptions)-1] = staging
+			buf.WriteString("-R " + c + " " + strconv.Itoa(i+1) + " " + joinRule(spec) + "\n")
+		}
+	}
+	if exists {
+		buf.WriteString("-F " + chain + "\n-X " + chain + "\n")
+	}
+	buf.WriteString("-E " + staging + " " + chain + "\nCOMMIT\n")
+	return buf.String(), nil
+}
+
+// chainRulespecs returns the rulespecs of all the rules of the chain, and
+// which of them are managed through the handle.
+func (ipt *IPTables) chainRulespecs(table, chain string) ([][]string, []bool, error) {
+	lines, err := ipt.ExecuteList([]string{"-t", table, "-S", chain})
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		specs [][]string
+		mine  []bool
+	)
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		r, err := ParseRule(line)
+		if err != nil {
+			return nil, nil, err
+		}
+		spec, err := splitRule(r.Spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		specs = append(specs, spec)
+		mine = append(mine, ipt.mine(r))
+	}
+	return specs, mine, nil
+}
+
+// chainPositions maps the positions of edits among the rules managed through
+// the handle, as returned by editScript, to positions in the whole chain,
+// given which of its rules are managed. A rule inserted past the managed
+// ones goes right after the last of them, or at the end of the chain.
+func chainPositions(mine []bool, edits []ChainEdit) []ChainEdit {
+	mine = append([]bool{}, mine...)
+	out := make([]ChainEdit, len(edits))
+	for k, e := range edits {
+		// i is the index in the chain of the e.Pos-th managed rule
+		i, n := -1, 0
+		for j, m := range mine {
+			if m {
+				if n++; n == e.Pos {
+					i = j
+					break
+				}
+			}
+		}
+		switch {
+		case e.Delete:
+			mine = append(mine[:i], mine[i+1:]...)
+		case i < 0:
+			i = len(mine)
+			for j := len(mine) - 1; j >= 0; j-- {
+				if mine[j] {
+					i = j + 1
+					break
+				}
+			}
+			fallthrough
+		default:
+			mine = append(mine[:i], append([]bool{true}, mine[i:]...)...)
+		}
+		e.Pos = i + 1
+		out[k] = e
+	}
+	return out
+}
+
+// editScript returns the edits turning current into desired: deletions by
+// decreasing position first, then insertions by increasing position, so
+// each position is valid when its edit is applied.
+func editScript(current, desired [][]string) []ChainEdit {
+	a := make([]string, len(current))
+	for i, spec := range current {
+		a[i] = joinRule(NormalizeRule(spec))
+	}
+	b := make([]string, len(desired))
+	for i, spec := range desired {
+		b[i] = joinRule(NormalizeRule(spec))
+	}
+
+	// keepA and keepB mark the rules of the common subsequence
+	keepA := make([]bool, len(a))
+	keepB := make([]bool, len(b))
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		keepA[prefix], keepB[prefix] = true, true
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		keepA[len(a)-1-suffix], keepB[len(b)-1-suffix] = true, true
+		suffix++
+	}
+	lcs(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], keepA[prefix:len(a)-suffix], keepB[prefix:len(b)-suffix])
+
+	var edits []ChainEdit
+	for i := len(a) - 1; i >= 0; i-- {
+		if !keepA[i] {
+			edits = append(edits, ChainEdit{Delete: true, Pos: i + 1, Rulespec: current[i]})
+		}
+	}
+	for i := range b {
+		if !keepB[i] {
+			edits = append(edits, ChainEdit{Pos: i + 1, Rulespec: desired[i]})
+		}
+	}
+	return edits
+}
+
+// lcs marks the elements of a and b in one of their longest common
+// subsequences, unless the table needed is too large.
+func lcs(a, b []string, keepA, keepB []bool) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 || (n+1)*(m+1) > maxEditScriptCells {
+		return
+	}
+	// l[i*(m+1)+j] is the length of the LCS of a[i:] and b[j:]
+	l := make([]int32, (n+1)*(m+1))
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				l[i*(m+1)+j] = l[(i+1)*(m+1)+j+1] + 1
+			case l[(i+1)*(m+1)+j] >= l[i*(m+1)+j+1]:
+				l[i*(m+1)+j] = l[(i+1)*(m+1)+j]
+			default:
+				l[i*(m+1)+j] = l[i*(m+1)+j+1]
+			}
+		}
+	}
+	for i, j := 0, 0; i < n && j < m; {
+		switch {
+		case a[i] == b[j]:
+			keepA[i], keepB[j] = true, true
+			i++
+			j++
+		case l[(i+1)*(m+1)+j] >= l[i*(m+1)+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+}
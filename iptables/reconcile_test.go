@@ -0,0 +1,159 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEditScript(t *testing.T) {
+	rules := func(specs ...string) [][]string {
+		var out [][]string
+		for _, s := range specs {
+			spec, err := splitRule(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, spec)
+		}
+		return out
+	}
+	for _, tt := range []struct {
+		name             string
+		current, desired [][]string
+		edits            []string
+	}{
+		{"equal", rules("-j A", "-j B"), rules("-j A", "-j B"), nil},
+		{"empty", nil, rules("-j A", "-j B"), []string{"-I 1 -j A", "-I 2 -j B"}},
+		{"cleared", rules("-j A", "-j B"), nil, []string{"-D 2 -j B", "-D 1 -j A"}},
+		{"insert middle", rules("-j A", "-j C"), rules("-j A", "-j B", "-j C"), []string{"-I 2 -j B"}},
+		{"delete middle", rules("-j A", "-j B", "-j C"), rules("-j A", "-j C"), []string{"-D 2 -j B"}},
+		{
+			"replace",
+			rules("-j A", "-s 192.0.2.1/32 -j B", "-j C", "-j D"),
+			rules("-j A", "-s 192.0.2.2 -j B", "-j C", "-j E", "-j D"),
+			[]string{"-D 2 -s 192.0.2.1/32 -j B", "-I 2 -s 192.0.2.2 -j B", "-I 4 -j E"},
+		},
+		{
+			"normalized",
+			rules("-s 192.0.2.1/32 -p tcp -m tcp --dport 22 -j ACCEPT"),
+			rules("-p tcp -s 192.0.2.1 --dport 22 -j ACCEPT"),
+			nil,
+		},
+		{"moved", rules("-j A", "-j B", "-j C"), rules("-j C", "-j A", "-j B"), []string{"-D 3 -j C", "-I 1 -j C"}},
+	} {
+		var got []string
+		for _, e := range editScript(tt.current, tt.desired) {
+			got = append(got, e.String())
+		}
+		if !reflect.DeepEqual(got, tt.edits) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.edits)
+		}
+	}
+}
+
+func TestReconcileChain(t *testing.T) {
+	ipt, _ := newFakeIPTables(t, `case "$*" in
+*"-S SVC"*) printf -- '-N SVC\n-A SVC -s 192.0.2.1/32 -j ACCEPT\n-A SVC -s 192.0.2.2/32 -j ACCEPT\n-A SVC -j DROP\n';;
+*"-S NEW"*) exit 1;;
+esac`)
+	dir := filepath.Dir(ipt.path)
+	input := filepath.Join(dir, "restored")
+	script := "#!/bin/sh\ncat > " + input + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables-restore"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	edits, err := ipt.ReconcileChain("filter", "SVC", [][]string{
+		{"-s", "192.0.2.1", "-j", "ACCEPT"},
+		{"-s", "192.0.2.3", "-j", "ACCEPT"},
+		{"-j", "DROP"},
+	})
+	if err != nil {
+		t.Fatalf("ReconcileChain failed: %v", err)
+	}
+	if len(edits) != 2 {
+		t.Fatalf("ReconcileChain made edits %v", edits)
+	}
+	data, _ := ioutil.ReadFile(input)
+	expected := "*filter\n-D SVC -s 192.0.2.2/32 -j ACCEPT\n-I SVC 2 -s 192.0.2.3 -j ACCEPT\nCOMMIT\n"
+	if string(data) != expected {
+		t.Fatalf("restored %q, want %q", data, expected)
+	}
+
+	if _, err := ipt.ReconcileChain("filter", "NEW", [][]string{{"-j", "RETURN"}}); err != nil {
+		t.Fatalf("ReconcileChain failed: %v", err)
+	}
+	data, _ = ioutil.ReadFile(input)
+	expected = "*filter\n:NEW - [0:0]\n-I NEW 1 -j RETURN\nCOMMIT\n"
+	if string(data) != expected {
+		t.Fatalf("restored %q, want %q", data, expected)
+	}
+}
+
+func TestReconcileStrategy(t *testing.T) {
+	ipt, _ := newFakeIPTables(t, `case "$*" in
+*"-S SVC-STG"*) exit 1;;
+*"-t filter -S") printf -- '-P INPUT ACCEPT\n-N SVC\n-A INPUT -s 192.0.2.0/24 -j SVC\n-A INPUT -g SVC\n-A SVC -j DROP\n';;
+esac`)
+	dir := filepath.Dir(ipt.path)
+	input := filepath.Join(dir, "restored")
+	script := "#!/bin/sh\ncat >> " + input + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables-restore"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	WithReconcileStrategy(FlushAndRebuild)(ipt)
+	WithReconcileStrategy(StagingSwap, "SVC", "INPUT")(ipt)
+	if s := ipt.reconcileStrategy("OTHER"); s != FlushAndRebuild {
+		t.Fatalf("default strategy is %v", s)
+	}
+
+	if _, err := ipt.ReconcileChain("filter", "SVC", [][]string{{"-j", "ACCEPT"}}); err != nil {
+		t.Fatalf("ReconcileChain failed: %v", err)
+	}
+	data, _ := ioutil.ReadFile(input)
+	expected := "*filter\n:SVC-STG - [0:0]\n-A SVC-STG -j ACCEPT\nCOMMIT\n" +
+		"*filter\n-R INPUT 1 -s 192.0.2.0/24 -j SVC-STG\n-R INPUT 2 -g SVC-STG\n-F SVC\n-X SVC\n-E SVC-STG SVC\nCOMMIT\n"
+	if string(data) != expected {
+		t.Fatalf("restored %q, want %q", data, expected)
+	}
+
+	if _, err := ipt.ReconcileChain("filter", "INPUT", nil); err == nil {
+		t.Fatal("ReconcileChain swapped a built-in chain")
+	}
+
+	// rules are tagged with the owner whatever the strategy
+	os.Remove(input)
+	Owner("agent")(ipt)
+	if _, err := ipt.ReconcileChain("filter", "OTHER", [][]string{{"-j", "ACCEPT"}}); err != nil {
+		t.Fatalf("ReconcileChain failed: %v", err)
+	}
+	data, _ = ioutil.ReadFile(input)
+	tag := "-m comment --comment owner=agent,id=" + ruleID([]string{"-j", "ACCEPT"})
+	if !strings.Contains(string(data), "-A OTHER "+tag+" -j ACCEPT\n") {
+		t.Fatalf("restored %q, want the rule tagged with the owner", data)
+	}
+}
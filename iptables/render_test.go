@@ -0,0 +1,26 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import "testing"
+
+func TestRenderCommand(t *testing.T) {
+	args := []string{"iptables", "-t", "filter", "-A", "INPUT", "!", "-s", "10.0.0.0/8",
+		"-m", "comment", "--comment", "allow web's traffic", "--comment", "", "--comment", "$HOME!", "-j", "ACCEPT"}
+	expected := `iptables -t filter -A INPUT ! -s 10.0.0.0/8 -m comment --comment 'allow web'\''s traffic' --comment '' --comment '$HOME!' -j ACCEPT`
+	if got := RenderCommand(args); got != expected {
+		t.Fatalf("RenderCommand mismatch: \ngot  %s \nneed %s", got, expected)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// countersPrefix matches the "[pkts:bytes] " prefix of rules saved with counters.
+var countersPrefix = regexp.MustCompile(`^\[[0-9]+:[0-9]+\] +`)
+
+// getIptablesRestoreCommand returns the restore command for the given protocol, either "iptables-restore" or "ip6tables-restore".
+func getIptablesRestoreCommand(proto Protocol) string {
+	return getIptablesCommand(proto) + "-restore"
+}
+
+// restore feeds data to iptables-restore, run with the given flags.
+func (ipt *IPTables) restore(data string, flags ...string) (err error) {
+	if err := ipt.ready(); err != nil {
+		return err
+	}
+	if ipt.readOnly {
+		return ErrReadOnly
+	}
+	if ipt.audit != nil {
+		rec := auditRestore(data)
+		defer func() { ipt.audit.write(rec, err) }()
+	}
+	if len(ipt.guards) > 0 {
+		if err := ipt.checkGuardsRestore(data, containsString(flags, "--noflush")); err != nil {
+			return err
+		}
+	}
+	return ipt.runRestore(data, flags...)
+}
+
+// runRestore runs iptables-restore on data without the checks of restore,
+// for commands that already passed those of runWithOutput.
+func (ipt *IPTables) runRestore(data string, flags ...string) error {
+	name := getIptablesRestoreCommand(ipt.proto)
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{name}, flags...)
+	return ipt.runLocked(path, args, ipt.restoreWaitArgs(), strings.NewReader(data), nil)
+}
+
+// RestoreOptions controls how Restore applies restore-format data.
+type RestoreOptions struct {
+	// NoFlush keeps the existing contents of the tables in the data.
+	NoFlush bool
+	// PreserveCounters applies the packet and byte counters in the data,
+	// i.e. "[pkts:bytes]" prefixes and chain declarations, instead of zeroing them.
+	PreserveCounters bool
+}
+
+// Restore applies restore-format data, e.g. the output of SaveChain, with iptables-restore.
+func (ipt *IPTables) Restore(data string, opts RestoreOptions) error {
+	var flags []string
+	if opts.NoFlush {
+		flags = append(flags, "--noflush")
+	}
+	if opts.PreserveCounters {
+		flags = append(flags, "--counters")
+	}
+	return ipt.restore(data, flags...)
+}
+
+// RestoreChain applies restore-format rule lines for a single chain with
+// iptables-restore --noflush, leaving the rest of the table untouched.
+// The snippet may be the output of SaveChain; table headers, the chain
+// declaration, COMMIT lines, comments and blank lines are skipped, and every
+// other line must add a rule to the given chain ("-A <chain> ...").
+// If flush is set, the existing rules of the chain are removed first, all in
+// the same transaction; with an Owner, only the rules of the owner are. The
+// chain is created if it does not exist.
+func (ipt *IPTables) RestoreChain(table, chain string, snippet string, flush bool) error {
+	return ipt.restoreChain(table, chain, snippet, flush, false)
+}
+
+// RestoreChainWithCounters acts like RestoreChain, but applies the "[pkts:bytes]"
+// counters of the rule lines, e.g. as returned by SaveChainWithCounters, so
+// accounting rules keep their packet and byte counts across a reload.
+func (ipt *IPTables) RestoreChainWithCounters(table, chain string, snippet string, flush bool) error {
+	return ipt.restoreChain(table, chain, snippet, flush, true)
+}
+
+func (ipt *IPTables) restoreChain(table, chain string, snippet string, flush, counters bool) error {
+	rules, err := parseChainSnippet(table, chain, snippet, counters)
+	if err != nil {
+		return err
+	}
+	for i := range rules {
+		if rules[i], err = ipt.ownedRuleLine(rules[i]); err != nil {
+			return err
+		}
+	}
+
+	exists, err := ipt.ChainExists(table, chain)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("*" + table + "\n")
+	switch {
+	case !exists:
+		buf.WriteString(":" + chain + " - [0:0]\n")
+	case flush && ipt.owner != "":
+		// the rules of other owners are kept
+		lines, err := ipt.ExecuteList([]string{"-t", table, "-S", chain})
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			if !strings.HasPrefix(line, "-A ") {
+				continue
+			}
+			r, err := ParseRule(line)
+			if err != nil {
+				return err
+			}
+			if ipt.mine(r) {
+				buf.WriteString("-D " + chain + " " + r.Spec + "\n")
+			}
+		}
+	case flush:
+		buf.WriteString("-F " + chain + "\n")
+	}
+	for _, rule := range rules {
+		buf.WriteString(rule + "\n")
+	}
+	buf.WriteString("COMMIT\n")
+
+	return ipt.Restore(buf.String(), RestoreOptions{NoFlush: true, PreserveCounters: counters})
+}
+
+// Move moves the rule at position fromPos of the specified table/chain to
+// position toPos (both 1-based), shifting the rules in between. The rule is
+// deleted and re-inserted in a single iptables-restore transaction, so the
+// chain is never seen without it. Counters of the rule are reset.
+func (ipt *IPTables) Move(table, chain string, fromPos, toPos int) error {
+	if fromPos < 1 || toPos < 1 {
+		return fmt.Errorf("invalid rule positions %d and %d", fromPos, toPos)
+	}
+	if fromPos == toPos {
+		return nil
+	}
+
+	// "-S <chain> <pos>" lists just the rule at pos, quoted as restore expects
+	rules, err := ipt.ExecuteList([]string{"-t", table, "-S", chain, strconv.Itoa(fromPos)})
+	if err != nil {
+		return err
+	}
+	if len(rules) != 1 || !strings.HasPrefix(rules[0], "-A "+chain+" ") {
+		return fmt.Errorf("unexpected listing of rule %d in chain %s: %q", fromPos, chain, rules)
+	}
+	spec := strings.TrimPrefix(rules[0], "-A "+chain+" ")
+
+	// delete by rulespec rather than position, in case the chain changed meanwhile
+	data := fmt.Sprintf("*%s\n-D %s %s\n-I %s %d %s\nCOMMIT\n", table, chain, spec, chain, toPos, spec)
+	return ipt.Restore(data, RestoreOptions{NoFlush: true})
+}
+
+// parseChainSnippet returns the rule lines of a restore-format snippet for a single chain.
+// Unless counters is set, "[pkts:bytes]" prefixes are stripped from the lines.
+func parseChainSnippet(table, chain, snippet string, counters bool) ([]string, error) {
+	var rules []string
+	for _, line := range strings.Split(snippet, "\n") {
+		line = strings.TrimSpace(line)
+		if prefix := countersPrefix.FindString(line); prefix != "" {
+			rule := line[len(prefix):]
+			if !strings.HasPrefix(rule, "-A "+chain+" ") {
+				return nil, fmt.Errorf("snippet line does not append to chain %s: %q", chain, line)
+			}
+			if !counters {
+				line = rule
+			}
+			rules = append(rules, line)
+			continue
+		}
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || line == "COMMIT":
+		case strings.HasPrefix(line, "*"):
+			if line != "*"+table {
+				return nil, fmt.Errorf("snippet is for table %s, not %s", line[1:], table)
+			}
+		case strings.HasPrefix(line, ":"):
+			if !strings.HasPrefix(line, ":"+chain+" ") && line != ":"+chain {
+				return nil, fmt.Errorf("snippet declares chain other than %s: %q", chain, line)
+			}
+		case strings.HasPrefix(line, "-A "+chain+" "):
+			rules = append(rules, line)
+		default:
+			return nil, fmt.Errorf("snippet line does not append to chain %s: %q", chain, line)
+		}
+	}
+	return rules, nil
+}
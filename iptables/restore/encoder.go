@@ -0,0 +1,227 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package restore writes input for iptables-restore and ip6tables-restore.
+//
+// An Encoder takes rules as argument lists, the way they are passed to
+// iptables, and takes care of the details that hand-built restore data
+// often gets wrong: quoting arguments with spaces or quotes, declaring
+// chains before the rules of a table, and ending every table with COMMIT.
+//
+//	enc := restore.NewEncoder(&buf)
+//	enc.Table("filter")
+//	enc.Chain("SVC", "")
+//	enc.Append("SVC", "-m", "comment", "--comment", "web server", "-j", "ACCEPT")
+//	if err := enc.Close(); err != nil {
+//		...
+//	}
+//
+// The result is applied with iptables.IPTables.Restore, or by piping it to
+// iptables-restore --noflush.
+package restore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrNoTable is returned for chain and rule operations before Table.
+var ErrNoTable = errors.New("restore: no table started")
+
+// Encoder writes restore-format data. Every table is buffered until the
+// next Table or Close, which write it with its chain declarations first
+// and a COMMIT last. Errors are sticky: after the first one, every method
+// returns it and nothing more is written.
+type Encoder struct {
+	w      *bufio.Writer
+	table  string
+	decls  bytes.Buffer
+	cmds   bytes.Buffer
+	chains map[string]bool
+	err    error
+}
+
+// NewEncoder returns an Encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// Table commits the current table, if any, and starts the named one.
+func (e *Encoder) Table(name string) error {
+	if e.err != nil {
+		return e.err
+	}
+	if err := checkName("table", name); err != nil {
+		return e.fail(err)
+	}
+	if err := e.commit(); err != nil {
+		return err
+	}
+	e.table = name
+	e.chains = make(map[string]bool)
+	return nil
+}
+
+// Chain declares a chain of the current table. The policy applies to
+// built-in chains, e.g. "ACCEPT"; it is "" for user-defined chains, which
+// are created, or flushed if they exist. A chain is declared only once.
+func (e *Encoder) Chain(name, policy string) error {
+	if err := e.check(name); err != nil {
+		return err
+	}
+	if policy == "" {
+		policy = "-"
+	} else if err := checkName("policy", policy); err != nil {
+		return e.fail(err)
+	}
+	if e.chains[name] {
+		return nil
+	}
+	e.chains[name] = true
+	fmt.Fprintf(&e.decls, ":%s %s [0:0]\n", name, policy)
+	return nil
+}
+
+// Append appends a rule to the chain.
+func (e *Encoder) Append(chain string, rulespec ...string) error {
+	return e.command("-A", chain, rulespec)
+}
+
+// Insert inserts a rule in the chain at the 1-based position.
+func (e *Encoder) Insert(chain string, pos int, rulespec ...string) error {
+	if pos < 1 {
+		return e.fail(fmt.Errorf("restore: invalid rule position %d", pos))
+	}
+	return e.command("-I", chain, append([]string{strconv.Itoa(pos)}, rulespec...))
+}
+
+// Delete deletes the rule from the chain.
+func (e *Encoder) Delete(chain string, rulespec ...string) error {
+	return e.command("-D", chain, rulespec)
+}
+
+// Flush deletes all rules of the chain.
+func (e *Encoder) Flush(chain string) error {
+	return e.command("-F", chain, nil)
+}
+
+// DeleteChain deletes the user-defined chain, which must be empty and
+// unreferenced once the preceding commands are applied.
+func (e *Encoder) DeleteChain(chain string) error {
+	return e.command("-X", chain, nil)
+}
+
+// Close commits the current table, if any, and flushes the output.
+func (e *Encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if err := e.commit(); err != nil {
+		return err
+	}
+	if err := e.w.Flush(); err != nil {
+		return e.fail(err)
+	}
+	return nil
+}
+
+func (e *Encoder) command(cmd, chain string, args []string) error {
+	if err := e.check(chain); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "\n\r") {
+			return e.fail(fmt.Errorf("restore: argument %q contains a line break", arg))
+		}
+	}
+	e.cmds.WriteString(cmd + " " + chain)
+	if len(args) > 0 {
+		e.cmds.WriteString(" " + Join(args))
+	}
+	e.cmds.WriteByte('\n')
+	return nil
+}
+
+// check returns the error, if any, of writing to the chain now.
+func (e *Encoder) check(chain string) error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.table == "" {
+		return e.fail(ErrNoTable)
+	}
+	if err := checkName("chain", chain); err != nil {
+		return e.fail(err)
+	}
+	return nil
+}
+
+// commit writes out the current table.
+func (e *Encoder) commit() error {
+	if e.table == "" {
+		return nil
+	}
+	e.w.WriteString("*" + e.table + "\n")
+	e.w.Write(e.decls.Bytes())
+	e.w.Write(e.cmds.Bytes())
+	if _, err := e.w.WriteString("COMMIT\n"); err != nil {
+		return e.fail(err)
+	}
+	e.table = ""
+	e.decls.Reset()
+	e.cmds.Reset()
+	return nil
+}
+
+func (e *Encoder) fail(err error) error {
+	e.err = err
+	return err
+}
+
+// checkName checks a table, chain or policy name, which cannot be quoted.
+func checkName(kind, name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\n\r\"'") || strings.HasPrefix(name, "-") {
+		return fmt.Errorf("restore: invalid %s name %q", kind, name)
+	}
+	return nil
+}
+
+// Join joins arguments into a restore line, double quoting the ones that
+// are empty or contain spaces, quotes or backslashes, and escaping quotes
+// and backslashes within them.
+func Join(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && !strings.ContainsAny(arg, " \t\"\\") {
+			quoted[i] = arg
+			continue
+		}
+		var b strings.Builder
+		b.WriteByte('"')
+		for j := 0; j < len(arg); j++ {
+			if arg[j] == '"' || arg[j] == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(arg[j])
+		}
+		b.WriteByte('"')
+		quoted[i] = b.String()
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	steps := []error{
+		enc.Table("filter"),
+		enc.Chain("INPUT", "DROP"),
+		enc.Append("INPUT", "-j", "SVC"),
+		// declarations go first, whenever they are made
+		enc.Chain("SVC", ""),
+		enc.Chain("SVC", ""),
+		enc.Append("SVC", "-m", "comment", "--comment", `say "hi" \o/`, "-j", "ACCEPT"),
+		enc.Insert("SVC", 1, "-p", "tcp", "!", "--dport", "22", "-j", "DROP"),
+		enc.Table("nat"),
+		enc.Flush("POSTROUTING"),
+		enc.Delete("PREROUTING", "-m", "comment", "--comment", "", "-j", "RETURN"),
+		enc.DeleteChain("OLD"),
+		enc.Close(),
+	}
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("step %d failed: %v", i, err)
+		}
+	}
+	expected := `*filter
+:INPUT DROP [0:0]
+:SVC - [0:0]
+-A INPUT -j SVC
+-A SVC -m comment --comment "say \"hi\" \\o/" -j ACCEPT
+-I SVC 1 -p tcp ! --dport 22 -j DROP
+COMMIT
+*nat
+-F POSTROUTING
+-D PREROUTING -m comment --comment "" -j RETURN
+-X OLD
+COMMIT
+`
+	if buf.String() != expected {
+		t.Fatalf("encoded mismatch: \ngot  %s \nneed %s", buf.String(), expected)
+	}
+}
+
+func TestEncoderErrors(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Append("INPUT", "-j", "ACCEPT"); err != ErrNoTable {
+		t.Fatalf("Append without a table returned %v", err)
+	}
+	// errors are sticky
+	if err := enc.Table("filter"); err != ErrNoTable {
+		t.Fatalf("Table after an error returned %v", err)
+	}
+
+	for _, f := range []func(*Encoder) error{
+		func(e *Encoder) error { return e.Table("my table") },
+		func(e *Encoder) error { return e.Chain("-j", "") },
+		func(e *Encoder) error { return e.Chain("INPUT", "DROP now") },
+		func(e *Encoder) error { return e.Append("INPUT", "--comment", "two\nlines") },
+		func(e *Encoder) error { return e.Insert("INPUT", 0, "-j", "ACCEPT") },
+	} {
+		buf.Reset()
+		enc := NewEncoder(&buf)
+		enc.Table("filter")
+		if err := f(enc); err == nil {
+			t.Errorf("invalid operation did not fail")
+		}
+		if err := enc.Close(); err == nil || buf.Len() != 0 {
+			t.Errorf("Close after an error returned %v and wrote %q", err, buf.String())
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Rule builds a rulespec from typed fields.
+// Empty fields are left out of the rulespec.
+type Rule struct {
+	Source      string
+	Destination string
+	// In and Out are interface names; a trailing "+" matches any interface with that prefix.
+	In       string
+	Out      string
+	Protocol string
+	// SourcePort and DestinationPort are ports or "first:last" ranges; they
+	// require Protocol to be one with ports, e.g. "tcp".
+	SourcePort      string
+	DestinationPort string
+	// Not negates the fields it has set.
+	Not     Negation
+	Matches []Match
+	Target  Target
+}
+
+// Negation selects the fields of a Rule to negate, e.g. Source to match
+// packets from anywhere but the source. Negated options are rendered with
+// "!" in front of the option, as in "! -s 192.0.2.1", the placement all
+// iptables versions since 1.4.3 accept. Matches are negated with Not.
+type Negation struct {
+	Source          bool
+	Destination     bool
+	In              bool
+	Out             bool
+	Protocol        bool
+	SourcePort      bool
+	DestinationPort bool
+}
+
+// Args renders the rule as a rulespec, in the order iptables itself lists the
+// options, so the result can be passed to Append, Insert, Delete or Exists.
+func (r *Rule) Args() ([]string, error) {
+	return r.args(nil)
+}
+
+// ArgsFor renders the rule like Args, for a handle of the given protocol:
+// ICMP protocol names are translated to those of the family, and matches and
+// targets implementing FamilySpecific render their family's arguments, so
+// one Rule can be used with both iptables and ip6tables.
+func (r *Rule) ArgsFor(proto Protocol) ([]string, error) {
+	return r.args(&proto)
+}
+
+// args renders the rule, translated for the protocol if it is not nil.
+func (r *Rule) args(proto *Protocol) ([]string, error) {
+	render := func(ext Match) ([]string, error) {
+		if f, ok := ext.(FamilySpecific); ok && proto != nil {
+			return f.ArgsFor(*proto)
+		}
+		return ext.Args()
+	}
+
+	var args []string
+	add := func(negate bool, opt, value string) {
+		if negate {
+			args = append(args, "!")
+		}
+		args = append(args, opt, value)
+	}
+	if r.Source != "" {
+		add(r.Not.Source, "-s", r.Source)
+	}
+	if r.Destination != "" {
+		add(r.Not.Destination, "-d", r.Destination)
+	}
+	if r.In != "" {
+		if err := ValidateInterface(r.In); err != nil {
+			return nil, err
+		}
+		add(r.Not.In, "-i", r.In)
+	}
+	if r.Out != "" {
+		if err := ValidateInterface(r.Out); err != nil {
+			return nil, err
+		}
+		add(r.Not.Out, "-o", r.Out)
+	}
+	if r.Protocol != "" {
+		protocol := r.Protocol
+		if proto != nil {
+			protocol = familyProtocol(protocol, *proto)
+		}
+		add(r.Not.Protocol, "-p", protocol)
+	}
+	// the protocol given by name in any case, or by number
+	protocol := normalizeProtocol(r.Protocol)
+	if r.SourcePort != "" || r.DestinationPort != "" {
+		switch protocol {
+		case "tcp", "udp", "udplite", "sctp", "dccp":
+		default:
+			return nil, fmt.Errorf("ports require the protocol to be one with ports, not %q", r.Protocol)
+		}
+		if r.Not.Protocol {
+			return nil, fmt.Errorf("ports cannot be matched with a negated protocol")
+		}
+		args = append(args, "-m", protocol)
+		if r.SourcePort != "" {
+			add(r.Not.SourcePort, "--sport", r.SourcePort)
+		}
+		if r.DestinationPort != "" {
+			add(r.Not.DestinationPort, "--dport", r.DestinationPort)
+		}
+	}
+
+	for _, m := range r.Matches {
+		match, err := render(m)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, match...)
+	}
+
+	if rj, ok := r.Target.(*Reject); ok && rj.With == RejectTCPReset &&
+		(protocol != "tcp" || r.Not.Protocol) {
+		// the kernel refuses such rules with an obscure error
+		return nil, fmt.Errorf("REJECT: tcp-reset requires the rule to match -p tcp")
+	}
+	if r.Target != nil {
+		target, err := render(r.Target)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, target...)
+	}
+	return args, nil
+}
+
+// CheckInterfaces verifies that the In and Out interfaces exist on this host.
+// Wildcard names must match at least one interface.
+func (r *Rule) CheckInterfaces() error {
+	for _, name := range []string{r.In, r.Out} {
+		if name == "" {
+			continue
+		}
+		if err := CheckInterfaceExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Jump is a plain "-j <target>" target without options, e.g. Jump("ACCEPT")
+// or a jump to a user-defined chain.
+type Jump string
+
+func (j Jump) Args() ([]string, error) {
+	if j == "" {
+		return nil, fmt.Errorf("empty jump target")
+	}
+	return []string{"-j", string(j)}, nil
+}
+
+// maxInterfaceNameLen is IFNAMSIZ minus the trailing NUL.
+const maxInterfaceNameLen = 15
+
+// ValidateInterface checks that name is usable as an iptables -i/-o argument:
+// a valid Linux interface name, optionally ending in the "+" wildcard.
+func ValidateInterface(name string) error {
+	base := strings.TrimSuffix(name, "+")
+	switch {
+	case name == "":
+		return fmt.Errorf("empty interface name")
+	case len(name) > maxInterfaceNameLen:
+		return fmt.Errorf("interface name %q longer than %d characters", name, maxInterfaceNameLen)
+	case strings.Contains(base, "+"):
+		return fmt.Errorf("interface name %q: wildcard \"+\" is only allowed at the end", name)
+	case base == "." || base == "..":
+		return fmt.Errorf("invalid interface name %q", name)
+	case strings.ContainsAny(base, "/: \t\n"):
+		return fmt.Errorf("interface name %q contains invalid characters", name)
+	}
+	return nil
+}
+
+// CheckInterfaceExists verifies that an interface with the given name exists on
+// this host. A wildcard name must match at least one interface.
+func CheckInterfaceExists(name string) error {
+	if err := ValidateInterface(name); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(name, "+") {
+		_, err := net.InterfaceByName(name)
+		return err
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	prefix := strings.TrimSuffix(name, "+")
+	for _, iface := range ifaces {
+		if strings.HasPrefix(iface.Name, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no interface matches %q", name)
+}
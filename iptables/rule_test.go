@@ -0,0 +1,316 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRuleArgs(t *testing.T) {
+	r := &Rule{
+		Source:   "192.0.2.0/24",
+		In:       "eth+",
+		Protocol: "tcp",
+		Matches: []Match{
+			&Recent{Command: RecentUpdate, Name: "SSH", Seconds: 60, HitCount: 4},
+			&ConnLimit{Limit: 10, MaskLen: 24},
+		},
+		Target: Jump("DROP"),
+	}
+	args, err := r.Args()
+	if err != nil {
+		t.Fatalf("Args failed: %v", err)
+	}
+	expected := []string{
+		"-s", "192.0.2.0/24", "-i", "eth+", "-p", "tcp",
+		"-m", "recent", "--update", "--seconds", "60", "--hitcount", "4", "--name", "SSH", "--rsource",
+		"-m", "connlimit", "--connlimit-above", "10", "--connlimit-mask", "24",
+		"-j", "DROP",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Args mismatch: \ngot  %#v \nneed %#v", args, expected)
+	}
+}
+
+func TestRuleArgsProtocolCase(t *testing.T) {
+	// the port match is named after the normalized protocol
+	r := &Rule{Protocol: "TCP", DestinationPort: "22", Target: &Reject{With: RejectTCPReset}}
+	args, err := r.Args()
+	if err != nil {
+		t.Fatalf("Args failed: %v", err)
+	}
+	expected := []string{"-p", "TCP", "-m", "tcp", "--dport", "22", "-j", "REJECT", "--reject-with", "tcp-reset"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Args mismatch: \ngot  %#v \nneed %#v", args, expected)
+	}
+}
+
+func TestRuleArgsInvalid(t *testing.T) {
+	rules := []*Rule{
+		{In: "eth+0"},
+		{Out: "a-very-long-interface"},
+		{Matches: []Match{&Recent{Command: RecentSet, Seconds: 10}}},
+		{Matches: []Match{&ConnLimit{Limit: 1, MaskLen: 8, Global: true}}},
+		{Target: &NFQueue{CPUFanout: true}},
+		{Matches: []Match{&PhysDev{}}},
+		{Matches: []Match{&AddrTypeMatch{}}},
+		{DestinationPort: "22"},
+		{Matches: []Match{&Fragment{First: true}}},
+		{Target: &TCPMSS{}},
+		{Protocol: "tcp", DestinationPort: "22", Not: Negation{Protocol: true}},
+		{Matches: []Match{Not(Jump("ACCEPT"))}},
+		{Matches: []Match{Not(Not(&ICMP{Type: "echo-request"}))}},
+		{Protocol: "tcp", Matches: []Match{&TCPFlags{Mask: []TCPFlag{TCPFlagSYN}, Comp: []TCPFlag{TCPFlagACK}}}},
+		{Protocol: "tcp", Matches: []Match{&TCPFlags{Mask: []TCPFlag{"SYNACK"}, Comp: []TCPFlag{TCPFlagNone}}}},
+		{Protocol: "tcp", Matches: []Match{&TCPFlags{Mask: []TCPFlag{TCPFlagSYN}}}},
+		{Matches: []Match{&AddrTypeMatch{Dst: []AddrType{"LOCALHOST"}}}},
+		{Matches: []Match{&AddrTypeMatch{Src: []AddrType{AddrTypeLocal}, LimitIfaceIn: true, LimitIfaceOut: true}}},
+	}
+	for _, r := range rules {
+		if _, err := r.Args(); err == nil {
+			t.Errorf("Args of %#v did not fail", r)
+		}
+	}
+}
+
+func TestRuleArgsFor(t *testing.T) {
+	r := &Rule{
+		Protocol: "icmp",
+		Matches:  []Match{&ICMP{Type: "echo-request"}},
+		Target:   &Reject{With: "icmp-host-prohibited"},
+	}
+
+	args, err := r.ArgsFor(ProtocolIPv6)
+	if err != nil {
+		t.Fatalf("ArgsFor failed: %v", err)
+	}
+	expected := []string{"-p", "ipv6-icmp", "-m", "icmp6", "--icmpv6-type", "echo-request", "-j", "REJECT", "--reject-with", "icmp6-adm-prohibited"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("IPv6 args mismatch: \ngot  %q \nneed %q", args, expected)
+	}
+
+	r.Protocol = "icmpv6"
+	r.Target = &Reject{With: "icmp6-port-unreachable"}
+	args, err = r.ArgsFor(ProtocolIPv4)
+	if err != nil {
+		t.Fatalf("ArgsFor failed: %v", err)
+	}
+	expected = []string{"-p", "icmp", "-m", "icmp", "--icmp-type", "echo-request", "-j", "REJECT", "--reject-with", "icmp-port-unreachable"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("IPv4 args mismatch: \ngot  %q \nneed %q", args, expected)
+	}
+
+	// Args renders the rule untranslated
+	args, _ = r.Args()
+	expected = []string{"-p", "icmpv6", "-m", "icmp", "--icmp-type", "echo-request", "-j", "REJECT", "--reject-with", "icmp6-port-unreachable"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Args mismatch: \ngot  %q \nneed %q", args, expected)
+	}
+}
+
+func TestReject(t *testing.T) {
+	r := &Rule{Protocol: "tcp", Target: &Reject{With: RejectTCPReset}}
+	args, err := r.ArgsFor(ProtocolIPv6)
+	expected := []string{"-p", "tcp", "-j", "REJECT", "--reject-with", "tcp-reset"}
+	if err != nil || !reflect.DeepEqual(args, expected) {
+		t.Fatalf("ArgsFor returned %q, %v; want %q", args, err, expected)
+	}
+
+	for _, r := range []*Rule{
+		{Protocol: "udp", Target: &Reject{With: RejectTCPReset}},
+		{Protocol: "tcp", Not: Negation{Protocol: true}, Target: &Reject{With: RejectTCPReset}},
+		{Target: &Reject{With: RejectTCPReset}},
+		{Target: &Reject{With: "icmp-port-unreach"}},
+	} {
+		if _, err := r.Args(); err == nil {
+			t.Errorf("Args of %#v did not fail", r)
+		}
+	}
+
+	if _, err := (&Reject{With: RejectICMPProtoUnreachable}).ArgsFor(ProtocolIPv6); !errors.Is(err, ErrWrongFamily) {
+		t.Errorf("ArgsFor of an answer without an IPv6 counterpart returned %v", err)
+	}
+	if _, err := (&Reject{With: RejectICMP6PolicyFail}).ArgsFor(ProtocolIPv4); !errors.Is(err, ErrWrongFamily) {
+		t.Errorf("ArgsFor of an answer without an IPv4 counterpart returned %v", err)
+	}
+}
+
+func TestValidateInterface(t *testing.T) {
+	for _, name := range []string{"eth0", "eth+", "+", "wg-home.10"} {
+		if err := ValidateInterface(name); err != nil {
+			t.Errorf("ValidateInterface(%q) failed: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "e+th", "eth 0", "eth/0", "..", "sixteen-chars-xx"} {
+		if err := ValidateInterface(name); err == nil {
+			t.Errorf("ValidateInterface(%q) did not fail", name)
+		}
+	}
+}
+
+func TestPhysDevCheckChain(t *testing.T) {
+	p := &PhysDev{Out: "veth+"}
+	if err := p.CheckChain("FORWARD"); err == nil {
+		t.Fatalf("CheckChain of routed physdev-out in FORWARD did not fail")
+	}
+	p.IsBridged = true
+	if err := p.CheckChain("FORWARD"); err != nil {
+		t.Fatalf("CheckChain of bridged physdev-out in FORWARD failed: %v", err)
+	}
+	p = &PhysDev{In: "veth+"}
+	if err := p.CheckChain("OUTPUT"); err == nil {
+		t.Fatalf("CheckChain of physdev-in in OUTPUT did not fail")
+	}
+}
+
+func TestAddrTypeMatch(t *testing.T) {
+	// masquerade everything but traffic to the host's own addresses
+	r := &Rule{
+		Out:     "eth0",
+		Matches: []Match{&AddrTypeMatch{Dst: []AddrType{AddrTypeLocal, AddrTypeBroadcast}, LimitIfaceOut: true}},
+		Target:  Jump("MASQUERADE"),
+	}
+	args, err := r.Args()
+	if err != nil {
+		t.Fatalf("Args failed: %v", err)
+	}
+	expected := []string{"-o", "eth0", "-m", "addrtype", "--dst-type", "LOCAL,BROADCAST", "--limit-iface-out", "-j", "MASQUERADE"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Args mismatch: \ngot  %#v \nneed %#v", args, expected)
+	}
+
+	m := &AddrTypeMatch{Src: []AddrType{AddrTypeLocal}, LimitIfaceOut: true}
+	if err := m.CheckChain("POSTROUTING"); err != nil {
+		t.Errorf("CheckChain(POSTROUTING) failed: %v", err)
+	}
+	if err := m.CheckChain("INPUT"); err == nil {
+		t.Errorf("CheckChain(INPUT) accepted limit-iface-out")
+	}
+}
+
+func TestTCPFlags(t *testing.T) {
+	for _, tt := range []struct {
+		flags    *TCPFlags
+		expected []string
+	}{
+		{SYNOnly(), []string{"-m", "tcp", "--tcp-flags", "FIN,SYN,RST,ACK", "SYN"}},
+		{XmasScan(), []string{"-m", "tcp", "--tcp-flags", "FIN,SYN,RST,PSH,ACK,URG", "FIN,PSH,URG"}},
+		{NullScan(), []string{"-m", "tcp", "--tcp-flags", "FIN,SYN,RST,PSH,ACK,URG", "NONE"}},
+	} {
+		args, err := tt.flags.Args()
+		if err != nil {
+			t.Errorf("Args of %+v failed: %v", tt.flags, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, tt.expected) {
+			t.Errorf("Args of %+v = %q, want %q", tt.flags, args, tt.expected)
+		}
+	}
+}
+
+func TestRuleNegation(t *testing.T) {
+	r := &Rule{
+		Source:          "192.0.2.0/24",
+		In:              "lo",
+		Protocol:        "tcp",
+		DestinationPort: "22",
+		Not:             Negation{Source: true, In: true, DestinationPort: true},
+		Matches:         []Match{Not(SYNOnly())},
+		Target:          Jump("DROP"),
+	}
+	args, err := r.Args()
+	if err != nil {
+		t.Fatalf("Args failed: %v", err)
+	}
+	expected := []string{
+		"!", "-s", "192.0.2.0/24", "!", "-i", "lo", "-p", "tcp",
+		"-m", "tcp", "!", "--dport", "22",
+		"-m", "tcp", "!", "--tcp-flags", "FIN,SYN,RST,ACK", "SYN",
+		"-j", "DROP",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Args mismatch: \ngot  %#v \nneed %#v", args, expected)
+	}
+
+	// negation survives the translation to the other family
+	icmp := &Rule{Protocol: "icmp", Matches: []Match{Not(&ICMP{Type: "echo-request"})}}
+	args, err = icmp.ArgsFor(ProtocolIPv6)
+	if err != nil {
+		t.Fatalf("ArgsFor failed: %v", err)
+	}
+	expected = []string{"-p", "ipv6-icmp", "-m", "icmp6", "!", "--icmpv6-type", "echo-request"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("ArgsFor mismatch: \ngot  %#v \nneed %#v", args, expected)
+	}
+}
+
+func TestFragment(t *testing.T) {
+	r := &Rule{Matches: []Match{&Fragment{}}, Target: Jump("DROP")}
+	for _, tt := range []struct {
+		proto    Protocol
+		expected []string
+	}{
+		{ProtocolIPv4, []string{"-f", "-j", "DROP"}},
+		{ProtocolIPv6, []string{"-m", "frag", "-j", "DROP"}},
+	} {
+		args, err := r.ArgsFor(tt.proto)
+		if err != nil {
+			t.Fatalf("ArgsFor failed: %v", err)
+		}
+		if !reflect.DeepEqual(args, tt.expected) {
+			t.Errorf("ArgsFor(%v) = %q, want %q", tt.proto, args, tt.expected)
+		}
+	}
+
+	f := &Fragment{ID: "100:200", More: true}
+	args, err := f.ArgsFor(ProtocolIPv6)
+	if err != nil {
+		t.Fatalf("ArgsFor failed: %v", err)
+	}
+	if expected := []string{"-m", "frag", "--fragid", "100:200", "--fragmore"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("ArgsFor = %q, want %q", args, expected)
+	}
+	if _, err := f.ArgsFor(ProtocolIPv4); err == nil {
+		t.Error("IPv4 accepted fragment header options")
+	}
+}
+
+func TestStatistic(t *testing.T) {
+	args, err := (&Statistic{Mode: StatisticNth, Every: 3, Packet: 1}).Args()
+	expected := []string{"-m", "statistic", "--mode", "nth", "--every", "3", "--packet", "1"}
+	if err != nil || !reflect.DeepEqual(args, expected) {
+		t.Fatalf("nth Args returned %q, %v; want %q", args, err, expected)
+	}
+	args, err = (&Statistic{Mode: StatisticRandom, Probability: 0.5}).Args()
+	expected = []string{"-m", "statistic", "--mode", "random", "--probability", "0.50000000000"}
+	if err != nil || !reflect.DeepEqual(args, expected) {
+		t.Fatalf("random Args returned %q, %v; want %q", args, err, expected)
+	}
+
+	for _, s := range []*Statistic{
+		{Mode: StatisticRandom},
+		{Mode: StatisticRandom, Probability: 1.5},
+		{Mode: StatisticRandom, Probability: 0.5, Every: 2},
+		{Mode: StatisticNth, Every: 2, Packet: 2},
+		{Mode: StatisticNth, Every: 2, Probability: 0.5},
+		{Mode: "round-robin"},
+	} {
+		if _, err := s.Args(); err == nil {
+			t.Errorf("Args of %#v did not fail", s)
+		}
+	}
+}
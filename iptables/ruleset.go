@@ -0,0 +1,442 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Ruleset declares the complete contents of a set of chains, grouped by
+// table. Chains that are not listed are left untouched when it is applied.
+type Ruleset struct {
+	Tables []RulesetTable `json:"tables"`
+}
+
+// RulesetTable lists the declared chains of one table.
+type RulesetTable struct {
+	Name   string         `json:"name"`
+	Chains []RulesetChain `json:"chains"`
+	// After names tables of the ruleset that must be applied before this
+	// one when tables are applied in parallel, see ApplyParallelism. Tables
+	// matching on marks are always applied after the mangle table.
+	After []string `json:"after,omitempty"`
+}
+
+// RulesetChain declares the rules of a chain. User-defined chains are
+// created if they do not exist.
+type RulesetChain struct {
+	Name string `json:"name"`
+	// Policy sets the policy of a built-in chain; empty keeps the current one.
+	Policy string        `json:"policy,omitempty"`
+	Rules  []RulesetRule `json:"rules,omitempty"`
+}
+
+// RulesetRule is a rule with typed fields for the common matches. Matches
+// and TargetArgs hold any further arguments verbatim.
+type RulesetRule struct {
+	Protocol        string `json:"protocol,omitempty"`
+	Source          string `json:"source,omitempty"`
+	Destination     string `json:"destination,omitempty"`
+	InInterface     string `json:"in,omitempty"`
+	OutInterface    string `json:"out,omitempty"`
+	SourcePort      string `json:"sport,omitempty"`
+	DestinationPort string `json:"dport,omitempty"`
+	// State lists conntrack states, e.g. ["ESTABLISHED", "RELATED"].
+	State      []string `json:"state,omitempty"`
+	Comment    string   `json:"comment,omitempty"`
+	Matches    []string `json:"matches,omitempty"`
+	Jump       string   `json:"jump,omitempty"`
+	Goto       string   `json:"goto,omitempty"`
+	TargetArgs []string `json:"target_args,omitempty"`
+}
+
+// Args returns the rulespec of the rule.
+func (r *RulesetRule) Args() ([]string, error) {
+	var args []string
+	add := func(opt, val string) {
+		if val != "" {
+			args = append(args, opt, val)
+		}
+	}
+	add("-s", r.Source)
+	add("-d", r.Destination)
+	add("-i", r.InInterface)
+	add("-o", r.OutInterface)
+	add("-p", r.Protocol)
+	if r.SourcePort != "" || r.DestinationPort != "" {
+		if r.Protocol == "" {
+			return nil, fmt.Errorf("ports require a protocol")
+		}
+		args = append(args, "-m", r.Protocol)
+		add("--sport", r.SourcePort)
+		add("--dport", r.DestinationPort)
+	}
+	if len(r.State) > 0 {
+		args = append(args, "-m", "conntrack", "--ctstate", strings.Join(r.State, ","))
+	}
+	args = append(args, r.Matches...)
+	if r.Comment != "" {
+		if err := ValidateComment(r.Comment); err != nil {
+			return nil, err
+		}
+		args = append(args, "-m", "comment", "--comment", r.Comment)
+	}
+	switch {
+	case r.Jump != "" && r.Goto != "":
+		return nil, fmt.Errorf("rule has both jump %s and goto %s", r.Jump, r.Goto)
+	case r.Jump != "":
+		args = append(args, "-j", r.Jump)
+	case r.Goto != "":
+		args = append(args, "-g", r.Goto)
+	case len(r.TargetArgs) > 0:
+		return nil, fmt.Errorf("target arguments without a target")
+	}
+	return append(args, r.TargetArgs...), nil
+}
+
+// LoadRulesetJSON decodes a Ruleset from JSON and validates it.
+func LoadRulesetJSON(r io.Reader) (*Ruleset, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var rs Ruleset
+	if err := dec.Decode(&rs); err != nil {
+		return nil, err
+	}
+	if err := rs.Validate(); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// Validate checks the ruleset for missing or duplicate names and rules that
+// cannot be rendered. It does not consult the kernel.
+func (rs *Ruleset) Validate() error {
+	tables := make(map[string]bool)
+	for _, t := range rs.Tables {
+		if t.Name == "" {
+			return fmt.Errorf("table without a name")
+		}
+		if tables[t.Name] {
+			return fmt.Errorf("table %s declared twice", t.Name)
+		}
+		tables[t.Name] = true
+
+		chains := make(map[string]bool)
+		for _, c := range t.Chains {
+			if c.Name == "" {
+				return fmt.Errorf("chain without a name in table %s", t.Name)
+			}
+			if chains[c.Name] {
+				return fmt.Errorf("chain %s declared twice in table %s", c.Name, t.Name)
+			}
+			chains[c.Name] = true
+			for i := range c.Rules {
+				if _, err := c.Rules[i].Args(); err != nil {
+					return fmt.Errorf("rule %d of chain %s in table %s: %v", i+1, c.Name, t.Name, err)
+				}
+			}
+		}
+	}
+	_, err := rulesetDeps(rs)
+	return err
+}
+
+// ApplyRuleset replaces the rules of every chain declared in the ruleset,
+// creating missing user-defined chains and setting the policies of built-in
+// ones. Each table is applied in a single iptables-restore transaction,
+// in order, or concurrently as allowed by ApplyParallelism. Failures are
+// handled as selected with OnError and reported in an *ApplyError; by
+// default the remaining tables are still applied, except those depending
+// on a failed one. With an Owner, only the rules of the owner are replaced;
+// those of others in the same chains are kept.
+func (ipt *IPTables) ApplyRuleset(rs *Ruleset) error {
+	return ipt.ApplyRulesetProgress(rs, nil)
+}
+
+// ApplyRulesetProgress applies the ruleset like ApplyRuleset, calling
+// progress as each table is done with nil if it was applied, or with the
+// error it failed with. progress is never called concurrently, even with
+// ApplyParallelism. Under RollbackAll, tables reported applied are restored
+// again if another one fails; see the *ApplyError returned.
+func (ipt *IPTables) ApplyRulesetProgress(rs *Ruleset, progress func(table string, err *RuleError)) error {
+	if err := rs.Validate(); err != nil {
+		return err
+	}
+	deps, err := rulesetDeps(rs)
+	if err != nil {
+		return err
+	}
+	var (
+		tables []string
+		steps  []func() *RuleError
+	)
+	for _, t := range rs.Tables {
+		t := t
+		tables = append(tables, t.Name)
+		steps = append(steps, func() *RuleError {
+			if err := ipt.applyRulesetTable(t); err != nil {
+				if re, ok := err.(*RuleError); ok {
+					return re
+				}
+				return newRuleError(t.Name, "", 0, nil, err)
+			}
+			return nil
+		})
+	}
+	return ipt.applyGraph(tables, steps, deps, ipt.parallelism, progress)
+}
+
+func (ipt *IPTables) applyRulesetTable(t RulesetTable) error {
+	current, err := ipt.listTable(t.Name)
+	if err != nil {
+		return err
+	}
+	data, err := ipt.rulesetTableData(t, current)
+	if err != nil {
+		return err
+	}
+	if err := ipt.Restore(data, RestoreOptions{NoFlush: true}); err != nil {
+		return restoreRuleError(t.Name, data, err)
+	}
+	return nil
+}
+
+// restoreErrorLine matches the line number iptables-restore reports, e.g.
+// "iptables-restore: line 5 failed" or "Error occurred at line: 5".
+var restoreErrorLine = regexp.MustCompile(`line:? ([0-9]+)`)
+
+// restoreRuleError returns a *RuleError for the failure of restoring data
+// into the table, naming the rule of the line iptables-restore reported: its
+// chain, 1-based position among the rules of the chain in data, which is
+// its position in the RulesetChain, and rulespec.
+func restoreRuleError(table, data string, err error) *RuleError {
+	re := newRuleError(table, "", 0, nil, err)
+	m := restoreErrorLine.FindStringSubmatch(re.Stderr)
+	if m == nil {
+		return re
+	}
+	re.Line, _ = strconv.Atoi(m[1])
+	lines := strings.Split(data, "\n")
+	if re.Line < 1 || re.Line > len(lines) || !strings.HasPrefix(lines[re.Line-1], "-A ") {
+		return re
+	}
+	args, perr := splitRule(lines[re.Line-1])
+	if perr != nil || len(args) < 2 {
+		return re
+	}
+	re.Chain, re.Rulespec = args[1], args[2:]
+	prefix := "-A " + re.Chain + " "
+	for _, line := range lines[:re.Line] {
+		if strings.HasPrefix(line, prefix) {
+			re.Index++
+		}
+	}
+	return re
+}
+
+// listTable parses the "iptables -S" output of the whole table.
+func (ipt *IPTables) listTable(table string) (*tableRules, error) {
+	lines, err := ipt.ExecuteList([]string{"-t", table, "-S"})
+	if err != nil {
+		return nil, err
+	}
+	return parseTableRules(lines)
+}
+
+// rulesetTableData renders the restore data applying a table of a ruleset
+// with --noflush, given the current contents of the table.
+func (ipt *IPTables) rulesetTableData(t RulesetTable, current *tableRules) (string, error) {
+	var decls, flushes, rules bytes.Buffer
+	for _, c := range t.Chains {
+		exists := containsString(current.chains, c.Name)
+		if current.builtin[c.Name] {
+			if c.Policy != "" {
+				decls.WriteString(":" + c.Name + " " + c.Policy + " [0:0]\n")
+			}
+		} else {
+			if c.Policy != "" {
+				return "", fmt.Errorf("policy set on user-defined chain %s in table %s", c.Name, t.Name)
+			}
+			// declaring a user-defined chain creates or flushes it
+			if !exists || ipt.owner == "" {
+				decls.WriteString(":" + c.Name + " - [0:0]\n")
+			}
+		}
+		switch {
+		case ipt.owner != "":
+			// the rules of other owners are kept
+			for _, r := range current.rules[c.Name] {
+				if ipt.mine(r) {
+					flushes.WriteString("-D " + c.Name + " " + r.Spec + "\n")
+				}
+			}
+		case current.builtin[c.Name]:
+			// declaring a built-in chain does not flush it
+			flushes.WriteString("-F " + c.Name + "\n")
+		}
+		for i := range c.Rules {
+			args, err := ipt.rulesetRuleArgs(&c.Rules[i])
+			if err != nil {
+				return "", err
+			}
+			rules.WriteString("-A " + c.Name + " " + joinRule(args) + "\n")
+		}
+	}
+	return "*" + t.Name + "\n" + decls.String() + flushes.String() + rules.String() + "COMMIT\n", nil
+}
+
+// rulesetRuleArgs renders a rule of a ruleset, tagged with the owner of
+// the handle.
+func (ipt *IPTables) rulesetRuleArgs(r *RulesetRule) ([]string, error) {
+	args, err := r.Args()
+	if err != nil {
+		return nil, err
+	}
+	return ipt.owned(args)
+}
+
+// ChainDiff describes how a chain differs from its declaration in a Ruleset.
+type ChainDiff struct {
+	Table string
+	Chain string
+	// Create is set if the chain does not exist yet.
+	Create bool
+	// OldPolicy and NewPolicy are set if the policy changes.
+	OldPolicy string
+	NewPolicy string
+	// Added and Removed hold the normalized rulespecs missing from and
+	// extraneous in the chain.
+	Added   []string
+	Removed []string
+	// Reordered is set if the chain has the declared rules in another order.
+	Reordered bool
+}
+
+// String renders the difference in a unified-diff like format.
+func (d ChainDiff) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%s %s\n", d.Table, d.Chain)
+	if d.Create {
+		fmt.Fprintf(&buf, "+ -N %s\n", d.Chain)
+	}
+	if d.NewPolicy != "" {
+		fmt.Fprintf(&buf, "- -P %s %s\n+ -P %s %s\n", d.Chain, d.OldPolicy, d.Chain, d.NewPolicy)
+	}
+	for _, rule := range d.Removed {
+		fmt.Fprintf(&buf, "- -A %s %s\n", d.Chain, rule)
+	}
+	for _, rule := range d.Added {
+		fmt.Fprintf(&buf, "+ -A %s %s\n", d.Chain, rule)
+	}
+	if d.Reordered {
+		buf.WriteString("~ rules reordered\n")
+	}
+	return buf.String()
+}
+
+// DiffRuleset compares the declared chains with the current ones and returns
+// the differences, one entry per chain that ApplyRuleset would change.
+func (ipt *IPTables) DiffRuleset(rs *Ruleset) ([]ChainDiff, error) {
+	if err := rs.Validate(); err != nil {
+		return nil, err
+	}
+	var diffs []ChainDiff
+	for _, t := range rs.Tables {
+		current, err := ipt.listTable(t.Name)
+		if err != nil {
+			return nil, err
+		}
+		tdiffs, err := ipt.diffRulesetTable(t, current)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, tdiffs...)
+	}
+	return diffs, nil
+}
+
+func (ipt *IPTables) diffRulesetTable(t RulesetTable, current *tableRules) ([]ChainDiff, error) {
+	var diffs []ChainDiff
+	for _, c := range t.Chains {
+		d := ChainDiff{Table: t.Name, Chain: c.Name}
+		d.Create = !containsString(current.chains, c.Name)
+		if c.Policy != "" && current.policies[c.Name] != c.Policy {
+			d.OldPolicy = current.policies[c.Name]
+			d.NewPolicy = c.Policy
+		}
+
+		var have, want []string
+		for _, r := range current.rules[c.Name] {
+			if !ipt.mine(r) {
+				continue
+			}
+			args, err := splitRule(r.Spec)
+			if err != nil {
+				return nil, err
+			}
+			have = append(have, joinRule(NormalizeRule(args)))
+		}
+		for i := range c.Rules {
+			args, err := ipt.rulesetRuleArgs(&c.Rules[i])
+			if err != nil {
+				return nil, err
+			}
+			want = append(want, joinRule(NormalizeRule(args)))
+		}
+		d.Added = subtractRules(want, have)
+		d.Removed = subtractRules(have, want)
+		d.Reordered = len(d.Added) == 0 && len(d.Removed) == 0 && !equalStrings(have, want)
+
+		if d.Create || d.NewPolicy != "" || len(d.Added) > 0 || len(d.Removed) > 0 || d.Reordered {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
+
+// subtractRules returns the rules of a that are not in b, counting duplicates.
+func subtractRules(a, b []string) []string {
+	count := make(map[string]int)
+	for _, rule := range b {
+		count[rule]++
+	}
+	var diff []string
+	for _, rule := range a {
+		if count[rule] > 0 {
+			count[rule]--
+			continue
+		}
+		diff = append(diff, rule)
+	}
+	return diff
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testRulesetJSON = `{
+  "tables": [{
+    "name": "filter",
+    "chains": [
+      {"name": "INPUT", "policy": "DROP", "rules": [
+        {"in": "lo", "jump": "ACCEPT"},
+        {"state": ["ESTABLISHED", "RELATED"], "jump": "ACCEPT"},
+        {"protocol": "tcp", "dport": "22", "comment": "ssh access", "jump": "SSH"}
+      ]},
+      {"name": "SSH", "rules": [
+        {"source": "192.0.2.0/24", "jump": "ACCEPT"}
+      ]}
+    ]
+  }]
+}`
+
+func TestLoadRulesetJSON(t *testing.T) {
+	rs, err := LoadRulesetJSON(strings.NewReader(testRulesetJSON))
+	if err != nil {
+		t.Fatalf("LoadRulesetJSON failed: %v", err)
+	}
+	args, err := rs.Tables[0].Chains[0].Rules[2].Args()
+	if err != nil {
+		t.Fatalf("Args failed: %v", err)
+	}
+	expected := []string{"-p", "tcp", "-m", "tcp", "--dport", "22", "-m", "comment", "--comment", "ssh access", "-j", "SSH"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Args mismatch: \ngot  %#v \nneed %#v", args, expected)
+	}
+
+	invalid := []string{
+		`{"tables": [{"name": "filter", "chains": [{"name": "INPUT"}, {"name": "INPUT"}]}]}`,
+		`{"tables": [{"name": "filter", "chains": [{"name": "INPUT", "rules": [{"dport": "22"}]}]}]}`,
+		`{"tables": [{"name": "filter", "chains": [{"name": "INPUT", "rules": [{"jump": "A", "goto": "B"}]}]}]}`,
+		`{"tables": [{"name": "filter", "unknown": true}]}`,
+	}
+	for _, data := range invalid {
+		if _, err := LoadRulesetJSON(strings.NewReader(data)); err == nil {
+			t.Fatalf("LoadRulesetJSON of invalid ruleset did not fail: %s", data)
+		}
+	}
+}
+
+func TestRulesetTableData(t *testing.T) {
+	rs, err := LoadRulesetJSON(strings.NewReader(testRulesetJSON))
+	if err != nil {
+		t.Fatalf("LoadRulesetJSON failed: %v", err)
+	}
+	current, err := parseTableRules([]string{
+		"-P INPUT ACCEPT",
+		"-P FORWARD ACCEPT",
+		"-A INPUT -i lo -j ACCEPT",
+		"-A INPUT -p tcp -m tcp --dport 80 -j ACCEPT",
+	})
+	if err != nil {
+		t.Fatalf("parseTableRules failed: %v", err)
+	}
+
+	data, err := (&IPTables{}).rulesetTableData(rs.Tables[0], current)
+	if err != nil {
+		t.Fatalf("rulesetTableData failed: %v", err)
+	}
+	expected := `*filter
+:INPUT DROP [0:0]
+:SSH - [0:0]
+-F INPUT
+-A INPUT -i lo -j ACCEPT
+-A INPUT -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 22 -m comment --comment "ssh access" -j SSH
+-A SSH -s 192.0.2.0/24 -j ACCEPT
+COMMIT
+`
+	if data != expected {
+		t.Fatalf("rulesetTableData mismatch: \ngot  %s \nneed %s", data, expected)
+	}
+
+	diffs, err := (&IPTables{}).diffRulesetTable(rs.Tables[0], current)
+	if err != nil {
+		t.Fatalf("diffRulesetTable failed: %v", err)
+	}
+	if len(diffs) != 2 {
+		t.Fatalf("expected 2 chain diffs, got %d: %v", len(diffs), diffs)
+	}
+	input := diffs[0]
+	if input.Create || input.OldPolicy != "ACCEPT" || input.NewPolicy != "DROP" {
+		t.Fatalf("unexpected INPUT diff: %+v", input)
+	}
+	expectedAdded := []string{
+		"-m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		`-p tcp -m tcp --dport 22 -m comment --comment "ssh access" -j SSH`,
+	}
+	if !reflect.DeepEqual(input.Added, expectedAdded) {
+		t.Fatalf("Added mismatch: \ngot  %#v \nneed %#v", input.Added, expectedAdded)
+	}
+	expectedRemoved := []string{"-p tcp -m tcp --dport 80 -j ACCEPT"}
+	if !reflect.DeepEqual(input.Removed, expectedRemoved) {
+		t.Fatalf("Removed mismatch: \ngot  %#v \nneed %#v", input.Removed, expectedRemoved)
+	}
+	if !diffs[1].Create || diffs[1].Chain != "SSH" {
+		t.Fatalf("unexpected SSH diff: %+v", diffs[1])
+	}
+}
+
+func TestParseStats(t *testing.T) {
+	stats, err := parseStats("filter", []string{
+		"-P INPUT ACCEPT -c 10 600",
+		"-N LOG-DROP",
+		`-A INPUT -s 192.0.2.0/24 -m comment --comment "lan hosts" -c 42 3360 -j ACCEPT`,
+		"-A LOG-DROP -c 0 0 -j DROP",
+	})
+	if err != nil {
+		t.Fatalf("parseStats failed: %v", err)
+	}
+	expected := []Stat{
+		{Table: "filter", Chain: "INPUT", Rule: `-s 192.0.2.0/24 -m comment --comment "lan hosts" -j ACCEPT`, Packets: 42, Bytes: 3360},
+		{Table: "filter", Chain: "LOG-DROP", Rule: "-j DROP"},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("parseStats mismatch: \ngot  %#v \nneed %#v", stats, expected)
+	}
+
+	if _, err := parseStats("filter", []string{"-A INPUT -j ACCEPT"}); err == nil {
+		t.Fatalf("parseStats of rule without counters did not fail")
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	ipt, log := newFakeIPTables(t, `case "$*" in
+*-L*) echo "Chain INPUT (policy ACCEPT)";;
+*BAD*) echo "Bad argument" >&2; exit 2;;
+esac`)
+
+	out, err := ipt.RunWithOutput([]string{"-t", "filter", "-L", "INPUT"})
+	if err != nil || out != "Chain INPUT (policy ACCEPT)\n" {
+		t.Fatalf("RunWithOutput returned %q, %v", out, err)
+	}
+	err = ipt.Run("-t", "filter", "-A", "INPUT", "-j", "BAD")
+	if e, ok := err.(*Error); !ok || e.ExitStatus() != 2 {
+		t.Fatalf("Run returned %v, want *Error with status 2", err)
+	}
+
+	ReadOnly()(ipt)
+	if err := ipt.Run("-t", "filter", "-F", "INPUT"); err != ErrReadOnly {
+		t.Fatalf("Run on a read-only handle returned %v", err)
+	}
+
+	expected := []string{
+		"--wait -t filter -L INPUT",
+		"--wait -t filter -A INPUT -j BAD",
+	}
+	calls := fakeCalls(t, log)
+	if len(calls) != len(expected) || calls[0] != expected[0] || calls[1] != expected[1] {
+		t.Fatalf("calls mismatch: \ngot  %#v \nneed %#v", calls, expected)
+	}
+}
+
+func TestRunTooLong(t *testing.T) {
+	ipt, log := newFakeIPTables(t, "")
+	dir := filepath.Dir(ipt.path)
+	restored := filepath.Join(dir, "restored")
+	script := "#!/bin/sh\ncat >> " + restored + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables-restore"), []byte(script), 0755); err != nil {
+		t.Fatalf("writing fake iptables-restore: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	ipt.proto = ProtocolIPv4
+	StrictFamily()(ipt)
+
+	long := strings.Repeat("x", maxArgLen+1)
+	if err := ipt.Run("-t", "filter", "-A", "INPUT", "-m", "comment", "--comment", long, "-j", "ACCEPT"); err == nil {
+		t.Fatalf("Run with an overlong comment succeeded")
+	}
+	err := ipt.Run("-t", "filter", "-A", "INPUT", "-s", "2001:db8::1", "-m", "string", "--algo", "bm", "--string", long, "-j", "DROP")
+	if !errors.Is(err, ErrWrongFamily) {
+		t.Fatalf("Run with an IPv6 source returned %v, want ErrWrongFamily", err)
+	}
+	if _, err := os.Stat(restored); !os.IsNotExist(err) {
+		t.Fatalf("rejected rules were restored")
+	}
+
+	if err := ipt.Run("-t", "filter", "-A", "INPUT", "-m", "string", "--algo", "bm", "--string", long, "-j", "DROP"); err != nil {
+		t.Fatalf("Run with an overlong argument failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(restored)
+	if err != nil {
+		t.Fatalf("reading restored data: %v", err)
+	}
+	if expected := "*filter\n-A INPUT -m string --algo bm --string " + long + " -j DROP\nCOMMIT\n"; string(data) != expected {
+		t.Fatalf("unexpected restore data of %d bytes", len(data))
+	}
+	if calls := fakeCalls(t, log); len(calls) != 0 {
+		t.Fatalf("iptables called for overlong rules: %d calls", len(calls))
+	}
+}
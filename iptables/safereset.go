@@ -0,0 +1,98 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+)
+
+// safeResetTags mark the temporary rules installed by SafeReset.
+var safeResetTags = RuleTags{"temp": "go-iptables-safe-reset"}
+
+// safeResetRules are the temporary rules SafeReset installs in the filter
+// table, keeping loopback traffic and existing connections, such as the SSH
+// session of the administrator, alive.
+var safeResetRules = []struct {
+	chain    string
+	rulespec []string
+}{
+	{"INPUT", []string{"-i", "lo", "-j", "ACCEPT"}},
+	{"INPUT", []string{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+	{"FORWARD", []string{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+	{"OUTPUT", []string{"-o", "lo", "-j", "ACCEPT"}},
+	{"OUTPUT", []string{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+}
+
+// SafeReset flushes all chains of the table and deletes its user-defined
+// chains, keeping the policies of the built-in chains. For the filter table,
+// ACCEPT rules for loopback and ESTABLISHED,RELATED traffic are installed in
+// the same iptables-restore transaction, so reinitializing the firewall of a
+// remote host with a DROP policy does not cut the session doing it. The
+// temporary rules are tagged and can be removed with RemoveSafeResetRules
+// once the new rules are in place.
+func (ipt *IPTables) SafeReset(table string) error {
+	current, err := ipt.listTable(table)
+	if err != nil {
+		return err
+	}
+	data, err := safeResetData(table, current)
+	if err != nil {
+		return err
+	}
+	return ipt.Restore(data, RestoreOptions{})
+}
+
+// RemoveSafeResetRules deletes the temporary rules installed by SafeReset.
+func (ipt *IPTables) RemoveSafeResetRules(table string) error {
+	if table != "filter" {
+		return nil
+	}
+	for _, r := range safeResetRules {
+		spec, err := tagged(safeResetTags, r.rulespec)
+		if err != nil {
+			return err
+		}
+		if err := ipt.DeleteIfExists(table, r.chain, spec...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// safeResetData returns the restore data, to be applied without --noflush,
+// resetting the table.
+func safeResetData(table string, current *tableRules) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString("*" + table + "\n")
+	for _, chain := range current.chains {
+		if current.builtin[chain] {
+			buf.WriteString(":" + chain + " " + current.policies[chain] + " [0:0]\n")
+		}
+	}
+	if table == "filter" {
+		for _, r := range safeResetRules {
+			if !current.builtin[r.chain] {
+				continue
+			}
+			spec, err := tagged(safeResetTags, r.rulespec)
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString("-A " + r.chain + " " + joinRule(spec) + "\n")
+		}
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.String(), nil
+}
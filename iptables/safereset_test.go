@@ -0,0 +1,64 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"testing"
+)
+
+func TestSafeResetData(t *testing.T) {
+	current, err := parseTableRules([]string{
+		"-P INPUT DROP",
+		"-P FORWARD DROP",
+		"-P OUTPUT ACCEPT",
+		"-N SSH",
+		"-A INPUT -p tcp -m tcp --dport 22 -j SSH",
+		"-A SSH -j ACCEPT",
+	})
+	if err != nil {
+		t.Fatalf("parseTableRules failed: %v", err)
+	}
+
+	data, err := safeResetData("filter", current)
+	if err != nil {
+		t.Fatalf("safeResetData failed: %v", err)
+	}
+	expected := `*filter
+:INPUT DROP [0:0]
+:FORWARD DROP [0:0]
+:OUTPUT ACCEPT [0:0]
+-A INPUT -i lo -m comment --comment temp=go-iptables-safe-reset -j ACCEPT
+-A INPUT -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment temp=go-iptables-safe-reset -j ACCEPT
+-A FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment temp=go-iptables-safe-reset -j ACCEPT
+-A OUTPUT -o lo -m comment --comment temp=go-iptables-safe-reset -j ACCEPT
+-A OUTPUT -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment temp=go-iptables-safe-reset -j ACCEPT
+COMMIT
+`
+	if data != expected {
+		t.Fatalf("safeResetData mismatch: \ngot  %s \nneed %s", data, expected)
+	}
+
+	nat, err := parseTableRules([]string{"-P PREROUTING ACCEPT", "-N DNAT-RULES", "-A PREROUTING -j DNAT-RULES"})
+	if err != nil {
+		t.Fatalf("parseTableRules failed: %v", err)
+	}
+	data, err = safeResetData("nat", nat)
+	if err != nil {
+		t.Fatalf("safeResetData failed: %v", err)
+	}
+	if expected := "*nat\n:PREROUTING ACCEPT [0:0]\nCOMMIT\n"; data != expected {
+		t.Fatalf("safeResetData mismatch: \ngot  %s \nneed %s", data, expected)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// getIptablesSaveCommand returns the save command for the given protocol, either "iptables-save" or "ip6tables-save".
+func getIptablesSaveCommand(proto Protocol) string {
+	return getIptablesCommand(proto) + "-save"
+}
+
+// save runs iptables-save for the given table, or all tables if it is
+// empty, and returns its output.
+// If counters is set, the packet and byte counters are included.
+// iptables-save has no --wait, so the xtables lock is taken here.
+func (ipt *IPTables) save(table string, counters bool) (string, error) {
+	if err := ipt.ready(); err != nil {
+		return "", err
+	}
+	name := getIptablesSaveCommand(ipt.proto)
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{name}
+	if table != "" {
+		args = append(args, "-t", table)
+	}
+	if counters {
+		args = append(args, "--counters")
+	}
+	var stdout bytes.Buffer
+	if err := ipt.runLocked(path, args, nil, nil, &stdout); err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// SaveChain returns the iptables-save output of the specified table, limited to
+// the given chain: the table header, the chain declaration, the chain's rules
+// and the COMMIT line. The result can be fed to iptables-restore --noflush.
+func (ipt *IPTables) SaveChain(table, chain string) (string, error) {
+	out, err := ipt.save(table, false)
+	if err != nil {
+		return "", err
+	}
+	return filterSaveChain(out, table, chain)
+}
+
+// SaveChainWithCounters acts like SaveChain, but prefixes every rule with its
+// "[pkts:bytes]" counters, for use with RestoreChainWithCounters.
+func (ipt *IPTables) SaveChainWithCounters(table, chain string) (string, error) {
+	out, err := ipt.save(table, true)
+	if err != nil {
+		return "", err
+	}
+	return filterSaveChain(out, table, chain)
+}
+
+// Snapshot returns the iptables-save output, with counters, of the given
+// tables, or of all tables if none are given. Passing it to Restore with
+// PreserveCounters rolls the tables back to the saved state.
+func (ipt *IPTables) Snapshot(tables ...string) (string, error) {
+	if len(tables) == 0 {
+		return ipt.save("", true)
+	}
+	var buf bytes.Buffer
+	for _, table := range tables {
+		out, err := ipt.save(table, true)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(out)
+	}
+	return buf.String(), nil
+}
+
+// filterSaveChain extracts the given chain from iptables-save output.
+func filterSaveChain(out, table, chain string) (string, error) {
+	var (
+		buf     bytes.Buffer
+		inTable bool
+		found   bool
+	)
+	for _, line := range strings.Split(out, "\n") {
+		switch {
+		case line == "*"+table:
+			inTable = true
+			buf.WriteString(line + "\n")
+		case !inTable:
+		case line == "COMMIT":
+			buf.WriteString(line + "\n")
+			inTable = false
+		case strings.HasPrefix(line, ":"+chain+" "):
+			found = true
+			buf.WriteString(line + "\n")
+		case strings.HasPrefix(countersPrefix.ReplaceAllString(line, ""), "-A "+chain+" "):
+			buf.WriteString(line + "\n")
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("chain %s not found in table %s", chain, table)
+	}
+	return buf.String(), nil
+}
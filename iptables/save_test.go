@@ -0,0 +1,100 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testSaveOutput = `# Generated by iptables-save v1.8.7 on Thu Jan  1 00:00:00 2015
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD DROP [0:0]
+:OUTPUT ACCEPT [0:0]
+:TEST - [0:0]
+:TEST-2 - [0:0]
+-A INPUT -j TEST
+-A TEST -s 192.0.2.0/24 -j ACCEPT
+-A TEST-2 -j DROP
+[3:180] -A TEST -m comment --comment "a b" -j RETURN
+COMMIT
+# Completed on Thu Jan  1 00:00:00 2015
+`
+
+func TestFilterSaveChain(t *testing.T) {
+	out, err := filterSaveChain(testSaveOutput, "filter", "TEST")
+	if err != nil {
+		t.Fatalf("filterSaveChain failed: %v", err)
+	}
+	expected := `*filter
+:TEST - [0:0]
+-A TEST -s 192.0.2.0/24 -j ACCEPT
+[3:180] -A TEST -m comment --comment "a b" -j RETURN
+COMMIT
+`
+	if out != expected {
+		t.Fatalf("filterSaveChain mismatch: \ngot  %q \nneed %q", out, expected)
+	}
+
+	if _, err := filterSaveChain(testSaveOutput, "filter", "MISSING"); err == nil {
+		t.Fatalf("filterSaveChain of missing chain did not fail")
+	}
+}
+
+func TestParseChainSnippet(t *testing.T) {
+	snippet := `*filter
+:TEST - [0:0]
+# allow the test network
+-A TEST -s 192.0.2.0/24 -j ACCEPT
+
+-A TEST -j RETURN
+COMMIT
+`
+	rules, err := parseChainSnippet("filter", "TEST", snippet, false)
+	if err != nil {
+		t.Fatalf("parseChainSnippet failed: %v", err)
+	}
+	expected := []string{"-A TEST -s 192.0.2.0/24 -j ACCEPT", "-A TEST -j RETURN"}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("parseChainSnippet mismatch: \ngot  %#v \nneed %#v", rules, expected)
+	}
+
+	for _, bad := range []string{"*nat\n-A TEST -j RETURN", "-A OTHER -j RETURN", ":OTHER - [0:0]", "-F TEST"} {
+		if _, err := parseChainSnippet("filter", "TEST", bad, false); err == nil {
+			t.Errorf("parseChainSnippet of %q did not fail", bad)
+		}
+	}
+}
+
+func TestParseChainSnippetCounters(t *testing.T) {
+	snippet := "*filter\n:TEST - [0:0]\n[12:3456] -A TEST -j ACCEPT\nCOMMIT\n"
+
+	rules, err := parseChainSnippet("filter", "TEST", snippet, true)
+	if err != nil {
+		t.Fatalf("parseChainSnippet failed: %v", err)
+	}
+	if expected := []string{"[12:3456] -A TEST -j ACCEPT"}; !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("parseChainSnippet mismatch: \ngot  %#v \nneed %#v", rules, expected)
+	}
+
+	rules, err = parseChainSnippet("filter", "TEST", snippet, false)
+	if err != nil {
+		t.Fatalf("parseChainSnippet failed: %v", err)
+	}
+	if expected := []string{"-A TEST -j ACCEPT"}; !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("parseChainSnippet mismatch: \ngot  %#v \nneed %#v", rules, expected)
+	}
+}
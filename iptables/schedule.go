@@ -0,0 +1,274 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scheduleStateVersion is the version of the scheduler state format.
+const scheduleStateVersion = 1
+
+// maxScheduleDuration bounds ScheduledRules.Duration, as finding the
+// current window scans it minute by minute.
+const maxScheduleDuration = 31 * 24 * time.Hour
+
+// ScheduledRules are rules installed during the activation windows of a
+// cron spec, and deleted outside of them. Unlike the time match, the rules
+// are absent from the kernel outside of the windows.
+type ScheduledRules struct {
+	// Name identifies the schedule; the rules are tagged with the comment
+	// "schedule=<name>", so it must be valid as a RuleTags value.
+	Name  string
+	Table string
+	Chain string
+	// Rulespecs are appended to the chain in order.
+	Rulespecs [][]string
+	// Cron is a five-field cron spec, "minute hour day-of-month month
+	// day-of-week", e.g. "0 9 * * 1-5", matched in the local time zone.
+	// A window opens at every minute it matches.
+	Cron string
+	// Duration is the length of the windows, at most 31 days. Overlapping
+	// windows merge.
+	Duration time.Duration
+}
+
+// ScheduleState is the state of a schedule.
+type ScheduleState struct {
+	Name string `json:"name"`
+	// Since is when the rules were installed; zero if they are not.
+	Since time.Time `json:"since,omitempty"`
+}
+
+// scheduleState is the persistence format of a Scheduler.
+type scheduleState struct {
+	Version   int             `json:"version"`
+	Schedules []ScheduleState `json:"schedules"`
+}
+
+type schedule struct {
+	ScheduledRules
+	cron  *cronSpec
+	since time.Time
+}
+
+// Scheduler installs and deletes ScheduledRules as their windows open and
+// close, on every Tick, or from Run in the background.
+type Scheduler struct {
+	ipt *IPTables
+
+	// now returns the current time; replaced in tests
+	now func() time.Time
+
+	mu        sync.Mutex
+	schedules map[string]*schedule
+}
+
+// NewScheduler returns a scheduler without schedules.
+func NewScheduler(ipt *IPTables) *Scheduler {
+	return &Scheduler{
+		ipt:       ipt,
+		now:       time.Now,
+		schedules: make(map[string]*schedule),
+	}
+}
+
+// Add adds a schedule, or replaces the one with the same name, deleting its
+// rules if they are installed. The rules are installed by the next Tick if
+// a window is open.
+func (s *Scheduler) Add(sr ScheduledRules) error {
+	if !validTag(sr.Name) {
+		return fmt.Errorf("invalid schedule name %q", sr.Name)
+	}
+	if sr.Duration <= 0 || sr.Duration > maxScheduleDuration {
+		return fmt.Errorf("schedule %s: duration %v out of range", sr.Name, sr.Duration)
+	}
+	if len(sr.Rulespecs) == 0 {
+		return fmt.Errorf("schedule %s: no rules", sr.Name)
+	}
+	cron, err := parseCron(sr.Cron)
+	if err != nil {
+		return fmt.Errorf("schedule %s: %v", sr.Name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.schedules[sr.Name]; ok && !prev.since.IsZero() {
+		if err := s.uninstall(prev); err != nil {
+			return err
+		}
+	}
+	s.schedules[sr.Name] = &schedule{ScheduledRules: sr, cron: cron}
+	return nil
+}
+
+// Remove removes the schedule, deleting its rules if they are installed.
+// Removing an unknown schedule is not an error.
+func (s *Scheduler) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc, ok := s.schedules[name]
+	if !ok {
+		return nil
+	}
+	if !sc.since.IsZero() {
+		if err := s.uninstall(sc); err != nil {
+			return err
+		}
+	}
+	delete(s.schedules, name)
+	return nil
+}
+
+// Tick installs the rules of the schedules whose window has opened and
+// deletes those of the schedules whose window has closed. It attempts every
+// schedule and returns the first error.
+func (s *Scheduler) Tick() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	var firstErr error
+	for _, name := range s.names() {
+		sc := s.schedules[name]
+		_, open := sc.cron.lastWithin(now, sc.Duration)
+		var err error
+		switch {
+		case open && sc.since.IsZero():
+			if err = s.install(sc); err == nil {
+				sc.since = now
+			}
+		case !open && !sc.since.IsZero():
+			err = s.uninstall(sc)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Run calls Tick right away and then every interval until the context is
+// done, reporting
+// errors to onError if it is not nil. An interval of a minute or less keeps
+// the windows accurate to the minute.
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Tick(); err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// States returns the state of the schedules, ordered by name.
+func (s *Scheduler) States() []ScheduleState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.states()
+}
+
+func (s *Scheduler) states() []ScheduleState {
+	states := make([]ScheduleState, 0, len(s.schedules))
+	for _, name := range s.names() {
+		states = append(states, ScheduleState{Name: name, Since: s.schedules[name].since})
+	}
+	return states
+}
+
+func (s *Scheduler) names() []string {
+	names := make([]string, 0, len(s.schedules))
+	for name := range s.schedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Save writes the state of the schedules as JSON, for Load after a restart.
+func (s *Scheduler) Save(w io.Writer) error {
+	s.mu.Lock()
+	state := scheduleState{Version: scheduleStateVersion, Schedules: s.states()}
+	s.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(state)
+}
+
+// Load restores the state written by Save into the schedules added since,
+// so the next Tick deletes the rules of windows that closed while the
+// program was not running. Unknown schedules are ignored.
+func (s *Scheduler) Load(r io.Reader) error {
+	var state scheduleState
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&state); err != nil {
+		return err
+	}
+	if state.Version != scheduleStateVersion {
+		return fmt.Errorf("unsupported state version %d", state.Version)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range state.Schedules {
+		if sc, ok := s.schedules[st.Name]; ok {
+			sc.since = st.Since
+		}
+	}
+	return nil
+}
+
+// install appends the rules of the schedule that are missing.
+func (s *Scheduler) install(sc *schedule) error {
+	for _, rulespec := range sc.Rulespecs {
+		spec, err := tagged(RuleTags{"schedule": sc.Name}, rulespec)
+		if err != nil {
+			return fmt.Errorf("schedule %s: %v", sc.Name, err)
+		}
+		if err := s.ipt.AppendUnique(sc.Table, sc.Chain, spec...); err != nil {
+			return fmt.Errorf("schedule %s: %v", sc.Name, err)
+		}
+	}
+	return nil
+}
+
+// uninstall deletes the rules of the schedule that exist.
+func (s *Scheduler) uninstall(sc *schedule) error {
+	for _, rulespec := range sc.Rulespecs {
+		spec, err := tagged(RuleTags{"schedule": sc.Name}, rulespec)
+		if err != nil {
+			return fmt.Errorf("schedule %s: %v", sc.Name, err)
+		}
+		if err := s.ipt.DeleteIfExists(sc.Table, sc.Chain, spec...); err != nil {
+			return fmt.Errorf("schedule %s: %v", sc.Name, err)
+		}
+	}
+	sc.since = time.Time{}
+	return nil
+}
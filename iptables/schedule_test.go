@@ -0,0 +1,116 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	ipt, log := newFakeIPTables(t, `state="$(dirname "$0")/installed"
+case "$*" in
+*" -A "*) touch "$state";;
+*" -D "*) rm "$state";;
+*" -C "*) test -e "$state";;
+esac`)
+	now := time.Date(2020, 1, 1, 8, 59, 0, 0, time.UTC)
+	s := NewScheduler(ipt)
+	s.now = func() time.Time { return now }
+
+	sr := ScheduledRules{
+		Name:      "office-ssh",
+		Table:     "filter",
+		Chain:     "INPUT",
+		Rulespecs: [][]string{{"-p", "tcp", "--dport", "22", "-j", "ACCEPT"}},
+		Cron:      "0 9 * * 1-5",
+		Duration:  8 * time.Hour,
+	}
+	for _, bad := range []ScheduledRules{
+		{Name: "bad name", Rulespecs: sr.Rulespecs, Cron: sr.Cron, Duration: time.Hour},
+		{Name: "x", Rulespecs: sr.Rulespecs, Cron: "0 9 * *", Duration: time.Hour},
+		{Name: "x", Rulespecs: sr.Rulespecs, Cron: sr.Cron, Duration: 0},
+		{Name: "x", Cron: sr.Cron, Duration: time.Hour},
+	} {
+		if err := s.Add(bad); err == nil {
+			t.Errorf("Add(%+v) did not fail", bad)
+		}
+	}
+	if err := s.Add(sr); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	spec := "-t filter -%s INPUT -p tcp --dport 22 -m comment --comment schedule=office-ssh -j ACCEPT"
+	for _, tt := range []struct {
+		hour, min int
+		calls     []string
+	}{
+		{8, 59, nil},
+		{9, 0, []string{"C", "A"}},
+		{12, 0, nil},
+	} {
+		now = time.Date(2020, 1, 1, tt.hour, tt.min, 0, 0, time.UTC)
+		before := len(fakeCalls(t, log))
+		if err := s.Tick(); err != nil {
+			t.Fatalf("Tick at %v failed: %v", now, err)
+		}
+		var expected []string
+		for _, op := range tt.calls {
+			expected = append(expected, "--wait "+fmt.Sprintf(spec, op))
+		}
+		if calls := fakeCalls(t, log)[before:]; fmt.Sprint(calls) != fmt.Sprint(expected) {
+			t.Fatalf("calls at %v: \ngot  %q \nneed %q", now, calls, expected)
+		}
+	}
+	installed := time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC)
+	if states := s.States(); !reflect.DeepEqual(states, []ScheduleState{{Name: "office-ssh", Since: installed}}) {
+		t.Fatalf("States returned %+v", states)
+	}
+
+	// a restarted program deletes the rules once the window closed
+	var buf bytes.Buffer
+	if err := s.Save(&buf); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	s = NewScheduler(ipt)
+	s.now = func() time.Time { return now }
+	if err := s.Add(sr); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := s.Load(&buf); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if states := s.States(); !states[0].Since.Equal(installed) {
+		t.Fatalf("Load restored %+v", states)
+	}
+	now = time.Date(2020, 1, 1, 17, 0, 0, 0, time.UTC)
+	before := len(fakeCalls(t, log))
+	if err := s.Tick(); err != nil {
+		t.Fatalf("Tick failed: %v", err)
+	}
+	expected := []string{"--wait " + fmt.Sprintf(spec, "C"), "--wait " + fmt.Sprintf(spec, "D")}
+	if calls := fakeCalls(t, log)[before:]; !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("calls at %v: \ngot  %q \nneed %q", now, calls, expected)
+	}
+	if states := s.States(); !states[0].Since.IsZero() {
+		t.Fatalf("schedule still installed: %+v", states)
+	}
+}
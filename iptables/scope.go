@@ -0,0 +1,193 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// scopeTables are the tables searched by Scope.Rules and Scope.Purge, and
+// ListScopes, when none are given.
+var scopeTables = []string{"filter", "nat", "mangle", "raw"}
+
+// Scope adds rules tagged with the comment "scope=<id>", so that all rules
+// created for one purpose, e.g. a container, can be listed and purged
+// together. The tag lives in the kernel, so a restarted agent can find and
+// remove the rules of a scope, or of scopes it no longer knows about, with
+// ListScopes.
+type Scope struct {
+	ipt *IPTables
+	id  string
+}
+
+// Scope returns the scope with the given ID, which must be valid as a
+// RuleTags value, e.g. a container ID.
+func (ipt *IPTables) Scope(id string) (*Scope, error) {
+	if !validTag(id) {
+		return nil, fmt.Errorf("invalid scope ID %q", id)
+	}
+	return &Scope{ipt: ipt, id: id}, nil
+}
+
+// ID returns the ID of the scope.
+func (s *Scope) ID() string {
+	return s.id
+}
+
+// tagged returns rulespec tagged with the scope.
+func (s *Scope) tagged(rulespec []string) ([]string, error) {
+	return tagged(RuleTags{"scope": s.id}, rulespec)
+}
+
+// Append appends rulespec, tagged with the scope, to specified table/chain.
+func (s *Scope) Append(table, chain string, rulespec ...string) error {
+	spec, err := s.tagged(rulespec)
+	if err != nil {
+		return err
+	}
+	return s.ipt.Append(table, chain, spec...)
+}
+
+// AppendUnique acts like Append, unless the tagged rule already exists.
+func (s *Scope) AppendUnique(table, chain string, rulespec ...string) error {
+	spec, err := s.tagged(rulespec)
+	if err != nil {
+		return err
+	}
+	return s.ipt.AppendUnique(table, chain, spec...)
+}
+
+// Insert inserts rulespec, tagged with the scope, to specified table/chain
+// (in specified pos).
+func (s *Scope) Insert(table, chain string, pos int, rulespec ...string) error {
+	spec, err := s.tagged(rulespec)
+	if err != nil {
+		return err
+	}
+	return s.ipt.Insert(table, chain, pos, spec...)
+}
+
+// Delete removes rulespec, as added to the scope, from specified table/chain.
+func (s *Scope) Delete(table, chain string, rulespec ...string) error {
+	spec, err := s.tagged(rulespec)
+	if err != nil {
+		return err
+	}
+	return s.ipt.Delete(table, chain, spec...)
+}
+
+// Rules returns the rules of the scope in the given tables, by default
+// filter, nat, mangle and raw, in table and listing order.
+func (s *Scope) Rules(tables ...string) ([]*ParsedRule, error) {
+	rules := []*ParsedRule{}
+	for _, table := range defaultScopeTables(tables) {
+		current, err := s.ipt.listTable(table)
+		if err != nil {
+			return nil, err
+		}
+		for _, chain := range current.chains {
+			for _, r := range current.rules[chain] {
+				if r.Tags()["scope"] == s.id {
+					rules = append(rules, r)
+				}
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Purge deletes every rule of the scope in the given tables, by default
+// filter, nat, mangle and raw, with one iptables-restore transaction per
+// table, and returns the number of rules deleted. Chains are left in place.
+func (s *Scope) Purge(tables ...string) (int, error) {
+	deleted := 0
+	for _, table := range defaultScopeTables(tables) {
+		current, err := s.ipt.listTable(table)
+		if err != nil {
+			return deleted, err
+		}
+		data, n := purgeScopeData(table, s.id, current)
+		if n == 0 {
+			continue
+		}
+		if err := s.ipt.Restore(data, RestoreOptions{NoFlush: true}); err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// purgeScopeData returns the restore data deleting the rules of the scope
+// in the table, and their number.
+func purgeScopeData(table, id string, current *tableRules) (string, int) {
+	return deleteRulesData(table, current, func(r *ParsedRule) bool {
+		return r.Tags()["scope"] == id
+	})
+}
+
+// deleteRulesData returns the restore data deleting the rules of the table
+// that match, and their number.
+func deleteRulesData(table string, current *tableRules, match RuleFilter) (string, int) {
+	var buf bytes.Buffer
+	n := 0
+	buf.WriteString("*" + table + "\n")
+	for _, chain := range current.chains {
+		for _, r := range current.rules[chain] {
+			if !match(r) {
+				continue
+			}
+			buf.WriteString("-D " + chain + " " + r.Spec + "\n")
+			n++
+		}
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.String(), n
+}
+
+// ListScopes returns the sorted IDs of the scopes having rules in the given
+// tables, by default filter, nat, mangle and raw. An agent can compare them
+// to the containers it knows about after a restart, and purge the others.
+func (ipt *IPTables) ListScopes(tables ...string) ([]string, error) {
+	seen := map[string]bool{}
+	for _, table := range defaultScopeTables(tables) {
+		current, err := ipt.listTable(table)
+		if err != nil {
+			return nil, err
+		}
+		for _, chain := range current.chains {
+			for _, r := range current.rules[chain] {
+				if id, ok := r.Tags()["scope"]; ok {
+					seen[id] = true
+				}
+			}
+		}
+	}
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func defaultScopeTables(tables []string) []string {
+	if len(tables) == 0 {
+		return scopeTables
+	}
+	return tables
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScope(t *testing.T) {
+	ipt, log := newFakeIPTables(t, `case "$*" in
+*"-t filter -S"*) printf -- '-P INPUT ACCEPT\n-A INPUT -s 192.0.2.1/32 -m comment --comment scope=c1 -j ACCEPT\n-A INPUT -s 192.0.2.2/32 -m comment --comment scope=c2 -j ACCEPT\n-A INPUT -j LOG\n';;
+*"-t nat -S"*) printf -- '-P PREROUTING ACCEPT\n-A PREROUTING -p tcp -m tcp --dport 8080 -m comment --comment scope=c1 -j DNAT --to-destination 10.0.0.2:80\n';;
+esac`)
+
+	if _, err := ipt.Scope("bad id"); err == nil {
+		t.Fatalf("Scope with a space in the ID did not fail")
+	}
+	s, err := ipt.Scope("c1")
+	if err != nil {
+		t.Fatalf("Scope failed: %v", err)
+	}
+	if err := s.Append("filter", "INPUT", "-s", "192.0.2.1", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	rules, err := s.Rules("filter", "nat")
+	if err != nil {
+		t.Fatalf("Rules failed: %v", err)
+	}
+	if len(rules) != 2 || rules[0].Chain != "INPUT" || rules[1].Target != "DNAT" {
+		t.Fatalf("Rules returned %+v", rules)
+	}
+
+	ids, err := ipt.ListScopes("filter", "nat")
+	if err != nil {
+		t.Fatalf("ListScopes failed: %v", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"c1", "c2"}) {
+		t.Fatalf("ListScopes mismatch: %q", ids)
+	}
+
+	expectedCalls := []string{
+		"--wait -t filter -A INPUT -s 192.0.2.1 -m comment --comment scope=c1 -j ACCEPT",
+		"--wait -t filter -S",
+		"--wait -t nat -S",
+		"--wait -t filter -S",
+		"--wait -t nat -S",
+	}
+	if calls := fakeCalls(t, log); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("calls mismatch: \ngot  %q \nneed %q", calls, expectedCalls)
+	}
+}
+
+func TestPurgeScopeData(t *testing.T) {
+	current, err := parseTableRules([]string{
+		"-P INPUT ACCEPT",
+		"-N SVC",
+		"-A INPUT -s 192.0.2.1/32 -m comment --comment scope=c1 -j ACCEPT",
+		"-A INPUT -s 192.0.2.2/32 -m comment --comment scope=c2 -j ACCEPT",
+		"-A SVC -m comment --comment id=1,scope=c1 -j RETURN",
+	})
+	if err != nil {
+		t.Fatalf("parseTableRules failed: %v", err)
+	}
+
+	data, n := purgeScopeData("filter", "c1", current)
+	expected := `*filter
+-D INPUT -s 192.0.2.1/32 -m comment --comment scope=c1 -j ACCEPT
+-D SVC -m comment --comment id=1,scope=c1 -j RETURN
+COMMIT
+`
+	if n != 2 || data != expected {
+		t.Fatalf("purgeScopeData mismatch: %d \ngot  %s \nneed %s", n, data, expected)
+	}
+	if _, n := purgeScopeData("filter", "c3", current); n != 0 {
+		t.Fatalf("purgeScopeData of an unknown scope deleted %d rules", n)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// selfTestTables are the tables SelfTest lists. Only filter is required;
+// the others are skipped if the kernel does not provide them.
+var selfTestTables = []string{"filter", "nat", "mangle", "raw"}
+
+// selfTestLockTimeout bounds how long SelfTest waits for the lock.
+const selfTestLockTimeout = 5 * time.Second
+
+// SelfTest checks that this IPTables is usable: the binary runs, every
+// standard table can be listed (i.e. its kernel module is loaded or loadable),
+// and the lock can be acquired. Tables other than filter that do not exist
+// in the kernel are skipped rather than reported. Agents can call it at startup to fail fast.
+// The returned error describes every problem found; it matches ErrPermission
+// via errors.Is if the process lacks the required privileges.
+func (ipt *IPTables) SelfTest() error {
+	if err := ipt.ready(); err != nil {
+		return fmt.Errorf("self test: %v", err)
+	}
+	if _, err := getIptablesVersionString(ipt.path); err != nil {
+		return fmt.Errorf("self test: cannot run %s: %v", ipt.path, err)
+	}
+
+	var problems []string
+	for _, table := range selfTestTables {
+		err := ipt.run("-t", table, "-L", "-n")
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, ErrPermission) {
+			return fmt.Errorf("self test: listing table %s: %w", table, err)
+		}
+		if table != "filter" && isTableMissing(err) {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("listing table %s failed, is the %s kernel module available? (%v)",
+			table, tableModule(ipt.proto, table), strings.TrimSpace(err.Error())))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestLockTimeout)
+	defer cancel()
+	l, err := ipt.AcquireSequenceLock(ctx)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("acquiring the lock failed: %v", err))
+	} else {
+		l.Release()
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("self test: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// isTableMissing reports whether err says the table does not exist, as
+// iptables does when its kernel module is neither loaded nor loadable.
+func isTableMissing(err error) bool {
+	e, ok := err.(*Error)
+	return ok && strings.Contains(e.msg, "Table does not exist")
+}
+
+// tableModule returns the name of the kernel module providing the table.
+func tableModule(proto Protocol, table string) string {
+	if proto == ProtocolIPv6 {
+		return "ip6table_" + table
+	}
+	return "iptable_" + table
+}
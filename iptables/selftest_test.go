@@ -0,0 +1,59 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"strings"
+	"testing"
+)
+
+// missingTableScript makes the fake iptables fail to list the given table the
+// way iptables does when its kernel module is not available.
+func missingTableScript(table string) string {
+	return `case "$*" in
+*"-t ` + table + ` "*)
+	echo "iptables v1.8.7 (legacy): can't initialize iptables table '` + table + `': Table does not exist (do you need to insmod?)" >&2
+	exit 3;;
+esac`
+}
+
+func TestSelfTestSkipsMissingTable(t *testing.T) {
+	ipt, log := newFakeIPTables(t, missingTableScript("raw"))
+
+	if err := ipt.SelfTest(); err != nil {
+		t.Fatalf("SelfTest: %v", err)
+	}
+	var listed []string
+	for _, c := range fakeCalls(t, log) {
+		if strings.Contains(c, " -L ") {
+			listed = append(listed, c)
+		}
+	}
+	if len(listed) != len(selfTestTables) {
+		t.Errorf("listed %q, want every table in %q", listed, selfTestTables)
+	}
+}
+
+func TestSelfTestMissingFilter(t *testing.T) {
+	ipt, _ := newFakeIPTables(t, missingTableScript("filter"))
+
+	err := ipt.SelfTest()
+	if err == nil || !strings.Contains(err.Error(), "iptable_filter") {
+		t.Fatalf("SelfTest = %v, want an error naming iptable_filter", err)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// clone returns a copy of the table that can be modified independently.
+func (t *tableRules) clone() *tableRules {
+	c := &tableRules{
+		chains:   append([]string{}, t.chains...),
+		policies: make(map[string]string, len(t.policies)),
+		builtin:  make(map[string]bool, len(t.builtin)),
+		rules:    make(map[string][]*ParsedRule, len(t.rules)),
+	}
+	for k, v := range t.policies {
+		c.policies[k] = v
+	}
+	for k, v := range t.builtin {
+		c.builtin[k] = v
+	}
+	for k, v := range t.rules {
+		c.rules[k] = append([]*ParsedRule{}, v...)
+	}
+	return c
+}
+
+// simulate applies an iptables command, without the "-t <table>" option,
+// to the table, the way iptables would. Commands that do not change rules,
+// such as listing or zeroing counters, are ignored.
+func (t *tableRules) simulate(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	chain := ""
+	if len(args) > 1 {
+		chain = args[1]
+	}
+	exists := containsString(t.chains, chain)
+	needChain := func() error {
+		if !exists {
+			return fmt.Errorf("chain %s does not exist", chain)
+		}
+		return nil
+	}
+
+	switch args[0] {
+	case "-A", "--append":
+		if err := needChain(); err != nil {
+			return err
+		}
+		r, err := simulatedRule(chain, args[2:])
+		if err != nil {
+			return err
+		}
+		t.rules[chain] = append(t.rules[chain], r)
+	case "-I", "--insert", "-R", "--replace":
+		if err := needChain(); err != nil {
+			return err
+		}
+		spec := args[2:]
+		pos := 1
+		if n, err := strconv.Atoi(firstArg(spec)); err == nil {
+			pos, spec = n, spec[1:]
+		} else if args[0] == "-R" || args[0] == "--replace" {
+			return fmt.Errorf("replace requires a rule number")
+		}
+		r, err := simulatedRule(chain, spec)
+		if err != nil {
+			return err
+		}
+		rules := t.rules[chain]
+		if pos < 1 || pos > len(rules)+1 {
+			return fmt.Errorf("invalid rule number %d in chain %s", pos, chain)
+		}
+		if args[0] == "-I" || args[0] == "--insert" {
+			rules = append(rules[:pos-1], append([]*ParsedRule{r}, rules[pos-1:]...)...)
+		} else {
+			if pos > len(rules) {
+				return fmt.Errorf("invalid rule number %d in chain %s", pos, chain)
+			}
+			rules = append(append(rules[:pos-1:pos-1], r), rules[pos:]...)
+		}
+		t.rules[chain] = rules
+	case "-D", "--delete":
+		if err := needChain(); err != nil {
+			return err
+		}
+		rules := t.rules[chain]
+		i := -1
+		if n, err := strconv.Atoi(firstArg(args[2:])); err == nil && len(args) == 3 {
+			i = n - 1
+		} else {
+			for j, r := range rules {
+				spec, err := splitRule(r.Spec)
+				if err == nil && RulesEqual(spec, args[2:]) {
+					i = j
+					break
+				}
+			}
+		}
+		if i < 0 || i >= len(rules) {
+			return fmt.Errorf("rule to delete not found in chain %s", chain)
+		}
+		t.rules[chain] = append(rules[:i:i], rules[i+1:]...)
+	case "-F", "--flush":
+		if chain == "" {
+			t.rules = make(map[string][]*ParsedRule)
+			return nil
+		}
+		if err := needChain(); err != nil {
+			return err
+		}
+		delete(t.rules, chain)
+	case "-N", "--new-chain":
+		if exists {
+			return fmt.Errorf("chain %s already exists", chain)
+		}
+		t.chains = append(t.chains, chain)
+	case "-X", "--delete-chain":
+		for _, c := range t.chains {
+			if (chain == "" || c == chain) && !t.builtin[c] {
+				t.deleteChain(c)
+			}
+		}
+	case "-E", "--rename-chain":
+		if err := needChain(); err != nil {
+			return err
+		}
+		if len(args) < 3 {
+			return fmt.Errorf("rename requires a new name")
+		}
+		t.renameChain(chain, args[2])
+	case "-P", "--policy":
+		if !t.builtin[chain] || len(args) < 3 {
+			return fmt.Errorf("cannot set policy of chain %s", chain)
+		}
+		t.policies[chain] = args[2]
+	}
+	return nil
+}
+
+// simulateRestore applies restore data for the table, as parsed by
+// splitRestoreData, the way iptables-restore would.
+func (t *tableRules) simulateRestore(lines []string, noflush bool) error {
+	if !noflush {
+		// the table is replaced: user-defined chains are gone and the
+		// built-in ones are emptied
+		for _, c := range append([]string{}, t.chains...) {
+			if !t.builtin[c] {
+				t.deleteChain(c)
+			}
+		}
+		t.rules = make(map[string][]*ParsedRule)
+	}
+	for _, line := range lines {
+		line = countersPrefix.ReplaceAllString(line, "")
+		if strings.HasPrefix(line, ":") {
+			fields := strings.Fields(line[1:])
+			if len(fields) == 0 {
+				return fmt.Errorf("invalid chain declaration %q", line)
+			}
+			chain := fields[0]
+			switch {
+			case t.builtin[chain]:
+				if len(fields) > 1 && fields[1] != "-" {
+					t.policies[chain] = fields[1]
+				}
+			case containsString(t.chains, chain):
+				delete(t.rules, chain)
+			default:
+				t.chains = append(t.chains, chain)
+			}
+			continue
+		}
+		args, err := splitRule(line)
+		if err != nil {
+			return err
+		}
+		if err := t.simulate(args); err != nil {
+			return fmt.Errorf("%v: %s", err, line)
+		}
+	}
+	return nil
+}
+
+func (t *tableRules) deleteChain(chain string) {
+	for i, c := range t.chains {
+		if c == chain {
+			t.chains = append(t.chains[:i:i], t.chains[i+1:]...)
+			break
+		}
+	}
+	delete(t.rules, chain)
+}
+
+func (t *tableRules) renameChain(from, to string) {
+	for i, c := range t.chains {
+		if c == from {
+			t.chains[i] = to
+		}
+	}
+	t.rules[to] = t.rules[from]
+	delete(t.rules, from)
+	for chain, rules := range t.rules {
+		for i, r := range rules {
+			if r.Target == from {
+				renamed := *r
+				renamed.Target = to
+				t.rules[chain][i] = &renamed
+			}
+		}
+	}
+}
+
+// splitRestoreData splits restore data into the lines of each table,
+// without the table headers, COMMIT lines, comments and blank lines.
+func splitRestoreData(data string) (map[string][]string, []string, error) {
+	tables := make(map[string][]string)
+	var order []string
+	table := ""
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+			if _, ok := tables[table]; !ok {
+				order = append(order, table)
+				tables[table] = nil
+			}
+		case line == "COMMIT":
+			table = ""
+		case table == "":
+			return nil, nil, fmt.Errorf("restore line outside of a table: %q", line)
+		default:
+			tables[table] = append(tables[table], line)
+		}
+	}
+	return tables, order, nil
+}
+
+// simulatedRule parses a rulespec into a rule of the chain.
+func simulatedRule(chain string, spec []string) (*ParsedRule, error) {
+	r, err := parseRuleArgs(spec)
+	if err != nil {
+		return nil, err
+	}
+	r.Chain = chain
+	r.Spec = joinRule(spec)
+	return r, nil
+}
+
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
@@ -0,0 +1,176 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SNATUpdater keeps the SNAT rules for an egress interface pointed at its
+// current address, for deployments that use SNAT instead of MASQUERADE on a
+// dynamically addressed WAN interface.
+type SNATUpdater struct {
+	ipt   *IPTables
+	iface string
+
+	// primaryAddr returns the interface address; replaced in tests
+	primaryAddr func(iface string, proto Protocol) (net.IP, error)
+
+	mu   sync.Mutex
+	addr string
+}
+
+// NewSNATUpdater returns an updater for the SNAT rules of the nat table
+// that match the egress interface with "-o <iface>".
+func NewSNATUpdater(ipt *IPTables, iface string) *SNATUpdater {
+	return &SNATUpdater{ipt: ipt, iface: iface, primaryAddr: primaryAddr}
+}
+
+// Addr returns the interface address found by the last Update.
+func (u *SNATUpdater) Addr() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.addr
+}
+
+// Update looks up the primary address of the interface and replaces the
+// --to-source address of every SNAT rule for the interface that differs,
+// keeping any port range, in a single iptables-restore transaction. It
+// reports whether any rule was rewritten.
+func (u *SNATUpdater) Update() (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ip, err := u.primaryAddr(u.iface, u.ipt.Proto())
+	if err != nil {
+		return false, err
+	}
+	u.addr = ip.String()
+
+	current, err := u.ipt.listTable("nat")
+	if err != nil {
+		return false, err
+	}
+	data, err := snatUpdateData(u.iface, u.addr, current)
+	if err != nil || data == "" {
+		return false, err
+	}
+	if err := u.ipt.Restore(data, RestoreOptions{NoFlush: true}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Run updates the rules, then again whenever an address of the handle's
+// family changes, until the context is done. Errors of Update are passed to
+// onError if it is not nil. On Linux, address events are received over
+// rtnetlink.
+func (u *SNATUpdater) Run(ctx context.Context, onError func(error)) error {
+	update := func() {
+		if _, err := u.Update(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	update()
+	return watchAddrs(ctx, u.ipt.Proto(), update)
+}
+
+// snatUpdateData returns the restore data pointing the SNAT rules for iface
+// at addr, or "" if they all do.
+func snatUpdateData(iface, addr string, current *tableRules) (string, error) {
+	var rules bytes.Buffer
+	for _, chain := range current.chains {
+		for i, r := range current.rules[chain] {
+			if r.Target != "SNAT" || !equalStrings(r.Matches["-o"], []string{iface}) {
+				continue
+			}
+			args, err := splitRule(r.Spec)
+			if err != nil {
+				return "", err
+			}
+			changed := false
+			for j := 0; j+1 < len(args); j++ {
+				if args[j] != "--to-source" {
+					continue
+				}
+				if to := replaceSNATAddr(args[j+1], addr); to != args[j+1] {
+					args[j+1] = to
+					changed = true
+				}
+			}
+			if changed {
+				rules.WriteString("-R " + chain + " " + strconv.Itoa(i+1) + " " + joinRule(args) + "\n")
+			}
+		}
+	}
+	if rules.Len() == 0 {
+		return "", nil
+	}
+	return "*nat\n" + rules.String() + "COMMIT\n", nil
+}
+
+// replaceSNATAddr replaces the address of a --to-source value such as
+// "192.0.2.1", "192.0.2.1:1024-65535" or "[2001:db8::1]:80", keeping the
+// port range. Address ranges are left alone.
+func replaceSNATAddr(to, addr string) string {
+	host, ports := to, ""
+	switch {
+	case strings.HasPrefix(to, "["):
+		end := strings.Index(to, "]")
+		if end < 0 {
+			return to
+		}
+		host, ports = to[1:end], to[end+1:]
+	case strings.Count(to, ":") == 1:
+		i := strings.Index(to, ":")
+		host, ports = to[:i], to[i:]
+	}
+	if strings.Contains(host, "-") || host == addr {
+		return to
+	}
+	if strings.Contains(addr, ":") && ports != "" {
+		return "[" + addr + "]" + ports
+	}
+	return addr + ports
+}
+
+// primaryAddr returns the first global unicast address of the protocol's
+// family assigned to the interface.
+func primaryAddr(iface string, proto Protocol) (net.IP, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if (ipnet.IP.To4() != nil) == (proto == ProtocolIPv4) {
+			return ipnet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no address", iface)
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"testing"
+)
+
+func TestSNATUpdateData(t *testing.T) {
+	current, err := parseTableRules([]string{
+		"-P POSTROUTING ACCEPT",
+		"-N WAN-SNAT",
+		"-A POSTROUTING -o eth1 -j MASQUERADE",
+		"-A POSTROUTING -s 192.168.1.0/24 -o eth0 -j SNAT --to-source 203.0.113.5",
+		"-A POSTROUTING -o eth0 -j WAN-SNAT",
+		"-A WAN-SNAT -s 192.168.2.0/24 -o eth0 -p udp -j SNAT --to-source 203.0.113.5:1024-65535",
+		"-A WAN-SNAT -s 192.168.3.0/24 -o eth0 -j SNAT --to-source 203.0.113.9",
+		"-A WAN-SNAT -s 192.168.4.0/24 -o eth1 -j SNAT --to-source 198.51.100.1",
+	})
+	if err != nil {
+		t.Fatalf("parseTableRules failed: %v", err)
+	}
+
+	data, err := snatUpdateData("eth0", "203.0.113.9", current)
+	if err != nil {
+		t.Fatalf("snatUpdateData failed: %v", err)
+	}
+	expected := `*nat
+-R POSTROUTING 2 -s 192.168.1.0/24 -o eth0 -j SNAT --to-source 203.0.113.9
+-R WAN-SNAT 1 -s 192.168.2.0/24 -o eth0 -p udp -j SNAT --to-source 203.0.113.9:1024-65535
+COMMIT
+`
+	if data != expected {
+		t.Fatalf("snatUpdateData mismatch: \ngot  %s \nneed %s", data, expected)
+	}
+
+	data, err = snatUpdateData("eth1", "198.51.100.1", current)
+	if err != nil || data != "" {
+		t.Fatalf("snatUpdateData of up to date rules returned %q, %v", data, err)
+	}
+}
+
+func TestReplaceSNATAddr(t *testing.T) {
+	tests := []struct {
+		to, addr, expected string
+	}{
+		{"192.0.2.1", "192.0.2.2", "192.0.2.2"},
+		{"192.0.2.1:80-90", "192.0.2.2", "192.0.2.2:80-90"},
+		{"192.0.2.1-192.0.2.9", "192.0.2.2", "192.0.2.1-192.0.2.9"},
+		{"2001:db8::1", "2001:db8::2", "2001:db8::2"},
+		{"[2001:db8::1]:80", "2001:db8::2", "[2001:db8::2]:80"},
+	}
+	for _, tt := range tests {
+		if got := replaceSNATAddr(tt.to, tt.addr); got != tt.expected {
+			t.Fatalf("replaceSNATAddr(%q, %q) = %q, want %q", tt.to, tt.addr, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Stat holds the counters of a rule.
+type Stat struct {
+	Table string
+	Chain string
+	// Rule is the rulespec as listed, without "-A <chain>" and the counters.
+	Rule    string
+	Packets uint64
+	Bytes   uint64
+}
+
+// Stats returns the packet and byte counters of every rule in the specified
+// table/chain, or in all chains of the table if chain is empty.
+func (ipt *IPTables) Stats(table, chain string) ([]Stat, error) {
+	args := []string{"-t", table, "-v", "-S"}
+	if chain != "" {
+		args = append(args, chain)
+	}
+	lines, err := ipt.ExecuteList(args)
+	if err != nil {
+		return nil, err
+	}
+	return parseStats(table, lines)
+}
+
+// parseStats parses "iptables -v -S" output, where every rule carries its
+// counters as "-c <pkts> <bytes>".
+func parseStats(table string, lines []string) ([]Stat, error) {
+	var stats []Stat
+	for _, line := range lines {
+		args, err := splitRule(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) < 2 || args[0] != "-A" {
+			continue
+		}
+		stat := Stat{Table: table, Chain: args[1]}
+		var spec []string
+		found := false
+		for i := 2; i < len(args); i++ {
+			if args[i] == "-c" && i+2 < len(args) && !found {
+				if stat.Packets, err = strconv.ParseUint(args[i+1], 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid packet counter in rule: %s", line)
+				}
+				if stat.Bytes, err = strconv.ParseUint(args[i+2], 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid byte counter in rule: %s", line)
+				}
+				found = true
+				i += 2
+				continue
+			}
+			spec = append(spec, args[i])
+		}
+		if !found {
+			return nil, fmt.Errorf("no counters in rule: %s", line)
+		}
+		stat.Rule = joinRule(spec)
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+// StatDelta holds the counter increase of a rule between two samples.
+type StatDelta struct {
+	Table   string
+	Chain   string
+	Rule    string
+	Packets uint64
+	Bytes   uint64
+	// New is set if the rule was not in the previous sample; its whole
+	// counters are then reported as the delta.
+	New bool
+	// Reset is set if the counters went backwards, e.g. after "-Z" or the rule
+	// being replaced; the current counters are then reported as the delta.
+	Reset bool
+}
+
+// DiffStats computes the counter deltas of the rules in cur since prev, in
+// the order of cur. Rules are matched by table, chain and rulespec, so
+// reordering does not matter; identical rules are paired in order. Rules
+// whose rulespec changed but whose comment is unique in their chain in both
+// samples are matched by comment. Rules only in prev are left out.
+func DiffStats(prev, cur []Stat) []StatDelta {
+	bySpec := make(map[statKey][]int)
+	for i, s := range prev {
+		k := statKey{s.Table, s.Chain, s.Rule}
+		bySpec[k] = append(bySpec[k], i)
+	}
+
+	matched := make([]int, len(cur))
+	used := make([]bool, len(prev))
+	for i, s := range cur {
+		matched[i] = -1
+		k := statKey{s.Table, s.Chain, s.Rule}
+		if idx := bySpec[k]; len(idx) > 0 {
+			matched[i] = idx[0]
+			used[idx[0]] = true
+			bySpec[k] = idx[1:]
+		}
+	}
+
+	// pair the remaining rules by comment, if unambiguous
+	curUsed := make([]bool, len(cur))
+	for i := range cur {
+		curUsed[i] = matched[i] >= 0
+	}
+	prevComments := uniqueComments(prev, used)
+	curComments := uniqueComments(cur, curUsed)
+	for i, s := range cur {
+		if matched[i] >= 0 {
+			continue
+		}
+		c := statComment(s.Rule)
+		if c == "" {
+			continue
+		}
+		k := statKey{s.Table, s.Chain, c}
+		if j, ok := prevComments[k]; ok && j >= 0 && curComments[k] >= 0 {
+			matched[i] = j
+			used[j] = true
+			delete(prevComments, k)
+		}
+	}
+
+	deltas := make([]StatDelta, 0, len(cur))
+	for i, s := range cur {
+		d := StatDelta{Table: s.Table, Chain: s.Chain, Rule: s.Rule, Packets: s.Packets, Bytes: s.Bytes}
+		if j := matched[i]; j < 0 {
+			d.New = true
+		} else if p := prev[j]; s.Packets < p.Packets || s.Bytes < p.Bytes {
+			d.Reset = true
+		} else {
+			d.Packets -= p.Packets
+			d.Bytes -= p.Bytes
+		}
+		deltas = append(deltas, d)
+	}
+	return deltas
+}
+
+// statKey identifies a rule, or a comment in place of the rulespec.
+type statKey struct{ table, chain, rule string }
+
+// uniqueComments maps the table, chain and comment of the stats not marked
+// in skip to their index, or to -1 if the comment occurs more than once.
+func uniqueComments(stats []Stat, skip []bool) map[statKey]int {
+	comments := make(map[statKey]int)
+	for i, s := range stats {
+		if skip[i] {
+			continue
+		}
+		c := statComment(s.Rule)
+		if c == "" {
+			continue
+		}
+		k := statKey{s.Table, s.Chain, c}
+		if _, ok := comments[k]; ok {
+			comments[k] = -1
+		} else {
+			comments[k] = i
+		}
+	}
+	return comments
+}
+
+// statComment returns the comment of a rulespec, or "" if it has none.
+func statComment(rule string) string {
+	args, err := splitRule(rule)
+	if err != nil {
+		return ""
+	}
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "--comment" {
+			return args[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffStats(t *testing.T) {
+	prev := []Stat{
+		{"filter", "INPUT", "-p tcp -j ACCEPT", 10, 1000},
+		{"filter", "INPUT", "-j LOG", 1, 100},
+		{"filter", "INPUT", "-j LOG", 2, 200},
+		{"filter", "INPUT", `-s 192.0.2.1/32 -m comment --comment web -j ACCEPT`, 5, 500},
+		{"filter", "INPUT", "-p udp -j DROP", 3, 300},
+		{"filter", "OUTPUT", "-j ACCEPT", 7, 700},
+	}
+	cur := []Stat{
+		// reordered
+		{"filter", "INPUT", "-j LOG", 4, 400},
+		{"filter", "INPUT", "-p tcp -j ACCEPT", 15, 1500},
+		{"filter", "INPUT", "-j LOG", 2, 250},
+		// rulespec changed, same comment
+		{"filter", "INPUT", `-s 192.0.2.2/32 -m comment --comment web -j ACCEPT`, 6, 600},
+		// counters zeroed
+		{"filter", "OUTPUT", "-j ACCEPT", 1, 10},
+		{"filter", "INPUT", "-p icmp -j ACCEPT", 9, 900},
+	}
+	expected := []StatDelta{
+		{Table: "filter", Chain: "INPUT", Rule: "-j LOG", Packets: 3, Bytes: 300},
+		{Table: "filter", Chain: "INPUT", Rule: "-p tcp -j ACCEPT", Packets: 5, Bytes: 500},
+		{Table: "filter", Chain: "INPUT", Rule: "-j LOG", Packets: 0, Bytes: 50},
+		{Table: "filter", Chain: "INPUT", Rule: `-s 192.0.2.2/32 -m comment --comment web -j ACCEPT`, Packets: 1, Bytes: 100},
+		{Table: "filter", Chain: "OUTPUT", Rule: "-j ACCEPT", Packets: 1, Bytes: 10, Reset: true},
+		{Table: "filter", Chain: "INPUT", Rule: "-p icmp -j ACCEPT", Packets: 9, Bytes: 900, New: true},
+	}
+	if got := DiffStats(prev, cur); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("DiffStats mismatch:\ngot  %+v\nneed %+v", got, expected)
+	}
+}
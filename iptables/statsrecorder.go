@@ -0,0 +1,160 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StatSample is the counters of a rule at one sample of a StatsRecorder.
+type StatSample struct {
+	Time time.Time
+	Stat
+	// DeltaPackets, DeltaBytes, New and Reset describe the change since the
+	// previous sample, as in StatDelta.
+	DeltaPackets uint64
+	DeltaBytes   uint64
+	New          bool
+	Reset        bool
+}
+
+// StatsSink stores the samples taken by a StatsRecorder.
+type StatsSink interface {
+	// WriteSamples stores the samples of the rules taken at one time.
+	WriteSamples(samples []StatSample) error
+}
+
+// StatsRecorder samples the rule counters of a chain or table at an interval
+// and hands them, with the increase since the previous sample, to a sink,
+// e.g. a CSV file, for historical traffic analysis without a metrics stack.
+type StatsRecorder struct {
+	ipt   *IPTables
+	table string
+	chain string
+	sink  StatsSink
+
+	// now returns the current time; replaced in tests
+	now func() time.Time
+
+	mu   sync.Mutex
+	prev []Stat
+}
+
+// NewStatsRecorder returns a recorder of the counters of the specified
+// table/chain, or of all chains of the table if chain is empty.
+func NewStatsRecorder(ipt *IPTables, table, chain string, sink StatsSink) *StatsRecorder {
+	return &StatsRecorder{ipt: ipt, table: table, chain: chain, sink: sink, now: time.Now}
+}
+
+// Sample reads the counters and writes them to the sink. The deltas of the
+// first sample are the counters themselves, with New set.
+func (r *StatsRecorder) Sample() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := r.now()
+	stats, err := r.ipt.Stats(r.table, r.chain)
+	if err != nil {
+		return err
+	}
+	deltas := DiffStats(r.prev, stats)
+	samples := make([]StatSample, len(stats))
+	for i, s := range stats {
+		d := deltas[i]
+		samples[i] = StatSample{
+			Time:         t,
+			Stat:         s,
+			DeltaPackets: d.Packets,
+			DeltaBytes:   d.Bytes,
+			New:          d.New,
+			Reset:        d.Reset,
+		}
+	}
+	if err := r.sink.WriteSamples(samples); err != nil {
+		return err
+	}
+	r.prev = stats
+	return nil
+}
+
+// Run calls Sample every interval until the context is done, reporting
+// errors to onError if it is not nil.
+func (r *StatsRecorder) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Sample(); err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// csvStatsHeader names the columns written by CSVStatsSink.
+var csvStatsHeader = []string{"time", "table", "chain", "rule", "packets", "bytes", "delta_packets", "delta_bytes", "new", "reset"}
+
+// CSVStatsSink appends samples to a writer as CSV, one row per rule and
+// sample, with times in RFC 3339 format.
+type CSVStatsSink struct {
+	w *csv.Writer
+	// Header writes the column names before the first row; leave it unset
+	// when appending to an existing file.
+	Header bool
+
+	wroteHeader bool
+}
+
+// NewCSVStatsSink returns a sink writing CSV to w, with a header row.
+func NewCSVStatsSink(w io.Writer) *CSVStatsSink {
+	return &CSVStatsSink{w: csv.NewWriter(w), Header: true}
+}
+
+func (s *CSVStatsSink) WriteSamples(samples []StatSample) error {
+	if s.Header && !s.wroteHeader {
+		if err := s.w.Write(csvStatsHeader); err != nil {
+			return err
+		}
+		s.wroteHeader = true
+	}
+	for _, sm := range samples {
+		row := []string{
+			sm.Time.Format(time.RFC3339),
+			sm.Table,
+			sm.Chain,
+			sm.Rule,
+			strconv.FormatUint(sm.Packets, 10),
+			strconv.FormatUint(sm.Bytes, 10),
+			strconv.FormatUint(sm.DeltaPackets, 10),
+			strconv.FormatUint(sm.DeltaBytes, 10),
+			strconv.FormatBool(sm.New),
+			strconv.FormatBool(sm.Reset),
+		}
+		if err := s.w.Write(row); err != nil {
+			return err
+		}
+	}
+	// flush per sample, so the file is complete if the process dies
+	s.w.Flush()
+	return s.w.Error()
+}
@@ -0,0 +1,50 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStatsRecorder(t *testing.T) {
+	dir := t.TempDir()
+	// the counter grows by one packet of 100 bytes per call
+	ipt, _ := newFakeIPTables(t, `n=$(cat `+dir+`/n 2>/dev/null || echo 0); n=$((n+1)); echo $n > `+dir+`/n
+printf -- '-N ACCT\n-A ACCT -s 192.0.2.0/24 -c %d %d\n' $n $((n*100))`)
+
+	var buf bytes.Buffer
+	r := NewStatsRecorder(ipt, "filter", "ACCT", NewCSVStatsSink(&buf))
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if err := r.Sample(); err != nil {
+			t.Fatalf("Sample failed: %v", err)
+		}
+		now = now.Add(time.Minute)
+	}
+	expected := `time,table,chain,rule,packets,bytes,delta_packets,delta_bytes,new,reset
+2020-01-01T00:00:00Z,filter,ACCT,-s 192.0.2.0/24,1,100,1,100,true,false
+2020-01-01T00:01:00Z,filter,ACCT,-s 192.0.2.0/24,2,200,1,100,false,false
+`
+	if buf.String() != expected {
+		t.Fatalf("CSV mismatch:\ngot  %s\nneed %s", buf.String(), expected)
+	}
+}
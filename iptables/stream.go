@@ -0,0 +1,160 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultMaxLineSize is the longest output line accepted by ExecuteListFunc
+// unless configured otherwise with MaxLineSize.
+const DefaultMaxLineSize = 64 * 1024
+
+// ErrLineTooLong is returned when iptables prints a line longer than the
+// configured maximum line size.
+var ErrLineTooLong = errors.New("iptables: output line too long")
+
+// MaxLineSize bounds the memory used to buffer a single line of iptables
+// output while listing. Longer lines make the listing fail with
+// ErrLineTooLong. A size of zero or less selects DefaultMaxLineSize.
+func MaxLineSize(n int) Option {
+	return func(ipt *IPTables) {
+		ipt.maxLineSize = n
+	}
+}
+
+// ExecuteListFunc runs an iptables listing command and calls fn for each line
+// of its output, without the trailing newline, as it is read. Only the
+// current line is buffered, so chains with hundreds of thousands of rules can
+// be processed in constant memory.
+//
+// "-L" listings are made numeric unless the IPTables was created with
+// ResolveNames.
+// On binaries without -S, e.g. embedded builds, "-S" listings are emulated
+// by translating the output of "-L".
+//
+// If fn returns an error, the remaining output is discarded and that error is
+// returned once the command has exited.
+func (ipt *IPTables) ExecuteListFunc(args []string, fn func(line string) error) error {
+	if err := ipt.ready(); err != nil {
+		return err
+	}
+	if ipt.noListRules && (containsString(args, "-S") || containsString(args, "--list-rules")) {
+		return ipt.listRulesFallback(args, fn)
+	}
+	max := ipt.maxLineSize
+	if max <= 0 {
+		max = DefaultMaxLineSize
+	}
+	if !ipt.resolveNames {
+		args = numericArgs(args)
+	}
+	w := &lineWriter{max: max, fn: fn}
+	if err := ipt.runWithOutput(args, w); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// ListFunc calls fn for each line of "-S" output of the specified table/chain,
+// like List, but without holding the whole listing in memory.
+func (ipt *IPTables) ListFunc(table, chain string, fn func(rule string) error) error {
+	args := []string{"-t", table, "-S", chain}
+	return ipt.ExecuteListFunc(args, func(line string) error {
+		if !ipt.ownedLine(line) {
+			return nil
+		}
+		return fn(line)
+	})
+}
+
+// ListParsedFunc calls fn for each rule of the specified table/chain, like
+// ListParsed, but without holding the whole listing in memory. Chain
+// declarations and policies are skipped.
+func (ipt *IPTables) ListParsedFunc(table, chain string, fn func(rule *ParsedRule) error) error {
+	return ipt.executeParsedFunc([]string{"-t", table, "-S", chain}, fn)
+}
+
+// executeParsedFunc runs an iptables "-S" listing and calls fn for each rule.
+func (ipt *IPTables) executeParsedFunc(args []string, fn func(rule *ParsedRule) error) error {
+	return ipt.ExecuteListFunc(args, func(line string) error {
+		if !strings.HasPrefix(line, "-A ") || !ipt.ownedLine(line) {
+			// chain declaration or policy, or a rule of another owner
+			return nil
+		}
+		r, err := ParseRule(line)
+		if err != nil {
+			return err
+		}
+		return fn(r)
+	})
+}
+
+// lineWriter is an io.Writer splitting what is written into lines passed to
+// fn. After the first error, the rest of the output is consumed and dropped,
+// so the command is not left blocked on a full pipe.
+type lineWriter struct {
+	max int
+	fn  func(string) error
+	buf []byte
+	err error
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.err != nil {
+		return n, nil
+	}
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			if len(w.buf)+len(p) > w.max {
+				w.err = fmt.Errorf("%w: more than %d bytes", ErrLineTooLong, w.max)
+				return n, nil
+			}
+			w.buf = append(w.buf, p...)
+			break
+		}
+		if len(w.buf)+i > w.max {
+			w.err = fmt.Errorf("%w: more than %d bytes", ErrLineTooLong, w.max)
+			return n, nil
+		}
+		var line string
+		if len(w.buf) > 0 {
+			line = string(append(w.buf, p[:i]...))
+			w.buf = w.buf[:0]
+		} else {
+			line = string(p[:i])
+		}
+		if err := w.fn(line); err != nil {
+			w.err = err
+			return n, nil
+		}
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// flush passes a final unterminated line to fn and returns the first error.
+func (w *lineWriter) flush() error {
+	if w.err == nil && len(w.buf) > 0 {
+		w.err = w.fn(string(w.buf))
+		w.buf = nil
+	}
+	return w.err
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := &lineWriter{max: 8, fn: func(line string) error {
+		lines = append(lines, line)
+		return nil
+	}}
+	for _, chunk := range []string{"-P INP", "UT\n\n-A X\n-A", " Y"} {
+		w.Write([]byte(chunk))
+	}
+	if err := w.flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	expected := []string{"-P INPUT", "", "-A X", "-A Y"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("got %#v, want %#v", lines, expected)
+	}
+
+	w = &lineWriter{max: 8, fn: func(string) error { return nil }}
+	w.Write([]byte("-A INPUT -j ACCEPT\n"))
+	if err := w.flush(); !errors.Is(err, ErrLineTooLong) {
+		t.Fatalf("flush returned %v, want ErrLineTooLong", err)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	w = &lineWriter{max: 8, fn: func(string) error {
+		calls++
+		return stop
+	}}
+	if n, err := w.Write([]byte(strings.Repeat("-A X\n", 3))); n != 15 || err != nil {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	if err := w.flush(); err != stop || calls != 1 {
+		t.Fatalf("flush returned %v after %d calls", err, calls)
+	}
+}
+
+func TestListParsedFunc(t *testing.T) {
+	ipt, _ := newFakeIPTables(t, `echo "-N BIG"; seq 1 100000 | sed 's/^/-A BIG -s 10.0.0.0\/8 -m comment --comment r/; s/$/ -j DROP/'`)
+
+	n := 0
+	err := ipt.ListParsedFunc("filter", "BIG", func(r *ParsedRule) error {
+		n++
+		if r.Chain != "BIG" || r.Target != "DROP" {
+			t.Fatalf("unexpected rule %+v", r)
+		}
+		return nil
+	})
+	if err != nil || n != 100000 {
+		t.Fatalf("ListParsedFunc returned %v after %d rules", err, n)
+	}
+
+	stop := errors.New("stop")
+	n = 0
+	err = ipt.ListFunc("filter", "BIG", func(string) error {
+		if n++; n == 10 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 10 {
+		t.Fatalf("ListFunc returned %v after %d lines", err, n)
+	}
+
+	MaxLineSize(16)(ipt)
+	if _, err := ipt.List("filter", "BIG"); !errors.Is(err, ErrLineTooLong) {
+		t.Fatalf("List returned %v, want ErrLineTooLong", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// SynproxyConfig selects the port EnableSynproxyConfig protects and the TCP
+// options SYNPROXY announces to clients.
+type SynproxyConfig struct {
+	Port int
+	// Interface limits the protection to packets entering through it; empty
+	// matches all interfaces.
+	Interface string
+	// MSS defaults to that of a 1500 byte MTU: 1460 for IPv4 and 1440 for
+	// IPv6. It should match the MSS of the protected server.
+	MSS uint16
+	// WScale defaults to 7; it should match the window scaling of the
+	// protected server.
+	WScale uint8
+}
+
+// Default SYNPROXY options; see SynproxyConfig.
+const (
+	defaultSynproxyMSS    = 1460
+	defaultSynproxyMSSv6  = 1440
+	defaultSynproxyWScale = 7
+)
+
+// synproxyRule is one rule of the SYNPROXY rule set.
+type synproxyRule struct {
+	table    string
+	chain    string
+	rulespec []string
+}
+
+// synproxyRules returns the SYNPROXY rule set for the configuration, with
+// the defaults of the handle's family, in the order the rules must be
+// evaluated.
+func (ipt *IPTables) synproxyRules(cfg SynproxyConfig) ([]synproxyRule, error) {
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", cfg.Port)
+	}
+	match := []string{"-p", "tcp", "--dport", strconv.Itoa(cfg.Port)}
+	if cfg.Interface != "" {
+		if err := ValidateInterface(cfg.Interface); err != nil {
+			return nil, err
+		}
+		match = append([]string{"-i", cfg.Interface}, match...)
+	}
+	if cfg.MSS == 0 {
+		cfg.MSS = defaultSynproxyMSS
+		if ipt.IsIPv6() {
+			cfg.MSS = defaultSynproxyMSSv6
+		}
+	}
+	if cfg.WScale == 0 {
+		cfg.WScale = defaultSynproxyWScale
+	}
+	target, err := (&Synproxy{MSS: cfg.MSS, WScale: cfg.WScale, SackPerm: true, Timestamp: true}).Args()
+	if err != nil {
+		return nil, err
+	}
+
+	with := func(args ...string) []string {
+		return append(append([]string{}, match...), args...)
+	}
+	return []synproxyRule{
+		// SYN packets skip conntrack so SYNPROXY can answer them
+		{"raw", "PREROUTING", with("--syn", "-j", "CT", "--notrack")},
+		{"filter", "INPUT", with(append([]string{"-m", "conntrack", "--ctstate", "INVALID,UNTRACKED"}, target...)...)},
+		{"filter", "INPUT", with("-m", "conntrack", "--ctstate", "INVALID", "-j", "DROP")},
+	}, nil
+}
+
+// checkSynproxySysctls verifies the kernel settings SYNPROXY depends on. The
+// net.ipv4 TCP settings apply to IPv6 too, so both families check the same.
+func checkSynproxySysctls() error {
+	checks := []struct {
+		name, want, reason string
+	}{
+		{"net.netfilter.nf_conntrack_tcp_loose", "0", "conntrack must not pick up connections from ACK packets"},
+		{"net.ipv4.tcp_syncookies", "1", "SYN cookies must be enabled"},
+		{"net.ipv4.tcp_timestamps", "1", "TCP timestamps must be enabled"},
+	}
+	for _, c := range checks {
+		val, err := readSysctl(c.name)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", c.name, err)
+		}
+		if val != c.want {
+			return fmt.Errorf("%s is %s, must be %s: %s", c.name, val, c.want, c.reason)
+		}
+	}
+	return nil
+}
+
+// EnableSynproxy protects the TCP port against SYN floods by installing the
+// SYNPROXY rule set in the raw and filter tables, in a single
+// iptables-restore transaction. If iface is not empty, only packets entering
+// through it are handled. The filter rules are placed at the top of INPUT,
+// since they have to see the packets before any ACCEPT rule does; calling it
+// again moves them back there.
+// The relevant kernel sysctls are validated before any rule is installed.
+func (ipt *IPTables) EnableSynproxy(port int, iface string) error {
+	return ipt.EnableSynproxyConfig(SynproxyConfig{Port: port, Interface: iface})
+}
+
+// EnableSynproxyConfig acts like EnableSynproxy, with the TCP options
+// SYNPROXY announces set by the configuration.
+func (ipt *IPTables) EnableSynproxyConfig(cfg SynproxyConfig) error {
+	rules, err := ipt.synproxyRules(cfg)
+	if err != nil {
+		return err
+	}
+	if err := checkSynproxySysctls(); err != nil {
+		return err
+	}
+	return ipt.restoreSynproxy(rules, true)
+}
+
+// DisableSynproxy removes the rule set installed by EnableSynproxy with the
+// same port and interface, in a single iptables-restore transaction.
+func (ipt *IPTables) DisableSynproxy(port int, iface string) error {
+	return ipt.DisableSynproxyConfig(SynproxyConfig{Port: port, Interface: iface})
+}
+
+// DisableSynproxyConfig removes the rule set installed by
+// EnableSynproxyConfig with the same configuration.
+func (ipt *IPTables) DisableSynproxyConfig(cfg SynproxyConfig) error {
+	rules, err := ipt.synproxyRules(cfg)
+	if err != nil {
+		return err
+	}
+	return ipt.restoreSynproxy(rules, false)
+}
+
+// restoreSynproxy deletes the rules that exist and, if install is set, adds
+// them all again: the raw rule appended, the filter rules inserted in order
+// at the top of their chain.
+func (ipt *IPTables) restoreSynproxy(rules []synproxyRule, install bool) error {
+	var raw, filter bytes.Buffer
+	pos := 0
+	for _, r := range rules {
+		exists, err := ipt.Exists(r.table, r.chain, r.rulespec...)
+		if err != nil {
+			return err
+		}
+		if exists && install && r.table == "raw" {
+			continue
+		}
+		spec, err := ipt.owned(r.rulespec)
+		if err != nil {
+			return err
+		}
+		buf := &filter
+		if r.table == "raw" {
+			buf = &raw
+		}
+		if exists {
+			buf.WriteString("-D " + r.chain + " " + joinRule(spec) + "\n")
+		}
+		if !install {
+			continue
+		}
+		if r.table == "raw" {
+			buf.WriteString("-A " + r.chain + " " + joinRule(spec) + "\n")
+		} else {
+			pos++
+			buf.WriteString("-I " + r.chain + " " + strconv.Itoa(pos) + " " + joinRule(spec) + "\n")
+		}
+	}
+	var data string
+	if raw.Len() > 0 {
+		data += "*raw\n" + raw.String() + "COMMIT\n"
+	}
+	if filter.Len() > 0 {
+		data += "*filter\n" + filter.String() + "COMMIT\n"
+	}
+	if data == "" {
+		return nil
+	}
+	return ipt.Restore(data, RestoreOptions{NoFlush: true})
+}
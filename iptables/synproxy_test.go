@@ -0,0 +1,94 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSynproxy(t *testing.T) {
+	fakeSysctls(t, map[string]string{
+		"net.netfilter.nf_conntrack_tcp_loose": "0",
+		"net.ipv4.tcp_syncookies":              "1",
+		"net.ipv4.tcp_timestamps":              "1",
+	})
+	ipt, log := newFakeIPTables(t, `case "$*" in
+*"-C PREROUTING"*) exit 0;;
+*-C*) test -e "$(dirname "$0")/installed" || exit 1;;
+esac`)
+	dir := filepath.Dir(ipt.path)
+	input := filepath.Join(dir, "restored")
+	script := "#!/bin/sh\ncat > " + input + "\n"
+	for _, name := range []string{"iptables-restore", "ip6tables-restore"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	ipt.proto = ProtocolIPv4
+
+	// the raw rule exists already and is kept
+	if err := ipt.EnableSynproxy(443, "eth0"); err != nil {
+		t.Fatalf("EnableSynproxy failed: %v", err)
+	}
+	data, _ := ioutil.ReadFile(input)
+	expected := "*filter\n" +
+		"-I INPUT 1 -i eth0 -p tcp --dport 443 -m conntrack --ctstate INVALID,UNTRACKED -j SYNPROXY --sack-perm --timestamp --wscale 7 --mss 1460\n" +
+		"-I INPUT 2 -i eth0 -p tcp --dport 443 -m conntrack --ctstate INVALID -j DROP\n" +
+		"COMMIT\n"
+	if string(data) != expected {
+		t.Fatalf("restored %q, want %q", data, expected)
+	}
+	if calls := fakeCalls(t, log); len(calls) != 3 {
+		t.Fatalf("expected 3 checks, got %q", calls)
+	}
+
+	// IPv6 defaults to a smaller MSS, and installed rules are moved back
+	// to the top
+	if err := ioutil.WriteFile(filepath.Join(dir, "installed"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ipt.proto = ProtocolIPv6
+	if err := ipt.EnableSynproxyConfig(SynproxyConfig{Port: 443, WScale: 9}); err != nil {
+		t.Fatalf("EnableSynproxyConfig failed: %v", err)
+	}
+	data, _ = ioutil.ReadFile(input)
+	rule := "-p tcp --dport 443 -m conntrack --ctstate INVALID,UNTRACKED -j SYNPROXY --sack-perm --timestamp --wscale 9 --mss 1440"
+	drop := "-p tcp --dport 443 -m conntrack --ctstate INVALID -j DROP"
+	expected = "*filter\n-D INPUT " + rule + "\n-I INPUT 1 " + rule + "\n-D INPUT " + drop + "\n-I INPUT 2 " + drop + "\nCOMMIT\n"
+	if string(data) != expected {
+		t.Fatalf("restored %q, want %q", data, expected)
+	}
+
+	if err := ipt.DisableSynproxyConfig(SynproxyConfig{Port: 443, WScale: 9}); err != nil {
+		t.Fatalf("DisableSynproxyConfig failed: %v", err)
+	}
+	data, _ = ioutil.ReadFile(input)
+	expected = "*raw\n-D PREROUTING -p tcp --dport 443 --syn -j CT --notrack\nCOMMIT\n" +
+		"*filter\n-D INPUT " + rule + "\n-D INPUT " + drop + "\nCOMMIT\n"
+	if string(data) != expected {
+		t.Fatalf("restored %q, want %q", data, expected)
+	}
+
+	if err := ipt.EnableSynproxy(70000, ""); err == nil {
+		t.Fatal("EnableSynproxy accepted an invalid port")
+	}
+}
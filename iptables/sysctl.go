@@ -0,0 +1,209 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sysctlBase is where the kernel exposes sysctls. It is a variable so tests can
+// point it at a temporary directory.
+var sysctlBase = "/proc/sys"
+
+// Reverse path filtering modes for net.ipv4.conf.<iface>.rp_filter.
+const (
+	RPFilterOff    = 0
+	RPFilterStrict = 1
+	RPFilterLoose  = 2
+)
+
+// sysctlPath maps a dotted sysctl name to its /proc/sys path. As with
+// sysctl(8), a "/" in the name stands for a literal dot, so interface names
+// like "eth0.100" can be written as "net.ipv4.conf.eth0/100.rp_filter".
+// Names with empty, "." or ".." components are rejected so they cannot
+// escape sysctlBase.
+func sysctlPath(name string) (string, error) {
+	mapped := strings.Map(func(r rune) rune {
+		switch r {
+		case '.':
+			return '/'
+		case '/':
+			return '.'
+		}
+		return r
+	}, name)
+	for _, seg := range strings.Split(mapped, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", fmt.Errorf("invalid sysctl name %q", name)
+		}
+	}
+	return filepath.Join(sysctlBase, mapped), nil
+}
+
+// readSysctl returns the trimmed value of the given dotted sysctl name,
+// e.g. "net.ipv4.ip_forward".
+func readSysctl(name string) (string, error) {
+	path, err := sysctlPath(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ReadSysctl returns the current value of the dotted sysctl name.
+func ReadSysctl(name string) (string, error) {
+	return readSysctl(name)
+}
+
+// WriteSysctl sets the dotted sysctl name to value.
+func WriteSysctl(name, value string) error {
+	path, err := sysctlPath(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(value); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing %s: %v", name, err)
+	}
+	return f.Close()
+}
+
+// ensureSysctl sets name to want unless it already has that value.
+func ensureSysctl(name, want string) error {
+	val, err := readSysctl(name)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", name, err)
+	}
+	if val == want {
+		return nil
+	}
+	return WriteSysctl(name, want)
+}
+
+// ifaceSysctl returns the per-interface sysctl name, escaping dots in the
+// interface name. The interface must be a valid name without the "+"
+// wildcard; "all" and "default" select the global settings.
+func ifaceSysctl(family, iface, key string) (string, error) {
+	if err := ValidateInterface(iface); err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(iface, "+") {
+		return "", fmt.Errorf("interface name %q: wildcards are not allowed here", iface)
+	}
+	return "net." + family + ".conf." + strings.Replace(iface, ".", "/", -1) + "." + key, nil
+}
+
+// ForwardingEnabled reports whether the kernel forwards packets for the
+// protocol. NAT and FORWARD rules have no effect while it is disabled.
+func ForwardingEnabled(proto Protocol) (bool, error) {
+	name := "net.ipv4.ip_forward"
+	if proto == ProtocolIPv6 {
+		name = "net.ipv6.conf.all.forwarding"
+	}
+	val, err := readSysctl(name)
+	if err != nil {
+		return false, err
+	}
+	return val == "1", nil
+}
+
+// EnsureForwardingEnabled turns on IPv4 packet forwarding, which NAT rules
+// silently depend on. It is a no-op if forwarding is already enabled.
+func EnsureForwardingEnabled() error {
+	return ensureSysctl("net.ipv4.ip_forward", "1")
+}
+
+// EnsureIPv6ForwardingEnabled turns on IPv6 packet forwarding on all
+// interfaces.
+func EnsureIPv6ForwardingEnabled() error {
+	return ensureSysctl("net.ipv6.conf.all.forwarding", "1")
+}
+
+// bridgeSysctl returns the br_netfilter sysctl for the protocol.
+func bridgeSysctl(proto Protocol) string {
+	if proto == ProtocolIPv6 {
+		return "net.bridge.bridge-nf-call-ip6tables"
+	}
+	return "net.bridge.bridge-nf-call-iptables"
+}
+
+// BridgeNetfilterEnabled reports whether bridged traffic traverses the
+// iptables chains of the protocol. The sysctl only exists once the
+// br_netfilter module is loaded; a missing module reports false.
+func BridgeNetfilterEnabled(proto Protocol) (bool, error) {
+	val, err := readSysctl(bridgeSysctl(proto))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return val == "1", nil
+}
+
+// EnsureBridgeNetfilter makes bridged traffic traverse the iptables chains of
+// the protocol. It fails if the br_netfilter module is not loaded.
+func EnsureBridgeNetfilter(proto Protocol) error {
+	name := bridgeSysctl(proto)
+	path, err := sysctlPath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return fmt.Errorf("%s not available: is the br_netfilter module loaded?", name)
+	}
+	return ensureSysctl(name, "1")
+}
+
+// ReversePathFilter returns the rp_filter mode of the interface. Use "all"
+// for the global setting; the kernel applies the larger of the two.
+func ReversePathFilter(iface string) (int, error) {
+	name, err := ifaceSysctl("ipv4", iface, "rp_filter")
+	if err != nil {
+		return 0, err
+	}
+	val, err := readSysctl(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(val)
+}
+
+// SetReversePathFilter sets the rp_filter mode of the interface. Strict
+// filtering drops asymmetrically routed packets before any rule sees them,
+// which commonly breaks policy routing and multi-homed NAT.
+func SetReversePathFilter(iface string, mode int) error {
+	if mode < RPFilterOff || mode > RPFilterLoose {
+		return fmt.Errorf("invalid rp_filter mode %d", mode)
+	}
+	name, err := ifaceSysctl("ipv4", iface, "rp_filter")
+	if err != nil {
+		return err
+	}
+	return WriteSysctl(name, strconv.Itoa(mode))
+}
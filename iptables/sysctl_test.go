@@ -0,0 +1,121 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func fakeSysctls(t *testing.T, values map[string]string) {
+	dir, err := ioutil.TempDir("", "sysctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := sysctlBase
+	sysctlBase = dir
+	t.Cleanup(func() {
+		sysctlBase = old
+		os.RemoveAll(dir)
+	})
+	for name, val := range values {
+		path, err := sysctlPath(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(val+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSysctlPath(t *testing.T) {
+	got, err := sysctlPath("net.ipv4.conf.eth0/100.rp_filter")
+	want := filepath.Join(sysctlBase, "net/ipv4/conf/eth0.100/rp_filter")
+	if err != nil || got != want {
+		t.Errorf("got %q, %v; want %q", got, err, want)
+	}
+}
+
+func TestSysctlPathInvalid(t *testing.T) {
+	for _, name := range []string{
+		"net.ipv4.conf./.rp_filter",
+		"net.ipv4.conf.//.rp_filter",
+		"net..ipv4",
+		".net.ipv4",
+		"net.ipv4.",
+		"",
+	} {
+		if path, err := sysctlPath(name); err == nil {
+			t.Errorf("sysctlPath(%q) = %q, want error", name, path)
+		}
+		if err := WriteSysctl(name, "1"); err == nil {
+			t.Errorf("WriteSysctl(%q) succeeded, want error", name)
+		}
+	}
+}
+
+func TestEnsureForwardingEnabled(t *testing.T) {
+	fakeSysctls(t, map[string]string{"net.ipv4.ip_forward": "0"})
+
+	if on, err := ForwardingEnabled(ProtocolIPv4); err != nil || on {
+		t.Fatalf("ForwardingEnabled = %v, %v; want false", on, err)
+	}
+	if err := EnsureForwardingEnabled(); err != nil {
+		t.Fatal(err)
+	}
+	if on, err := ForwardingEnabled(ProtocolIPv4); err != nil || !on {
+		t.Fatalf("ForwardingEnabled = %v, %v; want true", on, err)
+	}
+}
+
+func TestBridgeNetfilter(t *testing.T) {
+	fakeSysctls(t, nil)
+
+	if on, err := BridgeNetfilterEnabled(ProtocolIPv4); err != nil || on {
+		t.Fatalf("BridgeNetfilterEnabled = %v, %v; want false, nil", on, err)
+	}
+	if err := EnsureBridgeNetfilter(ProtocolIPv4); err == nil {
+		t.Fatal("expected error without br_netfilter")
+	}
+}
+
+func TestReversePathFilter(t *testing.T) {
+	fakeSysctls(t, map[string]string{"net.ipv4.conf.eth0/100.rp_filter": "1"})
+
+	if err := SetReversePathFilter("eth0.100", RPFilterLoose); err != nil {
+		t.Fatal(err)
+	}
+	mode, err := ReversePathFilter("eth0.100")
+	if err != nil || mode != RPFilterLoose {
+		t.Fatalf("ReversePathFilter = %d, %v; want %d", mode, err, RPFilterLoose)
+	}
+	if err := SetReversePathFilter("eth0.100", 3); err == nil {
+		t.Fatal("expected error for invalid mode")
+	}
+	for _, iface := range []string{"", ".", "..", "../..", "eth+", "a/b"} {
+		if err := SetReversePathFilter(iface, RPFilterLoose); err == nil {
+			t.Errorf("SetReversePathFilter(%q) succeeded, want error", iface)
+		}
+		if _, err := ReversePathFilter(iface); err == nil {
+			t.Errorf("ReversePathFilter(%q) succeeded, want error", iface)
+		}
+	}
+}
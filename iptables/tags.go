@@ -0,0 +1,115 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RuleTags are key=value annotations stored in the comment of a rule, such
+// as "gen=42,gen-owner=dns-agent", used to recognize the rules a program created.
+type RuleTags map[string]string
+
+// String returns the comment text, with the keys sorted.
+func (t RuleTags) String() string {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + t[k]
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Args returns the comment match carrying the tags, so RuleTags can be used
+// as a Match.
+func (t RuleTags) Args() ([]string, error) {
+	if len(t) == 0 {
+		return nil, fmt.Errorf("no rule tags")
+	}
+	for k, v := range t {
+		if !validTag(k) || (v != "" && !validTag(v)) {
+			return nil, fmt.Errorf("invalid rule tag %s=%s", k, v)
+		}
+	}
+	return []string{"-m", "comment", "--comment", t.String()}, nil
+}
+
+// validTag reports whether s can be used as a tag key or value: it must not
+// contain the separators or anything iptables would need to quote.
+func validTag(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.:/@+", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ParseRuleTags parses a comment written by RuleTags.String. It returns false
+// if the comment is not in that format.
+func ParseRuleTags(comment string) (RuleTags, bool) {
+	if comment == "" {
+		return nil, false
+	}
+	tags := RuleTags{}
+	for _, pair := range strings.Split(comment, ",") {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, false
+		}
+		tags[pair[:i]] = pair[i+1:]
+	}
+	return tags, true
+}
+
+// Tags returns the tags of the rule, merged from all of its comments that
+// are in RuleTags format, or nil if there are none.
+func (r *ParsedRule) Tags() RuleTags {
+	var tags RuleTags
+	for _, comment := range r.Matches["--comment"] {
+		t, ok := ParseRuleTags(comment)
+		if !ok {
+			continue
+		}
+		if tags == nil {
+			tags = RuleTags{}
+		}
+		for k, v := range t {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// tagged returns rulespec with the tags appended as a comment match.
+func tagged(tags RuleTags, rulespec []string) ([]string, error) {
+	args, err := tags.Args()
+	if err != nil {
+		return nil, err
+	}
+	return withMatch(rulespec, args), nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Target is a typed iptables target extension.
+// Args renders the target as rulespec arguments, including the leading "-j <name>".
+type Target interface {
+	Args() ([]string, error)
+}
+
+// NFQueue is the "-j NFQUEUE" target, which hands packets to a userspace program.
+type NFQueue struct {
+	// Num is the queue number; ignored when Balance is set.
+	Num uint16
+	// Balance spreads packets over the queues in [BalanceFirst, BalanceLast].
+	Balance      bool
+	BalanceFirst uint16
+	BalanceLast  uint16
+	// Bypass accepts packets instead of dropping them when no program listens on the queue.
+	Bypass bool
+	// CPUFanout picks the queue by CPU id instead of flow hash; requires Balance.
+	CPUFanout bool
+}
+
+func (q *NFQueue) Args() ([]string, error) {
+	args := []string{"-j", "NFQUEUE"}
+	if q.Balance {
+		if q.BalanceFirst >= q.BalanceLast {
+			return nil, fmt.Errorf("NFQUEUE: invalid queue balance range %d:%d", q.BalanceFirst, q.BalanceLast)
+		}
+		if q.Num != 0 {
+			return nil, fmt.Errorf("NFQUEUE: queue number cannot be combined with queue balance")
+		}
+		args = append(args, "--queue-balance", fmt.Sprintf("%d:%d", q.BalanceFirst, q.BalanceLast))
+	} else {
+		if q.CPUFanout {
+			return nil, fmt.Errorf("NFQUEUE: cpu fanout requires queue balance")
+		}
+		args = append(args, "--queue-num", strconv.Itoa(int(q.Num)))
+	}
+	if q.Bypass {
+		args = append(args, "--queue-bypass")
+	}
+	if q.CPUFanout {
+		args = append(args, "--queue-cpu-fanout")
+	}
+	return args, nil
+}
+
+// Synproxy is the "-j SYNPROXY" target, which answers SYNs on behalf of the
+// server and only passes on connections that complete the handshake.
+// The options must match the TCP options of the protected server.
+type Synproxy struct {
+	MSS       uint16
+	WScale    uint8
+	SackPerm  bool
+	Timestamp bool
+}
+
+func (s *Synproxy) Args() ([]string, error) {
+	if s.WScale > 14 {
+		return nil, fmt.Errorf("SYNPROXY: window scale %d out of range 0-14", s.WScale)
+	}
+	args := []string{"-j", "SYNPROXY"}
+	if s.SackPerm {
+		args = append(args, "--sack-perm")
+	}
+	if s.Timestamp {
+		args = append(args, "--timestamp")
+	}
+	if s.WScale > 0 {
+		args = append(args, "--wscale", strconv.Itoa(int(s.WScale)))
+	}
+	if s.MSS > 0 {
+		args = append(args, "--mss", strconv.Itoa(int(s.MSS)))
+	}
+	return args, nil
+}
+
+// Reject is the "-j REJECT" target, which drops packets and answers them with
+// an ICMP error or a TCP reset. With names the answer; empty uses iptables'
+// default, port unreachable. The ICMP answers are specific to a family, and
+// a TCP reset requires the rule to match "-p tcp", which Rule checks.
+type Reject struct {
+	With RejectWith
+}
+
+// RejectWith is the answer of the REJECT target to the packets it rejects.
+type RejectWith string
+
+const (
+	RejectICMPNetUnreachable   RejectWith = "icmp-net-unreachable"
+	RejectICMPHostUnreachable  RejectWith = "icmp-host-unreachable"
+	RejectICMPPortUnreachable  RejectWith = "icmp-port-unreachable"
+	RejectICMPProtoUnreachable RejectWith = "icmp-proto-unreachable"
+	RejectICMPNetProhibited    RejectWith = "icmp-net-prohibited"
+	RejectICMPHostProhibited   RejectWith = "icmp-host-prohibited"
+	RejectICMPAdminProhibited  RejectWith = "icmp-admin-prohibited"
+
+	RejectICMP6NoRoute         RejectWith = "icmp6-no-route"
+	RejectICMP6AdmProhibited   RejectWith = "icmp6-adm-prohibited"
+	RejectICMP6AddrUnreachable RejectWith = "icmp6-addr-unreachable"
+	RejectICMP6PortUnreachable RejectWith = "icmp6-port-unreachable"
+	RejectICMP6PolicyFail      RejectWith = "icmp6-policy-fail"
+	RejectICMP6RejectRoute     RejectWith = "icmp6-reject-route"
+
+	// RejectTCPReset answers with a TCP RST, in both families.
+	RejectTCPReset RejectWith = "tcp-reset"
+)
+
+// rejectWithFamily pairs the ICMP answers of REJECT with their counterparts
+// of the other family.
+var rejectWithFamily = map[RejectWith]RejectWith{
+	RejectICMPNetUnreachable:   RejectICMP6NoRoute,
+	RejectICMPHostUnreachable:  RejectICMP6AddrUnreachable,
+	RejectICMPPortUnreachable:  RejectICMP6PortUnreachable,
+	RejectICMPAdminProhibited:  RejectICMP6AdmProhibited,
+	RejectICMPNetProhibited:    RejectICMP6AdmProhibited,
+	RejectICMPHostProhibited:   RejectICMP6AdmProhibited,
+	RejectICMP6NoRoute:         RejectICMPNetUnreachable,
+	RejectICMP6AddrUnreachable: RejectICMPHostUnreachable,
+	RejectICMP6PortUnreachable: RejectICMPPortUnreachable,
+	RejectICMP6AdmProhibited:   RejectICMPAdminProhibited,
+}
+
+// validFor reports whether the answer can be given by REJECT in a rule of
+// proto's family.
+func (w RejectWith) validFor(proto Protocol) bool {
+	switch w {
+	case "", RejectTCPReset:
+		return true
+	case RejectICMPNetUnreachable, RejectICMPHostUnreachable, RejectICMPPortUnreachable,
+		RejectICMPProtoUnreachable, RejectICMPNetProhibited, RejectICMPHostProhibited,
+		RejectICMPAdminProhibited:
+		return proto == ProtocolIPv4
+	case RejectICMP6NoRoute, RejectICMP6AdmProhibited, RejectICMP6AddrUnreachable,
+		RejectICMP6PortUnreachable, RejectICMP6PolicyFail, RejectICMP6RejectRoute:
+		return proto == ProtocolIPv6
+	}
+	return false
+}
+
+// Args renders the target as is. With must be one of the RejectWith values
+// of either family.
+func (r *Reject) Args() ([]string, error) {
+	if !r.With.validFor(ProtocolIPv4) && !r.With.validFor(ProtocolIPv6) {
+		return nil, fmt.Errorf("REJECT: unknown answer %q", r.With)
+	}
+	args := []string{"-j", "REJECT"}
+	if r.With != "" {
+		args = append(args, "--reject-with", string(r.With))
+	}
+	return args, nil
+}
+
+// ArgsFor renders the target with With translated to the ICMP answer of
+// proto's family, e.g. "icmp-port-unreachable" to "icmp6-port-unreachable".
+// Answers without a counterpart, e.g. "icmp-proto-unreachable", fail for
+// the other family.
+func (r *Reject) ArgsFor(proto Protocol) ([]string, error) {
+	with := r.With
+	if other, ok := rejectWithFamily[with]; ok && !with.validFor(proto) {
+		with = other
+	}
+	known := with.validFor(ProtocolIPv4) || with.validFor(ProtocolIPv6)
+	if known && !with.validFor(proto) {
+		family := "IPv4"
+		if proto == ProtocolIPv6 {
+			family = "IPv6"
+		}
+		return nil, fmt.Errorf("%w: REJECT answer %s has no %s counterpart", ErrWrongFamily, with, family)
+	}
+	return (&Reject{With: with}).Args()
+}
+
+// TCPMSS is the "-j TCPMSS" target, which rewrites the MSS option of TCP SYN
+// packets, typically to work around path MTU discovery blackholes on links
+// with a reduced MTU such as PPPoE or tunnels. It requires the rule to match
+// "-p tcp" and SYN packets, e.g. with SYNOnly or
+// TCPFlags{Mask: []TCPFlag{TCPFlagSYN, TCPFlagRST}, Comp: []TCPFlag{TCPFlagSYN}}.
+type TCPMSS struct {
+	// ClampToPMTU sets the MSS to the path MTU minus the IP and TCP headers.
+	ClampToPMTU bool
+	// MSS sets a fixed value instead.
+	MSS uint16
+}
+
+func (t *TCPMSS) Args() ([]string, error) {
+	switch {
+	case t.ClampToPMTU && t.MSS != 0:
+		return nil, fmt.Errorf("TCPMSS: clamp-mss-to-pmtu and set-mss are exclusive")
+	case t.ClampToPMTU:
+		return []string{"-j", "TCPMSS", "--clamp-mss-to-pmtu"}, nil
+	case t.MSS != 0:
+		return []string{"-j", "TCPMSS", "--set-mss", strconv.Itoa(int(t.MSS))}, nil
+	}
+	return nil, fmt.Errorf("TCPMSS: clamp-mss-to-pmtu or set-mss is required")
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNFQueueArgs(t *testing.T) {
+	for _, tt := range []struct {
+		q        NFQueue
+		expected []string
+	}{
+		{
+			NFQueue{},
+			[]string{"-j", "NFQUEUE", "--queue-num", "0"},
+		},
+		{
+			NFQueue{Num: 3, Bypass: true},
+			[]string{"-j", "NFQUEUE", "--queue-num", "3", "--queue-bypass"},
+		},
+		{
+			NFQueue{Balance: true, BalanceFirst: 0, BalanceLast: 3, CPUFanout: true},
+			[]string{"-j", "NFQUEUE", "--queue-balance", "0:3", "--queue-cpu-fanout"},
+		},
+	} {
+		args, err := tt.q.Args()
+		if err != nil {
+			t.Fatalf("Args of %+v failed: %v", tt.q, err)
+		}
+		if !reflect.DeepEqual(args, tt.expected) {
+			t.Fatalf("Args mismatch: \ngot  %#v \nneed %#v", args, tt.expected)
+		}
+	}
+}
+
+func TestNFQueueArgsInvalid(t *testing.T) {
+	for _, q := range []NFQueue{
+		{Balance: true, BalanceFirst: 4, BalanceLast: 4},
+		{Balance: true, BalanceFirst: 5, BalanceLast: 1},
+		{Balance: true, Num: 1, BalanceFirst: 0, BalanceLast: 1},
+		{Num: 1, CPUFanout: true},
+	} {
+		if _, err := q.Args(); err == nil {
+			t.Fatalf("Args of %+v succeeded, expected an error", q)
+		}
+	}
+}
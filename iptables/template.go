@@ -0,0 +1,105 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Expand returns a copy of the ruleset with every name and rule field
+// expanded as a text/template with the given data, typically a
+// map[string]string such as {"WanIface": "eth0", "HomeCIDR": "192.0.2.0/24"}
+// referenced as {{ .WanIface }}. Referencing a missing key is an error, so a
+// ruleset is never applied with an incomplete set of variables.
+func (rs *Ruleset) Expand(data interface{}) (*Ruleset, error) {
+	x := &rulesetExpander{data: data}
+	out := &Ruleset{}
+	for _, t := range rs.Tables {
+		x.where = "table " + t.Name
+		et := RulesetTable{Name: x.expand("name", t.Name), After: x.expandAll("after", t.After)}
+		for _, c := range t.Chains {
+			x.where = fmt.Sprintf("chain %s in table %s", c.Name, t.Name)
+			ec := RulesetChain{
+				Name:   x.expand("name", c.Name),
+				Policy: x.expand("policy", c.Policy),
+			}
+			for i, r := range c.Rules {
+				x.where = fmt.Sprintf("rule %d of chain %s in table %s", i+1, c.Name, t.Name)
+				ec.Rules = append(ec.Rules, RulesetRule{
+					Protocol:        x.expand("protocol", r.Protocol),
+					Source:          x.expand("source", r.Source),
+					Destination:     x.expand("destination", r.Destination),
+					InInterface:     x.expand("in", r.InInterface),
+					OutInterface:    x.expand("out", r.OutInterface),
+					SourcePort:      x.expand("sport", r.SourcePort),
+					DestinationPort: x.expand("dport", r.DestinationPort),
+					State:           x.expandAll("state", r.State),
+					Comment:         x.expand("comment", r.Comment),
+					Matches:         x.expandAll("matches", r.Matches),
+					Jump:            x.expand("jump", r.Jump),
+					Goto:            x.expand("goto", r.Goto),
+					TargetArgs:      x.expandAll("target_args", r.TargetArgs),
+				})
+			}
+			et.Chains = append(et.Chains, ec)
+		}
+		out.Tables = append(out.Tables, et)
+	}
+	if x.err != nil {
+		return nil, x.err
+	}
+	if err := out.Validate(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// rulesetExpander expands fields until the first error, which it keeps.
+type rulesetExpander struct {
+	data  interface{}
+	where string
+	err   error
+}
+
+func (x *rulesetExpander) expand(field, text string) string {
+	if x.err != nil || !strings.Contains(text, "{{") {
+		return text
+	}
+	tmpl, err := template.New(field).Option("missingkey=error").Parse(text)
+	if err != nil {
+		x.err = fmt.Errorf("%s, field %s: %v", x.where, field, err)
+		return ""
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, x.data); err != nil {
+		x.err = fmt.Errorf("%s, field %s: %v", x.where, field, err)
+		return ""
+	}
+	return buf.String()
+}
+
+func (x *rulesetExpander) expandAll(field string, texts []string) []string {
+	if texts == nil {
+		return nil
+	}
+	out := make([]string, len(texts))
+	for i, text := range texts {
+		out[i] = x.expand(field, text)
+	}
+	return out
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testTemplateYAML = `
+tables:
+  - name: nat
+    chains:
+      - name: POSTROUTING
+        rules:
+          - source: {{ .HomeCIDR }}
+            out: {{ .WanIface }}
+            jump: MASQUERADE
+`
+
+func TestRulesetExpand(t *testing.T) {
+	rs, err := LoadRulesetYAML(strings.NewReader(testTemplateYAML))
+	if err != nil {
+		t.Fatalf("LoadRulesetYAML failed: %v", err)
+	}
+
+	expanded, err := rs.Expand(map[string]string{"WanIface": "eth0", "HomeCIDR": "192.168.1.0/24"})
+	if err != nil {
+		t.Fatalf("Expand failed: %v", err)
+	}
+	args, err := expanded.Tables[0].Chains[0].Rules[0].Args()
+	if err != nil {
+		t.Fatalf("Args failed: %v", err)
+	}
+	expected := []string{"-s", "192.168.1.0/24", "-o", "eth0", "-j", "MASQUERADE"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Args mismatch: \ngot  %#v \nneed %#v", args, expected)
+	}
+	if rs.Tables[0].Chains[0].Rules[0].OutInterface != "{{ .WanIface }}" {
+		t.Fatalf("Expand modified the original ruleset")
+	}
+
+	_, err = rs.Expand(map[string]string{"WanIface": "eth0"})
+	if err == nil {
+		t.Fatalf("Expand with a missing key did not fail")
+	}
+	if !strings.Contains(err.Error(), "rule 1 of chain POSTROUTING in table nat, field source") {
+		t.Fatalf("Expand error does not locate the field: %v", err)
+	}
+}
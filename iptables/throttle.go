@@ -0,0 +1,56 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttle paces the commands run by the handle to at most rps per second,
+// so a reconciliation loop cannot monopolize the xtables lock on a busy
+// host. Commands wait their turn in the calling goroutine before taking the
+// lock. A non-positive rps disables pacing.
+func Throttle(rps float64) Option {
+	return func(ipt *IPTables) {
+		if rps <= 0 {
+			ipt.throttle = nil
+			return
+		}
+		ipt.throttle = &throttle{interval: time.Duration(float64(time.Second) / rps)}
+	}
+}
+
+// throttle spaces calls to wait at least interval apart.
+type throttle struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait blocks until the caller's turn and reserves the next one.
+func (t *throttle) wait() {
+	t.mu.Lock()
+	now := time.Now()
+	at := t.next
+	if at.Before(now) {
+		at = now
+	}
+	t.next = at.Add(t.interval)
+	t.mu.Unlock()
+
+	time.Sleep(at.Sub(now))
+}
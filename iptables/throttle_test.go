@@ -0,0 +1,42 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	ipt := &IPTables{}
+	Throttle(100)(ipt)
+	if ipt.throttle == nil || ipt.throttle.interval != 10*time.Millisecond {
+		t.Fatalf("unexpected throttle %+v", ipt.throttle)
+	}
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		ipt.throttle.wait()
+	}
+	// the first call passes immediately, the others wait an interval each
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("5 calls took %v, want at least 40ms", elapsed)
+	}
+
+	Throttle(0)(ipt)
+	if ipt.throttle != nil {
+		t.Errorf("Throttle(0) did not disable pacing")
+	}
+}
@@ -0,0 +1,416 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PacketSpec describes a packet for Trace. Zero fields are unknown, and
+// rules matching on them cannot be evaluated.
+type PacketSpec struct {
+	// Table defaults to "filter".
+	Table string
+	// Chain is the built-in chain where evaluation starts, e.g. "INPUT".
+	Chain           string
+	Protocol        string
+	Source          net.IP
+	Destination     net.IP
+	SourcePort      int
+	DestinationPort int
+	In              string
+	Out             string
+	// State is the conntrack state, e.g. "NEW" or "ESTABLISHED".
+	State string
+	// ICMPType is the ICMP or ICMPv6 type, by name or number, e.g.
+	// "echo-request" or "135".
+	ICMPType string
+}
+
+// TraceStep is a rule a traced packet matched, or could not be evaluated against.
+type TraceStep struct {
+	Chain string
+	// Rule is the 1-based position of the rule in Chain, or 0 for the chain policy.
+	Rule     int
+	RuleSpec string
+	// Target is the target of the rule, or the policy of the chain.
+	Target string
+	// Skipped is set if the rule uses options Trace cannot evaluate; it is
+	// then assumed not to match, and Reason names the options.
+	Skipped bool
+	Reason  string
+}
+
+// maxTraceSteps guards against malformed rulesets.
+const maxTraceSteps = 10000
+
+// Trace simulates the traversal of the packet through the current ruleset and
+// returns the rules it matches, ending with the one that decides its fate.
+// Only the basic address, interface, protocol, port and ICMP type matches
+// are evaluated; rules using other matches are reported as skipped.
+func (ipt *IPTables) Trace(pkt PacketSpec) ([]TraceStep, error) {
+	table := pkt.Table
+	if table == "" {
+		table = "filter"
+	}
+	lines, err := ipt.ExecuteList([]string{"-t", table, "-S"})
+	if err != nil {
+		return nil, err
+	}
+	t, err := parseTableRules(lines)
+	if err != nil {
+		return nil, err
+	}
+	return traceTableRules(t, pkt)
+}
+
+type traceFrame struct {
+	chain string
+	pos   int
+}
+
+func traceTableRules(t *tableRules, pkt PacketSpec) ([]TraceStep, error) {
+	if !t.builtin[pkt.Chain] {
+		return nil, fmt.Errorf("trace must start in a built-in chain, not %q", pkt.Chain)
+	}
+
+	var (
+		steps []TraceStep
+		stack []traceFrame
+		cur   = traceFrame{chain: pkt.Chain}
+	)
+	for n := 0; n < maxTraceSteps; n++ {
+		rules := t.rules[cur.chain]
+		if cur.pos >= len(rules) {
+			// fell off the end of the chain
+			if len(stack) > 0 {
+				cur, stack = stack[len(stack)-1], stack[:len(stack)-1]
+				continue
+			}
+			policy := t.policies[pkt.Chain]
+			return append(steps, TraceStep{Chain: pkt.Chain, Target: policy}), nil
+		}
+
+		r := rules[cur.pos]
+		cur.pos++
+		matched, unknown := evalRule(r, pkt)
+		if len(unknown) > 0 {
+			steps = append(steps, TraceStep{
+				Chain:    cur.chain,
+				Rule:     cur.pos,
+				RuleSpec: r.Spec,
+				Target:   r.Target,
+				Skipped:  true,
+				Reason:   "cannot evaluate " + strings.Join(unknown, ", "),
+			})
+			continue
+		}
+		if !matched {
+			continue
+		}
+		steps = append(steps, TraceStep{Chain: cur.chain, Rule: cur.pos, RuleSpec: r.Spec, Target: r.Target})
+
+		switch {
+		case r.Target == "RETURN":
+			if len(stack) == 0 {
+				policy := t.policies[pkt.Chain]
+				return append(steps, TraceStep{Chain: pkt.Chain, Target: policy}), nil
+			}
+			cur, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		case terminalTargets[r.Target]:
+			return steps, nil
+		case containsString(t.chains, r.Target):
+			if !r.Goto {
+				stack = append(stack, cur)
+			}
+			cur = traceFrame{chain: r.Target}
+		}
+		// any other target, e.g. LOG or MARK, continues with the next rule
+	}
+	return nil, fmt.Errorf("trace exceeded %d steps", maxTraceSteps)
+}
+
+// evalRule evaluates the clauses of the rule against the packet. It returns
+// whether all clauses match and the options that could not be evaluated.
+func evalRule(r *ParsedRule, pkt PacketSpec) (bool, []string) {
+	matched := true
+	var unknown []string
+	for _, c := range r.clauses {
+		ok, known := evalClause(c, pkt)
+		switch {
+		case !known:
+			unknown = append(unknown, c.option)
+		case ok == c.negated:
+			matched = false
+		}
+	}
+	return matched, unknown
+}
+
+// evalClause evaluates a single clause, ignoring its negation.
+func evalClause(c ruleClause, pkt PacketSpec) (matched bool, known bool) {
+	value := ""
+	if len(c.values) > 0 {
+		value = c.values[0]
+	}
+	switch c.option {
+	case "-m", "--match", "--comment":
+		return true, true
+	case "-s", "--source":
+		return matchAddress(value, pkt.Source)
+	case "-d", "--destination":
+		return matchAddress(value, pkt.Destination)
+	case "-i", "--in-interface":
+		return matchInterface(value, pkt.In)
+	case "-o", "--out-interface":
+		return matchInterface(value, pkt.Out)
+	case "-p", "--protocol":
+		if value == "all" || value == "0" {
+			return true, true
+		}
+		if pkt.Protocol == "" {
+			return false, false
+		}
+		return normalizeProtocol(value) == normalizeProtocol(pkt.Protocol), true
+	case "--sport", "--source-port":
+		return matchPorts(value, pkt.SourcePort)
+	case "--dport", "--destination-port":
+		return matchPorts(value, pkt.DestinationPort)
+	case "--sports", "--source-ports":
+		return matchPorts(value, pkt.SourcePort)
+	case "--dports", "--destination-ports":
+		return matchPorts(value, pkt.DestinationPort)
+	case "--ctstate", "--state":
+		if pkt.State == "" {
+			return false, false
+		}
+		return containsString(strings.Split(value, ","), strings.ToUpper(pkt.State)), true
+	case "--icmp-type", "--icmpv6-type":
+		if pkt.ICMPType == "" {
+			return false, false
+		}
+		v6 := c.option == "--icmpv6-type"
+		return value == "any" || icmpTypeNumber(value, v6) == icmpTypeNumber(pkt.ICMPType, v6), true
+	case "--ports":
+		if m, known := matchPorts(value, pkt.SourcePort); known && m {
+			return true, true
+		}
+		return matchPorts(value, pkt.DestinationPort)
+	}
+	return false, false
+}
+
+func matchAddress(value string, ip net.IP) (bool, bool) {
+	if ip == nil {
+		return false, false
+	}
+	if !strings.Contains(value, "/") {
+		other := net.ParseIP(value)
+		return other != nil && other.Equal(ip), other != nil
+	}
+	_, n, err := net.ParseCIDR(value)
+	if err != nil {
+		return false, false
+	}
+	return n.Contains(ip), true
+}
+
+func matchInterface(value, iface string) (bool, bool) {
+	if iface == "" {
+		return false, false
+	}
+	if strings.HasSuffix(value, "+") {
+		return strings.HasPrefix(iface, strings.TrimSuffix(value, "+")), true
+	}
+	return value == iface, true
+}
+
+// matchPorts matches a port against a comma separated list of ports and
+// "first:last" ranges.
+func matchPorts(value string, port int) (bool, bool) {
+	if port == 0 {
+		return false, false
+	}
+	for _, p := range strings.Split(value, ",") {
+		first, last := p, p
+		if i := strings.Index(p, ":"); i >= 0 {
+			first, last = p[:i], p[i+1:]
+		}
+		lo, err := strconv.Atoi(first)
+		if err != nil {
+			return false, false
+		}
+		hi, err := strconv.Atoi(last)
+		if err != nil {
+			return false, false
+		}
+		if port >= lo && port <= hi {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+var protocolNumbers = map[string]string{
+	"1":      "icmp",
+	"6":      "tcp",
+	"17":     "udp",
+	"58":     "ipv6-icmp",
+	"132":    "sctp",
+	"icmpv6": "ipv6-icmp",
+}
+
+func normalizeProtocol(p string) string {
+	p = strings.ToLower(p)
+	if name, ok := protocolNumbers[p]; ok {
+		return name
+	}
+	return p
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// traceChains are the raw table chains that see all packets before conntrack.
+var traceChains = []string{"PREROUTING", "OUTPUT"}
+
+// EnableTrace marks packets matching the rulespec for kernel tracing by
+// inserting TRACE rules at the top of the raw PREROUTING and OUTPUT chains.
+// The kernel then logs every rule the packets hit; see ParseTraceLine.
+// The rulespec must not be empty, since tracing all packets floods the log.
+func (ipt *IPTables) EnableTrace(rulespec ...string) error {
+	if len(rulespec) == 0 {
+		return fmt.Errorf("refusing to trace all packets, rulespec is empty")
+	}
+	rule := append(append([]string{}, rulespec...), "-j", "TRACE")
+	for _, chain := range traceChains {
+		exists, err := ipt.Exists("raw", chain, rule...)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := ipt.Insert("raw", chain, 1, rule...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DisableTrace removes the TRACE rules installed by EnableTrace for the rulespec.
+func (ipt *IPTables) DisableTrace(rulespec ...string) error {
+	rule := append(append([]string{}, rulespec...), "-j", "TRACE")
+	for _, chain := range traceChains {
+		exists, err := ipt.Exists("raw", chain, rule...)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := ipt.Delete("raw", chain, rule...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EnableTraceFor acts like EnableTrace, but removes the TRACE rules again
+// after the timeout. The returned function removes them right away; it is
+// safe to call more than once and after the timeout expired.
+func (ipt *IPTables) EnableTraceFor(timeout time.Duration, rulespec ...string) (func() error, error) {
+	if err := ipt.EnableTrace(rulespec...); err != nil {
+		return nil, err
+	}
+
+	var (
+		once sync.Once
+		err  error
+	)
+	disable := func() error {
+		once.Do(func() {
+			err = ipt.DisableTrace(rulespec...)
+		})
+		return err
+	}
+	timer := time.AfterFunc(timeout, func() { disable() })
+	return func() error {
+		timer.Stop()
+		return disable()
+	}, nil
+}
+
+// TraceEvent is a kernel log line produced by the TRACE target.
+type TraceEvent struct {
+	Table string
+	Chain string
+	// Type is "rule" if a rule matched, "return" if the packet fell off the
+	// end of a user-defined chain, or "policy" if the chain policy applied.
+	Type string
+	// Rule is the 1-based position of the rule for the "rule" type.
+	Rule int
+	// Fields holds the packet fields logged by the kernel, e.g. "SRC", "DPT"
+	// or "PROTO". Flags such as "SYN" have an empty value.
+	Fields map[string]string
+}
+
+// ParseTraceLine parses a kernel log line written by the TRACE target, e.g.
+// "TRACE: filter:INPUT:rule:3 IN=eth0 OUT= SRC=192.0.2.1 ... PROTO=TCP SPT=51234 DPT=22 SYN".
+// Anything preceding "TRACE:", such as a syslog or dmesg prefix, is ignored.
+func ParseTraceLine(line string) (*TraceEvent, error) {
+	i := strings.Index(line, "TRACE: ")
+	if i < 0 {
+		return nil, fmt.Errorf("not a TRACE log line: %s", line)
+	}
+	fields := strings.Fields(line[i+len("TRACE: "):])
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty TRACE log line: %s", line)
+	}
+
+	parts := strings.Split(fields[0], ":")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("malformed TRACE position %q", fields[0])
+	}
+	rule, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("malformed TRACE rule number %q", parts[3])
+	}
+
+	ev := &TraceEvent{
+		Table:  parts[0],
+		Chain:  parts[1],
+		Type:   parts[2],
+		Rule:   rule,
+		Fields: make(map[string]string),
+	}
+	for _, f := range fields[1:] {
+		if j := strings.Index(f, "="); j >= 0 {
+			ev.Fields[f[:j]] = f[j+1:]
+		} else {
+			ev.Fields[f] = ""
+		}
+	}
+	return ev, nil
+}
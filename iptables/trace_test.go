@@ -0,0 +1,96 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	lines := []string{
+		"-P INPUT DROP",
+		"-N SERVICES",
+		"-A INPUT -i lo -j ACCEPT",
+		"-A INPUT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"-A INPUT -p tcp -j LOG",
+		"-A INPUT -j SERVICES",
+		"-A SERVICES -s 192.0.2.0/24 -p tcp -m multiport --dports 22,8000:8080 -j ACCEPT",
+		"-A SERVICES ! -s 192.0.2.0/24 -j RETURN",
+	}
+	tr, err := parseTableRules(lines)
+	if err != nil {
+		t.Fatalf("parseTableRules failed: %v", err)
+	}
+
+	type step struct {
+		chain   string
+		rule    int
+		target  string
+		skipped bool
+	}
+	for _, tt := range []struct {
+		pkt      PacketSpec
+		expected []step
+	}{
+		{
+			PacketSpec{Chain: "INPUT", Protocol: "tcp", In: "eth0", Source: net.ParseIP("192.0.2.7"), DestinationPort: 8022},
+			[]step{{"INPUT", 2, "ACCEPT", true}, {"INPUT", 3, "LOG", false}, {"INPUT", 4, "SERVICES", false}, {"SERVICES", 1, "ACCEPT", false}},
+		},
+		{
+			PacketSpec{Chain: "INPUT", Protocol: "udp", In: "eth0", Source: net.ParseIP("198.51.100.1"), DestinationPort: 53},
+			[]step{{"INPUT", 2, "ACCEPT", true}, {"INPUT", 4, "SERVICES", false}, {"SERVICES", 2, "RETURN", false}, {"INPUT", 0, "DROP", false}},
+		},
+		{
+			PacketSpec{Chain: "INPUT", In: "lo"},
+			[]step{{"INPUT", 1, "ACCEPT", false}},
+		},
+	} {
+		steps, err := traceTableRules(tr, tt.pkt)
+		if err != nil {
+			t.Fatalf("trace failed: %v", err)
+		}
+		var got []step
+		for _, s := range steps {
+			got = append(got, step{s.Chain, s.Rule, s.Target, s.Skipped})
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("trace of %+v mismatch: \ngot  %#v \nneed %#v", tt.pkt, got, tt.expected)
+		}
+	}
+}
+
+func TestParseTraceLine(t *testing.T) {
+	line := "[ 1234.567890] TRACE: filter:INPUT:rule:3 IN=eth0 OUT= MAC=00:11 SRC=192.0.2.1 DST=192.0.2.2 LEN=60 PROTO=TCP SPT=51234 DPT=22 SYN URGP=0"
+	ev, err := ParseTraceLine(line)
+	if err != nil {
+		t.Fatalf("ParseTraceLine failed: %v", err)
+	}
+	if ev.Table != "filter" || ev.Chain != "INPUT" || ev.Type != "rule" || ev.Rule != 3 {
+		t.Fatalf("ParseTraceLine position mismatch: %+v", ev)
+	}
+	for k, v := range map[string]string{"IN": "eth0", "OUT": "", "SRC": "192.0.2.1", "DPT": "22", "SYN": ""} {
+		if got, ok := ev.Fields[k]; !ok || got != v {
+			t.Errorf("ParseTraceLine field %s: got %q, need %q", k, got, v)
+		}
+	}
+
+	for _, bad := range []string{"kernel: nothing to see", "TRACE: filter:INPUT:rule", "TRACE: filter:INPUT:rule:x IN=lo"} {
+		if _, err := ParseTraceLine(bad); err == nil {
+			t.Errorf("ParseTraceLine of %q did not fail", bad)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// expiresTag is the RuleTags key holding the Unix time a rule added by
+// AppendWithTTL expires at.
+const expiresTag = "expires"
+
+// AppendWithTTL appends rulespec to specified table/chain, tagged with the
+// comment "expires=<unix time>", for temporary rules such as time-boxed
+// debugging access. The rule is deleted by ExpireRules, or RunRuleExpiry in
+// the background, once ttl has passed. As the expiry lives in the kernel,
+// it survives restarts of the program.
+func (ipt *IPTables) AppendWithTTL(table, chain string, ttl time.Duration, rulespec ...string) error {
+	return ipt.appendWithTTL(time.Now(), table, chain, ttl, rulespec)
+}
+
+func (ipt *IPTables) appendWithTTL(now time.Time, table, chain string, ttl time.Duration, rulespec []string) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %v", ttl)
+	}
+	// round up, so the rule lives at least ttl
+	expires := now.Add(ttl + time.Second - 1).Unix()
+	spec, err := tagged(RuleTags{expiresTag: strconv.FormatInt(expires, 10)}, rulespec)
+	if err != nil {
+		return err
+	}
+	return ipt.Append(table, chain, spec...)
+}
+
+// RuleExpires returns when the rule expires, if it was added by
+// AppendWithTTL.
+func RuleExpires(r *ParsedRule) (time.Time, bool) {
+	v, ok := r.Tags()[expiresTag]
+	if !ok {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+// ExpireRules deletes the rules added by AppendWithTTL that have expired in
+// the given tables, by default filter, nat, mangle and raw, with one
+// iptables-restore transaction per table, and returns the number of rules
+// deleted.
+func (ipt *IPTables) ExpireRules(tables ...string) (int, error) {
+	return ipt.expireRules(time.Now(), tables)
+}
+
+func (ipt *IPTables) expireRules(now time.Time, tables []string) (int, error) {
+	expired := func(r *ParsedRule) bool {
+		expires, ok := RuleExpires(r)
+		return ok && !now.Before(expires)
+	}
+	deleted := 0
+	for _, table := range defaultScopeTables(tables) {
+		current, err := ipt.listTable(table)
+		if err != nil {
+			return deleted, err
+		}
+		data, n := deleteRulesData(table, current, expired)
+		if n == 0 {
+			continue
+		}
+		if err := ipt.Restore(data, RestoreOptions{NoFlush: true}); err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// RunRuleExpiry calls ExpireRules on the given tables every interval until
+// the context is done, reporting errors to onError if it is not nil.
+func (ipt *IPTables) RunRuleExpiry(ctx context.Context, interval time.Duration, onError func(error), tables ...string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := ipt.ExpireRules(tables...); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
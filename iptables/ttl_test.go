@@ -0,0 +1,88 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRuleTTL(t *testing.T) {
+	ipt, log := newFakeIPTables(t, `case "$*" in
+*"-t filter -S"*) printf -- '-P INPUT ACCEPT\n-A INPUT -s 192.0.2.1/32 -p tcp -m tcp --dport 22 -m comment --comment expires=1577836800 -j ACCEPT\n-A INPUT -s 192.0.2.2/32 -m comment --comment expires=1577840400 -j ACCEPT\n-A INPUT -m comment --comment expires=soon -j ACCEPT\n-A INPUT -j LOG\n';;
+esac`)
+	dir := filepath.Dir(ipt.path)
+	input := filepath.Join(dir, "restored")
+	script := "#!/bin/sh\ncat > " + input + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "iptables-restore"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := ipt.appendWithTTL(now, "filter", "INPUT", 90*time.Minute+time.Millisecond, []string{"-s", "192.0.2.3", "-j", "ACCEPT"}); err != nil {
+		t.Fatalf("AppendWithTTL failed: %v", err)
+	}
+	if err := ipt.appendWithTTL(now, "filter", "INPUT", 0, []string{"-j", "ACCEPT"}); err == nil {
+		t.Fatal("AppendWithTTL accepted a zero ttl")
+	}
+
+	n, err := ipt.expireRules(now.Add(-time.Second), []string{"filter"})
+	if err != nil || n != 0 {
+		t.Fatalf("expireRules before any expiry deleted %d rules: %v", n, err)
+	}
+	n, err = ipt.expireRules(now, []string{"filter"})
+	if err != nil || n != 1 {
+		t.Fatalf("expireRules deleted %d rules: %v", n, err)
+	}
+	data, _ := ioutil.ReadFile(input)
+	expected := "*filter\n-D INPUT -s 192.0.2.1/32 -p tcp -m tcp --dport 22 -m comment --comment expires=1577836800 -j ACCEPT\nCOMMIT\n"
+	if string(data) != expected {
+		t.Fatalf("restored %q, want %q", data, expected)
+	}
+
+	expectedCalls := []string{
+		"--wait -t filter -A INPUT -s 192.0.2.3 -m comment --comment expires=1577842201 -j ACCEPT",
+		"--wait -t filter -S",
+		"--wait -t filter -S",
+	}
+	if calls := fakeCalls(t, log); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("calls mismatch: \ngot  %q \nneed %q", calls, expectedCalls)
+	}
+}
+
+func TestRuleExpires(t *testing.T) {
+	r, err := ParseRule("-A INPUT -m comment --comment expires=1577836800,scope=c1 -j ACCEPT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires, ok := RuleExpires(r); !ok || expires.Unix() != 1577836800 {
+		t.Fatalf("RuleExpires returned %v, %v", expires, ok)
+	}
+	r, err = ParseRule("-A INPUT -j ACCEPT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := RuleExpires(r); ok {
+		t.Fatal("RuleExpires found an expiry on an untagged rule")
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// FindingMissingChain is a rule jumping to a chain that exists neither
+	// in the table nor in the ruleset.
+	FindingMissingChain FindingKind = "missing-chain"
+	// FindingUnsetMark is a rule matching a packet or connection mark that
+	// no rule sets.
+	FindingUnsetMark FindingKind = "unset-mark"
+	// FindingMissingSet is a rule referencing an ipset that does not exist.
+	FindingMissingSet FindingKind = "missing-set"
+)
+
+// extensionTargets are the targets that are not chains.
+var extensionTargets = map[string]bool{
+	"ACCEPT": true, "DROP": true, "RETURN": true, "QUEUE": true,
+	"AUDIT": true, "CHECKSUM": true, "CLASSIFY": true, "CLUSTERIP": true,
+	"CONNMARK": true, "CONNSECMARK": true, "CT": true, "DNAT": true,
+	"DNPT": true, "DSCP": true, "ECN": true, "HL": true, "HMARK": true,
+	"IDLETIMER": true, "LED": true, "LOG": true, "MARK": true,
+	"MASQUERADE": true, "NETMAP": true, "NFLOG": true, "NFQUEUE": true,
+	"NOTRACK": true, "RATEEST": true, "REDIRECT": true, "REJECT": true,
+	"SECMARK": true, "SET": true, "SNAT": true, "SNPT": true,
+	"SYNPROXY": true, "TCPMSS": true, "TCPOPTSTRIP": true, "TEE": true,
+	"TOS": true, "TPROXY": true, "TRACE": true, "TTL": true, "ULOG": true,
+}
+
+// ValidateRuleset checks the cross-references of the rules of a ruleset
+// against the tables as they will be once it is applied, and reports them
+// as findings instead of leaving them to fail iptables-restore, or to
+// silently never match:
+//
+//   - jumps and gotos to chains that exist neither in the table nor in the
+//     ruleset (FindingMissingChain)
+//   - matches on packet or connection marks that no rule of the resulting
+//     tables, nor of the current mangle table, sets (FindingUnsetMark)
+//   - ipsets matched, or added to with the SET target, that do not exist,
+//     as listed by "ipset list -n" (FindingMissingSet)
+//
+// Marks set by changing bits or by copying, e.g. CONNMARK --restore-mark,
+// are assumed to possibly set any mark. It returns an error if the ruleset
+// is invalid or a table cannot be listed.
+func (ipt *IPTables) ValidateRuleset(rs *Ruleset) ([]Finding, error) {
+	if err := rs.Validate(); err != nil {
+		return nil, err
+	}
+
+	type declaredRule struct {
+		table, chain string
+		pos          int
+		rule         *ParsedRule
+	}
+	var declared []declaredRule
+	chains := make(map[string]map[string]bool)
+	marks := &markSetters{}
+	hasMangle := false
+	for _, t := range rs.Tables {
+		current, err := ipt.listTable(t.Name)
+		if err != nil {
+			return nil, err
+		}
+		chains[t.Name] = make(map[string]bool)
+		replaced := make(map[string]bool)
+		for _, c := range t.Chains {
+			chains[t.Name][c.Name] = true
+			replaced[c.Name] = true
+			for i := range c.Rules {
+				args, err := c.Rules[i].Args()
+				if err != nil {
+					return nil, err
+				}
+				r, err := simulatedRule(c.Name, args)
+				if err != nil {
+					return nil, err
+				}
+				declared = append(declared, declaredRule{t.Name, c.Name, i + 1, r})
+				marks.add(r)
+			}
+		}
+		for _, c := range current.chains {
+			chains[t.Name][c] = true
+			if replaced[c] {
+				continue
+			}
+			for _, r := range current.rules[c] {
+				marks.add(r)
+			}
+		}
+		hasMangle = hasMangle || t.Name == "mangle"
+	}
+
+	var findings []Finding
+	var sets map[string]bool
+	var setsErr error
+	for _, d := range declared {
+		finding := func(kind FindingKind, format string, args ...interface{}) {
+			findings = append(findings, Finding{
+				Kind:     kind,
+				Table:    d.table,
+				Chain:    d.chain,
+				Rule:     d.pos,
+				RuleSpec: d.rule.Spec,
+				Message:  fmt.Sprintf(format, args...),
+			})
+		}
+
+		if t := d.rule.Target; t != "" && !extensionTargets[t] && !chains[d.table][t] {
+			finding(FindingMissingChain, "chain %s does not exist", t)
+		}
+
+		for _, m := range markMatches(d.rule) {
+			if !hasMangle {
+				// marks are usually set in the mangle table, so check
+				// it even if the ruleset leaves it alone
+				mangle, err := ipt.listTable("mangle")
+				if err != nil {
+					return nil, err
+				}
+				for _, c := range mangle.chains {
+					for _, r := range mangle.rules[c] {
+						marks.add(r)
+					}
+				}
+				hasMangle = true
+			}
+			if !marks.sets(m) {
+				finding(FindingUnsetMark, "no rule sets %s %s", m.option, m.value)
+			}
+		}
+
+		for _, name := range setNames(d.rule) {
+			if sets == nil && setsErr == nil {
+				sets, setsErr = ipsetNames()
+			}
+			switch {
+			case setsErr != nil:
+				finding(FindingMissingSet, "cannot check set %s: %v", name, setsErr)
+			case !sets[name]:
+				finding(FindingMissingSet, "set %s does not exist", name)
+			}
+		}
+	}
+	return findings, nil
+}
+
+// markMatch is a match on a packet mark, or a connection mark if ct is set.
+type markMatch struct {
+	option, value string
+	ct            bool
+}
+
+// markMatches returns the mark matches of the rule that only match marked
+// packets, i.e. not negated and not matching mark 0.
+func markMatches(r *ParsedRule) []markMatch {
+	var matches []markMatch
+	module := ""
+	for _, c := range r.clauses {
+		switch {
+		case c.option == "-m" || c.option == "--match":
+			if len(c.values) == 1 {
+				module = c.values[0]
+			}
+		case (c.option == "--mark" || c.option == "--ctmark") && !c.negated && len(c.values) == 1:
+			v, mask, ok := parseMark(c.values[0])
+			if !ok || v&mask == 0 {
+				continue
+			}
+			ct := c.option == "--ctmark" || module == "connmark"
+			matches = append(matches, markMatch{c.option, c.values[0], ct})
+		}
+	}
+	return matches
+}
+
+// markSetters collects the marks set by rules.
+type markSetters struct {
+	// marks and ctmarks are the values set exactly
+	marks, ctmarks []uint32
+	// anyMark and anyCtmark are set if a rule may set any value
+	anyMark, anyCtmark bool
+}
+
+// add records the marks set by the rule.
+func (s *markSetters) add(r *ParsedRule) {
+	opts := r.TargetOptions
+	for i := 0; i < len(opts); i++ {
+		value := ""
+		if i+1 < len(opts) {
+			value = opts[i+1]
+		}
+		switch r.Target + " " + opts[i] {
+		case "MARK --set-mark", "MARK --set-xmark":
+			if v, _, ok := parseMark(value); ok {
+				s.marks = append(s.marks, v)
+			} else {
+				s.anyMark = true
+			}
+		case "MARK --or-mark", "MARK --xor-mark", "MARK --and-mark", "CONNMARK --restore-mark":
+			s.anyMark = true
+		case "CONNMARK --set-mark", "CONNMARK --set-xmark":
+			if v, _, ok := parseMark(value); ok {
+				s.ctmarks = append(s.ctmarks, v)
+			} else {
+				s.anyCtmark = true
+			}
+		case "CONNMARK --save-mark":
+			s.anyCtmark = true
+		}
+	}
+}
+
+// sets reports whether a recorded rule may set a mark matched by m.
+func (s *markSetters) sets(m markMatch) bool {
+	v, mask, _ := parseMark(m.value)
+	values, any := s.marks, s.anyMark
+	if m.ct {
+		values, any = s.ctmarks, s.anyCtmark
+	}
+	if any {
+		return true
+	}
+	for _, set := range values {
+		if set&mask == v&mask {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMark parses a "value[/mask]" mark.
+func parseMark(s string) (value, mask uint32, ok bool) {
+	mask = 0xffffffff
+	if i := strings.Index(s, "/"); i >= 0 {
+		m, err := strconv.ParseUint(s[i+1:], 0, 32)
+		if err != nil {
+			return 0, 0, false
+		}
+		mask = uint32(m)
+		s = s[:i]
+	}
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	return uint32(v), mask, true
+}
+
+// setNames returns the ipsets the rule references.
+func setNames(r *ParsedRule) []string {
+	var names []string
+	for _, c := range r.clauses {
+		if c.option == "--match-set" && len(c.values) > 0 {
+			names = append(names, c.values[0])
+		}
+	}
+	opts := r.TargetOptions
+	for i := 0; r.Target == "SET" && i+1 < len(opts); i++ {
+		if opts[i] == "--add-set" || opts[i] == "--del-set" {
+			names = append(names, opts[i+1])
+		}
+	}
+	return names
+}
+
+// ipsetNames lists the existing ipsets with "ipset list -n".
+func ipsetNames() (map[string]bool, error) {
+	path, err := exec.LookPath("ipset")
+	if err != nil {
+		return nil, err
+	}
+	out, err := exec.Command(path, "list", "-n").Output()
+	if err != nil {
+		return nil, fmt.Errorf("ipset list: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, name := range strings.Fields(string(out)) {
+		names[name] = true
+	}
+	return names, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateRuleset(t *testing.T) {
+	ipt, _ := newFakeIPTables(t, `case "$*" in
+*"-t filter -S"*) printf -- '-P INPUT ACCEPT\n-N EXISTING\n';;
+*"-t mangle -S"*) printf -- '-P PREROUTING ACCEPT\n-A PREROUTING -i eth1 -j MARK --set-xmark 0x1/0xffffffff\n';;
+esac`)
+	dir := filepath.Dir(ipt.path)
+	if err := ioutil.WriteFile(filepath.Join(dir, "ipset"), []byte("#!/bin/sh\nprintf 'allowed\\nblocked\\n'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	rs := &Ruleset{Tables: []RulesetTable{{
+		Name: "filter",
+		Chains: []RulesetChain{
+			{Name: "INPUT", Rules: []RulesetRule{
+				{Jump: "SVC"},
+				{Jump: "EXISTING"},
+				{Protocol: "tcp", Jump: "MISSING"},
+				{Matches: []string{"-m", "mark", "--mark", "0x1"}, Jump: "ACCEPT"},
+				{Matches: []string{"-m", "mark", "--mark", "0x2/0xff"}, Jump: "ACCEPT"},
+				{Matches: []string{"-m", "mark", "!", "--mark", "0x2"}, Jump: "ACCEPT"},
+				{Matches: []string{"-m", "connmark", "--mark", "0x1"}, Jump: "ACCEPT"},
+				{Matches: []string{"-m", "set", "--match-set", "allowed", "src"}, Jump: "ACCEPT"},
+				{Matches: []string{"-m", "set", "--match-set", "bogus", "src"}, Jump: "DROP"},
+			}},
+			{Name: "SVC", Rules: []RulesetRule{
+				{Jump: "LOG", TargetArgs: []string{"--log-prefix", "svc: "}},
+			}},
+		},
+	}}}
+	findings, err := ipt.ValidateRuleset(rs)
+	if err != nil {
+		t.Fatalf("ValidateRuleset failed: %v", err)
+	}
+	var got []string
+	for _, f := range findings {
+		got = append(got, f.String())
+	}
+	expected := []string{
+		"missing-chain: filter/INPUT rule 3 (-p tcp -j MISSING): chain MISSING does not exist",
+		"unset-mark: filter/INPUT rule 5 (-m mark --mark 0x2/0xff -j ACCEPT): no rule sets --mark 0x2/0xff",
+		"unset-mark: filter/INPUT rule 7 (-m connmark --mark 0x1 -j ACCEPT): no rule sets --mark 0x1",
+		"missing-set: filter/INPUT rule 9 (-m set --match-set bogus src -j DROP): set bogus does not exist",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("findings mismatch: \ngot  %q \nneed %q", got, expected)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import "fmt"
+
+// VersionInfo describes the iptables binary of a handle, as returned by
+// IPTables.VersionInfo, e.g. for telemetry or diagnostics bundles.
+type VersionInfo struct {
+	Major int `json:"major"`
+	Minor int `json:"minor"`
+	Patch int `json:"patch"`
+	// Backend is either "legacy" or "nf_tables".
+	Backend string `json:"backend"`
+	// Path is the path of the iptables or ip6tables binary.
+	Path string `json:"path"`
+	// Embedded is set for embedded builds, e.g. busybox, that report no
+	// version; they are treated as version 0.0.0 without optional features.
+	Embedded bool     `json:"embedded"`
+	Features Features `json:"features"`
+}
+
+// Features are the optional features of an iptables binary, as detected
+// from its version. They describe the binary regardless of the options of
+// the handle, e.g. NoWait.
+type Features struct {
+	// Check is "-C", used by Exists.
+	Check bool `json:"check"`
+	// ListRules is "-S"; without it listings are emulated with "-L".
+	ListRules bool `json:"list_rules"`
+	// Wait is "--wait", WaitTimeout its timeout argument and WaitInterval
+	// "--wait-interval".
+	Wait         bool `json:"wait"`
+	WaitTimeout  bool `json:"wait_timeout"`
+	WaitInterval bool `json:"wait_interval"`
+	// RestoreWait is "--wait" of iptables-restore.
+	RestoreWait bool `json:"restore_wait"`
+}
+
+// String returns the version as "1.8.7".
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// VersionInfo returns the version, backend, path and features of the
+// iptables binary of the handle.
+func (ipt *IPTables) VersionInfo() (VersionInfo, error) {
+	if err := ipt.ready(); err != nil {
+		return VersionInfo{}, err
+	}
+	v1, v2, v3 := ipt.v1, ipt.v2, ipt.v3
+	return VersionInfo{
+		Major:    v1,
+		Minor:    v2,
+		Patch:    v3,
+		Backend:  ipt.mode,
+		Path:     ipt.path,
+		Embedded: v1 == 0 && v2 == 0 && v3 == 0,
+		Features: Features{
+			Check:        iptablesHasCheckCommand(v1, v2, v3),
+			ListRules:    iptablesHasListRulesCommand(v1, v2, v3),
+			Wait:         iptablesHasWaitCommand(v1, v2, v3),
+			WaitTimeout:  iptablesHasWaitTimeout(v1, v2, v3),
+			WaitInterval: iptablesHasWaitInterval(v1, v2, v3),
+			RestoreWait:  iptablesRestoreHasWaitCommand(v1, v2, v3),
+		},
+	}, nil
+}
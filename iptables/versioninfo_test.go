@@ -0,0 +1,59 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVersionInfo(t *testing.T) {
+	ipt := &IPTables{path: "/usr/sbin/iptables", v1: 1, v2: 6, v3: 0, mode: "legacy"}
+	info, err := ipt.VersionInfo()
+	if err != nil {
+		t.Fatalf("VersionInfo failed: %v", err)
+	}
+	expected := VersionInfo{
+		Major: 1, Minor: 6, Patch: 0,
+		Backend: "legacy",
+		Path:    "/usr/sbin/iptables",
+		Features: Features{
+			Check:       true,
+			ListRules:   true,
+			Wait:        true,
+			WaitTimeout: true,
+		},
+	}
+	if info != expected {
+		t.Fatalf("VersionInfo mismatch: \ngot  %+v \nneed %+v", info, expected)
+	}
+	if s := info.String(); s != "1.6.0" {
+		t.Fatalf("String returned %q", s)
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	const want = `{"major":1,"minor":6,"patch":0,"backend":"legacy","path":"/usr/sbin/iptables","embedded":false,"features":{"check":true,"list_rules":true,"wait":true,"wait_timeout":true,"wait_interval":false,"restore_wait":false}}`
+	if string(data) != want {
+		t.Fatalf("JSON mismatch: \ngot  %s \nneed %s", data, want)
+	}
+
+	info, _ = (&IPTables{mode: "legacy"}).VersionInfo()
+	if !info.Embedded || info.Features != (Features{}) {
+		t.Fatalf("VersionInfo of an embedded build returned %+v", info)
+	}
+}
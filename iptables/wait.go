@@ -0,0 +1,79 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"strconv"
+	"time"
+)
+
+// WaitTimeout bounds how long iptables waits for the xtables lock before
+// failing ("--wait <seconds>", rounded up), instead of waiting indefinitely.
+// It is ignored by iptables binaries older than 1.6.0.
+func WaitTimeout(d time.Duration) Option {
+	return func(ipt *IPTables) {
+		ipt.waitTimeout = d
+	}
+}
+
+// WaitInterval sets how often iptables retries taking a busy xtables lock
+// ("--wait-interval <microseconds>"); the default is one second. It is
+// ignored by iptables binaries older than 1.6.1.
+func WaitInterval(d time.Duration) Option {
+	return func(ipt *IPTables) {
+		ipt.waitInterval = d
+	}
+}
+
+// waitArgs returns the flags making iptables wait for the xtables lock, or
+// nil if it cannot and the lock must be taken by the caller.
+func (ipt *IPTables) waitArgs() []string {
+	if !ipt.hasWait {
+		return nil
+	}
+	return ipt.lockFlags(iptablesHasWaitTimeout(ipt.v1, ipt.v2, ipt.v3), iptablesHasWaitInterval(ipt.v1, ipt.v2, ipt.v3))
+}
+
+// restoreWaitArgs returns the flags making iptables-restore wait for the
+// xtables lock, or nil if it cannot.
+func (ipt *IPTables) restoreWaitArgs() []string {
+	if !ipt.hasRestoreWait {
+		return nil
+	}
+	// iptables-restore gained all of them at once
+	return ipt.lockFlags(true, true)
+}
+
+func (ipt *IPTables) lockFlags(timeout, interval bool) []string {
+	args := []string{"--wait"}
+	if timeout && ipt.waitTimeout > 0 {
+		secs := (ipt.waitTimeout + time.Second - 1) / time.Second
+		args = append(args, strconv.FormatInt(int64(secs), 10))
+	}
+	if interval && ipt.waitInterval > 0 {
+		args = append(args, "--wait-interval", strconv.FormatInt(ipt.waitInterval.Microseconds(), 10))
+	}
+	return args
+}
+
+// Checks if an iptables version is after 1.6.0, when --wait took a timeout
+func iptablesHasWaitTimeout(v1 int, v2 int, v3 int) bool {
+	return v1 > 1 || v1 == 1 && v2 >= 6
+}
+
+// Checks if an iptables version is after 1.6.1, when --wait-interval was added
+func iptablesHasWaitInterval(v1 int, v2 int, v3 int) bool {
+	return v1 > 1 || v1 == 1 && v2 > 6 || v1 == 1 && v2 == 6 && v3 >= 1
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNoWait(t *testing.T) {
+	ipt := &IPTables{hasWait: true, hasRestoreWait: true}
+	NoWait()(ipt)
+	if ipt.Wait() || ipt.hasRestoreWait {
+		t.Fatalf("NoWait left --wait enabled")
+	}
+}
+
+func TestWaitArgs(t *testing.T) {
+	for _, tt := range []struct {
+		v1, v2, v3 int
+		restore    bool
+		expected   []string
+	}{
+		{1, 4, 21, false, []string{"--wait"}},
+		{1, 6, 0, false, []string{"--wait", "3"}},
+		{1, 8, 7, false, []string{"--wait", "3", "--wait-interval", "50000"}},
+		{1, 4, 21, true, []string{"--wait", "3", "--wait-interval", "50000"}},
+	} {
+		ipt := &IPTables{hasWait: true, hasRestoreWait: true, v1: tt.v1, v2: tt.v2, v3: tt.v3}
+		WaitTimeout(2500 * time.Millisecond)(ipt)
+		WaitInterval(50 * time.Millisecond)(ipt)
+		got := ipt.waitArgs()
+		if tt.restore {
+			got = ipt.restoreWaitArgs()
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("v%d.%d.%d restore=%v: got %q, want %q", tt.v1, tt.v2, tt.v3, tt.restore, got, tt.expected)
+		}
+	}
+
+	ipt := &IPTables{hasWait: true, v1: 1, v2: 8, v3: 7}
+	if got := ipt.waitArgs(); !reflect.DeepEqual(got, []string{"--wait"}) {
+		t.Errorf("default wait args %q", got)
+	}
+	ipt.hasWait = false
+	if got := ipt.waitArgs(); got != nil {
+		t.Errorf("wait args without --wait support: %q", got)
+	}
+}
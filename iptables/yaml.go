@@ -0,0 +1,405 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// LoadRulesetYAML decodes a Ruleset from YAML and validates it. The schema
+// mirrors the JSON encoding of Ruleset:
+//
+//	tables:
+//	  - name: filter
+//	    chains:
+//	      - name: INPUT
+//	        policy: DROP          # built-in chains only
+//	        rules:
+//	          - in: lo
+//	            jump: ACCEPT
+//	          - state: [ESTABLISHED, RELATED]
+//	            jump: ACCEPT
+//	          - protocol: tcp
+//	            source: 192.0.2.0/24
+//	            dport: 22
+//	            comment: "ssh from the office"
+//	            jump: ACCEPT
+//	          - matches: [-m, limit, --limit, 5/min]
+//	            jump: LOG
+//	            target_args: [--log-prefix, "dropped: "]
+//
+// The rule fields are protocol, source, destination, in, out, sport, dport,
+// state, comment, matches, jump, goto and target_args. Unknown fields are
+// rejected. Only the block style subset of YAML used above is supported, plus
+// flow sequences of scalars; anchors, multi-line scalars and multiple
+// documents are not. Single-quoted scalars escape a quote by doubling it;
+// double-quoted ones support the escapes \", \\, \/, \n and \t. Plain
+// scalars may hold template actions such as {{ .WanIface }}, see
+// Ruleset.Expand.
+func LoadRulesetYAML(r io.Reader) (*Ruleset, error) {
+	tree, err := parseYAML(r)
+	if err != nil {
+		return nil, err
+	}
+	// the JSON decoder provides the field mapping and unknown field checks
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	return LoadRulesetJSON(bytes.NewReader(data))
+}
+
+// yamlLine is a significant line of a YAML document.
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// yamlParser parses the YAML subset used by LoadRulesetYAML into maps,
+// slices and strings.
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func parseYAML(r io.Reader) (interface{}, error) {
+	p := &yamlParser{}
+	scanner := bufio.NewScanner(r)
+	for num := 1; scanner.Scan(); num++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "---") && num == 1 {
+			continue
+		}
+		if strings.Contains(line, "\t") && strings.TrimLeft(line, " \t") != strings.TrimLeft(line, " ") {
+			return nil, fmt.Errorf("yaml: line %d: tabs are not allowed in indentation", num)
+		}
+		text := strings.TrimRight(stripYAMLComment(line), " ")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" {
+			continue
+		}
+		p.lines = append(p.lines, yamlLine{num, len(text) - len(trimmed), trimmed})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	v, err := p.parseBlock(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf(p.lines[p.pos], "unexpected indentation")
+	}
+	return v, nil
+}
+
+func (p *yamlParser) errorf(l yamlLine, format string, args ...interface{}) error {
+	return fmt.Errorf("yaml: line %d: %s", l.num, fmt.Sprintf(format, args...))
+}
+
+// parseBlock parses the sequence or mapping starting at the current line,
+// whose entries are indented by indent.
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	l := p.lines[p.pos]
+	if l.text == "-" || strings.HasPrefix(l.text, "- ") {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	seq := []interface{}{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorf(l, "unexpected indentation")
+		}
+		if l.text != "-" && !strings.HasPrefix(l.text, "- ") {
+			return nil, p.errorf(l, "expected a sequence entry")
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		switch {
+		case rest == "":
+			// the entry is the block on the following lines
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				seq = append(seq, "")
+				continue
+			}
+			v, err := p.parseBlock(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		case isYAMLMappingEntry(rest):
+			// "- key: value" starts a mapping indented like its first key
+			p.lines[p.pos] = yamlLine{l.num, l.indent + len(l.text) - len(rest), rest}
+			v, err := p.parseMapping(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		default:
+			v, err := parseYAMLValue(rest)
+			if err != nil {
+				return nil, p.errorf(l, "%v", err)
+			}
+			seq = append(seq, v)
+			p.pos++
+		}
+	}
+	return seq, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorf(l, "unexpected indentation")
+		}
+		if !isYAMLMappingEntry(l.text) {
+			return nil, p.errorf(l, "expected a mapping entry")
+		}
+		i := yamlKeyEnd(l.text)
+		key, err := parseYAMLScalar(strings.TrimSpace(l.text[:i]))
+		if err != nil {
+			return nil, p.errorf(l, "%v", err)
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf(l, "duplicate key %q", key)
+		}
+		rest := strings.TrimSpace(l.text[i+1:])
+		p.pos++
+		if rest != "" {
+			v, err := parseYAMLValue(rest)
+			if err != nil {
+				return nil, p.errorf(l, "%v", err)
+			}
+			m[key] = v
+			continue
+		}
+
+		// a nested block is indented further, except that sequences may
+		// start at the indentation of their key
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			isSeq := next.text == "-" || strings.HasPrefix(next.text, "- ")
+			if next.indent > indent || (next.indent == indent && isSeq) {
+				v, err := p.parseBlock(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+				continue
+			}
+		}
+		m[key] = ""
+	}
+	return m, nil
+}
+
+// yamlKeyEnd returns the index of the colon ending the key of a mapping
+// entry, or -1 if the text is not one.
+func yamlKeyEnd(text string) int {
+	if text == "" {
+		return -1
+	}
+	start := 0
+	if q := text[0]; q == '"' || q == '\'' {
+		end := yamlQuoteEnd(text)
+		if end < 0 {
+			return -1
+		}
+		start = end + 1
+	}
+	for i := start; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return i
+		}
+	}
+	return -1
+}
+
+// yamlQuoteEnd returns the index of the quote closing the quoted scalar text
+// starts with, or -1 if it is unterminated. Within double quotes, a quote is
+// escaped with a backslash; within single quotes, by doubling it.
+func yamlQuoteEnd(text string) int {
+	q := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case q == '"' && text[i] == '\\':
+			i++
+		case text[i] != q:
+		case q == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		default:
+			return i
+		}
+	}
+	return -1
+}
+
+func isYAMLMappingEntry(text string) bool {
+	return !strings.HasPrefix(text, "[") && yamlKeyEnd(text) > 0
+}
+
+// parseYAMLValue parses an inline value: a scalar or a flow sequence of scalars.
+func parseYAMLValue(text string) (interface{}, error) {
+	if !strings.HasPrefix(text, "[") {
+		return parseYAMLScalar(text)
+	}
+	if !strings.HasSuffix(text, "]") {
+		return nil, fmt.Errorf("unterminated flow sequence")
+	}
+	seq := []interface{}{}
+	inner := strings.TrimSpace(text[1 : len(text)-1])
+	if inner == "" {
+		return seq, nil
+	}
+	for _, item := range splitYAMLFlow(inner) {
+		v, err := parseYAMLScalar(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+	return seq, nil
+}
+
+// splitYAMLFlow splits the items of a flow sequence at commas outside quotes.
+func splitYAMLFlow(text string) []string {
+	var (
+		items []string
+		quote byte
+		start int
+	)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote == '\'' && c == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			// escaped quote
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, text[start:])
+}
+
+// parseYAMLScalar unquotes a scalar. All scalars are returned as strings, as
+// every field of a Ruleset is one.
+func parseYAMLScalar(text string) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	switch text[0] {
+	case '"':
+		if len(text) < 2 || text[len(text)-1] != '"' {
+			return "", fmt.Errorf("unterminated string %s", text)
+		}
+		var b strings.Builder
+		s := text[1 : len(text)-1]
+		for i := 0; i < len(s); i++ {
+			if s[i] != '\\' {
+				b.WriteByte(s[i])
+				continue
+			}
+			i++
+			if i == len(s) {
+				return "", fmt.Errorf("invalid escape in %s", text)
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\', '/':
+				b.WriteByte(s[i])
+			default:
+				return "", fmt.Errorf("unsupported escape \\%c in %s", s[i], text)
+			}
+		}
+		return b.String(), nil
+	case '\'':
+		if len(text) < 2 || text[len(text)-1] != '\'' {
+			return "", fmt.Errorf("unterminated string %s", text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	case '{':
+		// template actions are kept for Ruleset.Expand
+		if !strings.HasPrefix(text, "{{") {
+			return "", fmt.Errorf("unsupported YAML syntax %s", text)
+		}
+	case '&', '*', '|', '>', '!', '%', '@', '`':
+		return "", fmt.Errorf("unsupported YAML syntax %s", text)
+	}
+	if text == "~" || text == "null" {
+		return "", nil
+	}
+	return text, nil
+}
+
+// stripYAMLComment removes a trailing comment, i.e. a '#' at the start of the
+// line or after a space, outside quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote == '\'' && c == '\'' && i+1 < len(line) && line[i+1] == '\'':
+			// escaped quote
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			// quotes only start a scalar at its beginning
+			if i == 0 || strings.ContainsRune(" [,:-", rune(line[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || line[i-1] == ' '):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testRulesetYAML = `
+# host firewall
+tables:
+  - name: filter
+    chains:
+      - name: INPUT
+        policy: DROP          # built-in chains only
+        rules:
+          - in: lo
+            jump: ACCEPT
+          - state: [ESTABLISHED, RELATED]
+            jump: ACCEPT
+          - protocol: tcp
+            dport: 22
+            comment: "ssh access"
+            jump: SSH
+      - name: SSH
+        rules:
+        - source: 192.0.2.0/24
+          jump: ACCEPT
+      - name: LOGGING
+        rules:
+          - matches: [-m, limit, --limit, 5/min]
+            jump: LOG
+            target_args:
+              - --log-prefix
+              - 'dropped # '
+`
+
+func TestLoadRulesetYAML(t *testing.T) {
+	rs, err := LoadRulesetYAML(strings.NewReader(testRulesetYAML))
+	if err != nil {
+		t.Fatalf("LoadRulesetYAML failed: %v", err)
+	}
+	fromJSON, err := LoadRulesetJSON(strings.NewReader(testRulesetJSON))
+	if err != nil {
+		t.Fatalf("LoadRulesetJSON failed: %v", err)
+	}
+
+	logging := rs.Tables[0].Chains[2]
+	rs.Tables[0].Chains = rs.Tables[0].Chains[:2]
+	if !reflect.DeepEqual(rs, fromJSON) {
+		t.Fatalf("YAML and JSON rulesets differ: \ngot  %#v \nneed %#v", rs, fromJSON)
+	}
+
+	args, err := logging.Rules[0].Args()
+	if err != nil {
+		t.Fatalf("Args failed: %v", err)
+	}
+	expected := []string{"-m", "limit", "--limit", "5/min", "-j", "LOG", "--log-prefix", "dropped # "}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Args mismatch: \ngot  %#v \nneed %#v", args, expected)
+	}
+}
+
+func TestLoadRulesetYAMLQuotes(t *testing.T) {
+	data := `tables:
+  - name: filter
+    chains:
+      - name: INPUT
+        rules:
+          - comment: 'it''s: ok # x' # a comment
+            jump: ACCEPT
+          - matches: [-m, comment, --comment, 'a, ''b'' # c']
+            'jump': "DROP # \\"
+`
+	rs, err := LoadRulesetYAML(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("LoadRulesetYAML failed: %v", err)
+	}
+	rules := rs.Tables[0].Chains[0].Rules
+	if rules[0].Comment != "it's: ok # x" {
+		t.Errorf("comment is %q", rules[0].Comment)
+	}
+	if expected := []string{"-m", "comment", "--comment", "a, 'b' # c"}; !reflect.DeepEqual(rules[1].Matches, expected) {
+		t.Errorf("matches are %q, want %q", rules[1].Matches, expected)
+	}
+	if rules[1].Jump != "DROP # \\" {
+		t.Errorf("jump is %q", rules[1].Jump)
+	}
+}
+
+func TestLoadRulesetYAMLErrors(t *testing.T) {
+	invalid := map[string]string{
+		"unknown field":      "tables:\n  - name: filter\n    chain: []\n",
+		"bad indentation":    "tables:\n  - name: filter\n      chains: []\n",
+		"duplicate key":      "tables:\n  - name: filter\n    name: nat\n",
+		"unsupported syntax": "tables:\n  - name: &anchor filter\n",
+		"unterminated":       "tables: [filter\n",
+	}
+	for name, data := range invalid {
+		if _, err := LoadRulesetYAML(strings.NewReader(data)); err == nil {
+			t.Fatalf("LoadRulesetYAML with %s did not fail", name)
+		}
+	}
+}